@@ -3,8 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"time"
 
 	"github.com/awslabs/karpenter/pkg/apis"
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
 	"github.com/awslabs/karpenter/pkg/cloudprovider/registry"
 	"github.com/awslabs/karpenter/pkg/controllers"
@@ -21,6 +23,7 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	controllerruntime "sigs.k8s.io/controller-runtime"
 	controllerruntimezap "sigs.k8s.io/controller-runtime/pkg/log/zap"
+	controllerruntimemanager "sigs.k8s.io/controller-runtime/pkg/manager"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -36,17 +39,65 @@ func init() {
 
 // Options for running this binary
 type Options struct {
-	EnableVerboseLogging bool
-	MetricsPort          int
-	WebhookPort          int
-	HealthProbePort      int
+	EnableVerboseLogging           bool
+	MetricsPort                    int
+	WebhookPort                    int
+	WebhookCertDir                 string
+	HealthProbePort                int
+	LaunchTemplateNamePrefix       string
+	VMMemoryOverheadFraction       float64
+	StartupSettlePeriod            time.Duration
+	BatchWindow                    time.Duration
+	LaunchIdempotencyWindow        time.Duration
+	LaunchTimeout                  time.Duration
+	NodeCreationFailurePolicy      string
+	DebugBindAddress               string
+	VoluntaryEvictionPolicy        string
+	InvoluntaryEvictionPolicy      string
+	MaxConnsPerHost                int
+	MaxIdleConnsPerHost            int
+	MetricsLabels                  string
+	SystemNamespace                string
+	ManagedNodeLabelKey            string
+	MaxNoFitAttempts               int
+	NodeValidationURL              string
+	NodeValidationTimeout          time.Duration
+	RequeueJitter                  float64
+	InterruptionQueueName          string
+	HandleRebalanceRecommendations bool
+	CloudProvider                  string
+	DisableInstanceProfileCheck    bool
 }
 
 func main() {
 	flag.BoolVar(&options.EnableVerboseLogging, "verbose", false, "Enable verbose logging")
 	flag.IntVar(&options.WebhookPort, "webhook-port", 9443, "The port the webhook endpoint binds to for validation and mutation of resources")
+	flag.StringVar(&options.WebhookCertDir, "webhook-cert-dir", "/tmp/k8s-webhook-server/serving-certs", "The directory containing the webhook server's tls.crt and tls.key")
 	flag.IntVar(&options.MetricsPort, "metrics-port", 8080, "The port the metric endpoint binds to for operating metrics about the controller itself")
 	flag.IntVar(&options.HealthProbePort, "health-probe-port", 8081, "The port the health probe endpoint binds to for reporting controller health")
+	flag.StringVar(&options.LaunchTemplateNamePrefix, "launch-template-name-prefix", "Karpenter", "The prefix of launch template names, unique per installation to avoid collisions in shared accounts")
+	flag.Float64Var(&options.VMMemoryOverheadFraction, "vm-memory-overhead-fraction", 0.075, "The fraction of an instance's memory reserved by the hypervisor, kernel, and firmware, e.g. 0.075")
+	flag.DurationVar(&options.StartupSettlePeriod, "startup-settle-period", 10*time.Second, "How long to defer launches after startup, so that existing capacity is observed before provisioning more")
+	flag.DurationVar(&options.BatchWindow, "batch-window", time.Second, "How long to accumulate pending pods after they're first observed, so that pods arriving together are packed into fewer nodes")
+	flag.DurationVar(&options.LaunchIdempotencyWindow, "launch-idempotency-window", time.Minute, "How long launches for the same pods are deduplicated, which prevents retries from leaking instances")
+	flag.DurationVar(&options.LaunchTimeout, "launch-timeout", 30*time.Second, "How long each call to launch an instance may take before it's cancelled and retried, separately from how long nodes take to register, or 0 for no timeout")
+	flag.StringVar(&options.NodeCreationFailurePolicy, "node-creation-failure-policy", string(allocation.NodeCreationFailureTerminate), "Whether to Terminate instances whose nodes fail to be created, or Track them to retry creating their nodes")
+	flag.StringVar(&options.DebugBindAddress, "debug-bind-address", "", "The address the cloud provider's debug endpoint binds to for inspecting cached resources, e.g. :8082. Disabled if empty")
+	flag.StringVar(&options.VoluntaryEvictionPolicy, "voluntary-eviction-policy", string(reallocation.EvictionPolicyEvict), "Whether to Evict pods from voluntarily disrupted nodes, respecting PodDisruptionBudgets, or Delete them")
+	flag.StringVar(&options.InvoluntaryEvictionPolicy, "involuntary-eviction-policy", string(reallocation.EvictionPolicyEvict), "Whether to Evict pods from involuntarily disrupted nodes, respecting PodDisruptionBudgets, or Delete them")
+	flag.IntVar(&options.MaxConnsPerHost, "max-conns-per-host", 0, "The maximum connections the cloud provider's API clients open to each host, or 0 for unlimited")
+	flag.IntVar(&options.MaxIdleConnsPerHost, "max-idle-conns-per-host", 64, "The connections the cloud provider's API clients keep open to each host for reuse during large scale ups")
+	flag.StringVar(&options.MetricsLabels, "metrics-labels", "", "A comma separated list of provisioner label keys promoted into launch metrics' labels, e.g. example.com/team,example.com/cost-center")
+	flag.StringVar(&options.SystemNamespace, "system-namespace", "karpenter", "The namespace Karpenter runs in, which contains the karpenter-global-settings ConfigMap that may disable provisioning for all provisioners")
+	flag.StringVar(&options.ManagedNodeLabelKey, "managed-node-label-key", v1alpha1.DefaultManagedLabelKey, "The label key applied with the value true to nodes launched by Karpenter. Only nodes with this label are disrupted")
+	flag.IntVar(&options.MaxNoFitAttempts, "max-no-fit-attempts", 5, "How many times a pod that doesn't fit any instance type is evaluated, with exponential backoff, before it's given up on until its spec, its provisioner, or the instance types change, or 0 to never give up")
+	flag.StringVar(&options.NodeValidationURL, "node-validation-url", "", "An HTTP endpoint that receives a POST of each new node's details once it's ready. New nodes are tainted until it responds with a 2xx status, though pods Karpenter binds at launch still run. Disabled if empty")
+	flag.DurationVar(&options.NodeValidationTimeout, "node-validation-timeout", 10*time.Second, "How long each call to the node validation endpoint may take before it's cancelled and retried")
+	flag.Float64Var(&options.RequeueJitter, "requeue-jitter", 0.1, "The fraction of controllers' requeue intervals added at random, so that resources' periodic reconciles are spread out rather than simultaneous, e.g. 0.1")
+	flag.StringVar(&options.InterruptionQueueName, "interruption-queue-name", "", "The name of an SQS queue that EventBridge delivers spot interruption warnings and rebalance recommendations to. Nodes of instances with interruption warnings are cordoned and drained before they're interrupted. Disabled if empty")
+	flag.BoolVar(&options.HandleRebalanceRecommendations, "handle-rebalance-recommendations", false, "Also cordon and drain the nodes of instances that receive rebalance recommendations from the interruption queue, rather than waiting for interruption warnings")
+	flag.BoolVar(&options.DisableInstanceProfileCheck, "disable-instance-profile-check", false, "Skip checking that nodes' instance profile has the policies they need to join the cluster, e.g. if nodes' roles are granted equivalent permissions by other policies")
+	flag.StringVar(&options.CloudProvider, "cloud-provider", "", fmt.Sprintf("The name of the cloud provider to run, one of %v. May be empty if the binary is built with a single cloud provider", registry.Names()))
 	flag.Parse()
 
 	log.Setup(
@@ -59,19 +110,61 @@ func main() {
 		LeaderElectionID:       "karpenter-leader-election",
 		Scheme:                 scheme,
 		Port:                   options.WebhookPort,
+		CertDir:                options.WebhookCertDir,
 		MetricsBindAddress:     fmt.Sprintf(":%d", options.MetricsPort),
 		HealthProbeBindAddress: fmt.Sprintf(":%d", options.HealthProbePort),
-	})
+	}, options.RequeueJitter)
 
 	clientSet := kubernetes.NewForConfigOrDie(manager.GetConfig())
-	cloudProviderFactory := registry.NewFactory(cloudprovider.Options{Client: manager.GetClient(), ClientSet: clientSet})
+	cloudProviderFactory, err := registry.NewFactory(options.CloudProvider, cloudprovider.Options{
+		Client:                         manager.GetClient(),
+		ClientSet:                      clientSet,
+		LaunchTemplateNamePrefix:       options.LaunchTemplateNamePrefix,
+		VMMemoryOverheadFraction:       &options.VMMemoryOverheadFraction,
+		LaunchIdempotencyWindow:        &options.LaunchIdempotencyWindow,
+		LaunchTimeout:                  &options.LaunchTimeout,
+		DebugBindAddress:               options.DebugBindAddress,
+		MaxConnsPerHost:                &options.MaxConnsPerHost,
+		MaxIdleConnsPerHost:            &options.MaxIdleConnsPerHost,
+		ManagedLabelKey:                options.ManagedNodeLabelKey,
+		InterruptionQueueName:          options.InterruptionQueueName,
+		HandleRebalanceRecommendations: options.HandleRebalanceRecommendations,
+		DisableInstanceProfileCheck:    options.DisableInstanceProfileCheck,
+	})
+	log.PanicIfError(err, "Unable to create cloud provider")
+	nodeCreationFailurePolicy, err := allocation.ParseNodeCreationFailurePolicy(options.NodeCreationFailurePolicy)
+	log.PanicIfError(err, "Invalid node creation failure policy")
+	metricsLabels, err := allocation.ParseMetricsLabels(options.MetricsLabels)
+	log.PanicIfError(err, "Invalid metrics labels")
+	voluntaryEvictionPolicy, err := reallocation.ParseEvictionPolicy(options.VoluntaryEvictionPolicy)
+	log.PanicIfError(err, "Invalid voluntary eviction policy")
+	involuntaryEvictionPolicy, err := reallocation.ParseEvictionPolicy(options.InvoluntaryEvictionPolicy)
+	log.PanicIfError(err, "Invalid involuntary eviction policy")
+	validationHook, err := reallocation.NewValidationHook(options.NodeValidationURL, options.NodeValidationTimeout)
+	log.PanicIfError(err, "Invalid node validation hook")
+
+	// Cloud providers may optionally run tasks once the manager has started
+	if runnable, ok := cloudProviderFactory.(controllerruntimemanager.Runnable); ok {
+		log.PanicIfError(manager.Add(runnable), "Unable to add cloud provider to manager")
+	}
 
-	err := manager.RegisterWebhooks(
+	err = manager.RegisterWebhooks(
 		&webhooksprovisioning.Defaulter{},
 		&webhooksprovisioning.Validator{CloudProvider: cloudProviderFactory},
 	).RegisterControllers(
-		allocation.NewController(manager.GetClient(), clientSet.CoreV1(), cloudProviderFactory),
-		reallocation.NewController(manager.GetClient(), clientSet.CoreV1(), cloudProviderFactory),
+		allocation.NewController(manager.GetClient(), clientSet.CoreV1(), cloudProviderFactory, manager.GetEventRecorderFor("karpenter"), allocation.Options{
+			StartupSettlePeriod:       options.StartupSettlePeriod,
+			BatchWindow:               options.BatchWindow,
+			NodeCreationFailurePolicy: nodeCreationFailurePolicy,
+			MetricsLabels:             metricsLabels,
+			SystemNamespace:           options.SystemNamespace,
+			MaxNoFitAttempts:          options.MaxNoFitAttempts,
+			NodeValidation:            validationHook != nil,
+		}),
+		reallocation.NewController(manager.GetClient(), clientSet.CoreV1(), cloudProviderFactory, manager.GetEventRecorderFor("karpenter"), reallocation.EvictionPolicies{
+			Voluntary:   voluntaryEvictionPolicy,
+			Involuntary: involuntaryEvictionPolicy,
+		}, options.ManagedNodeLabelKey, validationHook),
 	).Start(controllerruntime.SetupSignalHandler())
 	log.PanicIfError(err, "Unable to start manager")
 }
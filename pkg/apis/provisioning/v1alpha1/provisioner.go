@@ -15,9 +15,13 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"strings"
+	"time"
+
 	"github.com/awslabs/karpenter/pkg/utils/functional"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"knative.dev/pkg/ptr"
 )
 
 // ProvisionerSpec is the top level provisioner specification. Provisioners
@@ -38,6 +42,112 @@ type ProvisionerSpec struct {
 	// TTLSeconds determines how long to wait before attempting to terminate a node.
 	// +optional
 	TTLSeconds *int32 `json:"ttlSeconds,omitempty"`
+	// DrainWarningSeconds determines how long a node may be blocked from
+	// draining by a PodDisruptionBudget before a warning event is emitted.
+	// +optional
+	DrainWarningSeconds *int32 `json:"drainWarningSeconds,omitempty"`
+	// DrainTimeoutSeconds determines how long a node may be blocked from
+	// draining by a PodDisruptionBudget before the drain is escalated.
+	// Voluntary disruptions stop terminating the node, while involuntary
+	// disruptions delete the blocked pods.
+	// +optional
+	DrainTimeoutSeconds *int32 `json:"drainTimeoutSeconds,omitempty"`
+	// DrainDeadlineSeconds determines how long a node may drain before it's
+	// terminated regardless of the pods remaining on it, which bounds how long
+	// rollouts take. Voluntarily disrupted nodes are returned to service at
+	// the drain timeout if it's shorter. If unspecified, drains are unbounded.
+	// +optional
+	DrainDeadlineSeconds *int32 `json:"drainDeadlineSeconds,omitempty"`
+	// DeregistrationDelaySeconds determines how long a draining node is
+	// excluded from external load balancers before its pods are evicted, so
+	// that load balancers deregister it gracefully.
+	// +optional
+	DeregistrationDelaySeconds *int32 `json:"deregistrationDelaySeconds,omitempty"`
+	// Weight orders provisioners that are able to provision the same pod. The
+	// provisioner with the highest weight is selected, and ties are balanced
+	// across equally weighted provisioners. Defaults to 0.
+	// +optional
+	Weight *int32 `json:"weight,omitempty"`
+	// MaxNodes caps the number of nodes that the provisioner may launch.
+	// Pods aren't provisioned while the provisioner has this many nodes. If
+	// unspecified, the number of nodes is unlimited.
+	// +optional
+	MaxNodes *int32 `json:"maxNodes,omitempty"`
+	// MaxFamilyPercentage caps the percentage of the provisioner's nodes that
+	// may share an instance family, e.g. m5, so that correlated failures or
+	// capacity shortages of one family don't affect every node. Families at
+	// the cap are only launched if no other family fits. If unspecified,
+	// families are unlimited.
+	// +optional
+	MaxFamilyPercentage *int32 `json:"maxFamilyPercentage,omitempty"`
+	// SelectionStrategy ranks the instance types that nodes may be launched
+	// as. lowest-price prefers the smallest instance types, most-pods prefers
+	// instance types that fit the most pods, and fewest-nodes prefers the
+	// largest instance types. Pods are packed onto as few nodes as possible
+	// regardless, and every instance type ranked for a node fits the same
+	// pods, so strategies other than lowest-price trade cost for headroom.
+	// Defaults to lowest-price.
+	// +optional
+	SelectionStrategy *string `json:"selectionStrategy,omitempty"`
+	// SubnetSelectionPolicy chooses the subnet that nodes are launched into in
+	// each zone. most-free-ips prefers the subnet with the most available IP
+	// addresses, round-robin rotates through the zone's subnets, and
+	// least-utilized-zone only launches into the zone whose subnets have the
+	// lowest share of their IP addresses in use. Defaults to most-free-ips.
+	// +optional
+	SubnetSelectionPolicy *string `json:"subnetSelectionPolicy,omitempty"`
+	// ObserveOnly provisioners don't launch or modify nodes. Instead, the nodes
+	// that would have been launched are previewed in the provisioner's status.
+	// +optional
+	ObserveOnly bool `json:"observeOnly,omitempty"`
+	// Paused provisioners don't launch new nodes, e.g. during incidents. Their
+	// existing nodes are still disrupted unless disruptions are also paused.
+	// +optional
+	Paused bool `json:"paused,omitempty"`
+	// Disruption constrains when the provisioner's nodes are voluntarily
+	// disrupted.
+	// +optional
+	Disruption *DisruptionSpec `json:"disruption,omitempty"`
+	// SerialEviction evicts the pods of draining nodes one at a time rather
+	// than all at once, e.g. for stateful workloads whose replicas must stay
+	// available. If not specified, pods are evicted all at once.
+	// +optional
+	SerialEviction *SerialEvictionSpec `json:"serialEviction,omitempty"`
+}
+
+// SerialEvictionSpec configures serial evictions. Each eviction waits for the
+// previously evicted pod to terminate and for its replacement, if it has a
+// controller, to become ready, so readiness gates hold back the drain.
+type SerialEvictionSpec struct {
+	// DelaySeconds is the minimum time between evictions. Defaults to 0.
+	// +optional
+	DelaySeconds *int32 `json:"delaySeconds,omitempty"`
+}
+
+// DisruptionSpec constrains voluntary disruptions of the provisioner's nodes,
+// e.g. terminating underutilized nodes. Involuntary disruptions, e.g. spot
+// interruptions, are never constrained.
+type DisruptionSpec struct {
+	// Window only permits voluntary disruptions while it's open. If not
+	// specified, voluntary disruptions are always permitted.
+	// +optional
+	Window *DisruptionWindow `json:"window,omitempty"`
+	// Paused stops voluntary disruptions until it's unset, e.g. during
+	// incidents.
+	// +optional
+	Paused bool `json:"paused,omitempty"`
+}
+
+// DisruptionWindow opens at the times matched by its schedule, and stays open
+// for its duration.
+type DisruptionWindow struct {
+	// Schedule is a cron expression of the times in UTC that the window
+	// opens, e.g. "0 22 * * 1-5" for 10pm on weekdays.
+	// +required
+	Schedule string `json:"schedule"`
+	// Duration is how long the window stays open, at most 168h.
+	// +required
+	Duration metav1.Duration `json:"duration"`
 }
 
 // ClusterSpec configures the cluster that the provisioner operates against. If
@@ -54,19 +164,24 @@ type ClusterSpec struct {
 	Endpoint string `json:"endpoint"`
 }
 
-// Constraints are applied to all nodes created by the provisioner. They can be
-// overriden by NodeSelectors at the pod level.
+// Constraints are applied to all nodes created by the provisioner. Pods can
+// further constrain them with node selectors and node affinity, but pods whose
+// requirements contradict the provisioner's aren't provisioned.
 type Constraints struct {
 	// Taints will be applied to every node launched by the Provisioner. If
 	// specified, the provisioner will not provision nodes for pods that do not
 	// have matching tolerations.
 	// +optional
 	Taints []v1.Taint `json:"taints,omitempty"`
-	// Labels will be applied to every node launched by the Provisioner unless
-	// overriden by pod node selectors. Well known labels control provisioning
-	// behavior. Additional labels may be supported by your cloudprovider.
+	// Labels will be applied to every node launched by the Provisioner. Well
+	// known labels control provisioning behavior. Additional labels may be
+	// supported by your cloudprovider.
 	// +optional
 	Labels map[string]string `json:"labels,omitempty"`
+	// Annotations will be applied to every node launched by the Provisioner.
+	// Annotations with the karpenter.sh domain are reserved.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
 	// Zones constrains where nodes will be launched by the Provisioner. If
 	// unspecified, defaults to all zones in the region. Cannot be specified if
 	// label "topology.kubernetes.io/zone" is specified.
@@ -103,9 +218,46 @@ var (
 	ProvisionerNameLabelKey      = SchemeGroupVersion.Group + "/name"
 	ProvisionerNamespaceLabelKey = SchemeGroupVersion.Group + "/namespace"
 	ProvisionerPhaseLabel        = SchemeGroupVersion.Group + "/lifecycle-phase"
+	// DefaultManagedLabelKey marks nodes launched by Karpenter, unless another
+	// key is configured. Nodes without it are never disrupted.
+	DefaultManagedLabelKey = "karpenter.sh/managed"
 
 	// Reserved annotations
-	ProvisionerTTLKey = SchemeGroupVersion.Group + "/ttl"
+	ProvisionerTTLKey        = SchemeGroupVersion.Group + "/ttl"
+	ProvisionerDrainStartKey = SchemeGroupVersion.Group + "/drain-start"
+	ProvisionerDisruptionKey = SchemeGroupVersion.Group + "/disruption"
+	ProvisionerTaintsKey     = SchemeGroupVersion.Group + "/taints"
+	// ProvisionerLastEvictionKey and ProvisionerLastEvictedOwnerKey record the
+	// time of a node's last serial eviction and the controller of the evicted
+	// pod, whose replacement is awaited before the next eviction
+	ProvisionerLastEvictionKey     = SchemeGroupVersion.Group + "/last-eviction"
+	ProvisionerLastEvictedOwnerKey = SchemeGroupVersion.Group + "/last-evicted-owner"
+	// ProvisionerDrainFailedKey records on a node when it was returned to
+	// service because its drain was blocked, so that it isn't disrupted again
+	// straight away
+	ProvisionerDrainFailedKey = SchemeGroupVersion.Group + "/drain-failed"
+	// ProvisionerSelectionReasonKey records on a node why its instance type
+	// was selected, for cloud providers that report it
+	ProvisionerSelectionReasonKey = SchemeGroupVersion.Group + "/selection-reason"
+	// ProvisionerManagedLabelMigratedKey records on a provisioner when the
+	// nodes it launched before nodes were labeled as managed were labeled
+	ProvisionerManagedLabelMigratedKey = SchemeGroupVersion.Group + "/managed-label-migrated"
+	// LaunchIntentKey records on a pending pod when a launch for it started,
+	// so that launches interrupted by a controller restart are deduplicated
+	LaunchIntentKey = SchemeGroupVersion.Group + "/launch-intent"
+
+	// Node initialization stages, annotated with the time each stage completed
+	ProvisionerInstanceLaunchedKey     = SchemeGroupVersion.Group + "/instance-launched"
+	ProvisionerNodeRegisteredKey       = SchemeGroupVersion.Group + "/node-registered"
+	ProvisionerDaemonSetsReadyKey      = SchemeGroupVersion.Group + "/daemonsets-ready"
+	ProvisionerStartupTaintsRemovedKey = SchemeGroupVersion.Group + "/startup-taints-removed"
+
+	// ValidationPendingTaintKey is applied to new nodes when a node validation
+	// hook is configured, and removed once the hook accepts the node
+	ValidationPendingTaintKey = SchemeGroupVersion.Group + "/validation-pending"
+
+	// ExcludeFromExternalLoadBalancersLabelKey is applied to draining nodes
+	ExcludeFromExternalLoadBalancersLabelKey = "node.kubernetes.io/exclude-from-external-load-balancers"
 
 	// Use ProvisionerSpec instead
 	ZoneLabelKey         = "topology.kubernetes.io/zone"
@@ -118,6 +270,69 @@ const (
 	ProvisionerDrainingPhase      = "draining"
 )
 
+const (
+	SelectionStrategyLowestPrice = "lowest-price"
+	SelectionStrategyMostPods    = "most-pods"
+	SelectionStrategyFewestNodes = "fewest-nodes"
+)
+
+var (
+	SelectionStrategies = []string{
+		SelectionStrategyLowestPrice,
+		SelectionStrategyMostPods,
+		SelectionStrategyFewestNodes,
+	}
+)
+
+const (
+	SubnetSelectionPolicyMostFreeIPs       = "most-free-ips"
+	SubnetSelectionPolicyRoundRobin        = "round-robin"
+	SubnetSelectionPolicyLeastUtilizedZone = "least-utilized-zone"
+)
+
+var (
+	SubnetSelectionPolicies = []string{
+		SubnetSelectionPolicyMostFreeIPs,
+		SubnetSelectionPolicyRoundRobin,
+		SubnetSelectionPolicyLeastUtilizedZone,
+	}
+)
+
+const (
+	// DisruptionVoluntary nodes are terminated at Karpenter's discretion, e.g.
+	// when underutilized, and may be left running if they cannot be drained.
+	DisruptionVoluntary = "voluntary"
+	// DisruptionInvoluntary nodes will be terminated regardless of whether
+	// they can be drained, e.g. due to a spot interruption.
+	DisruptionInvoluntary = "involuntary"
+)
+
+const (
+	// TerminationReasonTTLEmpty nodes were voluntarily terminated, e.g. once
+	// their TTL after becoming underutilized elapsed
+	TerminationReasonTTLEmpty = "ttl-empty"
+	// TerminationReasonInterruption nodes were involuntarily terminated
+	TerminationReasonInterruption = "interruption"
+	// TerminationReasonDrainDeadline nodes were terminated with pods
+	// remaining once they drained for longer than the drain deadline
+	TerminationReasonDrainDeadline = "drain-deadline"
+	// TerminationReasonRegistrationFailure instances were terminated because
+	// their nodes couldn't be created
+	TerminationReasonRegistrationFailure = "registration-failure"
+)
+
+// MaxDisruptionWindowDuration bounds how long disruption windows stay open
+const MaxDisruptionWindowDuration = 7 * 24 * time.Hour
+
+// Defaults of the drain fields, which are applied by the defaulting webhook.
+// Controllers fall back to them for provisioners created before the fields
+// were defaulted.
+const (
+	DefaultDrainWarningSeconds        = 60
+	DefaultDrainTimeoutSeconds        = 600
+	DefaultDeregistrationDelaySeconds = 15
+)
+
 // Provisioner is the Schema for the Provisioners API
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
@@ -137,17 +352,54 @@ type ProvisionerList struct {
 	Items           []Provisioner `json:"items"`
 }
 
+// GetWeight returns the provisioner's weight, defaulting to 0.
+func (p *Provisioner) GetWeight() int32 {
+	if p.Spec.Weight == nil {
+		return 0
+	}
+	return *p.Spec.Weight
+}
+
+// Requirements of nodes launched for the pod, which intersects the pod's
+// requirements with the provisioner's. An error is returned if the pod
+// contradicts the provisioner, e.g. it selects a zone that the provisioner
+// doesn't launch in.
+func (p *Provisioner) Requirements(pod *v1.Pod) (Requirements, error) {
+	requirements, err := PodRequirements(pod)
+	if err != nil {
+		return nil, err
+	}
+	return p.Spec.Constraints.Requirements().Intersect(requirements)
+}
+
+// ConstraintsWithOverrides returns the constraints of nodes launched for the
+// pod. The pod's requirements must be compatible with the provisioner's.
 func (p *Provisioner) ConstraintsWithOverrides(pod *v1.Pod) *Constraints {
+	requirements, err := p.Requirements(pod)
+	if err != nil {
+		requirements = p.Spec.Constraints.Requirements()
+	}
 	return &Constraints{
 		Taints:          p.Spec.Taints,
 		Labels:          p.Spec.Constraints.getLabels(p.Name, p.Namespace, pod),
-		Zones:           p.Spec.Constraints.getZones(pod),
-		InstanceTypes:   p.Spec.Constraints.getInstanceTypes(pod),
-		Architecture:    p.Spec.Constraints.getArchitecture(pod),
-		OperatingSystem: p.Spec.Constraints.getOperatingSystem(pod),
+		Annotations:     p.Spec.Annotations,
+		Zones:           requirements.Get(ZoneLabelKey),
+		InstanceTypes:   requirements.Get(InstanceTypeLabelKey),
+		Architecture:    ptr.String(requirements.Preferred(ArchitectureLabelKey, ArchitectureAmd64)),
+		OperatingSystem: ptr.String(requirements.Preferred(OperatingSystemLabelKey, OperatingSystemLinux)),
 	}
 }
 
+// IsReservedKey returns true if the label or annotation key belongs to the
+// karpenter.sh domain, e.g. provisioning.karpenter.sh/ttl
+func IsReservedKey(key string) bool {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	return parts[0] == "karpenter.sh" || strings.HasSuffix(parts[0], ".karpenter.sh")
+}
+
 func (c *Constraints) getLabels(name string, namespace string, pod *v1.Pod) map[string]string {
 	// These keys are guaranteed to not collide due to validation logic
 	return functional.UnionStringMaps(
@@ -159,55 +411,3 @@ func (c *Constraints) getLabels(name string, namespace string, pod *v1.Pod) map[
 		},
 	)
 }
-
-func (c *Constraints) getZones(pod *v1.Pod) []string {
-	// Pod may override zone
-	if zone, ok := pod.Spec.NodeSelector[ZoneLabelKey]; ok {
-		return []string{zone}
-	}
-	// Default to provisioner constraints
-	if len(c.Zones) != 0 {
-		return c.Zones
-	}
-	// Otherwise unconstrained
-	return nil
-}
-
-func (c *Constraints) getInstanceTypes(pod *v1.Pod) []string {
-	// Pod may override instance type
-	if instanceType, ok := pod.Spec.NodeSelector[InstanceTypeLabelKey]; ok {
-		return []string{instanceType}
-	}
-	// Default to provisioner constraints
-	if len(c.InstanceTypes) != 0 {
-		return c.InstanceTypes
-	}
-	// Otherwise unconstrained
-	return nil
-}
-
-func (c *Constraints) getArchitecture(pod *v1.Pod) *string {
-	// Pod may override arch
-	if architecture, ok := pod.Spec.NodeSelector[ArchitectureLabelKey]; ok {
-		return &architecture
-	}
-	// Use constraints if defined
-	if c.Architecture != nil {
-		return c.Architecture
-	}
-	// Default to amd64
-	return &ArchitectureAmd64
-}
-
-func (c *Constraints) getOperatingSystem(pod *v1.Pod) *string {
-	// Pod may override os
-	if operatingSystem, ok := pod.Spec.NodeSelector[OperatingSystemLabelKey]; ok {
-		return &operatingSystem
-	}
-	// Use constraints if defined
-	if c.OperatingSystem != nil {
-		return c.OperatingSystem
-	}
-	// Default to linux
-	return &OperatingSystemLinux
-}
@@ -28,8 +28,58 @@ type ProvisionerStatus struct {
 	// its target, and indicates whether or not those conditions are met.
 	// +optional
 	Conditions apis.Conditions `json:"conditions,omitempty"`
+
+	// UnavailableOfferings are the instance types and zones that recently
+	// failed to launch due to insufficient capacity. Offerings are removed
+	// once they haven't failed for a period of time.
+	// +optional
+	UnavailableOfferings []UnavailableOffering `json:"unavailableOfferings,omitempty"`
+
+	// Preview is the set of nodes that an observe-only provisioner would have
+	// launched during its last reconciliation.
+	// +optional
+	Preview []PreviewNode `json:"preview,omitempty"`
+}
+
+// PreviewNode is a node that would have been launched for a set of pods.
+type PreviewNode struct {
+	// InstanceTypes that the node would have been launched as
+	InstanceTypes []string `json:"instanceTypes"`
+	// Pods is the number of pods that would have been bound to the node
+	Pods int32 `json:"pods"`
+}
+
+// UnavailableOffering is an instance type in a zone that the cloud provider
+// recently didn't have capacity for.
+type UnavailableOffering struct {
+	// InstanceType that failed to launch
+	InstanceType string `json:"instanceType"`
+	// Zone that the instance type failed to launch in
+	Zone string `json:"zone"`
+	// LastObservedTime is the last time the offering failed to launch
+	LastObservedTime apis.VolatileTime `json:"lastObservedTime"`
 }
 
+const (
+	// SubnetsMatched is a condition that indicates whether the cloud provider
+	// discovered subnets to launch the provisioner's capacity in. It doesn't
+	// affect readiness, since subnets may be tagged after the provisioner is
+	// created.
+	SubnetsMatched apis.ConditionType = "SubnetsMatched"
+	// BelowMaxNodes is a condition that indicates whether the provisioner has
+	// fewer nodes than its spec.maxNodes, and is able to launch more.
+	BelowMaxNodes apis.ConditionType = "BelowMaxNodes"
+	// NodesConfigured is a condition that indicates whether the cloud
+	// provider found problems with the configuration of the provisioner's
+	// nodes, e.g. permissions that nodes need to join the cluster. It doesn't
+	// affect readiness, since nodes are still launched.
+	NodesConfigured apis.ConditionType = "NodesConfigured"
+	// ProvisioningEnabled is a condition that indicates whether launches are
+	// disabled for every provisioner by the global settings. It doesn't affect
+	// readiness, since launches resume once provisioning is enabled.
+	ProvisioningEnabled apis.ConditionType = "ProvisioningEnabled"
+)
+
 func (p *Provisioner) StatusConditions() apis.ConditionManager {
 	return apis.NewLivingConditionSet(
 		Active,
@@ -0,0 +1,147 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+	v1 "k8s.io/api/core/v1"
+)
+
+var (
+	// WellKnownLabels are translated into requirements, since they constrain
+	// the instance types that nodes are launched as.
+	WellKnownLabels = []string{
+		ZoneLabelKey,
+		InstanceTypeLabelKey,
+		ArchitectureLabelKey,
+		OperatingSystemLabelKey,
+	}
+)
+
+// Requirements are the allowed values of well known labels. Labels without
+// requirements are unconstrained. Requirements from different sources, e.g.
+// the provisioner and the pod, are intersected so that they compose.
+type Requirements map[string][]string
+
+// Requirements of nodes launched for the constraints
+func (c *Constraints) Requirements() Requirements {
+	requirements := Requirements{}
+	for _, key := range WellKnownLabels {
+		if value, ok := c.Labels[key]; ok {
+			requirements[key] = []string{value}
+		}
+	}
+	if len(c.Zones) != 0 {
+		requirements[ZoneLabelKey] = c.Zones
+	}
+	if len(c.InstanceTypes) != 0 {
+		requirements[InstanceTypeLabelKey] = c.InstanceTypes
+	}
+	if c.Architecture != nil {
+		requirements[ArchitectureLabelKey] = []string{*c.Architecture}
+	}
+	if c.OperatingSystem != nil {
+		requirements[OperatingSystemLabelKey] = []string{*c.OperatingSystem}
+	}
+	return requirements
+}
+
+// PodRequirements translates the pod's node selector and required node
+// affinity into requirements. Node affinity is supported if it has a single
+// term that only uses the In operator on well known labels, since other
+// affinities can't be expressed as a set of allowed values.
+func PodRequirements(pod *v1.Pod) (Requirements, error) {
+	requirements := Requirements{}
+	for _, key := range WellKnownLabels {
+		if value, ok := pod.Spec.NodeSelector[key]; ok {
+			requirements[key] = []string{value}
+		}
+	}
+	if pod.Spec.Affinity == nil || pod.Spec.Affinity.NodeAffinity == nil ||
+		pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return requirements, nil
+	}
+	terms := pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(terms) != 1 {
+		return nil, fmt.Errorf("node affinity with %d terms is not supported", len(terms))
+	}
+	if len(terms[0].MatchFields) != 0 {
+		return nil, fmt.Errorf("node affinity match fields are not supported")
+	}
+	affinity := Requirements{}
+	for _, expression := range terms[0].MatchExpressions {
+		if !functional.ContainsString(WellKnownLabels, expression.Key) {
+			return nil, fmt.Errorf("node affinity for label %s is not supported", expression.Key)
+		}
+		if expression.Operator != v1.NodeSelectorOpIn {
+			return nil, fmt.Errorf("node affinity operator %s is not supported", expression.Operator)
+		}
+		if values, ok := affinity[expression.Key]; ok {
+			affinity[expression.Key] = functional.IntersectStringSlice(values, expression.Values)
+		} else {
+			affinity[expression.Key] = expression.Values
+		}
+	}
+	return requirements.Intersect(affinity)
+}
+
+// Intersect returns the values allowed by both requirements, or an error if
+// they contradict each other, i.e. no value of a label is allowed by both.
+func (r Requirements) Intersect(requirements Requirements) (Requirements, error) {
+	result := Requirements{}
+	for key, values := range r {
+		result[key] = values
+	}
+	for key, values := range requirements {
+		existing, ok := result[key]
+		if !ok {
+			result[key] = values
+			continue
+		}
+		intersection := functional.IntersectStringSlice(existing, values)
+		if len(intersection) == 0 {
+			return nil, fmt.Errorf("no value of %s is in both %v and %v", key, existing, values)
+		}
+		result[key] = intersection
+	}
+	for key, values := range result {
+		if len(values) == 0 {
+			return nil, fmt.Errorf("no value of %s is allowed", key)
+		}
+		sorted := append([]string{}, values...)
+		sort.Strings(sorted)
+		result[key] = sorted
+	}
+	return result, nil
+}
+
+// Get returns the allowed values of the label, or nil if it's unconstrained
+func (r Requirements) Get(key string) []string {
+	return r[key]
+}
+
+// Preferred returns the preferred value of the label if it's allowed,
+// otherwise the first allowed value. If the label is unconstrained, the
+// preferred value is returned.
+func (r Requirements) Preferred(key string, preferred string) string {
+	values, ok := r[key]
+	if !ok || functional.ContainsString(values, preferred) {
+		return preferred
+	}
+	return values[0]
+}
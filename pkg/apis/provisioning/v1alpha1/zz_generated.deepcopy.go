@@ -56,6 +56,13 @@ func (in *Constraints) DeepCopyInto(out *Constraints) {
 			(*out)[key] = val
 		}
 	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 	if in.Zones != nil {
 		in, out := &in.Zones, &out.Zones
 		*out = make([]string, len(*in))
@@ -88,6 +95,62 @@ func (in *Constraints) DeepCopy() *Constraints {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DisruptionSpec) DeepCopyInto(out *DisruptionSpec) {
+	*out = *in
+	if in.Window != nil {
+		in, out := &in.Window, &out.Window
+		*out = new(DisruptionWindow)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DisruptionSpec.
+func (in *DisruptionSpec) DeepCopy() *DisruptionSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(DisruptionSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DisruptionWindow) DeepCopyInto(out *DisruptionWindow) {
+	*out = *in
+	out.Duration = in.Duration
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DisruptionWindow.
+func (in *DisruptionWindow) DeepCopy() *DisruptionWindow {
+	if in == nil {
+		return nil
+	}
+	out := new(DisruptionWindow)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PreviewNode) DeepCopyInto(out *PreviewNode) {
+	*out = *in
+	if in.InstanceTypes != nil {
+		in, out := &in.InstanceTypes, &out.InstanceTypes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PreviewNode.
+func (in *PreviewNode) DeepCopy() *PreviewNode {
+	if in == nil {
+		return nil
+	}
+	out := new(PreviewNode)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Provisioner) DeepCopyInto(out *Provisioner) {
 	*out = *in
@@ -161,6 +224,61 @@ func (in *ProvisionerSpec) DeepCopyInto(out *ProvisionerSpec) {
 		*out = new(int32)
 		**out = **in
 	}
+	if in.DrainWarningSeconds != nil {
+		in, out := &in.DrainWarningSeconds, &out.DrainWarningSeconds
+		*out = new(int32)
+		**out = **in
+	}
+	if in.DrainTimeoutSeconds != nil {
+		in, out := &in.DrainTimeoutSeconds, &out.DrainTimeoutSeconds
+		*out = new(int32)
+		**out = **in
+	}
+	if in.DrainDeadlineSeconds != nil {
+		in, out := &in.DrainDeadlineSeconds, &out.DrainDeadlineSeconds
+		*out = new(int32)
+		**out = **in
+	}
+	if in.DeregistrationDelaySeconds != nil {
+		in, out := &in.DeregistrationDelaySeconds, &out.DeregistrationDelaySeconds
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Weight != nil {
+		in, out := &in.Weight, &out.Weight
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MaxNodes != nil {
+		in, out := &in.MaxNodes, &out.MaxNodes
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MaxFamilyPercentage != nil {
+		in, out := &in.MaxFamilyPercentage, &out.MaxFamilyPercentage
+		*out = new(int32)
+		**out = **in
+	}
+	if in.SelectionStrategy != nil {
+		in, out := &in.SelectionStrategy, &out.SelectionStrategy
+		*out = new(string)
+		**out = **in
+	}
+	if in.SubnetSelectionPolicy != nil {
+		in, out := &in.SubnetSelectionPolicy, &out.SubnetSelectionPolicy
+		*out = new(string)
+		**out = **in
+	}
+	if in.Disruption != nil {
+		in, out := &in.Disruption, &out.Disruption
+		*out = new(DisruptionSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SerialEviction != nil {
+		in, out := &in.SerialEviction, &out.SerialEviction
+		*out = new(SerialEvictionSpec)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProvisionerSpec.
@@ -188,6 +306,20 @@ func (in *ProvisionerStatus) DeepCopyInto(out *ProvisionerStatus) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.UnavailableOfferings != nil {
+		in, out := &in.UnavailableOfferings, &out.UnavailableOfferings
+		*out = make([]UnavailableOffering, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Preview != nil {
+		in, out := &in.Preview, &out.Preview
+		*out = make([]PreviewNode, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProvisionerStatus.
@@ -199,3 +331,68 @@ func (in *ProvisionerStatus) DeepCopy() *ProvisionerStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in Requirements) DeepCopyInto(out *Requirements) {
+	{
+		in := &in
+		*out = make(Requirements, len(*in))
+		for key, val := range *in {
+			var outVal []string
+			if val == nil {
+				(*out)[key] = nil
+			} else {
+				in, out := &val, &outVal
+				*out = make([]string, len(*in))
+				copy(*out, *in)
+			}
+			(*out)[key] = outVal
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Requirements.
+func (in Requirements) DeepCopy() Requirements {
+	if in == nil {
+		return nil
+	}
+	out := new(Requirements)
+	in.DeepCopyInto(out)
+	return *out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SerialEvictionSpec) DeepCopyInto(out *SerialEvictionSpec) {
+	*out = *in
+	if in.DelaySeconds != nil {
+		in, out := &in.DelaySeconds, &out.DelaySeconds
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SerialEvictionSpec.
+func (in *SerialEvictionSpec) DeepCopy() *SerialEvictionSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SerialEvictionSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UnavailableOffering) DeepCopyInto(out *UnavailableOffering) {
+	*out = *in
+	in.LastObservedTime.DeepCopyInto(&out.LastObservedTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UnavailableOffering.
+func (in *UnavailableOffering) DeepCopy() *UnavailableOffering {
+	if in == nil {
+		return nil
+	}
+	out := new(UnavailableOffering)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -18,21 +18,25 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
 	"github.com/awslabs/karpenter/pkg/utils/functional"
+	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
 )
 
 // Capacity cloud provider implementation using AWS Fleet.
 type Capacity struct {
-	provisioner            *v1alpha1.Provisioner
-	nodeFactory            *NodeFactory
-	instanceProvider       *InstanceProvider
-	subnetProvider         *SubnetProvider
-	launchTemplateProvider *LaunchTemplateProvider
-	instanceTypeProvider   *InstanceTypeProvider
+	provisioner             *v1alpha1.Provisioner
+	nodeFactory             *NodeFactory
+	instanceProvider        *InstanceProvider
+	subnetProvider          *SubnetProvider
+	launchTemplateProvider  *LaunchTemplateProvider
+	instanceTypeProvider    *InstanceTypeProvider
+	placementGroupProvider  *PlacementGroupProvider
+	instanceProfileProvider *InstanceProfileProvider
 }
 
 var (
@@ -47,8 +51,8 @@ var (
 
 // Create a set of nodes given the constraints.
 func (c *Capacity) Create(ctx context.Context, packings []*cloudprovider.Packing) ([]*cloudprovider.PackedNode, error) {
-	instanceIDs := []*string{}
 	instancePackings := map[string]*cloudprovider.Packing{}
+	launchedInstances := map[string]*LaunchedInstance{}
 	for _, packing := range packings {
 		constraints := Constraints(*packing.Constraints)
 		// 1. Get Subnets and constrain by zones
@@ -62,46 +66,134 @@ func (c *Capacity) Create(ctx context.Context, packings []*cloudprovider.Packing
 				zonalSubnetOptions[zone] = subnets
 			}
 		}
+		// Zones are hard constraints, so capacity must not be launched elsewhere
+		if len(zonalSubnetOptions) == 0 {
+			return nil, fmt.Errorf("no subnets in zones %v", constraints.Zones)
+		}
+		zonalSubnetOptions = c.subnetProvider.Select(zonalSubnetOptions, aws.StringValue(c.provisioner.Spec.SubnetSelectionPolicy))
 		// 2. Get Launch Template
-		launchTemplate, err := c.launchTemplateProvider.Get(ctx, c.provisioner, &constraints)
+		launchTemplate, err := c.launchTemplateProvider.Get(ctx, c.provisioner, &constraints, packing.Pods, packing.InstanceTypeOptions)
 		if err != nil {
 			return nil, fmt.Errorf("getting launch template, %w", err)
 		}
+		instanceTypeOptions := packing.InstanceTypeOptions
+		if constraints.GetLaunchTemplate() != nil {
+			if instanceTypeOptions, err = c.matchingArchitecture(ctx, launchTemplate, instanceTypeOptions); err != nil {
+				return nil, err
+			}
+		}
 		// 3. Create instance
-		instanceID, err := c.instanceProvider.Create(ctx, launchTemplate, packing.InstanceTypeOptions, zonalSubnets, constraints.GetCapacityType())
+		selectionStrategy := aws.StringValue(c.provisioner.Spec.SelectionStrategy)
+		instanceTypeOptions = c.instanceTypeProvider.Rank(instanceTypeOptions, selectionStrategy)
+		instance, err := c.instanceProvider.Create(ctx, launchTemplate, instanceTypeOptions, zonalSubnetOptions, &constraints, selectionStrategy, packing.Pods)
 		if err != nil {
 			// TODO Aggregate errors and continue
 			return nil, fmt.Errorf("creating capacity %w", err)
 		}
-		instancePackings[*instanceID] = packing
-		instanceIDs = append(instanceIDs, instanceID)
+		instance.SelectionReason = selectionReasonFor(instance.InstanceType, instanceTypeOptions, &constraints, selectionStrategy, packing.Pods)
+		zap.S().Infow(InstanceLaunchedMessage,
+			"instanceId", instance.ID,
+			"instanceType", instance.InstanceType,
+			"zone", instance.Zone,
+			"selectionReason", instance.SelectionReason,
+		)
+		instancePackings[instance.ID] = packing
+		launchedInstances[instance.ID] = instance
 	}
-
-	// 4. Convert to Nodes
-	nodes, err := c.nodeFactory.For(ctx, instanceIDs)
+	// 4. Convert to PackedNodes
+	packedNodes, err := c.nodeFactory.For(ctx, instancePackings, launchedInstances)
 	if err != nil {
 		return nil, fmt.Errorf("determining nodes, %w", err)
 	}
-	// 5. Convert to PackedNodes, TODO: move this logic into NodeFactory
-	packedNodes := []*cloudprovider.PackedNode{}
-	for instanceID, node := range nodes {
-		packing := instancePackings[instanceID]
-		node.Labels = packing.Constraints.Labels
-		node.Spec.Taints = packing.Constraints.Taints
-		packedNodes = append(packedNodes, &cloudprovider.PackedNode{
-			Node: node,
-			Pods: packing.Pods,
-		})
-	}
 	return packedNodes, nil
 }
 
-func (c *Capacity) Delete(ctx context.Context, nodes []*v1.Node) error {
-	return c.instanceProvider.Terminate(ctx, nodes)
+// matchingArchitecture returns the instance types that support the
+// architecture of a customer specified launch template's AMI, since instances
+// of other architectures fail to boot it. Instance types are unfiltered if the
+// launch template doesn't specify an AMI.
+func (c *Capacity) matchingArchitecture(ctx context.Context, launchTemplate *LaunchTemplate, instanceTypes []cloudprovider.InstanceType) ([]cloudprovider.InstanceType, error) {
+	architecture, err := c.launchTemplateProvider.GetArchitecture(ctx, launchTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("getting architecture of launch template %s, %w", aws.StringValue(launchTemplate.Id), err)
+	}
+	if architecture == "" {
+		return instanceTypes, nil
+	}
+	matching := []cloudprovider.InstanceType{}
+	for _, instanceType := range instanceTypes {
+		if functional.ContainsString(instanceType.Architectures(), architecture) {
+			matching = append(matching, instanceType)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, fmt.Errorf("launch template %s has a %s AMI, which doesn't match the architecture of any instance type", aws.StringValue(launchTemplate.Id), architecture)
+	}
+	return matching, nil
+}
+
+func (c *Capacity) Delete(ctx context.Context, nodes []*v1.Node, reason string) error {
+	return c.instanceProvider.Terminate(ctx, nodes, reason)
 }
 
 func (c *Capacity) GetInstanceTypes(ctx context.Context) ([]cloudprovider.InstanceType, error) {
-	return c.instanceTypeProvider.Get(ctx, c.provisioner.Spec.Cluster)
+	instanceTypes, err := c.instanceTypeProvider.Get(ctx, c.provisioner.Spec.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	constraints := Constraints(c.provisioner.Spec.Constraints)
+	instanceTypes = c.instanceTypeProvider.WithObservedAllocatable(constraints.GetAMIFamily(), instanceTypes)
+	minNetworkBandwidth := constraints.GetMinNetworkBandwidth()
+	minInstanceStorage := constraints.GetMinInstanceStorage()
+	if !constraints.GetHibernationEnabled() && !constraints.GetNitroRequired() && minNetworkBandwidth == 0 && minInstanceStorage == 0 {
+		return instanceTypes, nil
+	}
+	// Only launch instance types that can be hibernated, are Nitro-based, or
+	// have enough guaranteed network bandwidth and instance storage
+	supported := []cloudprovider.InstanceType{}
+	for _, instanceType := range instanceTypes {
+		if constraints.GetHibernationEnabled() && !aws.BoolValue(instanceType.(*InstanceType).HibernationSupported) {
+			continue
+		}
+		if constraints.GetNitroRequired() && !instanceType.(*InstanceType).NitroBased() {
+			continue
+		}
+		if instanceType.(*InstanceType).NetworkBandwidth() < minNetworkBandwidth {
+			continue
+		}
+		if instanceType.(*InstanceType).InstanceStorage() < minInstanceStorage {
+			continue
+		}
+		supported = append(supported, instanceType)
+	}
+	return supported, nil
+}
+
+// ObserveAllocatable records the allocatable resources of a ready node for its
+// instance type and AMI family, which are derived from the node's labels
+func (c *Capacity) ObserveAllocatable(ctx context.Context, node *v1.Node) {
+	instanceType, ok := node.Labels[v1alpha1.InstanceTypeLabelKey]
+	if !ok {
+		return
+	}
+	constraints := Constraints{Labels: node.Labels}
+	c.instanceTypeProvider.ObserveAllocatable(constraints.GetAMIFamily(), instanceType, node.Status.Allocatable)
+}
+
+// CheckConfiguration checks the instance profile of launch templates created
+// by Karpenter. Custom launch templates specify their own instance profile.
+func (c *Capacity) CheckConfiguration(ctx context.Context) string {
+	if c.provisioner.Spec.Cluster == nil {
+		return ""
+	}
+	if _, ok := c.provisioner.Spec.Labels[LaunchTemplateIdLabel]; ok {
+		return ""
+	}
+	return c.instanceProfileProvider.Check(ctx, c.provisioner.Spec.Cluster.Name)
+}
+
+func (c *Capacity) GetUnavailableOfferings(ctx context.Context) []v1alpha1.UnavailableOffering {
+	return c.instanceProvider.GetUnavailableOfferings()
 }
 
 func (c *Capacity) GetZones(ctx context.Context) ([]string, error) {
@@ -16,7 +16,9 @@ package aws
 
 import (
 	"fmt"
+	"strconv"
 
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 	"github.com/awslabs/karpenter/pkg/utils/functional"
 )
@@ -26,18 +28,57 @@ const (
 	capacityTypeSpot             = "spot"
 	capacityTypeOnDemand         = "on-demand"
 	defaultLaunchTemplateVersion = "$Default"
+	amiFamilyBottlerocket        = "bottlerocket"
 )
 
 var (
-	CapacityTypeLabel          = fmt.Sprintf("%s/capacity-type", nodeLabelPrefix)
-	LaunchTemplateIdLabel      = fmt.Sprintf("%s/launch-template-id", nodeLabelPrefix)
-	LaunchTemplateVersionLabel = fmt.Sprintf("%s/launch-template-version", nodeLabelPrefix)
-	allowedLabels              = []string{CapacityTypeLabel, LaunchTemplateIdLabel, LaunchTemplateVersionLabel}
-	AWSToKubeArchitectures     = map[string]string{
+	CapacityTypeLabel             = fmt.Sprintf("%s/capacity-type", nodeLabelPrefix)
+	LaunchTemplateIdLabel         = fmt.Sprintf("%s/launch-template-id", nodeLabelPrefix)
+	LaunchTemplateVersionLabel    = fmt.Sprintf("%s/launch-template-version", nodeLabelPrefix)
+	SpotAllocationStrategyLabel   = fmt.Sprintf("%s/spot-allocation-strategy", nodeLabelPrefix)
+	PlacementGroupNameLabel       = fmt.Sprintf("%s/placement-group-name", nodeLabelPrefix)
+	PlacementPartitionNumberLabel = fmt.Sprintf("%s/placement-partition-number", nodeLabelPrefix)
+	HibernationEnabledLabel       = fmt.Sprintf("%s/hibernation-enabled", nodeLabelPrefix)
+	NitroRequiredLabel            = fmt.Sprintf("%s/nitro-required", nodeLabelPrefix)
+	BurstableCreditsLabel         = fmt.Sprintf("%s/burstable-credits", nodeLabelPrefix)
+	MinNetworkBandwidthLabel      = fmt.Sprintf("%s/min-network-bandwidth-gbps", nodeLabelPrefix)
+	MaxPriceLabel                 = fmt.Sprintf("%s/max-price", nodeLabelPrefix)
+	SpotMaxPriceLabel             = fmt.Sprintf("%s/spot-max-price", nodeLabelPrefix)
+	RejectDeprecatedAMILabel      = fmt.Sprintf("%s/reject-deprecated-ami", nodeLabelPrefix)
+	MinInstanceStorageLabel       = fmt.Sprintf("%s/min-instance-storage-gb", nodeLabelPrefix)
+	allowedLabels                 = []string{
+		CapacityTypeLabel,
+		LaunchTemplateIdLabel,
+		LaunchTemplateVersionLabel,
+		SpotAllocationStrategyLabel,
+		PlacementGroupNameLabel,
+		PlacementPartitionNumberLabel,
+		HibernationEnabledLabel,
+		NitroRequiredLabel,
+		BurstableCreditsLabel,
+		MinNetworkBandwidthLabel,
+		MaxPriceLabel,
+		SpotMaxPriceLabel,
+		RejectDeprecatedAMILabel,
+		MinInstanceStorageLabel,
+	}
+	spotAllocationStrategies = []string{
+		ec2.SpotAllocationStrategyCapacityOptimizedPrioritized,
+		ec2.SpotAllocationStrategyCapacityOptimized,
+		ec2.SpotAllocationStrategyLowestPrice,
+	}
+	AWSToKubeArchitectures = map[string]string{
 		"x86_64":                   v1alpha1.ArchitectureAmd64,
 		v1alpha1.ArchitectureArm64: v1alpha1.ArchitectureArm64,
 	}
 	KubeToAWSArchitectures = functional.InvertStringMap(AWSToKubeArchitectures)
+	// burstableCreditOptions are the CPU credit options of burstable instances
+	burstableCreditOptions = []string{burstableCreditsStandard, burstableCreditsUnlimited}
+)
+
+const (
+	burstableCreditsStandard  = "standard"
+	burstableCreditsUnlimited = "unlimited"
 )
 
 // Constraints are AWS specific constraints
@@ -51,6 +92,118 @@ func (c *Constraints) GetCapacityType() string {
 	return capacityType
 }
 
+// GetSpotAllocationStrategy returns the fleet allocation strategy for spot
+// capacity, defaulting to capacity-optimized-prioritized.
+func (c *Constraints) GetSpotAllocationStrategy() string {
+	strategy, ok := c.Labels[SpotAllocationStrategyLabel]
+	if !ok {
+		strategy = ec2.SpotAllocationStrategyCapacityOptimizedPrioritized
+	}
+	return strategy
+}
+
+// GetPlacementGroupName returns the placement group to launch into, if any.
+func (c *Constraints) GetPlacementGroupName() string {
+	return c.Labels[PlacementGroupNameLabel]
+}
+
+// GetPlacementPartitionNumber returns the partition of a partition placement
+// group to launch into, or 0 to let EC2 distribute instances across partitions.
+func (c *Constraints) GetPlacementPartitionNumber() int64 {
+	partition, err := strconv.ParseInt(c.Labels[PlacementPartitionNumberLabel], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return partition
+}
+
+// GetHibernationEnabled returns true if instances should be launched with
+// hibernation configured.
+func (c *Constraints) GetHibernationEnabled() bool {
+	enabled, err := strconv.ParseBool(c.Labels[HibernationEnabledLabel])
+	if err != nil {
+		return false
+	}
+	return enabled
+}
+
+// GetNitroRequired returns true if instances must be Nitro-based, e.g. for
+// features like EFA or IMDSv2 hop limits.
+func (c *Constraints) GetNitroRequired() bool {
+	required, err := strconv.ParseBool(c.Labels[NitroRequiredLabel])
+	if err != nil {
+		return false
+	}
+	return required
+}
+
+// GetRejectDeprecatedAMI returns true if launch templates must not be created
+// with deprecated AMIs. Otherwise, deprecated AMIs are used with a warning.
+func (c *Constraints) GetRejectDeprecatedAMI() bool {
+	reject, err := strconv.ParseBool(c.Labels[RejectDeprecatedAMILabel])
+	if err != nil {
+		return false
+	}
+	return reject
+}
+
+// GetBurstableCredits returns the CPU credit option of burstable instances,
+// defaulting to standard so that instances are throttled at their baseline
+// rather than charged for surplus credits.
+func (c *Constraints) GetBurstableCredits() string {
+	credits, ok := c.Labels[BurstableCreditsLabel]
+	if !ok {
+		credits = burstableCreditsStandard
+	}
+	return credits
+}
+
+// GetMinNetworkBandwidth returns the guaranteed network bandwidth in Gbps that
+// instance types must have, or 0 if there's no requirement.
+func (c *Constraints) GetMinNetworkBandwidth() float64 {
+	bandwidth, err := strconv.ParseFloat(c.Labels[MinNetworkBandwidthLabel], 64)
+	if err != nil {
+		return 0
+	}
+	return bandwidth
+}
+
+// GetMinInstanceStorage returns the total size in GB of local instance store
+// volumes, e.g. NVMe scratch disks, that instance types must have, or 0 if
+// there's no requirement.
+func (c *Constraints) GetMinInstanceStorage() int64 {
+	size, err := strconv.ParseInt(c.Labels[MinInstanceStorageLabel], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// GetMaxPrice returns the most that an instance may cost per hour in USD, or
+// nil if there's no cap. It's passed to EC2 fleet as the max total price of
+// both spot and on-demand capacity, which stops fleet from launching once the
+// price of the offering it allocates would exceed it. Instance types aren't
+// excluded by price beforehand, since there's no pricing data, so fleet only
+// falls back to cheaper offerings under the cap with a lowest-price
+// allocation strategy. Otherwise, the launch fails.
+func (c *Constraints) GetMaxPrice() *string {
+	price, ok := c.Labels[MaxPriceLabel]
+	if !ok {
+		return nil
+	}
+	return &price
+}
+
+// GetSpotMaxPrice returns the most that a spot instance may cost per hour in
+// USD, or nil to cap spot prices at the on-demand price, EC2's default
+func (c *Constraints) GetSpotMaxPrice() *string {
+	price, ok := c.Labels[SpotMaxPriceLabel]
+	if !ok {
+		return nil
+	}
+	return &price
+}
+
 type LaunchTemplate struct {
 	Id      *string
 	Version *string
@@ -70,3 +223,14 @@ func (c *Constraints) GetLaunchTemplate() *LaunchTemplate {
 		Version: &version,
 	}
 }
+
+// GetAMIFamily returns the family of AMIs that nodes are launched with, whose
+// system reservations determine the nodes' allocatable resources. Karpenter's
+// launch templates use Bottlerocket, while custom launch templates may use any
+// AMI, so each is its own family.
+func (c *Constraints) GetAMIFamily() string {
+	if launchTemplate := c.GetLaunchTemplate(); launchTemplate != nil {
+		return fmt.Sprintf("launch-template/%s", *launchTemplate.Id)
+	}
+	return amiFamilyBottlerocket
+}
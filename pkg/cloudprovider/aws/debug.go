@@ -0,0 +1,110 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+)
+
+// DebugCachesPath is the path of the debug endpoint serving cache contents
+const DebugCachesPath = "/debug/caches"
+
+// CacheEntry is an unexpired item of a provider's cache
+type CacheEntry struct {
+	Key        string          `json:"key"`
+	Value      json.RawMessage `json:"value"`
+	Expiration *time.Time      `json:"expiration,omitempty"`
+}
+
+// caches returns the providers' caches by name. The caches of role-scoped
+// factories are prefixed by their role ARN, e.g.
+// arn:aws:iam::111111111111:role/example/subnets.
+func (f *Factory) caches() map[string]*cache.Cache {
+	caches := map[string]*cache.Cache{
+		"instanceProfiles":     f.instanceProfileProvider.cache,
+		"instanceTypes":        f.instanceTypeProvider.cache,
+		"launchTemplates":      f.launchTemplateProvider.cache,
+		"placementGroups":      f.placementGroupProvider.cache,
+		"securityGroups":       f.securityGroupProvider.cache,
+		"subnets":              f.subnetProvider.cache,
+		"unavailableOfferings": f.instanceProvider.unavailableOfferings,
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for roleARN, factory := range f.roleScoped {
+		for name, c := range factory.caches() {
+			caches[fmt.Sprintf("%s/%s", roleARN, name)] = c
+		}
+	}
+	return caches
+}
+
+// debugHandler serves the contents of the providers' caches as JSON, keyed
+// by cache name. Entries are sorted by key so that responses are stable.
+func (f *Factory) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(DebugCachesPath, func(w http.ResponseWriter, r *http.Request) {
+		contents := map[string][]CacheEntry{}
+		for name, c := range f.caches() {
+			contents[name] = cacheEntries(c)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(contents); err != nil {
+			zap.S().Errorf("Failed to encode cache contents, %s", err.Error())
+		}
+	})
+	return mux
+}
+
+// serveDebug serves the debug endpoint until the context is done
+func (f *Factory) serveDebug(ctx context.Context) {
+	server := &http.Server{Addr: f.debugBindAddress, Handler: f.debugHandler()}
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			zap.S().Errorf("Failed to close debug server, %s", err.Error())
+		}
+	}()
+	zap.S().Infof("Serving cache contents on %s%s", f.debugBindAddress, DebugCachesPath)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		zap.S().Errorf("Failed to serve debug endpoint, %s", err.Error())
+	}
+}
+
+func cacheEntries(c *cache.Cache) []CacheEntry {
+	entries := []CacheEntry{}
+	for key, item := range c.Items() {
+		value, err := json.Marshal(item.Object)
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprintf("%v", item.Object))
+		}
+		entry := CacheEntry{Key: key, Value: value}
+		if item.Expiration > 0 {
+			expiration := time.Unix(0, item.Expiration)
+			entry.Expiration = &expiration
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
@@ -13,22 +13,34 @@ limitations under the License.
 package aws
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
 	"github.com/awslabs/karpenter/pkg/cloudprovider/aws/utils"
-	"github.com/awslabs/karpenter/pkg/utils/log"
 	"github.com/awslabs/karpenter/pkg/utils/project"
 	"github.com/patrickmn/go-cache"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 )
 
 const (
@@ -40,57 +52,335 @@ const (
 	ClusterTagKeyFormat = "kubernetes.io/cluster/%s"
 	// KarpenterTagKeyFormat is set on all Karpenter owned resources.
 	KarpenterTagKeyFormat = "karpenter.sh/cluster/%s"
+	// TerminationReasonTagKey records why Karpenter terminated an instance.
+	TerminationReasonTagKey = "karpenter.sh/termination-reason"
+	// ResourcePollInterval is how often resources referenced by provisioners,
+	// e.g. subnets and security groups, are checked for changes.
+	ResourcePollInterval = 1 * time.Minute
+	// DefaultMaxIdleConnsPerHost keeps enough connections open to each AWS
+	// endpoint for parallel launches. The stdlib default keeps 2, so bursts
+	// of requests repeatedly reconnect.
+	DefaultMaxIdleConnsPerHost = 64
+	// RequestErrorMessage is logged for every failed AWS API request
+	RequestErrorMessage = "AWS request failed"
+	// RoleARNAnnotation on a provisioner is the ARN of an IAM role to assume
+	// when provisioning, e.g. to launch nodes into another account. Label
+	// values can't contain ARNs, so it's configured as an annotation.
+	RoleARNAnnotation = "node.k8s.aws/role-arn"
 )
 
+// launchTemplateNamePrefixPattern restricts prefixes to the characters that are
+// valid in launch template names.
+var launchTemplateNamePrefixPattern = regexp.MustCompile(`^[a-zA-Z0-9().\-/_]+$`)
+
 type Factory struct {
-	nodeFactory            *NodeFactory
-	launchTemplateProvider *LaunchTemplateProvider
-	subnetProvider         *SubnetProvider
-	instanceTypeProvider   *InstanceTypeProvider
-	instanceProvider       *InstanceProvider
-}
-
-func NewFactory(options cloudprovider.Options) *Factory {
-	sess := withUserAgent(withRegion(session.Must(
-		session.NewSession(request.WithRetryer(
-			&aws.Config{STSRegionalEndpoint: endpoints.RegionalSTSEndpoint},
-			utils.NewRetryer())))))
+	kubeClient              client.Client
+	nodeFactory             *NodeFactory
+	launchTemplateProvider  *LaunchTemplateProvider
+	subnetProvider          *SubnetProvider
+	instanceTypeProvider    *InstanceTypeProvider
+	instanceProvider        *InstanceProvider
+	placementGroupProvider  *PlacementGroupProvider
+	securityGroupProvider   *SecurityGroupProvider
+	instanceProfileProvider *InstanceProfileProvider
+	changes                 chan event.GenericEvent
+	// debugBindAddress serves the providers' cache contents, if set
+	debugBindAddress string
+	// interruptionHandler consumes interruption notices, if a queue is set
+	interruptionHandler *InterruptionHandler
+	// session and options construct the factories of provisioners that
+	// assume roles, which are cached by role ARN
+	session    *session.Session
+	options    cloudprovider.Options
+	mu         sync.Mutex
+	roleScoped map[string]*Factory
+}
+
+// NewFactory constructs the AWS cloud provider. Setup errors are aggregated,
+// so that all misconfigurations are reported at once.
+func NewFactory(options cloudprovider.Options) (*Factory, error) {
+	errs := validateOptions(options)
+	sess, err := session.NewSession(request.WithRetryer(
+		&aws.Config{STSRegionalEndpoint: endpoints.RegionalSTSEndpoint, HTTPClient: newHTTPClient(options)},
+		utils.NewRetryer()))
+	if err != nil {
+		errs = multierr.Append(errs, fmt.Errorf("creating session, %w", err))
+	} else if err := withRegion(sess); err != nil {
+		errs = multierr.Append(errs, err)
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	sess = withUserAgent(sess)
+	sess = withRequestErrorLogging(sess)
+	sess = withThrottling(sess, NewThrottlingRateLimiter(DefaultAPIQPS, DefaultAPIBurst))
+	factory := newFactory(sess, options)
+	if options.InterruptionQueueName != "" {
+		factory.interruptionHandler = NewInterruptionHandler(sqs.New(sess), options.Client, options.InterruptionQueueName, factory.nodeFactory.managedLabelKey, options.HandleRebalanceRecommendations)
+	}
+	return factory, nil
+}
+
+// newFactory constructs the providers of the account that the session's
+// credentials belong to
+func newFactory(sess *session.Session, options cloudprovider.Options) *Factory {
 	ec2api := ec2.New(sess)
+	region := aws.StringValue(sess.Config.Region)
+	namePrefix := options.LaunchTemplateNamePrefix
+	if namePrefix == "" {
+		namePrefix = DefaultLaunchTemplateNamePrefix
+	}
+	idempotencyWindow := DefaultLaunchIdempotencyWindow
+	if options.LaunchIdempotencyWindow != nil {
+		idempotencyWindow = *options.LaunchIdempotencyWindow
+	}
+	launchTimeout := DefaultLaunchTimeout
+	if options.LaunchTimeout != nil {
+		launchTimeout = *options.LaunchTimeout
+	}
+	managedLabelKey := options.ManagedLabelKey
+	if managedLabelKey == "" {
+		managedLabelKey = v1alpha1.DefaultManagedLabelKey
+	}
+	memoryOverheadFraction := DefaultVMMemoryOverheadFraction
+	if options.VMMemoryOverheadFraction != nil {
+		memoryOverheadFraction = *options.VMMemoryOverheadFraction
+	}
+	securityGroupProvider := NewSecurityGroupProvider(ec2api, region)
 	launchTemplateProvider := &LaunchTemplateProvider{
-		ec2api: ec2api,
-		cache:  cache.New(CacheTTL, CacheCleanupInterval),
-		securityGroupProvider: &SecurityGroupProvider{
-			ec2api: ec2api,
-			cache:  cache.New(CacheTTL, CacheCleanupInterval),
-		},
-		ssm:       ssm.New(sess),
-		clientSet: options.ClientSet,
+		ec2api:                ec2api,
+		cache:                 cache.New(CacheTTL, CacheCleanupInterval),
+		launched:              cache.New(LaunchTemplateOrphanSafetyMargin, CacheCleanupInterval),
+		securityGroupProvider: securityGroupProvider,
+		ssm:                   ssm.New(sess),
+		clientSet:             options.ClientSet,
+		region:                region,
+		namePrefix:            namePrefix,
 	}
 	return &Factory{
-		nodeFactory:            &NodeFactory{ec2api: ec2api},
-		launchTemplateProvider: launchTemplateProvider,
-		subnetProvider:         NewSubnetProvider(ec2api),
-		instanceTypeProvider:   NewInstanceTypeProvider(ec2api),
-		instanceProvider:       &InstanceProvider{ec2api: ec2api},
+		kubeClient:              options.Client,
+		nodeFactory:             &NodeFactory{ec2api: ec2api, managedLabelKey: managedLabelKey},
+		launchTemplateProvider:  launchTemplateProvider,
+		subnetProvider:          NewSubnetProvider(ec2api, region),
+		instanceTypeProvider:    NewInstanceTypeProvider(ec2api, region, memoryOverheadFraction),
+		instanceProvider:        NewInstanceProvider(ec2api, idempotencyWindow, launchTimeout),
+		placementGroupProvider:  NewPlacementGroupProvider(ec2api, region),
+		securityGroupProvider:   securityGroupProvider,
+		instanceProfileProvider: NewInstanceProfileProvider(iam.New(sess), options.DisableInstanceProfileCheck),
+		changes:                 make(chan event.GenericEvent),
+		debugBindAddress:        options.DebugBindAddress,
+		session:                 sess,
+		options:                 options,
+		roleScoped:              map[string]*Factory{},
+	}
+}
+
+// validateOptions returns an aggregated error for the invalid options
+func validateOptions(options cloudprovider.Options) (errs error) {
+	if options.LaunchTemplateNamePrefix != "" && !launchTemplateNamePrefixPattern.MatchString(options.LaunchTemplateNamePrefix) {
+		errs = multierr.Append(errs, fmt.Errorf("launch template name prefix %q must match %s", options.LaunchTemplateNamePrefix, launchTemplateNamePrefixPattern))
+	}
+	if fraction := options.VMMemoryOverheadFraction; fraction != nil && (*fraction < 0 || *fraction >= 1) {
+		errs = multierr.Append(errs, fmt.Errorf("vm memory overhead fraction must be in [0, 1), got %v", *fraction))
+	}
+	if window := options.LaunchIdempotencyWindow; window != nil && *window < 0 {
+		errs = multierr.Append(errs, fmt.Errorf("launch idempotency window must not be negative, got %s", *window))
 	}
+	if timeout := options.LaunchTimeout; timeout != nil && *timeout < 0 {
+		errs = multierr.Append(errs, fmt.Errorf("launch timeout must not be negative, got %s", *timeout))
+	}
+	if conns := options.MaxConnsPerHost; conns != nil && *conns < 0 {
+		errs = multierr.Append(errs, fmt.Errorf("max conns per host must not be negative, got %d", *conns))
+	}
+	if conns := options.MaxIdleConnsPerHost; conns != nil && *conns < 0 {
+		errs = multierr.Append(errs, fmt.Errorf("max idle conns per host must not be negative, got %d", *conns))
+	}
+	if options.Client == nil {
+		errs = multierr.Append(errs, fmt.Errorf("kube client is required"))
+	}
+	if options.ClientSet == nil {
+		errs = multierr.Append(errs, fmt.Errorf("kube client set is required"))
+	}
+	return errs
 }
 
+// CapacityFor returns the capacity of the provisioner's account. Provisioners
+// annotated with a role ARN provision into the account of the role, using
+// clients that assume it.
 func (f *Factory) CapacityFor(provisioner *v1alpha1.Provisioner) cloudprovider.Capacity {
+	return f.factoryFor(provisioner).capacityFor(provisioner)
+}
+
+// factoryFor returns the factory of the provisioner's account
+func (f *Factory) factoryFor(provisioner *v1alpha1.Provisioner) *Factory {
+	if roleARN, ok := provisioner.Annotations[RoleARNAnnotation]; ok {
+		return f.forRole(roleARN)
+	}
+	return f
+}
+
+// forRole returns the cached factory whose clients assume the role, so that
+// sessions, credentials, and provider caches are reused across reconciles.
+// The credentials are retrieved from STS lazily and refreshed before expiry.
+// Copies of the session share its handlers, so requests of every role are
+// throttled by the same rate limiter. Role-scoped factories aren't started, so
+// the parent polls their resources and notifies controllers of changes.
+func (f *Factory) forRole(roleARN string) *Factory {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.roleScoped == nil {
+		f.roleScoped = map[string]*Factory{}
+	}
+	if factory, ok := f.roleScoped[roleARN]; ok {
+		return factory
+	}
+	sess := f.session.Copy(&aws.Config{Credentials: stscreds.NewCredentials(f.session, roleARN)})
+	factory := newFactory(sess, f.options)
+	factory.changes = f.changes
+	f.roleScoped[roleARN] = factory
+	zap.S().Debugf("Created session assuming role %s", roleARN)
+	return factory
+}
+
+func (f *Factory) capacityFor(provisioner *v1alpha1.Provisioner) cloudprovider.Capacity {
 	return &Capacity{
-		provisioner:            provisioner,
-		nodeFactory:            f.nodeFactory,
-		instanceProvider:       f.instanceProvider,
-		launchTemplateProvider: f.launchTemplateProvider,
-		instanceTypeProvider:   f.instanceTypeProvider,
-		subnetProvider:         f.subnetProvider,
+		provisioner:             provisioner,
+		nodeFactory:             f.nodeFactory,
+		instanceProvider:        f.instanceProvider,
+		launchTemplateProvider:  f.launchTemplateProvider,
+		instanceTypeProvider:    f.instanceTypeProvider,
+		subnetProvider:          f.subnetProvider,
+		placementGroupProvider:  f.placementGroupProvider,
+		instanceProfileProvider: f.instanceProfileProvider,
 	}
 }
 
-func withRegion(sess *session.Session) *session.Session {
+// Start deletes orphaned launch templates once the manager's caches have
+// synced, and then polls resources referenced by provisioners for changes and
+// reports spot pool metrics. It runs as a leader election runnable, so that a
+// single replica deletes resources, notifies controllers, and reports metrics.
+// If enabled, the leader also serves its cache contents for debugging and
+// consumes interruption notices.
+func (f *Factory) Start(ctx context.Context) error {
+	if f.debugBindAddress != "" {
+		go f.serveDebug(ctx)
+	}
+	if f.interruptionHandler != nil {
+		go f.interruptionHandler.Start(ctx)
+	}
+	f.deleteOrphanedLaunchTemplates(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(ResourcePollInterval):
+			f.notifyChanges(ctx)
+			f.reportSpotPools(ctx)
+		}
+	}
+}
+
+// Notify returns an event for each provisioner whose subnets or security
+// groups changed.
+func (f *Factory) Notify() <-chan event.GenericEvent {
+	return f.changes
+}
+
+func (f *Factory) deleteOrphanedLaunchTemplates(ctx context.Context) {
+	provisioners := &v1alpha1.ProvisionerList{}
+	if err := f.kubeClient.List(ctx, provisioners); err != nil {
+		zap.S().Errorf("Failed to list provisioners while deleting orphaned launch templates, %s", err.Error())
+		return
+	}
+	if err := f.launchTemplateProvider.DeleteOrphans(ctx, provisioners.Items); err != nil {
+		zap.S().Errorf("Failed to delete orphaned launch templates, %s", err.Error())
+	}
+}
+
+// notifyChanges refreshes the cached subnets and security groups of each
+// cluster in each account, and notifies the provisioners of clusters whose
+// resources changed.
+func (f *Factory) notifyChanges(ctx context.Context) {
+	provisioners := &v1alpha1.ProvisionerList{}
+	if err := f.kubeClient.List(ctx, provisioners); err != nil {
+		zap.S().Errorf("Failed to list provisioners while polling for changes, %s", err.Error())
+		return
+	}
+	changed := map[*Factory]map[string]bool{}
+	for i := range provisioners.Items {
+		provisioner := &provisioners.Items[i]
+		if provisioner.Spec.Cluster == nil {
+			continue
+		}
+		factory := f.factoryFor(provisioner)
+		if changed[factory] == nil {
+			changed[factory] = map[string]bool{}
+		}
+		clusterName := provisioner.Spec.Cluster.Name
+		if _, ok := changed[factory][clusterName]; ok {
+			continue
+		}
+		changed[factory][clusterName] = factory.refresh(ctx, clusterName)
+	}
+	for i := range provisioners.Items {
+		provisioner := &provisioners.Items[i]
+		if provisioner.Spec.Cluster == nil || !changed[f.factoryFor(provisioner)][provisioner.Spec.Cluster.Name] {
+			continue
+		}
+		zap.S().Debugf("Requeuing provisioner %s/%s after its cluster's resources changed", provisioner.Name, provisioner.Namespace)
+		select {
+		case f.changes <- event.GenericEvent{Object: provisioner}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh returns true if the cluster's subnets or security groups changed
+func (f *Factory) refresh(ctx context.Context, clusterName string) bool {
+	subnetsChanged, err := f.subnetProvider.Refresh(ctx, clusterName)
+	if err != nil {
+		zap.S().Errorf("Failed to refresh subnets for cluster %s, %s", clusterName, err.Error())
+	}
+	securityGroupsChanged, err := f.securityGroupProvider.Refresh(ctx, clusterName)
+	if err != nil {
+		zap.S().Errorf("Failed to refresh security groups for cluster %s, %s", clusterName, err.Error())
+	}
+	return subnetsChanged || securityGroupsChanged
+}
+
+// newHTTPClient returns a client for AWS APIs whose transport applies the
+// options' connection limits.
+func newHTTPClient(options cloudprovider.Options) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	if options.MaxIdleConnsPerHost != nil {
+		transport.MaxIdleConnsPerHost = *options.MaxIdleConnsPerHost
+	}
+	if options.MaxConnsPerHost != nil {
+		transport.MaxConnsPerHost = *options.MaxConnsPerHost
+	}
+	return &http.Client{Transport: transport}
+}
+
+// cacheKey scopes a cache key to a region so that providers sharing a cache
+// never return resources discovered in a different region.
+func cacheKey(region string, key string) string {
+	return fmt.Sprintf("%s/%s", region, key)
+}
+
+// withRegion sets the session's region from the metadata server, unless it's
+// already configured, e.g. by the AWS_REGION environment variable.
+func withRegion(sess *session.Session) error {
+	if aws.StringValue(sess.Config.Region) != "" {
+		return nil
+	}
 	region, err := ec2metadata.New(sess).Region()
-	log.PanicIfError(err, "failed to call the metadata server's region API")
+	if err != nil {
+		return fmt.Errorf("calling the metadata server's region API, %w", err)
+	}
 	sess.Config.Region = aws.String(region)
-	return sess
+	return nil
 }
 
 // withUserAgent adds a karpenter specific user-agent string to AWS session
@@ -99,3 +389,44 @@ func withUserAgent(sess *session.Session) *session.Session {
 	sess.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(userAgent))
 	return sess
 }
+
+// handledErrorCodes are expected by the callers of requests that fail with
+// them, e.g. launch templates are created when they aren't found
+var handledErrorCodes = map[string]bool{
+	"InvalidLaunchTemplateName.NotFoundException": true,
+	iam.ErrCodeNoSuchEntityException:              true,
+}
+
+// withRequestErrorLogging logs the request ID of every failed request across
+// all services, which AWS support needs to investigate failures. Complete
+// handlers run once per request, after any retries.
+func withRequestErrorLogging(sess *session.Session) *session.Session {
+	sess.Handlers.Complete.PushBack(logRequestError)
+	return sess
+}
+
+// logRequestError logs failed requests at error level, unless their callers
+// handle the error or it's throttling, which is logged and backed off from by
+// the rate limiter
+func logRequestError(r *request.Request) {
+	if r.Error == nil {
+		return
+	}
+	requestID := r.RequestID
+	// Some protocols, e.g. EC2's, only return the request ID in the error body
+	var failure awserr.RequestFailure
+	if requestID == "" && errors.As(r.Error, &failure) {
+		requestID = failure.RequestID()
+	}
+	log := zap.S().Errorw
+	var aerr awserr.Error
+	if (errors.As(r.Error, &aerr) && handledErrorCodes[aerr.Code()]) || request.IsErrorThrottle(r.Error) {
+		log = zap.S().Debugw
+	}
+	log(RequestErrorMessage,
+		"service", r.ClientInfo.ServiceName,
+		"operation", operationOf(r),
+		"requestId", requestID,
+		"error", r.Error.Error(),
+	)
+}
@@ -17,9 +17,11 @@ package fake
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/Pallinder/go-randomdata"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
@@ -28,17 +30,30 @@ import (
 // EC2Behavior must be reset between tests otherwise tests will
 // pollute each other.
 type EC2Behavior struct {
-	CreateFleetOutput                   *ec2.CreateFleetOutput
-	DescribeInstancesOutput             *ec2.DescribeInstancesOutput
-	DescribeLaunchTemplatesOutput       *ec2.DescribeLaunchTemplatesOutput
-	DescribeSubnetsOutput               *ec2.DescribeSubnetsOutput
-	DescribeSecurityGroupsOutput        *ec2.DescribeSecurityGroupsOutput
-	DescribeInstanceTypesOutput         *ec2.DescribeInstanceTypesOutput
-	DescribeInstanceTypeOfferingsOutput *ec2.DescribeInstanceTypeOfferingsOutput
-	DescribeAvailabilityZonesOutput     *ec2.DescribeAvailabilityZonesOutput
-	WantErr                             error
+	CreateFleetOutput                    *ec2.CreateFleetOutput
+	DescribeInstancesOutput              *ec2.DescribeInstancesOutput
+	DescribeLaunchTemplatesOutput        *ec2.DescribeLaunchTemplatesOutput
+	DescribeLaunchTemplateVersionsOutput *ec2.DescribeLaunchTemplateVersionsOutput
+	DescribeImagesOutput                 *ec2.DescribeImagesOutput
+	DescribePlacementGroupsOutput        *ec2.DescribePlacementGroupsOutput
+	DescribeSubnetsOutput                *ec2.DescribeSubnetsOutput
+	DescribeSecurityGroupsOutput         *ec2.DescribeSecurityGroupsOutput
+	DescribeInstanceTypesOutput          *ec2.DescribeInstanceTypesOutput
+	DescribeInstanceTypeOfferingsOutput  *ec2.DescribeInstanceTypeOfferingsOutput
+	DescribeAvailabilityZonesOutput      *ec2.DescribeAvailabilityZonesOutput
+	WantErr                              error
+	// CreateFleetDelay delays fleet's response, unless its context is done
+	CreateFleetDelay                    time.Duration
 	CalledWithCreateFleetInput          []ec2.CreateFleetInput
+	CalledWithDescribeLaunchTemplates   []ec2.DescribeLaunchTemplatesInput
+	CalledWithCreateLaunchTemplateInput []ec2.CreateLaunchTemplateInput
+	CalledWithDeleteLaunchTemplateInput []ec2.DeleteLaunchTemplateInput
+	CalledWithTerminateInstancesInput   []ec2.TerminateInstancesInput
+	CalledWithCreateTagsInput           []ec2.CreateTagsInput
+	CalledWithDescribeInstanceTypes     []ec2.DescribeInstanceTypesInput
 	Instances                           []*ec2.Instance
+	// fleets are keyed by client token, which EC2 deduplicates requests by
+	fleets map[string]*ec2.CreateFleetOutput
 }
 
 type EC2API struct {
@@ -54,12 +69,22 @@ func (e *EC2API) Reset() {
 
 func (e *EC2API) CreateFleetWithContext(ctx context.Context, input *ec2.CreateFleetInput, options ...request.Option) (*ec2.CreateFleetOutput, error) {
 	e.CalledWithCreateFleetInput = append(e.CalledWithCreateFleetInput, *input)
+	if e.CreateFleetDelay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+		case <-time.After(e.CreateFleetDelay):
+		}
+	}
 	if e.WantErr != nil {
 		return nil, e.WantErr
 	}
 	if e.CreateFleetOutput != nil {
 		return e.CreateFleetOutput, nil
 	}
+	if fleet, ok := e.fleets[aws.StringValue(input.ClientToken)]; ok {
+		return fleet, nil
+	}
 	if input.LaunchTemplateConfigs[0].LaunchTemplateSpecification.LaunchTemplateId == nil &&
 		input.LaunchTemplateConfigs[0].LaunchTemplateSpecification.LaunchTemplateName == nil {
 		return nil, fmt.Errorf("missing launch template id or name")
@@ -70,7 +95,26 @@ func (e *EC2API) CreateFleetWithContext(ctx context.Context, input *ec2.CreateFl
 		PrivateDnsName: aws.String(fmt.Sprintf("test-instance-%d.example.com", len(e.Instances))),
 	}
 	e.Instances = append(e.Instances, instance)
-	return &ec2.CreateFleetOutput{Instances: []*ec2.CreateFleetInstance{{InstanceIds: []*string{instance.InstanceId}}}}, nil
+	fleetInstance := &ec2.CreateFleetInstance{InstanceIds: []*string{instance.InstanceId}}
+	// Fulfill the first override, like the prioritized allocation strategies
+	if overrides := input.LaunchTemplateConfigs[0].Overrides; len(overrides) > 0 {
+		instance.InstanceType = overrides[0].InstanceType
+		fleetInstance.InstanceType = overrides[0].InstanceType
+		fleetInstance.LaunchTemplateAndOverrides = &ec2.LaunchTemplateAndOverridesResponse{
+			Overrides: &ec2.FleetLaunchTemplateOverrides{
+				InstanceType: overrides[0].InstanceType,
+				SubnetId:     overrides[0].SubnetId,
+			},
+		}
+	}
+	fleet := &ec2.CreateFleetOutput{Instances: []*ec2.CreateFleetInstance{fleetInstance}}
+	if input.ClientToken != nil {
+		if e.fleets == nil {
+			e.fleets = map[string]*ec2.CreateFleetOutput{}
+		}
+		e.fleets[aws.StringValue(input.ClientToken)] = fleet
+	}
+	return fleet, nil
 }
 
 func (e *EC2API) DescribeInstancesWithContext(context.Context, *ec2.DescribeInstancesInput, ...request.Option) (*ec2.DescribeInstancesOutput, error) {
@@ -85,11 +129,16 @@ func (e *EC2API) DescribeInstancesWithContext(context.Context, *ec2.DescribeInst
 	}, nil
 }
 
-func (e *EC2API) DescribeLaunchTemplatesWithContext(context.Context, *ec2.DescribeLaunchTemplatesInput, ...request.Option) (*ec2.DescribeLaunchTemplatesOutput, error) {
+func (e *EC2API) DescribeLaunchTemplatesWithContext(ctx context.Context, input *ec2.DescribeLaunchTemplatesInput, options ...request.Option) (*ec2.DescribeLaunchTemplatesOutput, error) {
+	e.CalledWithDescribeLaunchTemplates = append(e.CalledWithDescribeLaunchTemplates, *input)
 	if e.WantErr != nil {
 		return nil, e.WantErr
 	}
 	if e.DescribeLaunchTemplatesOutput != nil {
+		// EC2 returns an error when describing launch templates by name that don't exist
+		if len(e.DescribeLaunchTemplatesOutput.LaunchTemplates) == 0 && len(input.LaunchTemplateNames) > 0 {
+			return nil, awserr.New("InvalidLaunchTemplateName.NotFoundException", "not found", nil)
+		}
 		return e.DescribeLaunchTemplatesOutput, nil
 	}
 	return &ec2.DescribeLaunchTemplatesOutput{LaunchTemplates: []*ec2.LaunchTemplate{{
@@ -98,6 +147,81 @@ func (e *EC2API) DescribeLaunchTemplatesWithContext(context.Context, *ec2.Descri
 	}}}, nil
 }
 
+func (e *EC2API) DescribeLaunchTemplateVersionsWithContext(ctx context.Context, input *ec2.DescribeLaunchTemplateVersionsInput, options ...request.Option) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+	if e.WantErr != nil {
+		return nil, e.WantErr
+	}
+	if e.DescribeLaunchTemplateVersionsOutput != nil {
+		return e.DescribeLaunchTemplateVersionsOutput, nil
+	}
+	return &ec2.DescribeLaunchTemplateVersionsOutput{LaunchTemplateVersions: []*ec2.LaunchTemplateVersion{{
+		LaunchTemplateId:   input.LaunchTemplateId,
+		LaunchTemplateData: &ec2.ResponseLaunchTemplateData{ImageId: aws.String("test-ami-id")},
+	}}}, nil
+}
+
+func (e *EC2API) DescribeImagesWithContext(ctx context.Context, input *ec2.DescribeImagesInput, options ...request.Option) (*ec2.DescribeImagesOutput, error) {
+	if e.WantErr != nil {
+		return nil, e.WantErr
+	}
+	if e.DescribeImagesOutput != nil {
+		return e.DescribeImagesOutput, nil
+	}
+	return &ec2.DescribeImagesOutput{Images: []*ec2.Image{{
+		ImageId:      input.ImageIds[0],
+		Architecture: aws.String("x86_64"),
+	}}}, nil
+}
+
+func (e *EC2API) CreateLaunchTemplate(input *ec2.CreateLaunchTemplateInput) (*ec2.CreateLaunchTemplateOutput, error) {
+	e.CalledWithCreateLaunchTemplateInput = append(e.CalledWithCreateLaunchTemplateInput, *input)
+	if e.WantErr != nil {
+		return nil, e.WantErr
+	}
+	return &ec2.CreateLaunchTemplateOutput{LaunchTemplate: &ec2.LaunchTemplate{
+		LaunchTemplateName: input.LaunchTemplateName,
+		LaunchTemplateId:   aws.String("test-launch-template-id"),
+	}}, nil
+}
+
+func (e *EC2API) DescribePlacementGroupsWithContext(context.Context, *ec2.DescribePlacementGroupsInput, ...request.Option) (*ec2.DescribePlacementGroupsOutput, error) {
+	if e.WantErr != nil {
+		return nil, e.WantErr
+	}
+	if e.DescribePlacementGroupsOutput != nil {
+		return e.DescribePlacementGroupsOutput, nil
+	}
+	return &ec2.DescribePlacementGroupsOutput{PlacementGroups: []*ec2.PlacementGroup{{
+		GroupName:      aws.String("test-placement-group"),
+		Strategy:       aws.String(ec2.PlacementStrategyPartition),
+		PartitionCount: aws.Int64(3),
+	}}}, nil
+}
+
+func (e *EC2API) DeleteLaunchTemplateWithContext(ctx context.Context, input *ec2.DeleteLaunchTemplateInput, options ...request.Option) (*ec2.DeleteLaunchTemplateOutput, error) {
+	e.CalledWithDeleteLaunchTemplateInput = append(e.CalledWithDeleteLaunchTemplateInput, *input)
+	if e.WantErr != nil {
+		return nil, e.WantErr
+	}
+	return &ec2.DeleteLaunchTemplateOutput{}, nil
+}
+
+func (e *EC2API) TerminateInstancesWithContext(ctx context.Context, input *ec2.TerminateInstancesInput, options ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	e.CalledWithTerminateInstancesInput = append(e.CalledWithTerminateInstancesInput, *input)
+	if e.WantErr != nil {
+		return nil, e.WantErr
+	}
+	return &ec2.TerminateInstancesOutput{}, nil
+}
+
+func (e *EC2API) CreateTagsWithContext(ctx context.Context, input *ec2.CreateTagsInput, options ...request.Option) (*ec2.CreateTagsOutput, error) {
+	e.CalledWithCreateTagsInput = append(e.CalledWithCreateTagsInput, *input)
+	if e.WantErr != nil {
+		return nil, e.WantErr
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
 func (e *EC2API) DescribeSubnetsWithContext(context.Context, *ec2.DescribeSubnetsInput, ...request.Option) (*ec2.DescribeSubnetsOutput, error) {
 	if e.WantErr != nil {
 		return nil, e.WantErr
@@ -137,6 +261,7 @@ func (e *EC2API) DescribeAvailabilityZonesWithContext(context.Context, *ec2.Desc
 }
 
 func (e *EC2API) DescribeInstanceTypesPagesWithContext(ctx context.Context, input *ec2.DescribeInstanceTypesInput, fn func(*ec2.DescribeInstanceTypesOutput, bool) bool, opts ...request.Option) error {
+	e.CalledWithDescribeInstanceTypes = append(e.CalledWithDescribeInstanceTypes, *input)
 	if e.WantErr != nil {
 		return e.WantErr
 	}
@@ -152,6 +277,8 @@ func (e *EC2API) DescribeInstanceTypesPagesWithContext(ctx context.Context, inpu
 				SupportedVirtualizationTypes:  []*string{aws.String("hvm")},
 				BurstablePerformanceSupported: aws.Bool(false),
 				BareMetal:                     aws.Bool(false),
+				Hypervisor:                    aws.String("nitro"),
+				HibernationSupported:          aws.Bool(true),
 				ProcessorInfo: &ec2.ProcessorInfo{
 					SupportedArchitectures: aws.StringSlice([]string{"x86_64"}),
 				},
@@ -162,6 +289,7 @@ func (e *EC2API) DescribeInstanceTypesPagesWithContext(ctx context.Context, inpu
 					SizeInMiB: aws.Int64(8),
 				},
 				NetworkInfo: &ec2.NetworkInfo{
+					NetworkPerformance:        aws.String("Up to 10 Gigabit"),
 					MaximumNetworkInterfaces:  aws.Int64(3),
 					Ipv4AddressesPerInterface: aws.Int64(30),
 				},
@@ -172,6 +300,8 @@ func (e *EC2API) DescribeInstanceTypesPagesWithContext(ctx context.Context, inpu
 				SupportedVirtualizationTypes:  []*string{aws.String("hvm")},
 				BurstablePerformanceSupported: aws.Bool(false),
 				BareMetal:                     aws.Bool(false),
+				Hypervisor:                    aws.String("nitro"),
+				HibernationSupported:          aws.Bool(true),
 				ProcessorInfo: &ec2.ProcessorInfo{
 					SupportedArchitectures: aws.StringSlice([]string{"x86_64"}),
 				},
@@ -182,6 +312,7 @@ func (e *EC2API) DescribeInstanceTypesPagesWithContext(ctx context.Context, inpu
 					SizeInMiB: aws.Int64(16),
 				},
 				NetworkInfo: &ec2.NetworkInfo{
+					NetworkPerformance:        aws.String("Up to 10 Gigabit"),
 					MaximumNetworkInterfaces:  aws.Int64(4),
 					Ipv4AddressesPerInterface: aws.Int64(60),
 				},
@@ -192,6 +323,7 @@ func (e *EC2API) DescribeInstanceTypesPagesWithContext(ctx context.Context, inpu
 				SupportedVirtualizationTypes:  []*string{aws.String("hvm")},
 				BurstablePerformanceSupported: aws.Bool(false),
 				BareMetal:                     aws.Bool(false),
+				Hypervisor:                    aws.String("xen"),
 				ProcessorInfo: &ec2.ProcessorInfo{
 					SupportedArchitectures: aws.StringSlice([]string{"x86_64"}),
 				},
@@ -208,6 +340,7 @@ func (e *EC2API) DescribeInstanceTypesPagesWithContext(ctx context.Context, inpu
 					}},
 				},
 				NetworkInfo: &ec2.NetworkInfo{
+					NetworkPerformance:        aws.String("10 Gigabit"),
 					MaximumNetworkInterfaces:  aws.Int64(4),
 					Ipv4AddressesPerInterface: aws.Int64(60),
 				},
@@ -218,6 +351,7 @@ func (e *EC2API) DescribeInstanceTypesPagesWithContext(ctx context.Context, inpu
 				SupportedVirtualizationTypes:  []*string{aws.String("hvm")},
 				BurstablePerformanceSupported: aws.Bool(false),
 				BareMetal:                     aws.Bool(false),
+				Hypervisor:                    aws.String("nitro"),
 				ProcessorInfo: &ec2.ProcessorInfo{
 					SupportedArchitectures: aws.StringSlice([]string{"x86_64"}),
 				},
@@ -233,6 +367,7 @@ func (e *EC2API) DescribeInstanceTypesPagesWithContext(ctx context.Context, inpu
 						Count:        aws.Int64(4),
 					}}},
 				NetworkInfo: &ec2.NetworkInfo{
+					NetworkPerformance:        aws.String("25 Gigabit"),
 					MaximumNetworkInterfaces:  aws.Int64(4),
 					Ipv4AddressesPerInterface: aws.Int64(60),
 				},
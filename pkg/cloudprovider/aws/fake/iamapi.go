@@ -0,0 +1,70 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+)
+
+// IAMBehavior must be reset between tests otherwise tests will
+// pollute each other.
+type IAMBehavior struct {
+	GetInstanceProfileOutput       *iam.GetInstanceProfileOutput
+	ListAttachedRolePoliciesOutput *iam.ListAttachedRolePoliciesOutput
+	WantErr                        error
+}
+
+type IAMAPI struct {
+	iamiface.IAMAPI
+	IAMBehavior
+}
+
+// Reset must be called between tests otherwise tests will pollute
+// each other.
+func (a *IAMAPI) Reset() {
+	a.IAMBehavior = IAMBehavior{}
+}
+
+func (a *IAMAPI) GetInstanceProfileWithContext(_ context.Context, input *iam.GetInstanceProfileInput, _ ...request.Option) (*iam.GetInstanceProfileOutput, error) {
+	if a.WantErr != nil {
+		return nil, a.WantErr
+	}
+	if a.GetInstanceProfileOutput != nil {
+		return a.GetInstanceProfileOutput, nil
+	}
+	return &iam.GetInstanceProfileOutput{InstanceProfile: &iam.InstanceProfile{
+		InstanceProfileName: input.InstanceProfileName,
+		Roles:               []*iam.Role{{RoleName: aws.String("test-node-role")}},
+	}}, nil
+}
+
+func (a *IAMAPI) ListAttachedRolePoliciesWithContext(context.Context, *iam.ListAttachedRolePoliciesInput, ...request.Option) (*iam.ListAttachedRolePoliciesOutput, error) {
+	if a.WantErr != nil {
+		return nil, a.WantErr
+	}
+	if a.ListAttachedRolePoliciesOutput != nil {
+		return a.ListAttachedRolePoliciesOutput, nil
+	}
+	return &iam.ListAttachedRolePoliciesOutput{AttachedPolicies: []*iam.AttachedPolicy{
+		{PolicyName: aws.String("AmazonEKSWorkerNodePolicy"), PolicyArn: aws.String("arn:aws:iam::aws:policy/AmazonEKSWorkerNodePolicy")},
+		{PolicyName: aws.String("AmazonEC2ContainerRegistryReadOnly"), PolicyArn: aws.String("arn:aws:iam::aws:policy/AmazonEC2ContainerRegistryReadOnly")},
+		{PolicyName: aws.String("AmazonEKS_CNI_Policy"), PolicyArn: aws.String("arn:aws:iam::aws:policy/AmazonEKS_CNI_Policy")},
+	}}, nil
+}
@@ -15,6 +15,9 @@ limitations under the License.
 package fake
 
 import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 )
@@ -24,12 +27,40 @@ type SQSAPI struct {
 	QueueUrlOutput       sqs.GetQueueUrlOutput
 	QueueAttributeOutput sqs.GetQueueAttributesOutput
 	WantErr              error
+	// Messages are received once, in batches of up to the requested number
+	Messages                     []*sqs.Message
+	CalledWithDeleteMessageInput []sqs.DeleteMessageInput
+}
+
+func (m *SQSAPI) GetQueueUrl(*sqs.GetQueueUrlInput) (*sqs.GetQueueUrlOutput, error) {
+	return &m.QueueUrlOutput, m.WantErr
 }
 
-func (m SQSAPI) GetQueueUrl(*sqs.GetQueueUrlInput) (*sqs.GetQueueUrlOutput, error) {
+func (m *SQSAPI) GetQueueUrlWithContext(context.Context, *sqs.GetQueueUrlInput, ...request.Option) (*sqs.GetQueueUrlOutput, error) {
 	return &m.QueueUrlOutput, m.WantErr
 }
 
-func (m SQSAPI) GetQueueAttributes(*sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+func (m *SQSAPI) GetQueueAttributes(*sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
 	return &m.QueueAttributeOutput, m.WantErr
 }
+
+func (m *SQSAPI) ReceiveMessageWithContext(ctx context.Context, input *sqs.ReceiveMessageInput, options ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	if m.WantErr != nil {
+		return nil, m.WantErr
+	}
+	count := len(m.Messages)
+	if input.MaxNumberOfMessages != nil && int(*input.MaxNumberOfMessages) < count {
+		count = int(*input.MaxNumberOfMessages)
+	}
+	messages := m.Messages[:count]
+	m.Messages = m.Messages[count:]
+	return &sqs.ReceiveMessageOutput{Messages: messages}, nil
+}
+
+func (m *SQSAPI) DeleteMessageWithContext(ctx context.Context, input *sqs.DeleteMessageInput, options ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	m.CalledWithDeleteMessageInput = append(m.CalledWithDeleteMessageInput, *input)
+	if m.WantErr != nil {
+		return nil, m.WantErr
+	}
+	return &sqs.DeleteMessageOutput{}, nil
+}
@@ -16,84 +16,176 @@ package aws
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/rand"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/cloudprovider/aws/utils"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+	"github.com/patrickmn/go-cache"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"knative.dev/pkg/apis"
 )
 
 const (
 	// maxInstanceTypes defines the number of instance type options to pass to fleet
 	maxInstanceTypes = 20
+	// UnavailableOfferingsTTL is how long an offering is reported as
+	// unavailable after it last failed due to insufficient capacity.
+	UnavailableOfferingsTTL = 3 * time.Minute
+	// insufficientCapacityErrorCode is returned by fleet for offerings
+	// without capacity.
+	insufficientCapacityErrorCode = "InsufficientInstanceCapacity"
+	// DefaultLaunchIdempotencyWindow is used when no window is configured.
+	DefaultLaunchIdempotencyWindow = 1 * time.Minute
+	// DefaultLaunchTimeout is used when no timeout is configured. It's shorter
+	// than the default idempotency window, so that the retry of a cancelled
+	// launch is deduplicated with it.
+	DefaultLaunchTimeout = 30 * time.Second
+	// LaunchRequestMessage is logged at debug level with each fleet request
+	LaunchRequestMessage = "Launching instance"
+	// InstanceLaunchedMessage is logged with each launched instance and the
+	// reason its instance type was selected
+	InstanceLaunchedMessage = "Launched instance"
 )
 
+// providerIDPattern matches provider ids of the form aws:///<zone>/<instance id>
+var providerIDPattern = regexp.MustCompile(`^aws:///[^/]+/(i-[0-9a-f]+)$`)
+
 type InstanceProvider struct {
 	ec2api ec2iface.EC2API
+	// unavailableOfferings are keyed by instance type and zone, and expire
+	// UnavailableOfferingsTTL after they last failed.
+	unavailableOfferings *cache.Cache
+	// idempotencyWindow bounds how long a launch for the same pods is
+	// deduplicated by EC2, see clientTokenFor.
+	idempotencyWindow time.Duration
+	// launchTimeout cancels calls to fleet which haven't returned, so that
+	// they're retried rather than blocking the reconcile. Zero disables it.
+	launchTimeout time.Duration
+	now           func() time.Time
+}
+
+// LaunchedInstance is an instance launched by fleet, with the instance type
+// and zone that fleet fulfilled it with, which may be any of the options.
+type LaunchedInstance struct {
+	ID           string
+	InstanceType string
+	Zone         string
+	// SelectionReason explains why the instance type was selected, see
+	// selectionReasonFor
+	SelectionReason string
+}
+
+func NewInstanceProvider(ec2api ec2iface.EC2API, idempotencyWindow time.Duration, launchTimeout time.Duration) *InstanceProvider {
+	return &InstanceProvider{
+		ec2api:               ec2api,
+		unavailableOfferings: cache.New(UnavailableOfferingsTTL, CacheCleanupInterval),
+		idempotencyWindow:    idempotencyWindow,
+		launchTimeout:        launchTimeout,
+		now:                  time.Now,
+	}
 }
 
 // Create an instance given the constraints.
 // instanceTypeOptions should be sorted by priority for spot capacity type.
 // If spot is not used, the instanceTypeOptions are not required to be sorted
-// because we are using ec2 fleet's lowest-price OD allocation strategy
+// because we are using ec2 fleet's lowest-price OD allocation strategy, unless
+// another selection strategy prioritizes them.
 func (p *InstanceProvider) Create(ctx context.Context,
 	launchTemplate *LaunchTemplate,
 	instanceTypeOptions []cloudprovider.InstanceType,
 	zonalSubnetOptions map[string][]*ec2.Subnet,
-	capacityType string,
-) (*string, error) {
+	constraints *Constraints,
+	selectionStrategy string,
+	pods []*v1.Pod,
+) (*LaunchedInstance, error) {
+	capacityType := constraints.GetCapacityType()
+	spotAllocationStrategy := constraints.GetSpotAllocationStrategy()
+	onDemandAllocationStrategy := ec2.FleetOnDemandAllocationStrategyLowestPrice
+	if selectionStrategy != "" && selectionStrategy != v1alpha1.SelectionStrategyLowestPrice {
+		onDemandAllocationStrategy = ec2.FleetOnDemandAllocationStrategyPrioritized
+	}
 	// 1. Trim the instanceTypeOptions so that the fleet request doesn't get too large
 	// If ~130 instance types are passed into fleet, the request can exceed the EC2 request size limit (145kb)
 	// due to the overrides expansion for subnetId (depends on number of AZs), Instance Type, and Priority.
 	// For spot capacity-optimized-prioritized, the request should be smaller to prevent using
 	// excessively large instance types that are more plentiful in capacity which the algorithm will bias towards.
-	// packing.InstanceTypes is sorted by vcpus and memory ascending so it's safe to trim the end of the list
-	// to remove excessively large instance types
-	if len(instanceTypeOptions) > maxInstanceTypes {
-		instanceTypeOptions = instanceTypeOptions[:maxInstanceTypes]
-	}
+	// The options may be ranked largest first by the selection strategy, so the largest instance types
+	// are removed by size rather than by trimming the end of the list, keeping the ranking of the rest.
+	instanceTypeOptions = smallestInstanceTypes(instanceTypeOptions, maxInstanceTypes)
 	// 2. Construct override options.
 	var overrides []*ec2.FleetLaunchTemplateOverridesRequest
+	offerings := []string{}
 	for i, instanceType := range instanceTypeOptions {
 		for _, zone := range instanceType.Zones() {
 			subnets := zonalSubnetOptions[zone]
 			if len(subnets) == 0 {
 				continue
 			}
+			offerings = append(offerings, instanceType.Name()+"/"+zone)
 			override := &ec2.FleetLaunchTemplateOverridesRequest{
 				InstanceType: aws.String(instanceType.Name()),
 				// FleetAPI cannot span subnets from the same AZ, so randomize.
 				SubnetId: aws.String(*subnets[rand.Intn(len(subnets))].SubnetId),
 			}
-			// Add a priority for spot requests since we are using the capacity-optimized-prioritized spot allocation strategy
-			// to reduce the likelihood of getting an excessively large instance type.
-			// instanceTypeOptions are sorted by vcpus and memory so this prioritizes smaller instance types.
+			// Add a priority for spot requests using the capacity-optimized-prioritized spot allocation strategy
+			// to reduce the likelihood of getting an excessively large instance type, and for on-demand
+			// requests whose instance types are ranked by the selection strategy.
+			if (capacityType == capacityTypeSpot && spotAllocationStrategy == ec2.SpotAllocationStrategyCapacityOptimizedPrioritized) ||
+				(capacityType == capacityTypeOnDemand && onDemandAllocationStrategy == ec2.FleetOnDemandAllocationStrategyPrioritized) {
+				override.Priority = aws.Float64(priorityOf(instanceType.Name(), i, constraints.InstanceTypes))
+			}
+			// Spot instances are launched up to the spot max price, which
+			// fleet only accepts on overrides, rather than the launch
+			// template's market options
 			if capacityType == capacityTypeSpot {
-				override.Priority = aws.Float64(float64(i))
+				override.MaxPrice = constraints.GetSpotMaxPrice()
 			}
 			overrides = append(overrides, override)
 		}
 	}
 	// 3. Create fleet
-	createFleetOutput, err := p.ec2api.CreateFleetWithContext(ctx, &ec2.CreateFleetInput{
-		Type: aws.String(ec2.FleetTypeInstant),
+	launchCtx := ctx
+	if p.launchTimeout > 0 {
+		var cancel context.CancelFunc
+		launchCtx, cancel = context.WithTimeout(ctx, p.launchTimeout)
+		defer cancel()
+	}
+	createFleetInput := &ec2.CreateFleetInput{
+		ClientToken: p.clientTokenFor(launchTemplate, capacityType, offerings, pods),
+		Type:        aws.String(ec2.FleetTypeInstant),
 		TargetCapacitySpecification: &ec2.TargetCapacitySpecificationRequest{
 			DefaultTargetCapacityType: aws.String(capacityType),
 			TotalTargetCapacity:       aws.Int64(1),
 		},
-		// OnDemandOptions are allowed to be specified even when requesting spot
+		// OnDemandOptions are allowed to be specified even when requesting spot.
+		// The max total price caps fleet's spend, but doesn't exclude instance
+		// types from the overrides.
 		OnDemandOptions: &ec2.OnDemandOptionsRequest{
-			AllocationStrategy: aws.String(ec2.FleetOnDemandAllocationStrategyLowestPrice),
+			AllocationStrategy: aws.String(onDemandAllocationStrategy),
+			MaxTotalPrice:      constraints.GetMaxPrice(),
 		},
 		// SpotOptions are allowed to be specified even when requesting on-demand
 		SpotOptions: &ec2.SpotOptionsRequest{
-			AllocationStrategy: aws.String(ec2.SpotAllocationStrategyCapacityOptimizedPrioritized),
+			AllocationStrategy: aws.String(spotAllocationStrategy),
+			MaxTotalPrice:      constraints.GetMaxPrice(),
 		},
 		LaunchTemplateConfigs: []*ec2.FleetLaunchTemplateConfigRequest{{
 			LaunchTemplateSpecification: &ec2.FleetLaunchTemplateSpecificationRequest{
@@ -102,10 +194,25 @@ func (p *InstanceProvider) Create(ctx context.Context,
 			},
 			Overrides: overrides,
 		}},
-	})
+	}
+	logLaunchRequest(createFleetInput)
+	createFleetOutput, err := p.ec2api.CreateFleetWithContext(launchCtx, createFleetInput)
 	if err != nil {
+		// The client token deduplicates the retry if fleet launched the instance
+		if errors.Is(launchCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			return nil, &cloudprovider.LaunchTimeoutError{Timeout: p.launchTimeout}
+		}
+		if aerr, ok := err.(awserr.Error); ok {
+			if err := launchErrorFor(aerr.Code(), aerr.Message()); err != nil {
+				return nil, err
+			}
+		}
 		return nil, fmt.Errorf("creating fleet %w", err)
 	}
+	p.updateUnavailableOfferings(createFleetOutput, zonalSubnetOptions)
+	if err := fleetErrorFor(createFleetOutput); err != nil {
+		return nil, err
+	}
 	if count := len(createFleetOutput.Instances); count != 1 {
 		return nil, fmt.Errorf("expected 1 instance, but got %d due to errors %v", count, createFleetOutput.Errors)
 	}
@@ -116,15 +223,200 @@ func (p *InstanceProvider) Create(ctx context.Context,
 	if count := len(createFleetOutput.Errors); count > 0 {
 		zap.S().Warnf("CreateFleet encountered %d errors, but still launched instances, %v", count, createFleetOutput.Errors)
 	}
-	return createFleetOutput.Instances[0].InstanceIds[0], nil
+	return launchedInstanceFrom(createFleetOutput.Instances[0], zonalSubnetOptions), nil
+}
+
+// logLaunchRequest logs the resolved fleet request at debug level. The AMI,
+// security groups, and user data of launch templates are logged when they're
+// created, see LaunchTemplateMessage.
+func logLaunchRequest(input *ec2.CreateFleetInput) {
+	if !zap.L().Core().Enabled(zapcore.DebugLevel) {
+		return
+	}
+	config := input.LaunchTemplateConfigs[0]
+	instanceTypes := []string{}
+	subnets := []string{}
+	for _, override := range config.Overrides {
+		instanceTypes = append(instanceTypes, aws.StringValue(override.InstanceType))
+		subnets = append(subnets, aws.StringValue(override.SubnetId))
+	}
+	zap.S().Debugw(LaunchRequestMessage,
+		"launchTemplateId", aws.StringValue(config.LaunchTemplateSpecification.LaunchTemplateId),
+		"launchTemplateVersion", aws.StringValue(config.LaunchTemplateSpecification.Version),
+		"capacityType", aws.StringValue(input.TargetCapacitySpecification.DefaultTargetCapacityType),
+		"instanceTypes", functional.UniqueStrings(instanceTypes),
+		"subnets", functional.UniqueStrings(subnets),
+		"clientToken", aws.StringValue(input.ClientToken),
+	)
 }
 
-func (p *InstanceProvider) Terminate(ctx context.Context, nodes []*v1.Node) error {
+// launchedInstanceFrom returns the instance that fleet launched, and the
+// instance type and zone of the override that it fulfilled
+func launchedInstanceFrom(fleetInstance *ec2.CreateFleetInstance, zonalSubnetOptions map[string][]*ec2.Subnet) *LaunchedInstance {
+	instance := &LaunchedInstance{
+		ID:           aws.StringValue(fleetInstance.InstanceIds[0]),
+		InstanceType: aws.StringValue(fleetInstance.InstanceType),
+	}
+	if fleetInstance.LaunchTemplateAndOverrides == nil || fleetInstance.LaunchTemplateAndOverrides.Overrides == nil {
+		return instance
+	}
+	overrides := fleetInstance.LaunchTemplateAndOverrides.Overrides
+	if instance.InstanceType == "" {
+		instance.InstanceType = aws.StringValue(overrides.InstanceType)
+	}
+	instance.Zone = aws.StringValue(overrides.AvailabilityZone)
+	if instance.Zone == "" {
+		instance.Zone = zonesBySubnet(zonalSubnetOptions)[aws.StringValue(overrides.SubnetId)]
+	}
+	return instance
+}
+
+// zonesBySubnet returns the zone of each subnet id
+func zonesBySubnet(zonalSubnetOptions map[string][]*ec2.Subnet) map[string]string {
+	zones := map[string]string{}
+	for zone, subnets := range zonalSubnetOptions {
+		for _, subnet := range subnets {
+			zones[aws.StringValue(subnet.SubnetId)] = zone
+		}
+	}
+	return zones
+}
+
+// fleetErrorFor returns a typed launch error if no instances were
+// launched due to a quota or configuration error
+func fleetErrorFor(createFleetOutput *ec2.CreateFleetOutput) error {
+	if len(createFleetOutput.Instances) != 0 {
+		return nil
+	}
+	for _, fleetError := range createFleetOutput.Errors {
+		if err := launchErrorFor(aws.StringValue(fleetError.ErrorCode), aws.StringValue(fleetError.ErrorMessage)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// launchErrorFor returns a typed error for EC2 error codes that won't succeed
+// if retried, or nil otherwise
+func launchErrorFor(code string, message string) error {
+	if utils.IsQuotaExceeded(code) {
+		return &cloudprovider.QuotaExceededError{Quota: code, Message: message}
+	}
+	if utils.IsConfigurationError(code) {
+		return &cloudprovider.ConfigurationError{Code: code, Message: message}
+	}
+	return nil
+}
+
+// clientTokenFor derives an idempotency token for launching capacity for the
+// pods, or nil if there are no pods. EC2 returns the original result for
+// requests that reuse a token, so a launch that's retried after a partial
+// failure, e.g. if the node couldn't be created, doesn't leak an instance.
+//
+// The token is stable within a window of time, which is a tradeoff. A longer
+// window deduplicates retries that happen later, but will also deduplicate
+// legitimate launches for the same pods, e.g. if the first instance was
+// interrupted before the pods were bound. A retry that crosses a window
+// boundary isn't deduplicated, so the window should comfortably exceed the
+// controller's retry interval. Windows are aligned to the epoch, so that
+// replicas derive the same token.
+//
+// Pods with a recorded launch intent derive the token from it instead of the
+// window, so a launch interrupted by a controller restart is deduplicated
+// however long the restart takes, see cloudprovider.LaunchIntentOf.
+//
+// The token also covers the capacity type and the offerings, i.e. instance
+// types and zones, that the request may be fulfilled with. A launch that's
+// retried without the offerings that failed due to insufficient capacity is a
+// different request, which EC2 would otherwise answer with the failed fleet,
+// or reject with IdempotentParameterMismatch, until the token changed. Subnets
+// are chosen at random within a zone, so they're excluded. Launches for a
+// different set of pods, e.g. if a restarted controller packs them
+// differently, aren't deduplicated.
+func (p *InstanceProvider) clientTokenFor(launchTemplate *LaunchTemplate, capacityType string, offerings []string, pods []*v1.Pod) *string {
+	if len(pods) == 0 {
+		return nil
+	}
+	uids := []string{}
+	for _, pod := range pods {
+		uids = append(uids, string(pod.UID))
+	}
+	sort.Strings(uids)
+	offerings = functional.UniqueStrings(offerings)
+	sort.Strings(offerings)
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s/%s/%s/%s/%s/", aws.StringValue(launchTemplate.Id), aws.StringValue(launchTemplate.Version),
+		capacityType, strings.Join(offerings, ","), strings.Join(uids, ","))
+	if intent := cloudprovider.LaunchIntentOf(pods); intent != "" {
+		fmt.Fprint(hash, intent)
+	} else if p.idempotencyWindow > 0 {
+		fmt.Fprint(hash, p.now().Truncate(p.idempotencyWindow).Unix())
+	}
+	// Client tokens are limited to 64 characters, the length of a hex sha256
+	return aws.String(hex.EncodeToString(hash.Sum(nil)))
+}
+
+// updateUnavailableOfferings records the offerings that fleet failed to launch
+// due to insufficient capacity.
+func (p *InstanceProvider) updateUnavailableOfferings(createFleetOutput *ec2.CreateFleetOutput, zonalSubnetOptions map[string][]*ec2.Subnet) {
+	zones := zonesBySubnet(zonalSubnetOptions)
+	for _, fleetError := range createFleetOutput.Errors {
+		if aws.StringValue(fleetError.ErrorCode) != insufficientCapacityErrorCode ||
+			fleetError.LaunchTemplateAndOverrides == nil || fleetError.LaunchTemplateAndOverrides.Overrides == nil {
+			continue
+		}
+		overrides := fleetError.LaunchTemplateAndOverrides.Overrides
+		zone := aws.StringValue(overrides.AvailabilityZone)
+		if zone == "" {
+			zone = zones[aws.StringValue(overrides.SubnetId)]
+		}
+		offering := v1alpha1.UnavailableOffering{
+			InstanceType:     aws.StringValue(overrides.InstanceType),
+			Zone:             zone,
+			LastObservedTime: apis.VolatileTime{Inner: metav1.Now()},
+		}
+		p.unavailableOfferings.SetDefault(fmt.Sprintf("%s/%s", offering.InstanceType, offering.Zone), offering)
+	}
+}
+
+// GetUnavailableOfferings returns the offerings that recently failed to launch
+// due to insufficient capacity, sorted by instance type and zone.
+func (p *InstanceProvider) GetUnavailableOfferings() []v1alpha1.UnavailableOffering {
+	offerings := []v1alpha1.UnavailableOffering{}
+	for _, item := range p.unavailableOfferings.Items() {
+		offerings = append(offerings, item.Object.(v1alpha1.UnavailableOffering))
+	}
+	sort.Slice(offerings, func(i, j int) bool {
+		if offerings[i].InstanceType != offerings[j].InstanceType {
+			return offerings[i].InstanceType < offerings[j].InstanceType
+		}
+		return offerings[i].Zone < offerings[j].Zone
+	})
+	return offerings
+}
+
+// priorityOf ranks an instance type by its position in the provisioner's
+// instance types. If the provisioner does not rank the instance type, it falls
+// back to its position in instanceTypeOptions, which are sorted by vcpus and
+// memory so this prioritizes smaller instance types.
+func priorityOf(instanceType string, index int, ranking []string) float64 {
+	for rank, ranked := range ranking {
+		if ranked == instanceType {
+			return float64(rank)
+		}
+	}
+	return float64(len(ranking) + index)
+}
+
+func (p *InstanceProvider) Terminate(ctx context.Context, nodes []*v1.Node, reason string) error {
 	if len(nodes) == 0 {
 		return nil
 	}
 	ids := p.getInstanceIDs(nodes)
-
+	if len(ids) == 0 {
+		return nil
+	}
+	p.tagTerminationReason(ctx, ids, reason)
 	_, err := p.ec2api.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
 		InstanceIds: ids,
 	})
@@ -135,15 +427,54 @@ func (p *InstanceProvider) Terminate(ctx context.Context, nodes []*v1.Node) erro
 	return nil
 }
 
+// tagTerminationReason tags instances with the reason they're terminated.
+// Failing to tag doesn't prevent termination, since leaking instances is
+// worse than losing the reason.
+func (p *InstanceProvider) tagTerminationReason(ctx context.Context, ids []*string, reason string) {
+	if reason == "" {
+		return
+	}
+	if _, err := p.ec2api.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: ids,
+		Tags:      []*ec2.Tag{{Key: aws.String(TerminationReasonTagKey), Value: aws.String(reason)}},
+	}); err != nil {
+		zap.S().Warnf("Continuing after failing to tag %d instances with termination reason %s, %s", len(ids), reason, err.Error())
+	}
+}
+
+// getInstanceIDs parses the instance ids of the nodes' provider ids. Nodes
+// created outside of Karpenter may have provider ids in other formats, which
+// are skipped rather than failing the whole batch.
 func (p *InstanceProvider) getInstanceIDs(nodes []*v1.Node) []*string {
 	ids := []*string{}
 	for _, node := range nodes {
-		id := strings.Split(node.Spec.ProviderID, "/")
-		if len(id) < 5 {
-			zap.S().Debugf("Continuing after failure to parse instance id, %s has invalid format", node.Name)
+		matches := providerIDPattern.FindStringSubmatch(node.Spec.ProviderID)
+		if matches == nil {
+			zap.S().Debugf("Continuing after failure to parse instance id, %s has provider id %q in an unexpected format", node.Name, node.Spec.ProviderID)
 			continue
 		}
-		ids = append(ids, aws.String(id[4]))
+		ids = append(ids, aws.String(matches[1]))
 	}
 	return ids
 }
+
+// smallestInstanceTypes removes all but the count smallest instance types,
+// keeping the order of the rest
+func smallestInstanceTypes(instanceTypes []cloudprovider.InstanceType, count int) []cloudprovider.InstanceType {
+	if len(instanceTypes) <= count {
+		return instanceTypes
+	}
+	bySize := append([]cloudprovider.InstanceType{}, instanceTypes...)
+	sort.SliceStable(bySize, func(i, j int) bool { return compareSize(bySize[i], bySize[j]) < 0 })
+	smallest := map[string]bool{}
+	for _, instanceType := range bySize[:count] {
+		smallest[instanceType.Name()] = true
+	}
+	result := []cloudprovider.InstanceType{}
+	for _, instanceType := range instanceTypes {
+		if smallest[instanceType.Name()] {
+			result = append(result, instanceType)
+		}
+	}
+	return result
+}
@@ -0,0 +1,122 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+)
+
+// requiredNodePolicies are the managed policies that nodes need to join the
+// cluster and pull images. AmazonEKS_CNI_Policy isn't required, since it's
+// commonly granted to the CNI's service account instead.
+var requiredNodePolicies = []string{
+	"AmazonEKSWorkerNodePolicy",
+	"AmazonEC2ContainerRegistryReadOnly",
+}
+
+type InstanceProfileProvider struct {
+	iamapi iamiface.IAMAPI
+	cache  *cache.Cache
+	// disabled skips checking instance profiles, e.g. if nodes' roles are
+	// granted equivalent permissions by other policies
+	disabled bool
+}
+
+func NewInstanceProfileProvider(iamapi iamiface.IAMAPI, disabled bool) *InstanceProfileProvider {
+	return &InstanceProfileProvider{
+		iamapi:   iamapi,
+		cache:    cache.New(CacheTTL, CacheCleanupInterval),
+		disabled: disabled,
+	}
+}
+
+// instanceProfileName is the instance profile of the nodes of a cluster
+func instanceProfileName(clusterName string) string {
+	return fmt.Sprintf("KarpenterNodeInstanceProfile-%s", clusterName)
+}
+
+// Check returns a warning if the roles of the cluster's instance profile are
+// missing the policies that nodes need to join the cluster, or empty if they
+// aren't. Otherwise, nodes launch but never become ready. Since IAM
+// permissions are optional for Karpenter, and nodes' roles may be granted
+// equivalent permissions by other policies, the check is skipped if it's
+// denied or the instance profile isn't found, and never prevents launches.
+func (p *InstanceProfileProvider) Check(ctx context.Context, clusterName string) string {
+	if p.disabled {
+		return ""
+	}
+	name := instanceProfileName(clusterName)
+	if cached, ok := p.cache.Get(name); ok {
+		return cached.(string)
+	}
+	missing, err := p.getMissingPolicies(ctx, name)
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && (aerr.Code() == "AccessDenied" || aerr.Code() == iam.ErrCodeNoSuchEntityException) {
+		zap.S().Warnf("Skipping check of instance profile %s, %s", name, aerr.Message())
+		p.cache.SetDefault(name, "")
+		return ""
+	}
+	if err != nil {
+		zap.S().Errorf("Failed to check instance profile %s, %s", name, err.Error())
+		return ""
+	}
+	warning := ""
+	if len(missing) > 0 {
+		warning = fmt.Sprintf("instance profile %s must have a role with policies %v, nodes will not join the cluster without them", name, missing)
+	}
+	p.cache.SetDefault(name, warning)
+	zap.S().Debugf("Successfully checked instance profile %s", name)
+	return warning
+}
+
+func (p *InstanceProfileProvider) getMissingPolicies(ctx context.Context, name string) ([]string, error) {
+	output, err := p.iamapi.GetInstanceProfileWithContext(ctx, &iam.GetInstanceProfileInput{InstanceProfileName: aws.String(name)})
+	if err != nil {
+		return nil, fmt.Errorf("getting instance profile %s, %w", name, err)
+	}
+	attached := map[string]bool{}
+	for _, role := range output.InstanceProfile.Roles {
+		input := &iam.ListAttachedRolePoliciesInput{RoleName: role.RoleName}
+		for {
+			policies, err := p.iamapi.ListAttachedRolePoliciesWithContext(ctx, input)
+			if err != nil {
+				return nil, fmt.Errorf("listing policies of role %s, %w", aws.StringValue(role.RoleName), err)
+			}
+			for _, policy := range policies.AttachedPolicies {
+				attached[aws.StringValue(policy.PolicyName)] = true
+			}
+			if !aws.BoolValue(policies.IsTruncated) {
+				break
+			}
+			input.Marker = policies.Marker
+		}
+	}
+	missing := []string{}
+	for _, policy := range requiredNodePolicies {
+		if !attached[policy] {
+			missing = append(missing, policy)
+		}
+	}
+	return missing, nil
+}
@@ -16,6 +16,9 @@ package aws
 
 import (
 	"fmt"
+	"math"
+	"regexp"
+	"strconv"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -24,9 +27,21 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 )
 
+// guaranteedNetworkPerformancePattern matches network performance that's
+// sustained, e.g. "25 Gigabit" or "4x 100 Gigabit" across network cards, as
+// opposed to burstable "Up to 10 Gigabit" or unquantified "Moderate".
+var guaranteedNetworkPerformancePattern = regexp.MustCompile(`^(?:(\d+)x )?(\d+(?:\.\d+)?) Gigabit$`)
+
 type InstanceType struct {
 	ec2.InstanceTypeInfo
 	ZoneOptions []string
+	// MemoryOverheadFraction of advertised memory is reserved by the kernel and
+	// firmware, and is not allocatable.
+	MemoryOverheadFraction float64
+	// ObservedAllocatable is the cpu and memory that nodes of the instance
+	// type reported as allocatable, if any have been observed. It takes
+	// precedence over the estimated overhead.
+	ObservedAllocatable v1.ResourceList
 }
 
 func (i *InstanceType) Name() string {
@@ -53,7 +68,8 @@ func (i *InstanceType) CPU() *resource.Quantity {
 }
 
 func (i *InstanceType) Memory() *resource.Quantity {
-	return resources.Quantity(fmt.Sprintf("%dMi", *i.MemoryInfo.SizeInMiB))
+	advertised := *i.MemoryInfo.SizeInMiB
+	return resources.Quantity(fmt.Sprintf("%dMi", advertised-int64(math.Ceil(float64(advertised)*i.MemoryOverheadFraction))))
 }
 
 func (i *InstanceType) Pods() *resource.Quantity {
@@ -97,6 +113,53 @@ func (i *InstanceType) AWSNeurons() *resource.Quantity {
 	return resources.Quantity(fmt.Sprint(count))
 }
 
+// NitroBased returns true if the instance type runs on the Nitro system, i.e.
+// it uses the Nitro hypervisor or is bare metal
+func (i *InstanceType) NitroBased() bool {
+	return aws.StringValue(i.Hypervisor) == ec2.InstanceTypeHypervisorNitro || aws.BoolValue(i.BareMetal)
+}
+
+// NetworkBandwidth returns the instance type's guaranteed network bandwidth in
+// Gbps. Burstable and unquantified network performance isn't guaranteed, so
+// it's 0.
+func (i *InstanceType) NetworkBandwidth() float64 {
+	if i.NetworkInfo == nil {
+		return 0
+	}
+	matches := guaranteedNetworkPerformancePattern.FindStringSubmatch(aws.StringValue(i.NetworkInfo.NetworkPerformance))
+	if matches == nil {
+		return 0
+	}
+	bandwidth, err := strconv.ParseFloat(matches[2], 64)
+	if err != nil {
+		return 0
+	}
+	if matches[1] != "" {
+		cards, err := strconv.ParseFloat(matches[1], 64)
+		if err != nil {
+			return 0
+		}
+		bandwidth *= cards
+	}
+	return bandwidth
+}
+
+// Burstable returns true for instance types that earn CPU credits, e.g. t3
+func (i *InstanceType) Burstable() bool {
+	return aws.BoolValue(i.BurstablePerformanceSupported)
+}
+
+// EphemeralStorage is bounded by the largest data volume, since data volumes
+// are sized at launch to fit the pods' ephemeral storage requests
+func (i *InstanceType) EphemeralStorage() *resource.Quantity {
+	return resources.Quantity(fmt.Sprintf("%dGi", maxDataVolumeSizeGiB-dataVolumeReservedSizeGiB))
+}
+
+// HugePages are never preallocated on Bottlerocket nodes
+func (i *InstanceType) HugePages() v1.ResourceList {
+	return v1.ResourceList{}
+}
+
 // Overhead calculations copied from
 // https://github.com/awslabs/amazon-eks-ami/blob/5a3df0fdb17e540f8d5a9b405096f32d6b9b0a3f/files/bootstrap.sh#L237
 func (i *InstanceType) Overhead() v1.ResourceList {
@@ -122,5 +185,29 @@ func (i *InstanceType) Overhead() v1.ResourceList {
 			overhead.Cpu().Add(*resource.NewMilliQuantity(int64(r*cpuRange.percentage), resource.DecimalSI))
 		}
 	}
+	// Observed allocatable resources are reserved exactly, without exceeding
+	// the instance type's resources
+	for resourceName, total := range map[v1.ResourceName]*resource.Quantity{
+		v1.ResourceCPU:    i.CPU(),
+		v1.ResourceMemory: i.Memory(),
+	} {
+		if allocatable, ok := i.ObservedAllocatable[resourceName]; ok {
+			observed := total.DeepCopy()
+			observed.Sub(allocatable)
+			if observed.Sign() < 0 {
+				observed = resource.MustParse("0")
+			}
+			overhead[resourceName] = observed
+		}
+	}
 	return overhead
 }
+
+// InstanceStorage returns the total size in GB of the instance type's local
+// instance store volumes, or 0 if it only supports EBS.
+func (i *InstanceType) InstanceStorage() int64 {
+	if i.InstanceStorageInfo == nil {
+		return 0
+	}
+	return aws.Int64Value(i.InstanceStorageInfo.TotalSizeInGB)
+}
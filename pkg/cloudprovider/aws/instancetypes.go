@@ -17,6 +17,8 @@ package aws
 import (
 	"context"
 	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -26,41 +28,149 @@ import (
 	"github.com/awslabs/karpenter/pkg/utils/functional"
 	"github.com/patrickmn/go-cache"
 	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 const (
 	allInstanceTypesKey = "all"
+	// DefaultVMMemoryOverheadFraction is a conservative estimate of the memory
+	// reserved by the kernel and firmware, which isn't reported by EC2.
+	DefaultVMMemoryOverheadFraction = 0.075
 )
 
+// InstanceTypeProvider is shared by the capacity of every provisioner, so
+// instance types are cached once per factory.
 type InstanceTypeProvider struct {
-	ec2api ec2iface.EC2API
-	cache  *cache.Cache
+	ec2api                 ec2iface.EC2API
+	cache                  *cache.Cache
+	region                 string
+	memoryOverheadFraction float64
+	// mutex serializes cache misses, so that concurrent reconciles of
+	// different provisioners describe instance types once
+	mutex sync.Mutex
+	// allocatable observed from nodes, by AMI family and instance type
+	allocatable      map[string]map[string]v1.ResourceList
+	allocatableMutex sync.RWMutex
 }
 
-func NewInstanceTypeProvider(ec2api ec2iface.EC2API) *InstanceTypeProvider {
+func NewInstanceTypeProvider(ec2api ec2iface.EC2API, region string, memoryOverheadFraction float64) *InstanceTypeProvider {
 	return &InstanceTypeProvider{
-		ec2api: ec2api,
-		cache:  cache.New(CacheTTL, CacheCleanupInterval),
+		ec2api:                 ec2api,
+		cache:                  cache.New(CacheTTL, CacheCleanupInterval),
+		region:                 region,
+		memoryOverheadFraction: memoryOverheadFraction,
+		allocatable:            map[string]map[string]v1.ResourceList{},
 	}
 }
 
 // Get instance types that are available per availability zone
 func (p *InstanceTypeProvider) Get(ctx context.Context, cluster *v1alpha1.ClusterSpec) ([]cloudprovider.InstanceType, error) {
-	var instanceTypes []cloudprovider.InstanceType
-	if cached, ok := p.cache.Get(allInstanceTypesKey); ok {
-		instanceTypes = cached.([]cloudprovider.InstanceType)
-	} else {
-		var err error
-		instanceTypes, err = p.get(ctx, cluster)
-		if err != nil {
-			return nil, err
-		}
-		p.cache.SetDefault(allInstanceTypesKey, instanceTypes)
-		zap.S().Debugf("Successfully discovered %d EC2 instance types", len(instanceTypes))
+	key := cacheKey(p.region, allInstanceTypesKey)
+	if cached, ok := p.cache.Get(key); ok {
+		return cached.([]cloudprovider.InstanceType), nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// Another caller may have populated the cache while this one waited
+	if cached, ok := p.cache.Get(key); ok {
+		return cached.([]cloudprovider.InstanceType), nil
+	}
+	instanceTypes, err := p.get(ctx, cluster)
+	if err != nil {
+		return nil, err
 	}
+	p.cache.SetDefault(key, instanceTypes)
+	zap.S().Debugf("Successfully discovered %d EC2 instance types", len(instanceTypes))
 	return instanceTypes, nil
 }
 
+// ObserveAllocatable records the cpu and memory that a node of the instance
+// type reported as allocatable when launched with the AMI family. The latest
+// observation is used, since reservations may change with AMI versions.
+func (p *InstanceTypeProvider) ObserveAllocatable(amiFamily string, instanceType string, allocatable v1.ResourceList) {
+	observed := v1.ResourceList{}
+	for _, resourceName := range []v1.ResourceName{v1.ResourceCPU, v1.ResourceMemory} {
+		if quantity, ok := allocatable[resourceName]; ok {
+			observed[resourceName] = quantity.DeepCopy()
+		}
+	}
+	if len(observed) == 0 {
+		return
+	}
+	p.allocatableMutex.Lock()
+	defer p.allocatableMutex.Unlock()
+	if _, ok := p.allocatable[amiFamily]; !ok {
+		p.allocatable[amiFamily] = map[string]v1.ResourceList{}
+	}
+	if equality.Semantic.DeepEqual(p.allocatable[amiFamily][instanceType], observed) {
+		return
+	}
+	p.allocatable[amiFamily][instanceType] = observed
+	zap.S().Debugf("Observed allocatable %v for instance type %s with AMI family %s", observed, instanceType, amiFamily)
+}
+
+// WithObservedAllocatable returns the instance types with the allocatable
+// resources observed for the AMI family. Instance types are copied, since
+// they're shared by provisioners with different AMI families.
+func (p *InstanceTypeProvider) WithObservedAllocatable(amiFamily string, instanceTypes []cloudprovider.InstanceType) []cloudprovider.InstanceType {
+	p.allocatableMutex.RLock()
+	defer p.allocatableMutex.RUnlock()
+	observed := p.allocatable[amiFamily]
+	if len(observed) == 0 {
+		return instanceTypes
+	}
+	result := []cloudprovider.InstanceType{}
+	for _, instanceType := range instanceTypes {
+		if allocatable, ok := observed[instanceType.Name()]; ok {
+			copied := *instanceType.(*InstanceType)
+			copied.ObservedAllocatable = allocatable
+			instanceType = &copied
+		}
+		result = append(result, instanceType)
+	}
+	return result
+}
+
+// Rank orders the instance types by the selection strategy, most preferred
+// first. Without pricing data, smaller instance types are assumed to be
+// cheaper, so lowest-price prefers the smallest instance types.
+func (p *InstanceTypeProvider) Rank(instanceTypes []cloudprovider.InstanceType, strategy string) []cloudprovider.InstanceType {
+	ranked := append([]cloudprovider.InstanceType{}, instanceTypes...)
+	switch strategy {
+	case v1alpha1.SelectionStrategyMostPods:
+		sort.SliceStable(ranked, func(i, j int) bool {
+			if pods := ranked[i].Pods().Cmp(*ranked[j].Pods()); pods != 0 {
+				return pods > 0
+			}
+			return compareSize(ranked[i], ranked[j]) < 0
+		})
+	case v1alpha1.SelectionStrategyFewestNodes:
+		sort.SliceStable(ranked, func(i, j int) bool { return compareSize(ranked[i], ranked[j]) > 0 })
+	default:
+		sort.SliceStable(ranked, func(i, j int) bool { return compareSize(ranked[i], ranked[j]) < 0 })
+	}
+	return ranked
+}
+
+// compareSize compares instance types by their accelerators, then cpu, then
+// memory, since accelerators dominate the cost of an instance type.
+func compareSize(a cloudprovider.InstanceType, b cloudprovider.InstanceType) int {
+	for _, quantities := range [][2]*resource.Quantity{
+		{a.NvidiaGPUs(), b.NvidiaGPUs()},
+		{a.AMDGPUs(), b.AMDGPUs()},
+		{a.AWSNeurons(), b.AWSNeurons()},
+		{a.CPU(), b.CPU()},
+		{a.Memory(), b.Memory()},
+	} {
+		if comparison := quantities[0].Cmp(*quantities[1]); comparison != 0 {
+			return comparison
+		}
+	}
+	return 0
+}
+
 func (p *InstanceTypeProvider) get(ctx context.Context, cluster *v1alpha1.ClusterSpec) ([]cloudprovider.InstanceType, error) {
 	// 1. Get InstanceTypes from EC2
 	instanceTypes, err := p.getInstanceTypes(ctx)
@@ -68,10 +178,13 @@ func (p *InstanceTypeProvider) get(ctx context.Context, cluster *v1alpha1.Cluste
 		return nil, fmt.Errorf("retrieving all instance types, %w", err)
 	}
 
+	// 2. Get the zones that each instance type is offered in
+	offered := false
 	err = p.ec2api.DescribeInstanceTypeOfferingsPagesWithContext(ctx, &ec2.DescribeInstanceTypeOfferingsInput{
 		LocationType: aws.String("availability-zone"),
 	}, func(output *ec2.DescribeInstanceTypeOfferingsOutput, lastPage bool) bool {
 		for _, offering := range output.InstanceTypeOfferings {
+			offered = true
 			for _, instanceType := range instanceTypes {
 				if instanceType.Name() == aws.StringValue(offering.InstanceType) {
 					instanceType.ZoneOptions = append(instanceType.ZoneOptions, aws.StringValue(offering.Location))
@@ -83,6 +196,20 @@ func (p *InstanceTypeProvider) get(ctx context.Context, cluster *v1alpha1.Cluste
 	if err != nil {
 		return nil, fmt.Errorf("describing instance type zone offerings, %w", err)
 	}
+	// 3. Offerings may be empty in new or restricted regions, which would leave
+	// no instance type to launch, so assume every instance type is offered in
+	// every zone instead. Fleet launches from any of the options, so options
+	// that aren't actually offered don't prevent launches.
+	if !offered {
+		zones, err := p.getZones(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describing availability zones, %w", err)
+		}
+		zap.S().Warnf("No instance type offerings found in region %s, assuming every instance type is offered in zones %v", p.region, zones)
+		for _, instanceType := range instanceTypes {
+			instanceType.ZoneOptions = zones
+		}
+	}
 
 	// convert to cloudprovider.InstanceType
 	result := []cloudprovider.InstanceType{}
@@ -92,6 +219,21 @@ func (p *InstanceTypeProvider) get(ctx context.Context, cluster *v1alpha1.Cluste
 	return result, nil
 }
 
+// getZones returns the names of the region's available zones
+func (p *InstanceTypeProvider) getZones(ctx context.Context) ([]string, error) {
+	output, err := p.ec2api.DescribeAvailabilityZonesWithContext(ctx, &ec2.DescribeAvailabilityZonesInput{
+		Filters: []*ec2.Filter{{Name: aws.String("state"), Values: []*string{aws.String("available")}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	zones := []string{}
+	for _, zone := range output.AvailabilityZones {
+		zones = append(zones, aws.StringValue(zone.ZoneName))
+	}
+	return zones, nil
+}
+
 // getInstanceTypes retrieves all instance types from the ec2 DescribeInstanceTypes API using some opinionated filters
 func (p *InstanceTypeProvider) getInstanceTypes(ctx context.Context) ([]*InstanceType, error) {
 	instanceTypes := []*InstanceType{}
@@ -105,7 +247,7 @@ func (p *InstanceTypeProvider) getInstanceTypes(ctx context.Context) ([]*Instanc
 	}, func(page *ec2.DescribeInstanceTypesOutput, lastPage bool) bool {
 		for _, instanceType := range page.InstanceTypes {
 			if p.filter(instanceType) {
-				instanceTypes = append(instanceTypes, &InstanceType{InstanceTypeInfo: *instanceType})
+				instanceTypes = append(instanceTypes, &InstanceType{InstanceTypeInfo: *instanceType, MemoryOverheadFraction: p.memoryOverheadFraction})
 			}
 		}
 		return true
@@ -0,0 +1,197 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// SpotInterruptionDetailType is the EventBridge detail type of the
+	// warnings sent two minutes before spot instances are interrupted
+	SpotInterruptionDetailType = "EC2 Spot Instance Interruption Warning"
+	// RebalanceRecommendationDetailType is the EventBridge detail type of the
+	// recommendations sent when spot instances are at elevated risk of
+	// interruption
+	RebalanceRecommendationDetailType = "EC2 Instance Rebalance Recommendation"
+	// InterruptionWaitTimeSeconds long polls the queue, so that empty
+	// queues aren't polled continuously
+	InterruptionWaitTimeSeconds = 20
+	// InterruptionRetryInterval backs off polling after the queue fails to
+	// be received from
+	InterruptionRetryInterval = 10 * time.Second
+)
+
+// interruptionEvent is the subset of EventBridge's EC2 events that identifies
+// the affected instance
+type interruptionEvent struct {
+	DetailType string `json:"detail-type"`
+	Detail     struct {
+		InstanceID string `json:"instance-id"`
+	} `json:"detail"`
+}
+
+// InterruptionHandler consumes spot interruption warnings and rebalance
+// recommendations that EventBridge delivers to an SQS queue. The affected
+// nodes are marked terminable and involuntarily disrupted, so that the
+// reallocation controller cordons and drains them before the instances are
+// interrupted. Rebalance recommendations are only acted on if enabled, since
+// instances may run for a long time after they're recommended.
+type InterruptionHandler struct {
+	sqsapi                         sqsiface.SQSAPI
+	kubeClient                     client.Client
+	queueName                      string
+	queueURL                       string
+	managedLabelKey                string
+	handleRebalanceRecommendations bool
+}
+
+func NewInterruptionHandler(sqsapi sqsiface.SQSAPI, kubeClient client.Client, queueName string, managedLabelKey string, handleRebalanceRecommendations bool) *InterruptionHandler {
+	return &InterruptionHandler{
+		sqsapi:                         sqsapi,
+		kubeClient:                     kubeClient,
+		queueName:                      queueName,
+		managedLabelKey:                managedLabelKey,
+		handleRebalanceRecommendations: handleRebalanceRecommendations,
+	}
+}
+
+// Start polls the queue until the context is done. Messages that fail to be
+// handled aren't deleted, so they're received again once their visibility
+// timeout expires.
+func (h *InterruptionHandler) Start(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := h.poll(ctx); err != nil && ctx.Err() == nil {
+			zap.S().Errorf("Failed to receive interruption notices from queue %s, %s", h.queueName, err.Error())
+			select {
+			case <-ctx.Done():
+			case <-time.After(InterruptionRetryInterval):
+			}
+		}
+	}
+}
+
+// poll receives a batch of messages and deletes the ones that were handled
+func (h *InterruptionHandler) poll(ctx context.Context) error {
+	queueURL, err := h.getQueueURL(ctx)
+	if err != nil {
+		return err
+	}
+	output, err := h.sqsapi.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(queueURL),
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds:     aws.Int64(InterruptionWaitTimeSeconds),
+	})
+	if err != nil {
+		return fmt.Errorf("receiving messages, %w", err)
+	}
+	for _, message := range output.Messages {
+		if err := h.handle(ctx, message); err != nil {
+			zap.S().Errorf("Failed to handle interruption notice %s, %s", aws.StringValue(message.MessageId), err.Error())
+			continue
+		}
+		if _, err := h.sqsapi.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(queueURL),
+			ReceiptHandle: message.ReceiptHandle,
+		}); err != nil {
+			zap.S().Errorf("Failed to delete interruption notice %s, %s", aws.StringValue(message.MessageId), err.Error())
+		}
+	}
+	return nil
+}
+
+// getQueueURL resolves the queue's URL once, since it never changes
+func (h *InterruptionHandler) getQueueURL(ctx context.Context) (string, error) {
+	if h.queueURL != "" {
+		return h.queueURL, nil
+	}
+	output, err := h.sqsapi.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(h.queueName)})
+	if err != nil {
+		return "", fmt.Errorf("getting url of queue %s, %w", h.queueName, err)
+	}
+	h.queueURL = aws.StringValue(output.QueueUrl)
+	return h.queueURL, nil
+}
+
+// handle marks the node of the message's instance for involuntary disruption.
+// Messages of other events, of rebalance recommendations if they're disabled,
+// or of instances without managed nodes, are handled by ignoring them.
+func (h *InterruptionHandler) handle(ctx context.Context, message *sqs.Message) error {
+	event := interruptionEvent{}
+	if err := json.Unmarshal([]byte(aws.StringValue(message.Body)), &event); err != nil {
+		zap.S().Warnf("Ignoring interruption notice %s, %s", aws.StringValue(message.MessageId), err.Error())
+		return nil
+	}
+	if event.DetailType != SpotInterruptionDetailType && event.DetailType != RebalanceRecommendationDetailType {
+		zap.S().Debugf("Ignoring interruption notice %s of unexpected type %q", aws.StringValue(message.MessageId), event.DetailType)
+		return nil
+	}
+	if event.DetailType == RebalanceRecommendationDetailType && !h.handleRebalanceRecommendations {
+		zap.S().Debugf("Ignoring rebalance recommendation %s for instance %s since handling them is disabled", aws.StringValue(message.MessageId), event.Detail.InstanceID)
+		return nil
+	}
+	node, err := h.getNode(ctx, event.Detail.InstanceID)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		zap.S().Debugf("Ignoring interruption notice for instance %s without a managed node", event.Detail.InstanceID)
+		return nil
+	}
+	persisted := node.DeepCopy()
+	node.Annotations = functional.UnionStringMaps(node.Annotations, map[string]string{
+		v1alpha1.ProvisionerDisruptionKey: v1alpha1.DisruptionInvoluntary,
+	})
+	// Nodes that are already draining keep their drain start time
+	if node.Labels[v1alpha1.ProvisionerPhaseLabel] != v1alpha1.ProvisionerDrainingPhase {
+		node.Labels = functional.UnionStringMaps(node.Labels, map[string]string{
+			v1alpha1.ProvisionerPhaseLabel: v1alpha1.ProvisionerTerminablePhase,
+		})
+	}
+	if err := h.kubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil {
+		return fmt.Errorf("patching node %s, %w", node.Name, err)
+	}
+	zap.S().Infof("Marked node %s for involuntary disruption after receiving %q for instance %s", node.Name, event.DetailType, event.Detail.InstanceID)
+	return nil
+}
+
+// getNode returns the managed node of the instance, or nil if there is none.
+// Nodes launched before nodes were labeled as managed are labeled by the
+// reallocation controller once their provisioner is reconciled.
+func (h *InterruptionHandler) getNode(ctx context.Context, instanceID string) (*v1.Node, error) {
+	nodes := &v1.NodeList{}
+	if err := h.kubeClient.List(ctx, nodes, client.MatchingLabels{h.managedLabelKey: "true"}); err != nil {
+		return nil, fmt.Errorf("listing nodes, %w", err)
+	}
+	for i := range nodes.Items {
+		matches := providerIDPattern.FindStringSubmatch(nodes.Items[i].Spec.ProviderID)
+		if matches != nil && matches[1] == instanceID {
+			return &nodes.Items[i], nil
+		}
+	}
+	return nil, nil
+}
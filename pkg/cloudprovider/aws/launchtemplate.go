@@ -17,10 +17,13 @@ package aws
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"reflect"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -29,6 +32,8 @@ import (
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/utils/resources"
 	"github.com/mitchellh/hashstructure/v2"
 
 	"github.com/patrickmn/go-cache"
@@ -39,8 +44,26 @@ import (
 )
 
 const (
-	launchTemplateNameFormat = "Karpenter-%s/%s/%s-%s"
-	bottlerocketUserData     = `
+	launchTemplateNameFormat = "%s-%s/%s/%s-%s"
+	// LaunchTemplateMessage is logged at debug level when a launch template is
+	// created, with its resolved AMI, security groups, and user data hash.
+	LaunchTemplateMessage = "Created launch template"
+	// DeprecatedAMIMessage is logged at warning level when a launch template
+	// is created with a deprecated AMI.
+	DeprecatedAMIMessage = "Using deprecated AMI"
+	// DefaultLaunchTemplateNamePrefix is used when no name prefix is configured.
+	// It matches the names of launch templates created before the prefix was
+	// configurable, so that they're reused and garbage collected.
+	DefaultLaunchTemplateNamePrefix = "Karpenter"
+	// LaunchTemplateOrphanSafetyMargin protects recently created or launched
+	// launch templates from deletion. EC2 tags instances with their launch
+	// template eventually, so just-launched instances may not appear in use.
+	LaunchTemplateOrphanSafetyMargin = 10 * time.Minute
+	// launchTemplateIdTagKey is set by EC2 on instances launched from a template.
+	launchTemplateIdTagKey = "aws:ec2launchtemplate:id"
+	// bottlerocketRootDeviceName is the OS volume of the Bottlerocket AMI.
+	bottlerocketRootDeviceName = "/dev/xvda"
+	bottlerocketUserData       = `
 [settings.kubernetes]
 api-server = "{{.Cluster.Endpoint}}"
 cluster-certificate = "{{.Cluster.CABundle}}"
@@ -54,20 +77,39 @@ cluster-name = "{{.Cluster.Name}}"
 `
 )
 
+const (
+	// bottlerocketDataDeviceName is the volume of the Bottlerocket AMI that
+	// stores images, logs, and pods' ephemeral storage.
+	bottlerocketDataDeviceName = "/dev/xvdb"
+	// defaultDataVolumeSizeGiB is the size of the Bottlerocket AMI's data volume
+	defaultDataVolumeSizeGiB = 20
+	// dataVolumeReservedSizeGiB of data volumes is reserved for images and logs
+	dataVolumeReservedSizeGiB = 10
+	// maxDataVolumeSizeGiB is the largest EBS volume
+	maxDataVolumeSizeGiB = 16384
+)
+
 type LaunchTemplateProvider struct {
 	ec2api                ec2iface.EC2API
 	cache                 *cache.Cache
 	securityGroupProvider *SecurityGroupProvider
 	ssm                   ssmiface.SSMAPI
 	clientSet             *kubernetes.Clientset
+	region                string
+	namePrefix            string
+	// launched holds the ids of launch templates that instances were launched
+	// from within the orphan safety margin
+	launched *cache.Cache
 }
 
-func launchTemplateName(options *launchTemplateOptions) string {
+// launchTemplateName is unique per installation, cluster, provisioner, and
+// options, which prevents installations sharing an account from colliding.
+func (p *LaunchTemplateProvider) launchTemplateName(options *launchTemplateOptions) string {
 	hash, err := hashstructure.Hash(options, hashstructure.FormatV2, nil)
 	if err != nil {
 		zap.S().Panicf("hashing launch template, %w", err)
 	}
-	return fmt.Sprintf(launchTemplateNameFormat, options.Cluster.Name, options.Provisioner.Name, options.Provisioner.Namespace, fmt.Sprint(hash))
+	return fmt.Sprintf(launchTemplateNameFormat, p.namePrefix, options.Cluster.Name, options.Provisioner.Name, options.Provisioner.Namespace, fmt.Sprint(hash))
 }
 
 // launchTemplateOptions is hashed and results in the creation of a real EC2
@@ -79,21 +121,55 @@ type launchTemplateOptions struct {
 	Architecture string
 	Labels       map[string]string
 	Taints       []v1.Taint
+	// Placement is optional and only set for placement groups
+	PlacementGroupName       string
+	PlacementPartitionNumber int64
+	// Hibernation requires an encrypted root volume
+	HibernationEnabled bool
+	// DataVolumeSizeGiB is zero for the AMI's default data volume. It varies
+	// with the pods of each launch, but is doubled from the default size up to
+	// the largest EBS volume, so it adds at most ten launch templates per set of
+	// constraints.
+	DataVolumeSizeGiB int64
+	// CPUCredits is only set if every instance type is burstable, since
+	// other instance types don't accept a credit specification
+	CPUCredits string
+	// RejectDeprecatedAMI is checked when launch templates are created. It's
+	// not hashed, so that existing launch templates keep their names.
+	RejectDeprecatedAMI bool `hash:"ignore"`
 }
 
-func (p *LaunchTemplateProvider) Get(ctx context.Context, provisioner *v1alpha1.Provisioner, constraints *Constraints) (*LaunchTemplate, error) {
+// hashedIfSet are the options added after launch templates were first named by
+// their hash. They're only hashed if they're set, so that existing launch
+// templates keep their names.
+var hashedIfSet = map[string]bool{
+	"PlacementGroupName":       true,
+	"PlacementPartitionNumber": true,
+	"HibernationEnabled":       true,
+	"DataVolumeSizeGiB":        true,
+	"CPUCredits":               true,
+}
+
+// HashInclude implements hashstructure.Includable
+func (o launchTemplateOptions) HashInclude(field string, v interface{}) (bool, error) {
+	if hashedIfSet[field] {
+		return !v.(reflect.Value).IsZero(), nil
+	}
+	return true, nil
+}
+
+// Get returns the launch template for nodes of the constraints, whose data
+// volumes fit the pods' ephemeral storage requests and whose credit
+// specification applies to the instance types if they're burstable.
+func (p *LaunchTemplateProvider) Get(ctx context.Context, provisioner *v1alpha1.Provisioner, constraints *Constraints, pods []*v1.Pod, instanceTypes []cloudprovider.InstanceType) (*LaunchTemplate, error) {
 	// If the customer specified a launch template then just use it
 	if result := constraints.GetLaunchTemplate(); result != nil {
 		return result, nil
 	}
 
-	options := launchTemplateOptions{
-		Provisioner:  types.NamespacedName{Name: provisioner.Name, Namespace: provisioner.Namespace},
-		Cluster:      *provisioner.Spec.Cluster,
-		Architecture: KubeToAWSArchitectures[*constraints.Architecture],
-		Labels:       constraints.Labels,
-		Taints:       constraints.Taints,
-	}
+	options := launchTemplateOptionsFor(provisioner, constraints)
+	options.DataVolumeSizeGiB = dataVolumeSizeFor(pods)
+	options.CPUCredits = cpuCreditsFor(constraints, instanceTypes)
 	// See if we have a cached copy of the default one first, to avoid
 	// making an API call to EC2
 	key, err := hashstructure.Hash(options, hashstructure.FormatV2, nil)
@@ -102,8 +178,9 @@ func (p *LaunchTemplateProvider) Get(ctx context.Context, provisioner *v1alpha1.
 	}
 
 	result := &LaunchTemplate{Version: aws.String(defaultLaunchTemplateVersion)}
-	if cached, ok := p.cache.Get(fmt.Sprint(key)); ok {
+	if cached, ok := p.cache.Get(cacheKey(p.region, fmt.Sprint(key))); ok {
 		result.Id = cached.(*ec2.LaunchTemplate).LaunchTemplateId
+		p.launched.SetDefault(aws.StringValue(result.Id), true)
 		return result, nil
 	}
 
@@ -113,14 +190,182 @@ func (p *LaunchTemplateProvider) Get(ctx context.Context, provisioner *v1alpha1.
 		return nil, err
 	}
 	result.Id = launchTemplate.LaunchTemplateId
-	p.cache.Set(fmt.Sprint(key), launchTemplate, CacheTTL)
+	p.cache.Set(cacheKey(p.region, fmt.Sprint(key)), launchTemplate, CacheTTL)
+	p.launched.SetDefault(aws.StringValue(result.Id), true)
 	return result, nil
 }
 
+// GetArchitecture returns the architecture of the AMI of a customer specified
+// launch template, or empty if the launch template doesn't specify an AMI.
+func (p *LaunchTemplateProvider) GetArchitecture(ctx context.Context, launchTemplate *LaunchTemplate) (string, error) {
+	key := cacheKey(p.region, fmt.Sprintf("architecture/%s/%s", aws.StringValue(launchTemplate.Id), aws.StringValue(launchTemplate.Version)))
+	if cached, ok := p.cache.Get(key); ok {
+		return cached.(string), nil
+	}
+	output, err := p.ec2api.DescribeLaunchTemplateVersionsWithContext(ctx, &ec2.DescribeLaunchTemplateVersionsInput{
+		LaunchTemplateId: launchTemplate.Id,
+		Versions:         []*string{launchTemplate.Version},
+	})
+	if err != nil {
+		return "", fmt.Errorf("describing launch template versions, %w", err)
+	}
+	if length := len(output.LaunchTemplateVersions); length != 1 {
+		return "", fmt.Errorf("expected to find one launch template version, but found %d", length)
+	}
+	architecture := ""
+	if data := output.LaunchTemplateVersions[0].LaunchTemplateData; data != nil && data.ImageId != nil {
+		images, err := p.ec2api.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{ImageIds: []*string{data.ImageId}})
+		if err != nil {
+			return "", fmt.Errorf("describing images, %w", err)
+		}
+		if length := len(images.Images); length != 1 {
+			return "", fmt.Errorf("expected to find image %s, but found %d", aws.StringValue(data.ImageId), length)
+		}
+		architecture = AWSToKubeArchitectures[aws.StringValue(images.Images[0].Architecture)]
+	}
+	p.cache.Set(key, architecture, CacheTTL)
+	return architecture, nil
+}
+
+func launchTemplateOptionsFor(provisioner *v1alpha1.Provisioner, constraints *Constraints) launchTemplateOptions {
+	return launchTemplateOptions{
+		Provisioner:  types.NamespacedName{Name: provisioner.Name, Namespace: provisioner.Namespace},
+		Cluster:      *provisioner.Spec.Cluster,
+		Architecture: KubeToAWSArchitectures[*constraints.Architecture],
+		Labels:       constraints.Labels,
+		Taints:       constraints.Taints,
+
+		PlacementGroupName:       constraints.GetPlacementGroupName(),
+		PlacementPartitionNumber: constraints.GetPlacementPartitionNumber(),
+		HibernationEnabled:       constraints.GetHibernationEnabled(),
+		RejectDeprecatedAMI:      constraints.GetRejectDeprecatedAMI(),
+	}
+}
+
+// DeleteOrphans deletes launch templates created by this installation that are
+// neither resolved from the provisioners' constraints nor used by an instance.
+// Templates for pod specific constraints are recreated on demand. Templates
+// created or launched from within the safety margin are kept, since their
+// instances may not be tagged yet. Only the clusters of the provisioners are
+// searched, so templates of other clusters sharing the account are never
+// deleted.
+func (p *LaunchTemplateProvider) DeleteOrphans(ctx context.Context, provisioners []v1alpha1.Provisioner) error {
+	referenced := map[string]bool{}
+	clusters := map[string]bool{}
+	for i := range provisioners {
+		provisioner := &provisioners[i]
+		if provisioner.Spec.Cluster == nil {
+			continue
+		}
+		clusters[provisioner.Spec.Cluster.Name] = true
+		constraints := Constraints(*provisioner.ConstraintsWithOverrides(&v1.Pod{}))
+		if constraints.Architecture == nil {
+			continue
+		}
+		options := launchTemplateOptionsFor(provisioner, &constraints)
+		referenced[p.launchTemplateName(&options)] = true
+	}
+	launchTemplates := []*ec2.LaunchTemplate{}
+	for clusterName := range clusters {
+		owned, err := p.getOwnedLaunchTemplates(ctx, clusterName)
+		if err != nil {
+			return err
+		}
+		launchTemplates = append(launchTemplates, owned...)
+	}
+	inUse, err := p.getLaunchTemplatesInUse(ctx)
+	if err != nil {
+		return err
+	}
+	for _, launchTemplate := range launchTemplates {
+		if referenced[aws.StringValue(launchTemplate.LaunchTemplateName)] || inUse[aws.StringValue(launchTemplate.LaunchTemplateId)] {
+			continue
+		}
+		if p.isRecent(launchTemplate) {
+			zap.S().Debugf("Skipping deletion of recent launch template %s", aws.StringValue(launchTemplate.LaunchTemplateName))
+			continue
+		}
+		if _, err := p.ec2api.DeleteLaunchTemplateWithContext(ctx, &ec2.DeleteLaunchTemplateInput{
+			LaunchTemplateId: launchTemplate.LaunchTemplateId,
+		}); err != nil {
+			return fmt.Errorf("deleting launch template %s, %w", aws.StringValue(launchTemplate.LaunchTemplateName), err)
+		}
+		zap.S().Infof("Deleted orphaned launch template %s", aws.StringValue(launchTemplate.LaunchTemplateName))
+	}
+	return nil
+}
+
+// isRecent returns true if the launch template was created or launched from
+// within the orphan safety margin
+func (p *LaunchTemplateProvider) isRecent(launchTemplate *ec2.LaunchTemplate) bool {
+	if _, ok := p.launched.Get(aws.StringValue(launchTemplate.LaunchTemplateId)); ok {
+		return true
+	}
+	return time.Since(aws.TimeValue(launchTemplate.CreateTime)) < LaunchTemplateOrphanSafetyMargin
+}
+
+// getOwnedLaunchTemplates returns the launch templates tagged by Karpenter for
+// the cluster, whose names were formatted by this installation for the cluster.
+// Other clusters and installations in the account, including ones whose name
+// prefixes start with this installation's, are never matched.
+func (p *LaunchTemplateProvider) getOwnedLaunchTemplates(ctx context.Context, clusterName string) ([]*ec2.LaunchTemplate, error) {
+	launchTemplates := []*ec2.LaunchTemplate{}
+	input := &ec2.DescribeLaunchTemplatesInput{
+		Filters: []*ec2.Filter{{Name: aws.String("tag-key"), Values: []*string{aws.String(fmt.Sprintf(KarpenterTagKeyFormat, clusterName))}}},
+	}
+	namePrefix := fmt.Sprintf("%s-%s/", p.namePrefix, clusterName)
+	for {
+		output, err := p.ec2api.DescribeLaunchTemplatesWithContext(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("describing launch templates, %w", err)
+		}
+		for _, launchTemplate := range output.LaunchTemplates {
+			if strings.HasPrefix(aws.StringValue(launchTemplate.LaunchTemplateName), namePrefix) {
+				launchTemplates = append(launchTemplates, launchTemplate)
+			}
+		}
+		if output.NextToken == nil {
+			return launchTemplates, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+// getLaunchTemplatesInUse returns the ids of launch templates used by
+// instances that are not yet terminated.
+func (p *LaunchTemplateProvider) getLaunchTemplatesInUse(ctx context.Context) (map[string]bool, error) {
+	inUse := map[string]bool{}
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag-key"), Values: []*string{aws.String(launchTemplateIdTagKey)}},
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{"pending", "running", "shutting-down", "stopping", "stopped"})},
+		},
+	}
+	for {
+		output, err := p.ec2api.DescribeInstancesWithContext(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("describing instances, %w", err)
+		}
+		for _, reservation := range output.Reservations {
+			for _, instance := range reservation.Instances {
+				for _, tag := range instance.Tags {
+					if aws.StringValue(tag.Key) == launchTemplateIdTagKey {
+						inUse[aws.StringValue(tag.Value)] = true
+					}
+				}
+			}
+		}
+		if output.NextToken == nil {
+			return inUse, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
 // TODO, reconcile launch template if not equal to desired launch template (AMI upgrade, role changed, etc)
 func (p *LaunchTemplateProvider) getLaunchTemplate(ctx context.Context, options *launchTemplateOptions) (*ec2.LaunchTemplate, error) {
 	describelaunchTemplateOutput, err := p.ec2api.DescribeLaunchTemplatesWithContext(ctx, &ec2.DescribeLaunchTemplatesInput{
-		LaunchTemplateNames: []*string{aws.String(launchTemplateName(options))},
+		LaunchTemplateNames: []*string{aws.String(p.launchTemplateName(options))},
 	})
 	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidLaunchTemplateName.NotFoundException" {
 		return p.createLaunchTemplate(ctx, options)
@@ -146,16 +391,26 @@ func (p *LaunchTemplateProvider) createLaunchTemplate(ctx context.Context, optio
 		return nil, fmt.Errorf("getting AMI ID, %w", err)
 	}
 	zap.S().Debugf("Successfully discovered AMI ID %s for architecture %s", *amiID, options.Architecture)
+	if err := p.checkDeprecation(ctx, amiID, options.RejectDeprecatedAMI); err != nil {
+		return nil, err
+	}
 	userData, err := p.getUserData(options)
 	if err != nil {
 		return nil, fmt.Errorf("getting user data, %w", err)
 	}
 
 	output, err := p.ec2api.CreateLaunchTemplate(&ec2.CreateLaunchTemplateInput{
-		LaunchTemplateName: aws.String(launchTemplateName(options)),
+		LaunchTemplateName: aws.String(p.launchTemplateName(options)),
+		TagSpecifications: []*ec2.TagSpecification{{
+			ResourceType: aws.String(ec2.ResourceTypeLaunchTemplate),
+			Tags: []*ec2.Tag{{
+				Key:   aws.String(fmt.Sprintf(KarpenterTagKeyFormat, options.Cluster.Name)),
+				Value: aws.String("owned"),
+			}},
+		}},
 		LaunchTemplateData: &ec2.RequestLaunchTemplateData{
 			IamInstanceProfile: &ec2.LaunchTemplateIamInstanceProfileSpecificationRequest{
-				Name: aws.String(fmt.Sprintf("KarpenterNodeInstanceProfile-%s", options.Cluster.Name)),
+				Name: aws.String(instanceProfileName(options.Cluster.Name)),
 			},
 			TagSpecifications: []*ec2.LaunchTemplateTagSpecificationRequest{{
 				ResourceType: aws.String(ec2.ResourceTypeInstance),
@@ -173,15 +428,117 @@ func (p *LaunchTemplateProvider) createLaunchTemplate(ctx context.Context, optio
 			SecurityGroupIds: securityGroupIds,
 			UserData:         userData,
 			ImageId:          amiID,
+			Placement:        placementFor(options),
+
+			HibernationOptions:  hibernationOptionsFor(options),
+			BlockDeviceMappings: blockDeviceMappingsFor(options),
+			CreditSpecification: creditSpecificationFor(options),
 		},
 	})
 	if err != nil {
 		return nil, fmt.Errorf("creating launch template, %w", err)
 	}
-	zap.S().Debugf("Successfully created default launch template, %s", *output.LaunchTemplate.LaunchTemplateName)
+	// User data is hashed, since it may contain secrets
+	zap.S().Debugw(LaunchTemplateMessage,
+		"launchTemplateName", aws.StringValue(output.LaunchTemplate.LaunchTemplateName),
+		"launchTemplateId", aws.StringValue(output.LaunchTemplate.LaunchTemplateId),
+		"imageId", aws.StringValue(amiID),
+		"securityGroupIds", aws.StringValueSlice(securityGroupIds),
+		"userDataHash", fmt.Sprintf("%x", sha256.Sum256([]byte(aws.StringValue(userData)))),
+	)
 	return output.LaunchTemplate, nil
 }
 
+// placementFor returns the launch template's placement, or nil if the options
+// don't specify a placement group.
+func placementFor(options *launchTemplateOptions) *ec2.LaunchTemplatePlacementRequest {
+	if options.PlacementGroupName == "" {
+		return nil
+	}
+	placement := &ec2.LaunchTemplatePlacementRequest{GroupName: aws.String(options.PlacementGroupName)}
+	if options.PlacementPartitionNumber != 0 {
+		placement.PartitionNumber = aws.Int64(options.PlacementPartitionNumber)
+	}
+	return placement
+}
+
+// hibernationOptionsFor returns the launch template's hibernation options, or
+// nil if hibernation isn't enabled.
+func hibernationOptionsFor(options *launchTemplateOptions) *ec2.LaunchTemplateHibernationOptionsRequest {
+	if !options.HibernationEnabled {
+		return nil
+	}
+	return &ec2.LaunchTemplateHibernationOptionsRequest{Configured: aws.Bool(true)}
+}
+
+// cpuCreditsFor returns the constraints' CPU credit option if every instance
+// type is burstable, or empty otherwise. Packings that mix burstable and other
+// instance types launch with the account's default credit option.
+func cpuCreditsFor(constraints *Constraints, instanceTypes []cloudprovider.InstanceType) string {
+	if len(instanceTypes) == 0 {
+		return ""
+	}
+	for _, instanceType := range instanceTypes {
+		if awsInstanceType, ok := instanceType.(*InstanceType); !ok || !awsInstanceType.Burstable() {
+			return ""
+		}
+	}
+	return constraints.GetBurstableCredits()
+}
+
+// creditSpecificationFor returns the launch template's credit specification,
+// or nil if the options don't specify CPU credits.
+func creditSpecificationFor(options *launchTemplateOptions) *ec2.CreditSpecificationRequest {
+	if options.CPUCredits == "" {
+		return nil
+	}
+	return &ec2.CreditSpecificationRequest{CpuCredits: aws.String(options.CPUCredits)}
+}
+
+// blockDeviceMappingsFor returns the launch template's block device mappings.
+// The AMI's mappings are used unless hibernation is enabled, which requires
+// the root volume to be encrypted, or the data volume is resized.
+func blockDeviceMappingsFor(options *launchTemplateOptions) []*ec2.LaunchTemplateBlockDeviceMappingRequest {
+	var blockDeviceMappings []*ec2.LaunchTemplateBlockDeviceMappingRequest
+	if options.HibernationEnabled {
+		blockDeviceMappings = append(blockDeviceMappings, &ec2.LaunchTemplateBlockDeviceMappingRequest{
+			DeviceName: aws.String(bottlerocketRootDeviceName),
+			Ebs:        &ec2.LaunchTemplateEbsBlockDeviceRequest{Encrypted: aws.Bool(true)},
+		})
+	}
+	if options.DataVolumeSizeGiB != 0 {
+		blockDeviceMappings = append(blockDeviceMappings, &ec2.LaunchTemplateBlockDeviceMappingRequest{
+			DeviceName: aws.String(bottlerocketDataDeviceName),
+			Ebs:        &ec2.LaunchTemplateEbsBlockDeviceRequest{VolumeSize: aws.Int64(options.DataVolumeSizeGiB)},
+		})
+	}
+	return blockDeviceMappings
+}
+
+// dataVolumeSizeFor returns the size of the data volume that fits the pods'
+// ephemeral storage requests, or zero if the AMI's default data volume fits
+// them. Sizes are doubled from the default size, which bounds the number of
+// launch templates.
+func dataVolumeSizeFor(pods []*v1.Pod) int64 {
+	requested := resources.RequestsForPods(pods...)[v1.ResourceEphemeralStorage]
+	if requested.IsZero() {
+		return 0
+	}
+	// Round up to whole GiBs
+	required := (requested.Value()+(1<<30-1))>>30 + dataVolumeReservedSizeGiB
+	if required <= defaultDataVolumeSizeGiB {
+		return 0
+	}
+	size := int64(defaultDataVolumeSizeGiB)
+	for size < required {
+		size *= 2
+	}
+	if size > maxDataVolumeSizeGiB {
+		return maxDataVolumeSizeGiB
+	}
+	return size
+}
+
 func (p *LaunchTemplateProvider) getSecurityGroupIds(ctx context.Context, clusterName string) ([]*string, error) {
 	securityGroupIds := []*string{}
 	securityGroups, err := p.securityGroupProvider.Get(ctx, clusterName)
@@ -208,6 +565,35 @@ func (p *LaunchTemplateProvider) getAMIID(ctx context.Context, arch string) (*st
 	return paramOutput.Parameter.Value, nil
 }
 
+// checkDeprecation warns if the AMI has been deprecated, or returns an error
+// if deprecated AMIs are rejected. AMIs that will be deprecated in the future
+// are used silently.
+func (p *LaunchTemplateProvider) checkDeprecation(ctx context.Context, amiID *string, reject bool) error {
+	output, err := p.ec2api.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{ImageIds: []*string{amiID}})
+	if err != nil {
+		return fmt.Errorf("describing image %s, %w", aws.StringValue(amiID), err)
+	}
+	if length := len(output.Images); length != 1 {
+		return fmt.Errorf("expected to find image %s, but found %d", aws.StringValue(amiID), length)
+	}
+	deprecationTime := aws.StringValue(output.Images[0].DeprecationTime)
+	if deprecationTime == "" {
+		return nil
+	}
+	deprecated, err := time.Parse(time.RFC3339, deprecationTime)
+	if err != nil {
+		return fmt.Errorf("parsing deprecation time of image %s, %w", aws.StringValue(amiID), err)
+	}
+	if deprecated.After(time.Now()) {
+		return nil
+	}
+	if reject {
+		return fmt.Errorf("image %s was deprecated at %s", aws.StringValue(amiID), deprecationTime)
+	}
+	zap.S().Warnw(DeprecatedAMIMessage, "imageId", aws.StringValue(amiID), "deprecationTime", deprecationTime)
+	return nil
+}
+
 func (p *LaunchTemplateProvider) getUserData(options *launchTemplateOptions) (*string, error) {
 	t := template.Must(template.New("userData").Parse(bottlerocketUserData))
 	var userData bytes.Buffer
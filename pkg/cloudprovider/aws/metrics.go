@@ -0,0 +1,117 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	// spotPoolsActive is the number of distinct instance type and zone pools
+	// that a cluster's spot instances are spread across.
+	spotPoolsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "karpenter_spot_pools_active",
+		Help: "The number of distinct instance type and zone pools with running spot instances owned by Karpenter.",
+	}, []string{"cluster"})
+	// spotPoolInstances is the number of a cluster's spot instances in each pool.
+	spotPoolInstances = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "karpenter_spot_pool_instances",
+		Help: "The number of running spot instances owned by Karpenter in each instance type and zone pool.",
+	}, []string{"cluster", "instance_type", "zone"})
+	// awsThrottledTotal is the number of AWS API requests that were throttled
+	awsThrottledTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "karpenter_aws_throttled_total",
+		Help: "The number of AWS API request attempts that were throttled.",
+	}, []string{"service", "operation"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(spotPoolsActive, spotPoolInstances, awsThrottledTotal)
+}
+
+// spotPool is a spot capacity pool, i.e. an instance type in a zone
+type spotPool struct {
+	instanceType string
+	zone         string
+}
+
+// reportSpotPools updates the spot pool metrics of each cluster referenced by
+// a provisioner. Operators can use them to tune how diversified instance types
+// and zones are, which reduces the risk of interruptions.
+func (f *Factory) reportSpotPools(ctx context.Context) {
+	provisioners := &v1alpha1.ProvisionerList{}
+	if err := f.kubeClient.List(ctx, provisioners); err != nil {
+		zap.S().Errorf("Failed to list provisioners while reporting spot pools, %s", err.Error())
+		return
+	}
+	reported := map[string]bool{}
+	spotPoolInstances.Reset()
+	for _, provisioner := range provisioners.Items {
+		if provisioner.Spec.Cluster == nil || reported[provisioner.Spec.Cluster.Name] {
+			continue
+		}
+		clusterName := provisioner.Spec.Cluster.Name
+		reported[clusterName] = true
+		pools, err := f.instanceProvider.getSpotPools(ctx, clusterName)
+		if err != nil {
+			zap.S().Errorf("Failed to get spot pools for cluster %s, %s", clusterName, err.Error())
+			continue
+		}
+		spotPoolsActive.WithLabelValues(clusterName).Set(float64(len(pools)))
+		for pool, count := range pools {
+			spotPoolInstances.WithLabelValues(clusterName, pool.instanceType, pool.zone).Set(float64(count))
+		}
+	}
+}
+
+// getSpotPools returns the number of the cluster's pending or running spot
+// instances in each pool.
+func (p *InstanceProvider) getSpotPools(ctx context.Context, clusterName string) (map[spotPool]int, error) {
+	pools := map[spotPool]int{}
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag-key"), Values: []*string{aws.String(fmt.Sprintf(KarpenterTagKeyFormat, clusterName))}},
+			{Name: aws.String("instance-lifecycle"), Values: []*string{aws.String(ec2.InstanceLifecycleTypeSpot)}},
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning})},
+		},
+	}
+	for {
+		output, err := p.ec2api.DescribeInstancesWithContext(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("describing instances, %w", err)
+		}
+		for _, reservation := range output.Reservations {
+			for _, instance := range reservation.Instances {
+				if aws.StringValue(instance.InstanceLifecycle) != ec2.InstanceLifecycleTypeSpot || instance.Placement == nil {
+					continue
+				}
+				pools[spotPool{
+					instanceType: aws.StringValue(instance.InstanceType),
+					zone:         aws.StringValue(instance.Placement.AvailabilityZone),
+				}]++
+			}
+		}
+		if output.NextToken == nil {
+			return pools, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
@@ -18,9 +18,13 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -28,17 +32,26 @@ import (
 
 type NodeFactory struct {
 	ec2api ec2iface.EC2API
+	// managedLabelKey marks nodes as managed by Karpenter
+	managedLabelKey string
 }
 
-// For a given set of instanceIDs return a map of instanceID to Kubernetes node object.
-func (n *NodeFactory) For(ctx context.Context, instanceIDs []*string) (map[string]*v1.Node, error) {
+// For a given map of instanceID to packing, return the packed Kubernetes node
+// objects, stamped with the labels, annotations, and taints of their packing.
+// Nodes are labeled with the instance type and zone that fleet launched, since
+// packings allow several of each.
+func (n *NodeFactory) For(ctx context.Context, instancePackings map[string]*cloudprovider.Packing, launchedInstances map[string]*LaunchedInstance) ([]*cloudprovider.PackedNode, error) {
 	// EC2 will return all instances if unspecified, so we must short circuit
-	if len(instanceIDs) == 0 {
+	if len(instancePackings) == 0 {
 		return nil, nil
 	}
+	instanceIDs := []*string{}
+	for instanceID := range instancePackings {
+		instanceIDs = append(instanceIDs, aws.String(instanceID))
+	}
 	describeInstancesOutput, err := n.ec2api.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{InstanceIds: instanceIDs})
 	if err == nil {
-		return n.nodesFrom(describeInstancesOutput.Reservations), nil
+		return n.packedNodesFrom(describeInstancesOutput.Reservations, instancePackings, launchedInstances), nil
 	}
 	if aerr, ok := err.(awserr.Error); ok {
 		return nil, aerr
@@ -46,23 +59,30 @@ func (n *NodeFactory) For(ctx context.Context, instanceIDs []*string) (map[strin
 	return nil, fmt.Errorf("failed to describe ec2 instances, %w", err)
 }
 
-func (n *NodeFactory) nodesFrom(reservations []*ec2.Reservation) map[string]*v1.Node {
-	nodes := map[string]*v1.Node{}
+func (n *NodeFactory) packedNodesFrom(reservations []*ec2.Reservation, instancePackings map[string]*cloudprovider.Packing, launchedInstances map[string]*LaunchedInstance) []*cloudprovider.PackedNode {
+	packedNodes := []*cloudprovider.PackedNode{}
 	for _, reservation := range reservations {
 		for _, instance := range reservation.Instances {
-			nodes[*instance.InstanceId] = n.nodeFrom(instance)
+			packing := instancePackings[*instance.InstanceId]
+			packedNodes = append(packedNodes, &cloudprovider.PackedNode{
+				Node: n.nodeFrom(instance, launchedInstances[*instance.InstanceId], packing.Constraints),
+				Pods: packing.Pods,
+			})
 		}
 	}
-	return nodes
+	return packedNodes
 }
 
-func (n *NodeFactory) nodeFrom(instance *ec2.Instance) *v1.Node {
+func (n *NodeFactory) nodeFrom(instance *ec2.Instance, launchedInstance *LaunchedInstance, constraints *v1alpha1.Constraints) *v1.Node {
 	return &v1.Node{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: *instance.PrivateDnsName,
+			Name:        *instance.PrivateDnsName,
+			Labels:      n.labelsFor(instance, launchedInstance, constraints),
+			Annotations: n.annotationsFor(launchedInstance, constraints),
 		},
 		Spec: v1.NodeSpec{
 			ProviderID: fmt.Sprintf("aws:///%s/%s", *instance.Placement.AvailabilityZone, *instance.InstanceId),
+			Taints:     constraints.Taints,
 		},
 		Status: v1.NodeStatus{
 			Allocatable: v1.ResourceList{
@@ -74,3 +94,34 @@ func (n *NodeFactory) nodeFrom(instance *ec2.Instance) *v1.Node {
 		},
 	}
 }
+
+// labelsFor returns the constraints' labels, the managed label, and the
+// launched instance type and zone. Fleet's result is preferred, falling back
+// to the described instance.
+func (n *NodeFactory) labelsFor(instance *ec2.Instance, launchedInstance *LaunchedInstance, constraints *v1alpha1.Constraints) map[string]string {
+	launched := map[string]string{n.managedLabelKey: "true"}
+	if instanceType := aws.StringValue(instance.InstanceType); instanceType != "" {
+		launched[v1alpha1.InstanceTypeLabelKey] = instanceType
+	}
+	if zone := aws.StringValue(instance.Placement.AvailabilityZone); zone != "" {
+		launched[v1alpha1.ZoneLabelKey] = zone
+	}
+	if launchedInstance != nil && launchedInstance.InstanceType != "" {
+		launched[v1alpha1.InstanceTypeLabelKey] = launchedInstance.InstanceType
+	}
+	if launchedInstance != nil && launchedInstance.Zone != "" {
+		launched[v1alpha1.ZoneLabelKey] = launchedInstance.Zone
+	}
+	return functional.UnionStringMaps(constraints.Labels, launched)
+}
+
+// annotationsFor returns the constraints' annotations and the reason the
+// launched instance type was selected
+func (n *NodeFactory) annotationsFor(launchedInstance *LaunchedInstance, constraints *v1alpha1.Constraints) map[string]string {
+	if launchedInstance == nil || launchedInstance.SelectionReason == "" {
+		return constraints.Annotations
+	}
+	return functional.UnionStringMaps(constraints.Annotations, map[string]string{
+		v1alpha1.ProvisionerSelectionReasonKey: launchedInstance.SelectionReason,
+	})
+}
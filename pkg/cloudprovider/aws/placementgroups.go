@@ -0,0 +1,60 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+)
+
+type PlacementGroupProvider struct {
+	ec2api ec2iface.EC2API
+	cache  *cache.Cache
+	region string
+}
+
+func NewPlacementGroupProvider(ec2api ec2iface.EC2API, region string) *PlacementGroupProvider {
+	return &PlacementGroupProvider{
+		ec2api: ec2api,
+		cache:  cache.New(CacheTTL, CacheCleanupInterval),
+		region: region,
+	}
+}
+
+// Get the placement group with the given name
+func (p *PlacementGroupProvider) Get(ctx context.Context, name string) (*ec2.PlacementGroup, error) {
+	if placementGroup, ok := p.cache.Get(cacheKey(p.region, name)); ok {
+		return placementGroup.(*ec2.PlacementGroup), nil
+	}
+	output, err := p.ec2api.DescribePlacementGroupsWithContext(ctx, &ec2.DescribePlacementGroupsInput{
+		GroupNames: []*string{aws.String(name)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describing placement group %s, %w", name, err)
+	}
+	if length := len(output.PlacementGroups); length != 1 {
+		return nil, fmt.Errorf("expected to find one placement group %s, but found %d", name, length)
+	}
+	placementGroup := output.PlacementGroups[0]
+	p.cache.SetDefault(cacheKey(p.region, name), placementGroup)
+	zap.S().Debugf("Successfully discovered placement group %s", name)
+	return placementGroup, nil
+}
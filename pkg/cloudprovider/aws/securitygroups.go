@@ -17,6 +17,9 @@ package aws
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"sort"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
@@ -27,22 +30,45 @@ import (
 type SecurityGroupProvider struct {
 	ec2api ec2iface.EC2API
 	cache  *cache.Cache
+	region string
 }
 
-func NewSecurityGroupProvider(ec2api ec2iface.EC2API) *SecurityGroupProvider {
+func NewSecurityGroupProvider(ec2api ec2iface.EC2API, region string) *SecurityGroupProvider {
 	return &SecurityGroupProvider{
 		ec2api: ec2api,
 		cache:  cache.New(CacheTTL, CacheCleanupInterval),
+		region: region,
 	}
 }
 
 func (s *SecurityGroupProvider) Get(ctx context.Context, clusterName string) ([]*ec2.SecurityGroup, error) {
-	if securityGroups, ok := s.cache.Get(clusterName); ok {
+	if securityGroups, ok := s.cache.Get(cacheKey(s.region, clusterName)); ok {
 		return securityGroups.([]*ec2.SecurityGroup), nil
 	}
 	return s.getSecurityGroups(ctx, clusterName)
 }
 
+// Refresh rediscovers the cluster's security groups and returns true if they
+// differ from the cached security groups.
+func (s *SecurityGroupProvider) Refresh(ctx context.Context, clusterName string) (bool, error) {
+	cached, ok := s.cache.Get(cacheKey(s.region, clusterName))
+	securityGroups, err := s.getSecurityGroups(ctx, clusterName)
+	if err != nil {
+		return false, err
+	}
+	return ok && !reflect.DeepEqual(securityGroupIdsOf(cached.([]*ec2.SecurityGroup)), securityGroupIdsOf(securityGroups)), nil
+}
+
+// securityGroupIdsOf returns the sorted ids of the security groups
+func securityGroupIdsOf(securityGroups []*ec2.SecurityGroup) []string {
+	ids := []string{}
+	for _, securityGroup := range securityGroups {
+		ids = append(ids, aws.StringValue(securityGroup.GroupId))
+	}
+	sort.Strings(ids)
+	return ids
+}
+
 func (s *SecurityGroupProvider) getSecurityGroups(ctx context.Context, clusterName string) ([]*ec2.SecurityGroup, error) {
 	describeSecurityGroupOutput, err := s.ec2api.DescribeSecurityGroupsWithContext(ctx, &ec2.DescribeSecurityGroupsInput{
 		Filters: []*ec2.Filter{{
@@ -55,7 +81,7 @@ func (s *SecurityGroupProvider) getSecurityGroups(ctx context.Context, clusterNa
 	}
 
 	securityGroups := describeSecurityGroupOutput.SecurityGroups
-	s.cache.Set(clusterName, securityGroups, CacheTTL)
+	s.cache.Set(cacheKey(s.region, clusterName), securityGroups, CacheTTL)
 	zap.S().Debugf("Successfully discovered %d security groups for cluster %s", len(securityGroups), clusterName)
 	return securityGroups, nil
 }
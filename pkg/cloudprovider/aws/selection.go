@@ -0,0 +1,62 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"fmt"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/utils/resources"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Selection reasons name the dominant constraint that an instance type was
+// launched for
+const (
+	SelectionReasonOnlyFit             = "only-fit"
+	SelectionReasonRequiredAccelerator = "required-accelerator"
+	SelectionReasonCheapest            = "cheapest"
+	SelectionReasonMostPods            = "most-pods"
+	SelectionReasonFewestNodes         = "fewest-nodes"
+	SelectionReasonSpotAllocation      = "spot-allocation"
+)
+
+// selectionReasonFor explains why fleet launched the instance type from the
+// options. A single option is the only fit. Otherwise, accelerators that the
+// pods request dominate, followed by the spot allocation strategy, then the
+// selection strategy, which decides between on-demand options.
+func selectionReasonFor(instanceType string, options []cloudprovider.InstanceType, constraints *Constraints, selectionStrategy string, pods []*v1.Pod) string {
+	if len(options) == 1 {
+		return fmt.Sprintf("%s: %s is the only instance type that fits the pods", SelectionReasonOnlyFit, instanceType)
+	}
+	requests := resources.RequestsForPods(pods...)
+	for _, accelerator := range []v1.ResourceName{resources.NvidiaGPU, resources.AMDGPU, resources.AWSNeuron} {
+		if quantity, ok := requests[accelerator]; ok && !quantity.IsZero() {
+			return fmt.Sprintf("%s: %s provides the %s that the pods request, of %d instance types that fit", SelectionReasonRequiredAccelerator, instanceType, accelerator, len(options))
+		}
+	}
+	if constraints.GetCapacityType() == capacityTypeSpot {
+		return fmt.Sprintf("%s: %s was allocated by the %s spot allocation strategy, of %d instance types that fit", SelectionReasonSpotAllocation, instanceType, constraints.GetSpotAllocationStrategy(), len(options))
+	}
+	switch selectionStrategy {
+	case v1alpha1.SelectionStrategyMostPods:
+		return fmt.Sprintf("%s: %s fits the most pods, of %d instance types that fit", SelectionReasonMostPods, instanceType, len(options))
+	case v1alpha1.SelectionStrategyFewestNodes:
+		return fmt.Sprintf("%s: %s is the largest, of %d instance types that fit", SelectionReasonFewestNodes, instanceType, len(options))
+	default:
+		return fmt.Sprintf("%s: %s is the lowest priced, of %d instance types that fit", SelectionReasonCheapest, instanceType, len(options))
+	}
+}
@@ -17,39 +17,179 @@ package aws
 import (
 	"context"
 	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 	"github.com/patrickmn/go-cache"
 	"go.uber.org/zap"
 )
 
+// reservedIPAddressesPerSubnet are the addresses in every subnet that AWS
+// reserves, and which can never be available to instances
+const reservedIPAddressesPerSubnet = 5
+
 type SubnetProvider struct {
 	ec2api ec2iface.EC2API
 	cache  *cache.Cache
+	region string
+	// rotations is the next subnet of each zone for round-robin selection
+	rotations      map[string]int
+	rotationsMutex sync.Mutex
 }
 
-func NewSubnetProvider(ec2api ec2iface.EC2API) *SubnetProvider {
+func NewSubnetProvider(ec2api ec2iface.EC2API, region string) *SubnetProvider {
 	return &SubnetProvider{
-		ec2api: ec2api,
-		cache:  cache.New(CacheTTL, CacheCleanupInterval),
+		ec2api:    ec2api,
+		cache:     cache.New(CacheTTL, CacheCleanupInterval),
+		region:    region,
+		rotations: map[string]int{},
 	}
 }
 
 func (s *SubnetProvider) GetZonalSubnets(ctx context.Context, clusterName string) (map[string][]*ec2.Subnet, error) {
-	if zonalSubnets, ok := s.cache.Get(clusterName); ok {
+	key := cacheKey(s.region, clusterName)
+	if zonalSubnets, ok := s.cache.Get(key); ok {
 		return zonalSubnets.(map[string][]*ec2.Subnet), nil
 	}
 	zonalSubnets, err := s.getZonalSubnets(ctx, clusterName)
 	if err != nil {
 		return nil, err
 	}
-	s.cache.Set(clusterName, zonalSubnets, CacheTTL)
+	s.cache.Set(key, zonalSubnets, CacheTTL)
 	zap.S().Debugf("Successfully discovered subnets in %d zones for cluster %s", len(zonalSubnets), clusterName)
 	return zonalSubnets, nil
 }
 
+// Refresh rediscovers the cluster's subnets and returns true if they differ
+// from the cached subnets. Subnets that aren't cached haven't been used since
+// they expired, so they're never considered changed.
+func (s *SubnetProvider) Refresh(ctx context.Context, clusterName string) (bool, error) {
+	key := cacheKey(s.region, clusterName)
+	cached, ok := s.cache.Get(key)
+	zonalSubnets, err := s.getZonalSubnets(ctx, clusterName)
+	if err != nil {
+		return false, err
+	}
+	s.cache.Set(key, zonalSubnets, CacheTTL)
+	return ok && !reflect.DeepEqual(subnetIdsOf(cached.(map[string][]*ec2.Subnet)), subnetIdsOf(zonalSubnets)), nil
+}
+
+// subnetIdsOf returns the sorted subnet ids in each zone, which ignores
+// attributes that change frequently, e.g. available ip addresses.
+func subnetIdsOf(zonalSubnets map[string][]*ec2.Subnet) map[string][]string {
+	ids := map[string][]string{}
+	for zone, subnets := range zonalSubnets {
+		for _, subnet := range subnets {
+			ids[zone] = append(ids[zone], aws.StringValue(subnet.SubnetId))
+		}
+		sort.Strings(ids[zone])
+	}
+	return ids
+}
+
+// Select chooses one subnet in each zone according to the policy, since
+// fleet can't span subnets in the same zone. Unknown policies default to
+// most-free-ips.
+func (s *SubnetProvider) Select(zonalSubnets map[string][]*ec2.Subnet, policy string) map[string][]*ec2.Subnet {
+	switch policy {
+	case v1alpha1.SubnetSelectionPolicyRoundRobin:
+		return s.selectRoundRobin(zonalSubnets)
+	case v1alpha1.SubnetSelectionPolicyLeastUtilizedZone:
+		return selectLeastUtilizedZone(zonalSubnets)
+	default:
+		return selectMostFreeIPs(zonalSubnets)
+	}
+}
+
+// selectMostFreeIPs chooses the subnet with the most available IP addresses in
+// each zone. Ties are broken by subnet id, so that selection is stable.
+func selectMostFreeIPs(zonalSubnets map[string][]*ec2.Subnet) map[string][]*ec2.Subnet {
+	selected := map[string][]*ec2.Subnet{}
+	for zone, subnets := range zonalSubnets {
+		var best *ec2.Subnet
+		for _, subnet := range subnets {
+			if best == nil ||
+				aws.Int64Value(subnet.AvailableIpAddressCount) > aws.Int64Value(best.AvailableIpAddressCount) ||
+				(aws.Int64Value(subnet.AvailableIpAddressCount) == aws.Int64Value(best.AvailableIpAddressCount) &&
+					aws.StringValue(subnet.SubnetId) < aws.StringValue(best.SubnetId)) {
+				best = subnet
+			}
+		}
+		if best != nil {
+			selected[zone] = []*ec2.Subnet{best}
+		}
+	}
+	return selected
+}
+
+// selectRoundRobin rotates through each zone's subnets, ordered by id, on
+// every selection
+func (s *SubnetProvider) selectRoundRobin(zonalSubnets map[string][]*ec2.Subnet) map[string][]*ec2.Subnet {
+	s.rotationsMutex.Lock()
+	defer s.rotationsMutex.Unlock()
+	selected := map[string][]*ec2.Subnet{}
+	for zone, subnets := range zonalSubnets {
+		if len(subnets) == 0 {
+			continue
+		}
+		sorted := append([]*ec2.Subnet{}, subnets...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return aws.StringValue(sorted[i].SubnetId) < aws.StringValue(sorted[j].SubnetId)
+		})
+		selected[zone] = []*ec2.Subnet{sorted[s.rotations[zone]%len(sorted)]}
+		s.rotations[zone] = (s.rotations[zone] + 1) % len(sorted)
+	}
+	return selected
+}
+
+// selectLeastUtilizedZone chooses the subnet with the most available IP
+// addresses in the zone whose subnets have the lowest share of their IP
+// addresses in use. Ties are broken by zone name, so that selection is stable.
+func selectLeastUtilizedZone(zonalSubnets map[string][]*ec2.Subnet) map[string][]*ec2.Subnet {
+	leastUtilizedZone := ""
+	leastUtilization := 0.0
+	for zone, subnets := range zonalSubnets {
+		if len(subnets) == 0 {
+			continue
+		}
+		utilization := utilizationOf(subnets)
+		if leastUtilizedZone == "" || utilization < leastUtilization ||
+			(utilization == leastUtilization && zone < leastUtilizedZone) {
+			leastUtilizedZone = zone
+			leastUtilization = utilization
+		}
+	}
+	if leastUtilizedZone == "" {
+		return map[string][]*ec2.Subnet{}
+	}
+	return selectMostFreeIPs(map[string][]*ec2.Subnet{leastUtilizedZone: zonalSubnets[leastUtilizedZone]})
+}
+
+// utilizationOf returns the share of the subnets' usable IP addresses that
+// are in use. Subnets without a valid CIDR block are ignored.
+func utilizationOf(subnets []*ec2.Subnet) float64 {
+	var total, available int64
+	for _, subnet := range subnets {
+		_, cidr, err := net.ParseCIDR(aws.StringValue(subnet.CidrBlock))
+		if err != nil {
+			continue
+		}
+		ones, bits := cidr.Mask.Size()
+		total += int64(1)<<uint(bits-ones) - reservedIPAddressesPerSubnet
+		available += aws.Int64Value(subnet.AvailableIpAddressCount)
+	}
+	if total <= 0 {
+		return 0
+	}
+	return 1 - float64(available)/float64(total)
+}
+
 func (s *SubnetProvider) getZonalSubnets(ctx context.Context, clusterName string) (map[string][]*ec2.Subnet, error) {
 	describeSubnetOutput, err := s.ec2api.DescribeSubnetsWithContext(ctx, &ec2.DescribeSubnetsInput{
 		Filters: []*ec2.Filter{{
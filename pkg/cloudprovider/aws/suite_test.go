@@ -18,29 +18,57 @@ import (
 	"testing"
 
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
 
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/cloudprovider/aws/utils"
 	. "github.com/awslabs/karpenter/pkg/test/expectations"
 	"github.com/awslabs/karpenter/pkg/utils/resources"
+	"github.com/mitchellh/hashstructure/v2"
 	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 	"knative.dev/pkg/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/envtest/printer"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 
 	"github.com/Pallinder/go-randomdata"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 	"github.com/awslabs/karpenter/pkg/cloudprovider/aws/fake"
 	"github.com/awslabs/karpenter/pkg/controllers/provisioning/v1alpha1/allocation"
 	"github.com/awslabs/karpenter/pkg/test"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
 	webhooksprovisioning "github.com/awslabs/karpenter/pkg/webhooks/provisioning/v1alpha1"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"knative.dev/pkg/apis"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 func TestAPIs(t *testing.T) {
@@ -48,34 +76,75 @@ func TestAPIs(t *testing.T) {
 	RunSpecsWithDefaultAndCustomReporters(t, "CloudProvider/AWS", []Reporter{printer.NewlineReporter{}})
 }
 
+const testRegion = "test-region-1"
+
+// taggingEC2API records how many instances were tagged when each termination
+// is requested, and fails tagging with createTagsErr
+type taggingEC2API struct {
+	*fake.EC2API
+	createTagsErr           error
+	taggedBeforeTermination []int
+}
+
+func (t *taggingEC2API) CreateTagsWithContext(ctx context.Context, input *ec2.CreateTagsInput, options ...request.Option) (*ec2.CreateTagsOutput, error) {
+	if t.createTagsErr != nil {
+		return nil, t.createTagsErr
+	}
+	return t.EC2API.CreateTagsWithContext(ctx, input, options...)
+}
+
+func (t *taggingEC2API) TerminateInstancesWithContext(ctx context.Context, input *ec2.TerminateInstancesInput, options ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	tagged := 0
+	for _, input := range t.CalledWithCreateTagsInput {
+		tagged += len(input.Resources)
+	}
+	t.taggedBeforeTermination = append(t.taggedBeforeTermination, tagged)
+	return t.EC2API.TerminateInstancesWithContext(ctx, input, options...)
+}
+
 var subnetCache = cache.New(CacheTTL, CacheCleanupInterval)
 var launchTemplateCache = cache.New(CacheTTL, CacheCleanupInterval)
 var instanceProfileCache = cache.New(CacheTTL, CacheCleanupInterval)
 var securityGroupCache = cache.New(CacheTTL, CacheCleanupInterval)
+var placementGroupCache = cache.New(CacheTTL, CacheCleanupInterval)
+var unavailableOfferingsCache = cache.New(UnavailableOfferingsTTL, CacheCleanupInterval)
 var fakeEC2API *fake.EC2API
+var fakeIAMAPI *fake.IAMAPI
+var cloudProviderFactory *Factory
 var env = test.NewEnvironment(func(e *test.Environment) {
 	clientSet := kubernetes.NewForConfigOrDie(e.Manager.GetConfig())
 	fakeEC2API = &fake.EC2API{}
+	fakeIAMAPI = &fake.IAMAPI{}
 	subnetProvider := &SubnetProvider{
 		ec2api: fakeEC2API,
 		cache:  subnetCache,
+		region: testRegion,
 	}
 	launchTemplateProvider := &LaunchTemplateProvider{
-		ec2api: fakeEC2API,
-		cache:  launchTemplateCache,
+		ec2api:   fakeEC2API,
+		cache:    launchTemplateCache,
+		launched: cache.New(LaunchTemplateOrphanSafetyMargin, CacheCleanupInterval),
 		securityGroupProvider: &SecurityGroupProvider{
 			ec2api: fakeEC2API,
 			cache:  securityGroupCache,
+			region: testRegion,
 		},
-		ssm:       &fake.SSMAPI{},
-		clientSet: clientSet,
+		ssm:        &fake.SSMAPI{},
+		clientSet:  clientSet,
+		region:     testRegion,
+		namePrefix: "test-prefix",
 	}
-	cloudProviderFactory := &Factory{
-		nodeFactory:            &NodeFactory{ec2api: fakeEC2API},
-		launchTemplateProvider: launchTemplateProvider,
-		subnetProvider:         subnetProvider,
-		instanceTypeProvider:   NewInstanceTypeProvider(fakeEC2API),
-		instanceProvider:       &InstanceProvider{ec2api: fakeEC2API},
+	cloudProviderFactory = &Factory{
+		kubeClient:              e.Manager.GetClient(),
+		nodeFactory:             &NodeFactory{ec2api: fakeEC2API, managedLabelKey: v1alpha1.DefaultManagedLabelKey},
+		launchTemplateProvider:  launchTemplateProvider,
+		subnetProvider:          subnetProvider,
+		instanceTypeProvider:    NewInstanceTypeProvider(fakeEC2API, testRegion, DefaultVMMemoryOverheadFraction),
+		instanceProvider:        &InstanceProvider{ec2api: fakeEC2API, unavailableOfferings: unavailableOfferingsCache, now: time.Now},
+		placementGroupProvider:  &PlacementGroupProvider{ec2api: fakeEC2API, cache: placementGroupCache, region: testRegion},
+		securityGroupProvider:   launchTemplateProvider.securityGroupProvider,
+		instanceProfileProvider: &InstanceProfileProvider{iamapi: fakeIAMAPI, cache: instanceProfileCache},
+		changes:                 make(chan event.GenericEvent),
 	}
 	e.Manager.RegisterWebhooks(
 		&webhooksprovisioning.Validator{CloudProvider: cloudProviderFactory},
@@ -85,6 +154,8 @@ var env = test.NewEnvironment(func(e *test.Environment) {
 			e.Manager.GetClient(),
 			clientSet.CoreV1(),
 			cloudProviderFactory,
+			e.Manager.GetEventRecorderFor("karpenter"),
+			allocation.Options{SystemNamespace: "default"},
 		),
 	)
 })
@@ -118,12 +189,15 @@ var _ = Describe("Allocation", func() {
 
 	AfterEach(func() {
 		fakeEC2API.Reset()
+		fakeIAMAPI.Reset()
 		ExpectCleanedUp(env.Client)
 		for _, cache := range []*cache.Cache{
 			subnetCache,
 			launchTemplateCache,
 			instanceProfileCache,
 			securityGroupCache,
+			placementGroupCache,
+			unavailableOfferingsCache,
 		} {
 			cache.Flush()
 		}
@@ -180,10 +254,29 @@ var _ = Describe("Allocation", func() {
 				),
 			)
 		})
-		It("should allow pod to override default zone", func() {
+		It("should launch pods with required zone affinity in that zone", func() {
+			// Setup
+			pod := test.PendingPodWith(test.PodOptions{
+				NodeRequirements: []v1.NodeSelectorRequirement{
+					{Key: v1alpha1.ZoneLabelKey, Operator: v1.NodeSelectorOpIn, Values: []string{"test-zone-1c"}},
+				},
+			})
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+			node := ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+			Expect(node.Labels).To(HaveKeyWithValue(v1alpha1.ZoneLabelKey, "test-zone-1c"))
+			Expect(fakeEC2API.CalledWithCreateFleetInput).To(HaveLen(1))
+			for _, override := range fakeEC2API.CalledWithCreateFleetInput[0].LaunchTemplateConfigs[0].Overrides {
+				Expect(aws.StringValue(override.SubnetId)).To(Equal("test-subnet-3"))
+			}
+		})
+		It("should allow pod to constrain the provisioner's zones", func() {
 			// Setup
 			provisioner.Spec.Zones = []string{"test-zone-1a", "test-zone-1b"}
-			pod := test.PendingPodWith(test.PodOptions{NodeSelector: map[string]string{v1alpha1.ZoneLabelKey: "test-zone-1c"}})
+			pod := test.PendingPodWith(test.PodOptions{NodeSelector: map[string]string{v1alpha1.ZoneLabelKey: "test-zone-1b"}})
 			ExpectCreatedWithStatus(env.Client, pod)
 			ExpectCreated(env.Client, provisioner)
 			ExpectEventuallyReconciled(env.Client, provisioner)
@@ -191,14 +284,26 @@ var _ = Describe("Allocation", func() {
 			scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
 			ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
 			Expect(fakeEC2API.CalledWithCreateFleetInput).To(HaveLen(1))
-			Expect(fakeEC2API.CalledWithCreateFleetInput[0].LaunchTemplateConfigs[0].Overrides).To(
-				ContainElements(
-					&ec2.FleetLaunchTemplateOverridesRequest{
-						InstanceType: aws.String("m5.large"),
-						SubnetId:     aws.String("test-subnet-3"),
-					},
-				),
-			)
+			overrides := fakeEC2API.CalledWithCreateFleetInput[0].LaunchTemplateConfigs[0].Overrides
+			Expect(overrides).To(ContainElement(&ec2.FleetLaunchTemplateOverridesRequest{
+				InstanceType: aws.String("m5.large"),
+				SubnetId:     aws.String("test-subnet-2"),
+			}))
+			for _, override := range overrides {
+				Expect(aws.StringValue(override.SubnetId)).To(Equal("test-subnet-2"))
+			}
+		})
+		It("should not launch nodes for pods that select a zone outside of the provisioner's zones", func() {
+			// Setup
+			provisioner.Spec.Zones = []string{"test-zone-1a", "test-zone-1b"}
+			pod := test.PendingPodWith(test.PodOptions{NodeSelector: map[string]string{v1alpha1.ZoneLabelKey: "test-zone-1c"}})
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			unscheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+			Expect(unscheduled.Spec.NodeName).To(BeEmpty())
+			Expect(fakeEC2API.CalledWithCreateFleetInput).To(BeEmpty())
 		})
 		It("should launch nodes for pods with different node selectors", func() {
 			// Setup
@@ -219,6 +324,193 @@ var _ = Describe("Allocation", func() {
 			Expect(node1.ObjectMeta.Labels).To(HaveKeyWithValue(LaunchTemplateIdLabel, lt1))
 			Expect(node2.ObjectMeta.Labels).To(HaveKeyWithValue(LaunchTemplateIdLabel, lt2))
 		})
+		It("should not launch nodes for a launch template whose AMI doesn't match the instance types' architecture", func() {
+			// Setup
+			fakeEC2API.DescribeImagesOutput = &ec2.DescribeImagesOutput{Images: []*ec2.Image{{
+				ImageId:      aws.String("test-ami-id"),
+				Architecture: aws.String(v1alpha1.ArchitectureArm64),
+			}}}
+			pod := test.PendingPodWith(test.PodOptions{NodeSelector: map[string]string{LaunchTemplateIdLabel: "abc123"}})
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			unscheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+			Expect(unscheduled.Spec.NodeName).To(BeEmpty())
+			Expect(fakeEC2API.CalledWithCreateFleetInput).To(BeEmpty())
+		})
+		It("should exclude instance types that don't match the architecture of a launch template's AMI", func() {
+			instanceTypeOf := func(name string, architecture string) cloudprovider.InstanceType {
+				return &InstanceType{InstanceTypeInfo: ec2.InstanceTypeInfo{
+					InstanceType:  aws.String(name),
+					ProcessorInfo: &ec2.ProcessorInfo{SupportedArchitectures: aws.StringSlice([]string{architecture})},
+				}}
+			}
+			instanceTypes := []cloudprovider.InstanceType{
+				instanceTypeOf("m5.large", "x86_64"),
+				instanceTypeOf("m6g.large", "arm64"),
+			}
+			launchTemplate := &LaunchTemplate{Id: aws.String("abc123"), Version: aws.String(defaultLaunchTemplateVersion)}
+			matching, err := cloudProviderFactory.CapacityFor(provisioner).(*Capacity).matchingArchitecture(context.Background(), launchTemplate, instanceTypes)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matching).To(HaveLen(1))
+			Expect(matching[0].Name()).To(Equal("m5.large"))
+		})
+		It("should label nodes as managed", func() {
+			// Setup
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+			node := ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+			Expect(node.ObjectMeta.Labels).To(HaveKeyWithValue(v1alpha1.DefaultManagedLabelKey, "true"))
+		})
+		It("should apply the provisioner's annotations to nodes", func() {
+			// Setup
+			provisioner.Spec.Annotations = map[string]string{"example.com/owner": "test-team"}
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+			node := ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+			Expect(node.ObjectMeta.Annotations).To(HaveKeyWithValue("example.com/owner", "test-team"))
+		})
+		It("should prioritize spot instance types by the provisioner's ranking", func() {
+			// Setup
+			provisioner.Spec.Labels = map[string]string{CapacityTypeLabel: capacityTypeSpot}
+			provisioner.Spec.InstanceTypes = []string{"m5.xlarge", "m5.large"}
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+			ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+			Expect(fakeEC2API.CalledWithCreateFleetInput).To(HaveLen(1))
+			Expect(fakeEC2API.CalledWithCreateFleetInput[0].SpotOptions.AllocationStrategy).To(
+				Equal(aws.String(ec2.SpotAllocationStrategyCapacityOptimizedPrioritized)))
+			Expect(fakeEC2API.CalledWithCreateFleetInput[0].LaunchTemplateConfigs[0].Overrides).To(
+				ContainElements(
+					&ec2.FleetLaunchTemplateOverridesRequest{
+						InstanceType: aws.String("m5.xlarge"),
+						SubnetId:     aws.String("test-subnet-1"),
+						Priority:     aws.Float64(0),
+					},
+					&ec2.FleetLaunchTemplateOverridesRequest{
+						InstanceType: aws.String("m5.large"),
+						SubnetId:     aws.String("test-subnet-1"),
+						Priority:     aws.Float64(1),
+					},
+				),
+			)
+		})
+		It("should not prioritize spot instance types for other allocation strategies", func() {
+			// Setup
+			provisioner.Spec.Labels = map[string]string{
+				CapacityTypeLabel:           capacityTypeSpot,
+				SpotAllocationStrategyLabel: ec2.SpotAllocationStrategyCapacityOptimized,
+			}
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			Expect(fakeEC2API.CalledWithCreateFleetInput).To(HaveLen(1))
+			Expect(fakeEC2API.CalledWithCreateFleetInput[0].SpotOptions.AllocationStrategy).To(
+				Equal(aws.String(ec2.SpotAllocationStrategyCapacityOptimized)))
+			for _, override := range fakeEC2API.CalledWithCreateFleetInput[0].LaunchTemplateConfigs[0].Overrides {
+				Expect(override.Priority).To(BeNil())
+			}
+		})
+		It("should cap the hourly spend of fleet on spot and on-demand capacity", func() {
+			// Setup
+			provisioner.Spec.Labels = map[string]string{MaxPriceLabel: "0.25"}
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			Expect(fakeEC2API.CalledWithCreateFleetInput).To(HaveLen(1))
+			Expect(aws.StringValue(fakeEC2API.CalledWithCreateFleetInput[0].OnDemandOptions.MaxTotalPrice)).To(Equal("0.25"))
+			Expect(aws.StringValue(fakeEC2API.CalledWithCreateFleetInput[0].SpotOptions.MaxTotalPrice)).To(Equal("0.25"))
+		})
+		It("should not cap prices without a max price", func() {
+			// Setup
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			Expect(fakeEC2API.CalledWithCreateFleetInput).To(HaveLen(1))
+			Expect(fakeEC2API.CalledWithCreateFleetInput[0].OnDemandOptions.MaxTotalPrice).To(BeNil())
+			Expect(fakeEC2API.CalledWithCreateFleetInput[0].SpotOptions.MaxTotalPrice).To(BeNil())
+		})
+		It("should bid the spot max price for spot offerings", func() {
+			// Setup
+			provisioner.Spec.Labels = map[string]string{CapacityTypeLabel: capacityTypeSpot, SpotMaxPriceLabel: "0.1"}
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			Expect(fakeEC2API.CalledWithCreateFleetInput).To(HaveLen(1))
+			overrides := fakeEC2API.CalledWithCreateFleetInput[0].LaunchTemplateConfigs[0].Overrides
+			Expect(overrides).ToNot(BeEmpty())
+			for _, override := range overrides {
+				Expect(aws.StringValue(override.MaxPrice)).To(Equal("0.1"))
+			}
+		})
+		It("should default the spot max price to the on-demand price", func() {
+			// Setup
+			provisioner.Spec.Labels = map[string]string{CapacityTypeLabel: capacityTypeSpot}
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			Expect(fakeEC2API.CalledWithCreateFleetInput).To(HaveLen(1))
+			for _, override := range fakeEC2API.CalledWithCreateFleetInput[0].LaunchTemplateConfigs[0].Overrides {
+				Expect(override.MaxPrice).To(BeNil())
+			}
+		})
+		It("should prioritize on-demand instance types by the provisioner's selection strategy", func() {
+			// Setup
+			provisioner.Spec.SelectionStrategy = aws.String(v1alpha1.SelectionStrategyFewestNodes)
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			Expect(fakeEC2API.CalledWithCreateFleetInput).To(HaveLen(1))
+			Expect(fakeEC2API.CalledWithCreateFleetInput[0].OnDemandOptions.AllocationStrategy).To(
+				Equal(aws.String(ec2.FleetOnDemandAllocationStrategyPrioritized)))
+			priorities := map[string]float64{}
+			for _, override := range fakeEC2API.CalledWithCreateFleetInput[0].LaunchTemplateConfigs[0].Overrides {
+				Expect(override.Priority).ToNot(BeNil())
+				priorities[aws.StringValue(override.InstanceType)] = aws.Float64Value(override.Priority)
+			}
+			Expect(priorities).To(HaveKey("m5.large"))
+			Expect(priorities).To(HaveKey("m5.xlarge"))
+			Expect(priorities["m5.xlarge"]).To(BeNumerically("<", priorities["m5.large"]))
+		})
+		It("should not prioritize on-demand instance types for the lowest price", func() {
+			// Setup
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			Expect(fakeEC2API.CalledWithCreateFleetInput).To(HaveLen(1))
+			Expect(fakeEC2API.CalledWithCreateFleetInput[0].OnDemandOptions.AllocationStrategy).To(
+				Equal(aws.String(ec2.FleetOnDemandAllocationStrategyLowestPrice)))
+			for _, override := range fakeEC2API.CalledWithCreateFleetInput[0].LaunchTemplateConfigs[0].Overrides {
+				Expect(override.Priority).To(BeNil())
+			}
+		})
 		It("should launch instances for Nvidia GPU resource requests", func() {
 			// Setup
 			pod1 := test.PendingPodWith(test.PodOptions{
@@ -320,6 +612,1574 @@ var _ = Describe("Allocation", func() {
 			)
 		})
 	})
+	Context("LaunchTemplates", func() {
+		It("should name launch templates with the prefix and cluster name", func() {
+			// Setup
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+			Expect(fakeEC2API.CalledWithDescribeLaunchTemplates).ToNot(BeEmpty())
+			Expect(aws.StringValue(fakeEC2API.CalledWithDescribeLaunchTemplates[0].LaunchTemplateNames[0])).To(
+				HavePrefix(fmt.Sprintf("test-prefix-%s/", provisioner.Spec.Cluster.Name)))
+		})
+		It("should keep the legacy name prefix by default and not collide across clusters", func() {
+			provider := &LaunchTemplateProvider{namePrefix: DefaultLaunchTemplateNamePrefix}
+			options := &launchTemplateOptions{Cluster: v1alpha1.ClusterSpec{Name: "test-cluster-1"}}
+			other := &launchTemplateOptions{Cluster: v1alpha1.ClusterSpec{Name: "test-cluster-2"}}
+			Expect(provider.launchTemplateName(options)).To(HavePrefix("Karpenter-test-cluster-1/"))
+			Expect(provider.launchTemplateName(other)).To(HavePrefix("Karpenter-test-cluster-2/"))
+			Expect(provider.launchTemplateName(options)).ToNot(Equal(provider.launchTemplateName(other)))
+		})
+		It("should keep the names of launch templates created before options were added", func() {
+			provider := &LaunchTemplateProvider{namePrefix: DefaultLaunchTemplateNamePrefix}
+			options := &launchTemplateOptions{
+				Provisioner:         types.NamespacedName{Name: "test-provisioner", Namespace: "default"},
+				Cluster:             v1alpha1.ClusterSpec{Name: "test-cluster"},
+				Architecture:        "x86_64",
+				Labels:              map[string]string{"test-key": "test-value"},
+				Taints:              []v1.Taint{{Key: "test-taint", Effect: v1.TaintEffectNoSchedule}},
+				RejectDeprecatedAMI: true,
+			}
+			// The options before placement, hibernation, data volume, and credit options were added
+			type launchTemplateOptions struct {
+				Provisioner  types.NamespacedName
+				Cluster      v1alpha1.ClusterSpec
+				Architecture string
+				Labels       map[string]string
+				Taints       []v1.Taint
+			}
+			hash, err := hashstructure.Hash(launchTemplateOptions{
+				Provisioner:  options.Provisioner,
+				Cluster:      options.Cluster,
+				Architecture: options.Architecture,
+				Labels:       options.Labels,
+				Taints:       options.Taints,
+			}, hashstructure.FormatV2, nil)
+			Expect(err).ToNot(HaveOccurred())
+			legacyName := fmt.Sprintf("Karpenter-test-cluster/test-provisioner/default-%d", hash)
+			// Assertions
+			Expect(provider.launchTemplateName(options)).To(Equal(legacyName))
+			options.DataVolumeSizeGiB = 40
+			Expect(provider.launchTemplateName(options)).ToNot(Equal(legacyName))
+		})
+		It("should launch into the placement group's partition", func() {
+			// Setup
+			fakeEC2API.DescribeLaunchTemplatesOutput = &ec2.DescribeLaunchTemplatesOutput{}
+			provisioner.Spec.Labels = map[string]string{
+				PlacementGroupNameLabel:       "test-placement-group",
+				PlacementPartitionNumberLabel: "2",
+			}
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+			ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+			Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput).To(HaveLen(1))
+			Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput[0].LaunchTemplateData.Placement).To(Equal(&ec2.LaunchTemplatePlacementRequest{
+				GroupName:       aws.String("test-placement-group"),
+				PartitionNumber: aws.Int64(2),
+			}))
+		})
+		It("should configure hibernation with an encrypted root volume when enabled", func() {
+			// Setup
+			fakeEC2API.DescribeLaunchTemplatesOutput = &ec2.DescribeLaunchTemplatesOutput{}
+			provisioner.Spec.Labels = map[string]string{HibernationEnabledLabel: "true"}
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+			ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+			Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput).To(HaveLen(1))
+			launchTemplateData := fakeEC2API.CalledWithCreateLaunchTemplateInput[0].LaunchTemplateData
+			Expect(launchTemplateData.HibernationOptions).To(Equal(&ec2.LaunchTemplateHibernationOptionsRequest{Configured: aws.Bool(true)}))
+			Expect(launchTemplateData.BlockDeviceMappings).To(ConsistOf(&ec2.LaunchTemplateBlockDeviceMappingRequest{
+				DeviceName: aws.String("/dev/xvda"),
+				Ebs:        &ec2.LaunchTemplateEbsBlockDeviceRequest{Encrypted: aws.Bool(true)},
+			}))
+			Expect(fakeEC2API.CalledWithCreateFleetInput).To(HaveLen(1))
+			for _, override := range fakeEC2API.CalledWithCreateFleetInput[0].LaunchTemplateConfigs[0].Overrides {
+				Expect(aws.StringValue(override.InstanceType)).To(HavePrefix("m5."))
+			}
+		})
+		It("should not configure hibernation by default", func() {
+			// Setup
+			fakeEC2API.DescribeLaunchTemplatesOutput = &ec2.DescribeLaunchTemplatesOutput{}
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+			ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+			Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput).To(HaveLen(1))
+			Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput[0].LaunchTemplateData.HibernationOptions).To(BeNil())
+			Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput[0].LaunchTemplateData.BlockDeviceMappings).To(BeEmpty())
+		})
+		It("should resize the data volume for ephemeral storage larger than the default", func() {
+			// Setup
+			fakeEC2API.DescribeLaunchTemplatesOutput = &ec2.DescribeLaunchTemplatesOutput{}
+			pod := test.PendingPodWith(test.PodOptions{
+				ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceEphemeralStorage: resource.MustParse("50Gi")}},
+			})
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+			ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+			Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput).To(HaveLen(1))
+			Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput[0].LaunchTemplateData.BlockDeviceMappings).To(ConsistOf(&ec2.LaunchTemplateBlockDeviceMappingRequest{
+				DeviceName: aws.String("/dev/xvdb"),
+				Ebs:        &ec2.LaunchTemplateEbsBlockDeviceRequest{VolumeSize: aws.Int64(80)},
+			}))
+		})
+		It("should size data volumes between the default and largest volume sizes", func() {
+			Expect(dataVolumeSizeFor([]*v1.Pod{test.PendingPodWith(test.PodOptions{
+				ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceEphemeralStorage: resource.MustParse("10Gi")}},
+			})})).To(BeZero())
+			Expect(dataVolumeSizeFor([]*v1.Pod{test.PendingPod()})).To(BeZero())
+			Expect(dataVolumeSizeFor([]*v1.Pod{test.PendingPodWith(test.PodOptions{
+				ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceEphemeralStorage: resource.MustParse("20Ti")}},
+			})})).To(BeNumerically("==", maxDataVolumeSizeGiB))
+		})
+		It("should set the credit specification only for burstable instance types", func() {
+			// Setup
+			fakeEC2API.DescribeLaunchTemplatesOutput = &ec2.DescribeLaunchTemplatesOutput{}
+			provisioner.Spec.Labels = map[string]string{BurstableCreditsLabel: "unlimited"}
+			ExpectCreated(env.Client, provisioner)
+			constraints := Constraints(*provisioner.ConstraintsWithOverrides(&v1.Pod{}))
+			burstable := &InstanceType{InstanceTypeInfo: ec2.InstanceTypeInfo{InstanceType: aws.String("t3.large"), BurstablePerformanceSupported: aws.Bool(true)}}
+			standard := &InstanceType{InstanceTypeInfo: ec2.InstanceTypeInfo{InstanceType: aws.String("m5.large"), BurstablePerformanceSupported: aws.Bool(false)}}
+			// Assertions
+			_, err := cloudProviderFactory.launchTemplateProvider.Get(context.Background(), provisioner, &constraints, nil, []cloudprovider.InstanceType{burstable})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = cloudProviderFactory.launchTemplateProvider.Get(context.Background(), provisioner, &constraints, nil, []cloudprovider.InstanceType{burstable, standard})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput).To(HaveLen(2))
+			Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput[0].LaunchTemplateData.CreditSpecification).To(Equal(&ec2.CreditSpecificationRequest{CpuCredits: aws.String("unlimited")}))
+			Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput[1].LaunchTemplateData.CreditSpecification).To(BeNil())
+		})
+		It("should default burstable instance types to standard credits", func() {
+			constraints := Constraints{}
+			burstable := &InstanceType{InstanceTypeInfo: ec2.InstanceTypeInfo{InstanceType: aws.String("t3.large"), BurstablePerformanceSupported: aws.Bool(true)}}
+			Expect(cpuCreditsFor(&constraints, []cloudprovider.InstanceType{burstable})).To(Equal("standard"))
+			Expect(cpuCreditsFor(&constraints, nil)).To(BeEmpty())
+		})
+		It("should delete orphaned launch templates and keep referenced ones", func() {
+			// Setup
+			ExpectCreated(env.Client, provisioner)
+			provider := &LaunchTemplateProvider{ec2api: fakeEC2API, launched: cache.New(LaunchTemplateOrphanSafetyMargin, CacheCleanupInterval), namePrefix: "test-prefix"}
+			constraints := Constraints(*provisioner.ConstraintsWithOverrides(&v1.Pod{}))
+			options := launchTemplateOptionsFor(provisioner, &constraints)
+			referenced := &ec2.LaunchTemplate{LaunchTemplateId: aws.String("lt-referenced"), LaunchTemplateName: aws.String(provider.launchTemplateName(&options))}
+			inUse := &ec2.LaunchTemplate{LaunchTemplateId: aws.String("lt-in-use"), LaunchTemplateName: aws.String("test-prefix-test-cluster/deleted/default-1")}
+			orphaned := &ec2.LaunchTemplate{LaunchTemplateId: aws.String("lt-orphaned"), LaunchTemplateName: aws.String("test-prefix-test-cluster/deleted/default-2")}
+			unowned := &ec2.LaunchTemplate{LaunchTemplateId: aws.String("lt-unowned"), LaunchTemplateName: aws.String("other-prefix-test-cluster/deleted/default-3")}
+			otherCluster := &ec2.LaunchTemplate{LaunchTemplateId: aws.String("lt-other-cluster"), LaunchTemplateName: aws.String("test-prefix-other-cluster/deleted/default-4")}
+			longerPrefix := &ec2.LaunchTemplate{LaunchTemplateId: aws.String("lt-longer-prefix"), LaunchTemplateName: aws.String("test-prefix-prod-test-cluster/deleted/default-5")}
+			fakeEC2API.DescribeLaunchTemplatesOutput = &ec2.DescribeLaunchTemplatesOutput{
+				LaunchTemplates: []*ec2.LaunchTemplate{referenced, inUse, orphaned, unowned, otherCluster, longerPrefix},
+			}
+			fakeEC2API.DescribeInstancesOutput = &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{{
+				InstanceId: aws.String("test-instance"),
+				Tags:       []*ec2.Tag{{Key: aws.String(launchTemplateIdTagKey), Value: inUse.LaunchTemplateId}},
+			}}}}}
+			// Assertions
+			Expect(provider.DeleteOrphans(context.Background(), []v1alpha1.Provisioner{*provisioner})).To(Succeed())
+			Expect(fakeEC2API.CalledWithDeleteLaunchTemplateInput).To(ConsistOf(ec2.DeleteLaunchTemplateInput{LaunchTemplateId: orphaned.LaunchTemplateId}))
+			Expect(fakeEC2API.CalledWithDescribeLaunchTemplates).To(HaveLen(1))
+			Expect(aws.StringValueSlice(fakeEC2API.CalledWithDescribeLaunchTemplates[0].Filters[0].Values)).To(ConsistOf(fmt.Sprintf(KarpenterTagKeyFormat, "test-cluster")))
+		})
+		It("should not delete launch templates of instances launched within the safety margin", func() {
+			// Setup
+			ExpectCreated(env.Client, provisioner)
+			provider := &LaunchTemplateProvider{
+				ec2api:     fakeEC2API,
+				launched:   cache.New(LaunchTemplateOrphanSafetyMargin, CacheCleanupInterval),
+				namePrefix: "test-prefix",
+			}
+			justLaunched := &ec2.LaunchTemplate{LaunchTemplateId: aws.String("lt-just-launched"), LaunchTemplateName: aws.String("test-prefix-test-cluster/pod/default-1")}
+			justCreated := &ec2.LaunchTemplate{LaunchTemplateId: aws.String("lt-just-created"), LaunchTemplateName: aws.String("test-prefix-test-cluster/pod/default-2"), CreateTime: aws.Time(time.Now())}
+			orphaned := &ec2.LaunchTemplate{LaunchTemplateId: aws.String("lt-orphaned"), LaunchTemplateName: aws.String("test-prefix-test-cluster/pod/default-3"), CreateTime: aws.Time(time.Now().Add(-time.Hour))}
+			fakeEC2API.DescribeLaunchTemplatesOutput = &ec2.DescribeLaunchTemplatesOutput{
+				LaunchTemplates: []*ec2.LaunchTemplate{justLaunched, justCreated, orphaned},
+			}
+			// The instance isn't tagged with its launch template yet, and its node hasn't registered
+			fakeEC2API.DescribeInstancesOutput = &ec2.DescribeInstancesOutput{}
+			provider.launched.SetDefault(aws.StringValue(justLaunched.LaunchTemplateId), true)
+			// Assertions
+			Expect(provider.DeleteOrphans(context.Background(), []v1alpha1.Provisioner{*provisioner})).To(Succeed())
+			Expect(fakeEC2API.CalledWithDeleteLaunchTemplateInput).To(ConsistOf(ec2.DeleteLaunchTemplateInput{LaunchTemplateId: orphaned.LaunchTemplateId}))
+		})
+		It("should warn when launch templates are created with a deprecated AMI", func() {
+			// Setup
+			core, logs := observer.New(zapcore.WarnLevel)
+			defer zap.ReplaceGlobals(zap.New(core))()
+			fakeEC2API.DescribeLaunchTemplatesOutput = &ec2.DescribeLaunchTemplatesOutput{}
+			fakeEC2API.DescribeImagesOutput = &ec2.DescribeImagesOutput{Images: []*ec2.Image{{
+				ImageId:         aws.String("test-ami-id"),
+				DeprecationTime: aws.String("2021-01-01T00:00:00.000Z"),
+			}}}
+			ExpectCreated(env.Client, provisioner)
+			constraints := Constraints(*provisioner.ConstraintsWithOverrides(&v1.Pod{}))
+			// Assertions
+			_, err := cloudProviderFactory.launchTemplateProvider.Get(context.Background(), provisioner, &constraints, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput).To(HaveLen(1))
+			entries := logs.FilterMessage(DeprecatedAMIMessage).All()
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].ContextMap()).To(HaveKeyWithValue("deprecationTime", "2021-01-01T00:00:00.000Z"))
+		})
+		It("should refuse a deprecated AMI if deprecated AMIs are rejected", func() {
+			// Setup
+			fakeEC2API.DescribeLaunchTemplatesOutput = &ec2.DescribeLaunchTemplatesOutput{}
+			fakeEC2API.DescribeImagesOutput = &ec2.DescribeImagesOutput{Images: []*ec2.Image{{
+				ImageId:         aws.String("test-ami-id"),
+				DeprecationTime: aws.String("2021-01-01T00:00:00.000Z"),
+			}}}
+			provisioner.Spec.Labels = map[string]string{RejectDeprecatedAMILabel: "true"}
+			ExpectCreated(env.Client, provisioner)
+			constraints := Constraints(*provisioner.ConstraintsWithOverrides(&v1.Pod{}))
+			// Assertions
+			_, err := cloudProviderFactory.launchTemplateProvider.Get(context.Background(), provisioner, &constraints, nil, nil)
+			Expect(err).To(HaveOccurred())
+			Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput).To(BeEmpty())
+		})
+		It("should use AMIs whose deprecation is in the future", func() {
+			// Setup
+			fakeEC2API.DescribeLaunchTemplatesOutput = &ec2.DescribeLaunchTemplatesOutput{}
+			fakeEC2API.DescribeImagesOutput = &ec2.DescribeImagesOutput{Images: []*ec2.Image{{
+				ImageId:         aws.String("test-ami-id"),
+				DeprecationTime: aws.String(time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)),
+			}}}
+			provisioner.Spec.Labels = map[string]string{RejectDeprecatedAMILabel: "true"}
+			ExpectCreated(env.Client, provisioner)
+			constraints := Constraints(*provisioner.ConstraintsWithOverrides(&v1.Pod{}))
+			// Assertions
+			_, err := cloudProviderFactory.launchTemplateProvider.Get(context.Background(), provisioner, &constraints, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput).To(HaveLen(1))
+		})
+	})
+
+	Context("Quotas", func() {
+		It("should return a typed error when fleet is blocked by a quota", func() {
+			for _, code := range utils.QuotaExceededErrorCodes {
+				fakeEC2API.CreateFleetOutput = &ec2.CreateFleetOutput{Errors: []*ec2.CreateFleetError{{
+					ErrorCode:    aws.String(code),
+					ErrorMessage: aws.String(randomdata.SillyName()),
+				}}}
+				_, err := NewInstanceProvider(fakeEC2API, DefaultLaunchIdempotencyWindow, DefaultLaunchTimeout).Create(context.Background(),
+					&LaunchTemplate{Id: aws.String("test-launch-template-id"), Version: aws.String(defaultLaunchTemplateVersion)},
+					nil, nil, &Constraints{}, "", nil,
+				)
+				var quotaExceededError *cloudprovider.QuotaExceededError
+				Expect(errors.As(err, &quotaExceededError)).To(BeTrue())
+				Expect(quotaExceededError.Quota).To(Equal(code))
+			}
+		})
+		It("should not retry quota errors", func() {
+			for _, code := range utils.QuotaExceededErrorCodes {
+				Expect(utils.NewRetryer().ShouldRetry(&request.Request{Error: awserr.New(code, randomdata.SillyName(), nil)})).To(BeFalse())
+			}
+		})
+	})
+	Context("SpotErrors", func() {
+		It("should return a configuration error when the spot max price is too low", func() {
+			fakeEC2API.CreateFleetOutput = &ec2.CreateFleetOutput{Errors: []*ec2.CreateFleetError{{
+				ErrorCode:    aws.String("SpotMaxPriceTooLow"),
+				ErrorMessage: aws.String(randomdata.SillyName()),
+			}}}
+			_, err := NewInstanceProvider(fakeEC2API, DefaultLaunchIdempotencyWindow, DefaultLaunchTimeout).Create(context.Background(),
+				&LaunchTemplate{Id: aws.String("test-launch-template-id"), Version: aws.String(defaultLaunchTemplateVersion)},
+				nil, nil, &Constraints{}, "", nil,
+			)
+			var configurationError *cloudprovider.ConfigurationError
+			Expect(errors.As(err, &configurationError)).To(BeTrue())
+			Expect(configurationError.Code).To(Equal("SpotMaxPriceTooLow"))
+		})
+		It("should return a quota error when the spot instance count is exceeded", func() {
+			fakeEC2API.CreateFleetOutput = &ec2.CreateFleetOutput{Errors: []*ec2.CreateFleetError{{
+				ErrorCode:    aws.String("MaxSpotInstanceCountExceeded"),
+				ErrorMessage: aws.String(randomdata.SillyName()),
+			}}}
+			_, err := NewInstanceProvider(fakeEC2API, DefaultLaunchIdempotencyWindow, DefaultLaunchTimeout).Create(context.Background(),
+				&LaunchTemplate{Id: aws.String("test-launch-template-id"), Version: aws.String(defaultLaunchTemplateVersion)},
+				nil, nil, &Constraints{}, "", nil,
+			)
+			var quotaExceededError *cloudprovider.QuotaExceededError
+			Expect(errors.As(err, &quotaExceededError)).To(BeTrue())
+			Expect(quotaExceededError.Quota).To(Equal("MaxSpotInstanceCountExceeded"))
+		})
+		It("should not retry configuration errors", func() {
+			for _, code := range utils.ConfigurationErrorCodes {
+				Expect(utils.NewRetryer().ShouldRetry(&request.Request{Error: awserr.New(code, randomdata.SillyName(), nil)})).To(BeFalse())
+			}
+		})
+	})
+	Context("LaunchTimeout", func() {
+		It("should cancel launches that exceed the launch timeout with a retryable error", func() {
+			fakeEC2API.CreateFleetDelay = time.Minute
+			_, err := NewInstanceProvider(fakeEC2API, DefaultLaunchIdempotencyWindow, 10*time.Millisecond).Create(context.Background(),
+				&LaunchTemplate{Id: aws.String("test-launch-template-id"), Version: aws.String(defaultLaunchTemplateVersion)},
+				nil, nil, &Constraints{}, "", nil,
+			)
+			var launchTimeoutError *cloudprovider.LaunchTimeoutError
+			Expect(errors.As(err, &launchTimeoutError)).To(BeTrue())
+			Expect(launchTimeoutError.Timeout).To(Equal(10 * time.Millisecond))
+			var quotaExceededError *cloudprovider.QuotaExceededError
+			Expect(errors.As(err, &quotaExceededError)).To(BeFalse())
+			var configurationError *cloudprovider.ConfigurationError
+			Expect(errors.As(err, &configurationError)).To(BeFalse())
+		})
+		It("should launch if fleet responds within the launch timeout", func() {
+			fakeEC2API.CreateFleetDelay = time.Millisecond
+			launched, err := NewInstanceProvider(fakeEC2API, DefaultLaunchIdempotencyWindow, time.Minute).Create(context.Background(),
+				&LaunchTemplate{Id: aws.String("test-launch-template-id"), Version: aws.String(defaultLaunchTemplateVersion)},
+				nil, nil, &Constraints{}, "", nil,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(launched.ID).ToNot(BeEmpty())
+		})
+	})
+	Context("LaunchRequestLogging", func() {
+		var logs *observer.ObservedLogs
+		var restoreLogger func()
+		BeforeEach(func() {
+			var core zapcore.Core
+			core, logs = observer.New(zapcore.DebugLevel)
+			restoreLogger = zap.ReplaceGlobals(zap.New(core))
+		})
+		AfterEach(func() {
+			restoreLogger()
+		})
+		It("should log the resolved fleet request at debug level", func() {
+			instanceType := &InstanceType{
+				InstanceTypeInfo: ec2.InstanceTypeInfo{InstanceType: aws.String("m5.large")},
+				ZoneOptions:      []string{"test-zone-1a"},
+			}
+			_, err := NewInstanceProvider(fakeEC2API, DefaultLaunchIdempotencyWindow, DefaultLaunchTimeout).Create(context.Background(),
+				&LaunchTemplate{Id: aws.String("test-launch-template-id"), Version: aws.String(defaultLaunchTemplateVersion)},
+				[]cloudprovider.InstanceType{instanceType},
+				map[string][]*ec2.Subnet{"test-zone-1a": {{SubnetId: aws.String("test-subnet-1")}}},
+				&Constraints{}, "", nil,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			entries := logs.FilterMessage(LaunchRequestMessage).All()
+			Expect(entries).To(HaveLen(1))
+			fields := entries[0].ContextMap()
+			Expect(fields).To(HaveKeyWithValue("launchTemplateId", "test-launch-template-id"))
+			Expect(fields).To(HaveKeyWithValue("launchTemplateVersion", defaultLaunchTemplateVersion))
+			Expect(fields).To(HaveKeyWithValue("capacityType", capacityTypeOnDemand))
+			Expect(fields).To(HaveKeyWithValue("instanceTypes", ConsistOf("m5.large")))
+			Expect(fields).To(HaveKeyWithValue("subnets", ConsistOf("test-subnet-1")))
+		})
+		It("should log launch templates' resolved fields with their user data hashed", func() {
+			fakeEC2API.DescribeLaunchTemplatesOutput = &ec2.DescribeLaunchTemplatesOutput{}
+			ExpectCreated(env.Client, provisioner)
+			constraints := Constraints(*provisioner.ConstraintsWithOverrides(&v1.Pod{}))
+			_, err := cloudProviderFactory.launchTemplateProvider.Get(context.Background(), provisioner, &constraints, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			entries := logs.FilterMessage(LaunchTemplateMessage).All()
+			Expect(entries).To(HaveLen(1))
+			fields := entries[0].ContextMap()
+			launchTemplateData := fakeEC2API.CalledWithCreateLaunchTemplateInput[0].LaunchTemplateData
+			Expect(fields).To(HaveKeyWithValue("imageId", aws.StringValue(launchTemplateData.ImageId)))
+			Expect(fields).To(HaveKeyWithValue("securityGroupIds", ConsistOf(aws.StringValueSlice(launchTemplateData.SecurityGroupIds))))
+			Expect(fields).To(HaveKey("userDataHash"))
+			for _, value := range fields {
+				Expect(value).ToNot(Equal(aws.StringValue(launchTemplateData.UserData)))
+			}
+		})
+	})
+	Context("Throttling", func() {
+		throttledRequest := func(operation string) *request.Request {
+			return &request.Request{
+				ClientInfo: metadata.ClientInfo{ServiceName: ec2.ServiceName},
+				Operation:  &request.Operation{Name: operation},
+				Error:      awserr.New("RequestLimitExceeded", randomdata.SillyName(), nil),
+			}
+		}
+		It("should count throttled requests", func() {
+			limiter := NewThrottlingRateLimiter(DefaultAPIQPS, DefaultAPIBurst)
+			before := testutil.ToFloat64(awsThrottledTotal.WithLabelValues(ec2.ServiceName, "CreateFleet"))
+			limiter.observe(throttledRequest("CreateFleet"))
+			limiter.observe(throttledRequest("CreateFleet"))
+			Expect(testutil.ToFloat64(awsThrottledTotal.WithLabelValues(ec2.ServiceName, "CreateFleet"))).To(BeNumerically("==", before+2))
+		})
+		It("should not count requests that failed for other reasons", func() {
+			limiter := NewThrottlingRateLimiter(DefaultAPIQPS, DefaultAPIBurst)
+			before := testutil.ToFloat64(awsThrottledTotal.WithLabelValues(ec2.ServiceName, "DescribeInstances"))
+			limiter.observe(&request.Request{
+				ClientInfo: metadata.ClientInfo{ServiceName: ec2.ServiceName},
+				Operation:  &request.Operation{Name: "DescribeInstances"},
+				Error:      awserr.New("InvalidInstanceID.NotFound", randomdata.SillyName(), nil),
+			})
+			Expect(testutil.ToFloat64(awsThrottledTotal.WithLabelValues(ec2.ServiceName, "DescribeInstances"))).To(BeNumerically("==", before))
+			Expect(limiter.Limit()).To(BeNumerically("==", DefaultAPIQPS))
+		})
+		It("should reduce the rate limit when throttled", func() {
+			limiter := NewThrottlingRateLimiter(DefaultAPIQPS, DefaultAPIBurst)
+			limiter.observe(throttledRequest("CreateFleet"))
+			Expect(limiter.Limit()).To(BeNumerically("==", DefaultAPIQPS/2))
+			for i := 0; i < 10; i++ {
+				limiter.observe(throttledRequest("CreateFleet"))
+			}
+			Expect(limiter.Limit()).To(BeNumerically("==", MinAPIQPS))
+		})
+		It("should gradually recover the rate limit without throttling", func() {
+			limiter := NewThrottlingRateLimiter(DefaultAPIQPS, DefaultAPIBurst)
+			limiter.observe(throttledRequest("CreateFleet"))
+			limiter.complete(&request.Request{})
+			Expect(limiter.Limit()).To(BeNumerically("==", DefaultAPIQPS/2))
+			limiter.recoveryInterval = 0
+			limiter.complete(&request.Request{})
+			Expect(limiter.Limit()).To(BeNumerically("==", DefaultAPIQPS/2+DefaultAPIQPS/10))
+			for i := 0; i < 10; i++ {
+				limiter.complete(&request.Request{})
+			}
+			Expect(limiter.Limit()).To(BeNumerically("==", DefaultAPIQPS))
+		})
+	})
+	Context("RequestErrorLogging", func() {
+		var logs *observer.ObservedLogs
+		var restoreLogger func()
+		BeforeEach(func() {
+			var core zapcore.Core
+			core, logs = observer.New(zapcore.ErrorLevel)
+			restoreLogger = zap.ReplaceGlobals(zap.New(core))
+		})
+		AfterEach(func() {
+			restoreLogger()
+		})
+		It("should log the request id of failed requests", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `<Response><Errors><Error><Code>InvalidParameterValue</Code><Message>test</Message></Error></Errors><RequestID>test-request-id</RequestID></Response>`)
+			}))
+			defer server.Close()
+			sess := withRequestErrorLogging(session.Must(session.NewSession(&aws.Config{
+				Region:      aws.String("test-region"),
+				Endpoint:    aws.String(server.URL),
+				Credentials: credentials.NewStaticCredentials("test-access-key", "test-secret-key", ""),
+				MaxRetries:  aws.Int(0),
+			})))
+			_, err := ec2.New(sess).DescribeInstances(&ec2.DescribeInstancesInput{})
+			Expect(err).To(HaveOccurred())
+			entries := logs.FilterMessage(RequestErrorMessage).All()
+			Expect(entries).To(HaveLen(1))
+			fields := entries[0].ContextMap()
+			Expect(fields).To(HaveKeyWithValue("service", ec2.ServiceName))
+			Expect(fields).To(HaveKeyWithValue("operation", "DescribeInstances"))
+			Expect(fields).To(HaveKeyWithValue("requestId", "test-request-id"))
+		})
+		It("should log errors that callers handle, and throttling, at debug level", func() {
+			for _, err := range []error{
+				awserr.New("InvalidLaunchTemplateName.NotFoundException", "test", nil),
+				awserr.New(iam.ErrCodeNoSuchEntityException, "test", nil),
+				awserr.New("RequestLimitExceeded", "test", nil),
+			} {
+				logRequestError(&request.Request{
+					ClientInfo: metadata.ClientInfo{ServiceName: ec2.ServiceName},
+					Operation:  &request.Operation{Name: "DescribeLaunchTemplates"},
+					Error:      err,
+				})
+			}
+			Expect(logs.FilterMessage(RequestErrorMessage).Len()).To(BeZero())
+		})
+		It("should not log successful requests", func() {
+			logRequestError(&request.Request{
+				ClientInfo: metadata.ClientInfo{ServiceName: ec2.ServiceName},
+				Operation:  &request.Operation{Name: "DescribeInstances"},
+				RequestID:  "test-request-id",
+			})
+			Expect(logs.FilterMessage(RequestErrorMessage).Len()).To(BeZero())
+		})
+	})
+	Context("Termination", func() {
+		nodeWithProviderID := func(providerID string) *v1.Node {
+			return &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: strings.ToLower(randomdata.SillyName())},
+				Spec:       v1.NodeSpec{ProviderID: providerID},
+			}
+		}
+		It("should only terminate nodes with aws provider ids", func() {
+			Expect(NewInstanceProvider(fakeEC2API, DefaultLaunchIdempotencyWindow, DefaultLaunchTimeout).Terminate(context.Background(), []*v1.Node{
+				nodeWithProviderID("aws:///test-zone-1a/i-0123456789abcdef0"),
+				nodeWithProviderID("gce://test-project/test-zone-1a/test-instance"),
+				nodeWithProviderID("kind://docker/kind/kind-worker"),
+				nodeWithProviderID("aws:///test-zone-1b/not-an-instance"),
+				nodeWithProviderID(""),
+				nodeWithProviderID("aws:///test-zone-1c/i-0fedcba9876543210"),
+			}, v1alpha1.TerminationReasonTTLEmpty)).To(Succeed())
+			Expect(fakeEC2API.CalledWithTerminateInstancesInput).To(HaveLen(1))
+			Expect(aws.StringValueSlice(fakeEC2API.CalledWithTerminateInstancesInput[0].InstanceIds)).To(ConsistOf(
+				"i-0123456789abcdef0", "i-0fedcba9876543210",
+			))
+		})
+		It("should not call ec2 if no nodes have aws provider ids", func() {
+			Expect(NewInstanceProvider(fakeEC2API, DefaultLaunchIdempotencyWindow, DefaultLaunchTimeout).Terminate(context.Background(), []*v1.Node{
+				nodeWithProviderID("fake:///test-node"),
+			}, v1alpha1.TerminationReasonTTLEmpty)).To(Succeed())
+			Expect(fakeEC2API.CalledWithCreateTagsInput).To(BeEmpty())
+			Expect(fakeEC2API.CalledWithTerminateInstancesInput).To(BeEmpty())
+		})
+		It("should tag instances with their termination reason before terminating them", func() {
+			ec2api := &taggingEC2API{EC2API: fakeEC2API}
+			Expect(NewInstanceProvider(ec2api, DefaultLaunchIdempotencyWindow, DefaultLaunchTimeout).Terminate(context.Background(), []*v1.Node{
+				nodeWithProviderID("aws:///test-zone-1a/i-0123456789abcdef0"),
+				nodeWithProviderID("fake:///test-node"),
+				nodeWithProviderID("aws:///test-zone-1c/i-0fedcba9876543210"),
+			}, v1alpha1.TerminationReasonDrainDeadline)).To(Succeed())
+			Expect(fakeEC2API.CalledWithCreateTagsInput).To(HaveLen(1))
+			input := fakeEC2API.CalledWithCreateTagsInput[0]
+			Expect(aws.StringValueSlice(input.Resources)).To(ConsistOf("i-0123456789abcdef0", "i-0fedcba9876543210"))
+			Expect(input.Tags).To(HaveLen(1))
+			Expect(aws.StringValue(input.Tags[0].Key)).To(Equal(TerminationReasonTagKey))
+			Expect(aws.StringValue(input.Tags[0].Value)).To(Equal(v1alpha1.TerminationReasonDrainDeadline))
+			Expect(ec2api.taggedBeforeTermination).To(Equal([]int{2}))
+		})
+		It("should not tag instances without a termination reason", func() {
+			Expect(NewInstanceProvider(fakeEC2API, DefaultLaunchIdempotencyWindow, DefaultLaunchTimeout).Terminate(context.Background(), []*v1.Node{
+				nodeWithProviderID("aws:///test-zone-1a/i-0123456789abcdef0"),
+			}, "")).To(Succeed())
+			Expect(fakeEC2API.CalledWithCreateTagsInput).To(BeEmpty())
+			Expect(fakeEC2API.CalledWithTerminateInstancesInput).To(HaveLen(1))
+		})
+		It("should terminate instances that fail to be tagged", func() {
+			ec2api := &taggingEC2API{EC2API: fakeEC2API, createTagsErr: errors.New("unauthorized")}
+			Expect(NewInstanceProvider(ec2api, DefaultLaunchIdempotencyWindow, DefaultLaunchTimeout).Terminate(context.Background(), []*v1.Node{
+				nodeWithProviderID("aws:///test-zone-1a/i-0123456789abcdef0"),
+			}, v1alpha1.TerminationReasonTTLEmpty)).To(Succeed())
+			Expect(fakeEC2API.CalledWithTerminateInstancesInput).To(HaveLen(1))
+		})
+	})
+	Context("UnavailableOfferings", func() {
+		var instance *ec2.Instance
+		BeforeEach(func() {
+			instance = &ec2.Instance{
+				InstanceId:     aws.String(randomdata.SillyName()),
+				Placement:      &ec2.Placement{AvailabilityZone: aws.String("test-zone-1b")},
+				PrivateDnsName: aws.String(strings.ToLower(randomdata.SillyName())),
+			}
+			fakeEC2API.CreateFleetOutput = &ec2.CreateFleetOutput{
+				Instances: []*ec2.CreateFleetInstance{{InstanceIds: []*string{instance.InstanceId}}},
+				Errors: []*ec2.CreateFleetError{
+					{
+						ErrorCode: aws.String("InsufficientInstanceCapacity"),
+						LaunchTemplateAndOverrides: &ec2.LaunchTemplateAndOverridesResponse{
+							Overrides: &ec2.FleetLaunchTemplateOverrides{InstanceType: aws.String("m5.large"), SubnetId: aws.String("test-subnet-1")},
+						},
+					},
+					{
+						ErrorCode: aws.String("InsufficientInstanceCapacity"),
+						LaunchTemplateAndOverrides: &ec2.LaunchTemplateAndOverridesResponse{
+							Overrides: &ec2.FleetLaunchTemplateOverrides{InstanceType: aws.String("m5.large"), AvailabilityZone: aws.String("test-zone-1c")},
+						},
+					},
+					{
+						ErrorCode: aws.String("InvalidParameterValue"),
+						LaunchTemplateAndOverrides: &ec2.LaunchTemplateAndOverridesResponse{
+							Overrides: &ec2.FleetLaunchTemplateOverrides{InstanceType: aws.String("m5.xlarge"), SubnetId: aws.String("test-subnet-1")},
+						},
+					},
+				},
+			}
+			fakeEC2API.DescribeInstancesOutput = &ec2.DescribeInstancesOutput{
+				Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{instance}}},
+			}
+		})
+		It("should report offerings that failed due to insufficient capacity", func() {
+			instanceProvider := NewInstanceProvider(fakeEC2API, DefaultLaunchIdempotencyWindow, DefaultLaunchTimeout)
+			Expect(instanceProvider.GetUnavailableOfferings()).To(BeEmpty())
+			_, err := instanceProvider.Create(context.Background(),
+				&LaunchTemplate{Id: aws.String("test-launch-template-id"), Version: aws.String(defaultLaunchTemplateVersion)},
+				nil, map[string][]*ec2.Subnet{"test-zone-1a": {{SubnetId: aws.String("test-subnet-1")}}}, &Constraints{}, "", nil,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			offerings := instanceProvider.GetUnavailableOfferings()
+			Expect(offerings).To(HaveLen(2))
+			Expect(offerings[0].InstanceType).To(Equal("m5.large"))
+			Expect(offerings[0].Zone).To(Equal("test-zone-1a"))
+			Expect(offerings[0].LastObservedTime.Inner.IsZero()).To(BeFalse())
+			Expect(offerings[1].InstanceType).To(Equal("m5.large"))
+			Expect(offerings[1].Zone).To(Equal("test-zone-1c"))
+		})
+		It("should expire offerings that haven't failed recently", func() {
+			instanceProvider := &InstanceProvider{ec2api: fakeEC2API, unavailableOfferings: cache.New(time.Millisecond, CacheCleanupInterval), now: time.Now}
+			_, err := instanceProvider.Create(context.Background(),
+				&LaunchTemplate{Id: aws.String("test-launch-template-id"), Version: aws.String(defaultLaunchTemplateVersion)},
+				nil, nil, &Constraints{}, "", nil,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(instanceProvider.GetUnavailableOfferings).Should(BeEmpty())
+		})
+		It("should summarize unavailable offerings in the provisioner's status", func() {
+			// Setup
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			ExpectNodeExists(env.Client, aws.StringValue(instance.PrivateDnsName))
+			Eventually(func() []string {
+				updated := &v1alpha1.Provisioner{}
+				Expect(env.Client.Get(context.Background(), client.ObjectKey{Name: provisioner.Name, Namespace: provisioner.Namespace}, updated)).To(Succeed())
+				offerings := []string{}
+				for _, offering := range updated.Status.UnavailableOfferings {
+					offerings = append(offerings, fmt.Sprintf("%s/%s", offering.InstanceType, offering.Zone))
+				}
+				return offerings
+			}, ReconcilerPropagationTime, RequestInterval).Should(ConsistOf("m5.large/test-zone-1a", "m5.large/test-zone-1c"))
+		})
+	})
+	Context("LaunchedInstances", func() {
+		var instance *ec2.Instance
+		BeforeEach(func() {
+			instance = &ec2.Instance{
+				InstanceId:     aws.String(randomdata.SillyName()),
+				InstanceType:   aws.String("m5.xlarge"),
+				Placement:      &ec2.Placement{AvailabilityZone: aws.String("test-zone-1b")},
+				PrivateDnsName: aws.String(strings.ToLower(randomdata.SillyName())),
+			}
+			fakeEC2API.CreateFleetOutput = &ec2.CreateFleetOutput{
+				Instances: []*ec2.CreateFleetInstance{{
+					InstanceIds:  []*string{instance.InstanceId},
+					InstanceType: aws.String("m5.xlarge"),
+					LaunchTemplateAndOverrides: &ec2.LaunchTemplateAndOverridesResponse{
+						Overrides: &ec2.FleetLaunchTemplateOverrides{InstanceType: aws.String("m5.xlarge"), SubnetId: aws.String("test-subnet-2")},
+					},
+				}},
+			}
+			fakeEC2API.DescribeInstancesOutput = &ec2.DescribeInstancesOutput{
+				Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{instance}}},
+			}
+		})
+		It("should return the instance type and zone that fleet fulfilled", func() {
+			launched, err := NewInstanceProvider(fakeEC2API, DefaultLaunchIdempotencyWindow, DefaultLaunchTimeout).Create(context.Background(),
+				&LaunchTemplate{Id: aws.String("test-launch-template-id"), Version: aws.String(defaultLaunchTemplateVersion)},
+				nil, map[string][]*ec2.Subnet{
+					"test-zone-1a": {{SubnetId: aws.String("test-subnet-1")}},
+					"test-zone-1b": {{SubnetId: aws.String("test-subnet-2")}},
+				}, &Constraints{}, "", nil,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(launched).To(Equal(&LaunchedInstance{
+				ID:           aws.StringValue(instance.InstanceId),
+				InstanceType: "m5.xlarge",
+				Zone:         "test-zone-1b",
+			}))
+		})
+		It("should label nodes with the launched instance type and zone", func() {
+			// Setup
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			// Assertions
+			node := ExpectNodeExists(env.Client, aws.StringValue(instance.PrivateDnsName))
+			Expect(node.Labels).To(HaveKeyWithValue(v1alpha1.InstanceTypeLabelKey, "m5.xlarge"))
+			Expect(node.Labels).To(HaveKeyWithValue(v1alpha1.ZoneLabelKey, "test-zone-1b"))
+		})
+	})
+	Context("Subnets", func() {
+		It("should report provisioners whose cluster has no subnets", func() {
+			fakeEC2API.DescribeSubnetsOutput = &ec2.DescribeSubnetsOutput{}
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			Eventually(func() bool {
+				updated := &v1alpha1.Provisioner{}
+				Expect(env.Client.Get(context.Background(), client.ObjectKey{Name: provisioner.Name, Namespace: provisioner.Namespace}, updated)).To(Succeed())
+				condition := updated.StatusConditions().GetCondition(v1alpha1.SubnetsMatched)
+				return condition.IsFalse() && condition.Reason == "NoSubnetsMatched"
+			}, ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+			Eventually(func() []string {
+				events := &v1.EventList{}
+				Expect(env.Client.List(context.Background(), events, client.InNamespace(provisioner.Namespace))).To(Succeed())
+				reasons := []string{}
+				for _, event := range events.Items {
+					if event.InvolvedObject.Name == provisioner.Name {
+						reasons = append(reasons, event.Reason)
+					}
+				}
+				return reasons
+			}, ReconcilerPropagationTime, RequestInterval).Should(ContainElement("NoSubnetsMatched"))
+		})
+		It("should mark subnets as matched when they're discovered", func() {
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			Eventually(func() bool {
+				updated := &v1alpha1.Provisioner{}
+				Expect(env.Client.Get(context.Background(), client.ObjectKey{Name: provisioner.Name, Namespace: provisioner.Namespace}, updated)).To(Succeed())
+				return updated.StatusConditions().GetCondition(v1alpha1.SubnetsMatched).IsTrue()
+			}, ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+		})
+	})
+	Context("InstanceProfile", func() {
+		nodesConfigured := func() *apis.Condition {
+			updated := &v1alpha1.Provisioner{}
+			Expect(env.Client.Get(context.Background(), client.ObjectKey{Name: provisioner.Name, Namespace: provisioner.Namespace}, updated)).To(Succeed())
+			return updated.StatusConditions().GetCondition(v1alpha1.NodesConfigured)
+		}
+		It("should mark nodes as configured if the instance profile has the required policies", func() {
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			Eventually(func() bool { return nodesConfigured().IsTrue() }, ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+		})
+		It("should admit provisioners but warn if the instance profile is missing a required policy", func() {
+			fakeIAMAPI.ListAttachedRolePoliciesOutput = &iam.ListAttachedRolePoliciesOutput{AttachedPolicies: []*iam.AttachedPolicy{
+				{PolicyName: aws.String("AmazonEKSWorkerNodePolicy"), PolicyArn: aws.String("arn:aws:iam::aws:policy/AmazonEKSWorkerNodePolicy")},
+			}}
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			Eventually(func() bool { return nodesConfigured().IsFalse() }, ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+			Expect(nodesConfigured().Message).To(ContainSubstring("AmazonEC2ContainerRegistryReadOnly"))
+			Expect(nodesConfigured().Message).ToNot(ContainSubstring("AmazonEKSWorkerNodePolicy"))
+			Eventually(func() []string {
+				events := &v1.EventList{}
+				Expect(env.Client.List(context.Background(), events, client.InNamespace(provisioner.Namespace))).To(Succeed())
+				reasons := []string{}
+				for _, event := range events.Items {
+					if event.InvolvedObject.Name == provisioner.Name {
+						reasons = append(reasons, event.Reason)
+					}
+				}
+				return reasons
+			}, ReconcilerPropagationTime, RequestInterval).Should(ContainElement("NodesMisconfigured"))
+		})
+		It("should skip the check if the instance profile doesn't exist", func() {
+			fakeIAMAPI.WantErr = awserr.New(iam.ErrCodeNoSuchEntityException, "not found", nil)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			Eventually(func() bool { return nodesConfigured().IsTrue() }, ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+		})
+		It("should skip the check if iam permissions are denied", func() {
+			fakeIAMAPI.WantErr = awserr.New("AccessDenied", "not authorized", nil)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			Eventually(func() bool { return nodesConfigured().IsTrue() }, ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+		})
+		It("should skip the check for custom launch templates", func() {
+			fakeIAMAPI.ListAttachedRolePoliciesOutput = &iam.ListAttachedRolePoliciesOutput{}
+			provisioner.Spec.Labels = map[string]string{LaunchTemplateIdLabel: "test-launch-template-id"}
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			Eventually(func() bool { return nodesConfigured().IsTrue() }, ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+		})
+		It("should skip the check if it's disabled", func() {
+			fakeIAMAPI.ListAttachedRolePoliciesOutput = &iam.ListAttachedRolePoliciesOutput{}
+			provider := NewInstanceProfileProvider(fakeIAMAPI, true)
+			Expect(provider.Check(context.Background(), "test-cluster")).To(BeEmpty())
+			Expect(NewInstanceProfileProvider(fakeIAMAPI, false).Check(context.Background(), "test-cluster")).ToNot(BeEmpty())
+		})
+	})
+	Context("SubnetSelection", func() {
+		var zonalSubnets map[string][]*ec2.Subnet
+		BeforeEach(func() {
+			zonalSubnets = map[string][]*ec2.Subnet{
+				// 50% of the /24s' 251 usable addresses are in use
+				"test-zone-1a": {
+					{SubnetId: aws.String("test-subnet-1"), CidrBlock: aws.String("10.0.1.0/24"), AvailableIpAddressCount: aws.Int64(100)},
+					{SubnetId: aws.String("test-subnet-2"), CidrBlock: aws.String("10.0.2.0/24"), AvailableIpAddressCount: aws.Int64(151)},
+				},
+				// 20% of the /24s' 251 usable addresses are in use
+				"test-zone-1b": {
+					{SubnetId: aws.String("test-subnet-3"), CidrBlock: aws.String("10.0.3.0/24"), AvailableIpAddressCount: aws.Int64(250)},
+					{SubnetId: aws.String("test-subnet-4"), CidrBlock: aws.String("10.0.4.0/24"), AvailableIpAddressCount: aws.Int64(152)},
+				},
+			}
+		})
+		subnetIdsOf := func(selected map[string][]*ec2.Subnet) map[string][]string {
+			ids := map[string][]string{}
+			for zone, subnets := range selected {
+				for _, subnet := range subnets {
+					ids[zone] = append(ids[zone], aws.StringValue(subnet.SubnetId))
+				}
+			}
+			return ids
+		}
+		It("should select the subnet with the most free ips in each zone by default", func() {
+			selected := NewSubnetProvider(fakeEC2API, "test-region").Select(zonalSubnets, "")
+			Expect(subnetIdsOf(selected)).To(Equal(map[string][]string{
+				"test-zone-1a": {"test-subnet-2"},
+				"test-zone-1b": {"test-subnet-3"},
+			}))
+			Expect(NewSubnetProvider(fakeEC2API, "test-region").Select(zonalSubnets, v1alpha1.SubnetSelectionPolicyMostFreeIPs)).To(Equal(selected))
+		})
+		It("should rotate through each zone's subnets", func() {
+			subnetProvider := NewSubnetProvider(fakeEC2API, "test-region")
+			Expect(subnetIdsOf(subnetProvider.Select(zonalSubnets, v1alpha1.SubnetSelectionPolicyRoundRobin))).To(Equal(map[string][]string{
+				"test-zone-1a": {"test-subnet-1"},
+				"test-zone-1b": {"test-subnet-3"},
+			}))
+			Expect(subnetIdsOf(subnetProvider.Select(zonalSubnets, v1alpha1.SubnetSelectionPolicyRoundRobin))).To(Equal(map[string][]string{
+				"test-zone-1a": {"test-subnet-2"},
+				"test-zone-1b": {"test-subnet-4"},
+			}))
+			Expect(subnetIdsOf(subnetProvider.Select(zonalSubnets, v1alpha1.SubnetSelectionPolicyRoundRobin))).To(Equal(map[string][]string{
+				"test-zone-1a": {"test-subnet-1"},
+				"test-zone-1b": {"test-subnet-3"},
+			}))
+		})
+		It("should select the subnet with the most free ips in the least utilized zone", func() {
+			selected := NewSubnetProvider(fakeEC2API, "test-region").Select(zonalSubnets, v1alpha1.SubnetSelectionPolicyLeastUtilizedZone)
+			Expect(subnetIdsOf(selected)).To(Equal(map[string][]string{
+				"test-zone-1b": {"test-subnet-3"},
+			}))
+		})
+		It("should launch into the selected subnets", func() {
+			fakeEC2API.DescribeSubnetsOutput = &ec2.DescribeSubnetsOutput{}
+			for zone, subnets := range zonalSubnets {
+				for _, subnet := range subnets {
+					subnet.AvailabilityZone = aws.String(zone)
+					fakeEC2API.DescribeSubnetsOutput.Subnets = append(fakeEC2API.DescribeSubnetsOutput.Subnets, subnet)
+				}
+			}
+			provisioner.Spec.SubnetSelectionPolicy = aws.String(v1alpha1.SubnetSelectionPolicyLeastUtilizedZone)
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+			ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+			Expect(fakeEC2API.CalledWithCreateFleetInput).To(HaveLen(1))
+			Expect(fakeEC2API.CalledWithCreateFleetInput[0].LaunchTemplateConfigs[0].Overrides).ToNot(BeEmpty())
+			for _, override := range fakeEC2API.CalledWithCreateFleetInput[0].LaunchTemplateConfigs[0].Overrides {
+				Expect(aws.StringValue(override.SubnetId)).To(Equal("test-subnet-3"))
+			}
+		})
+	})
+	Context("Idempotency", func() {
+		var instanceProvider *InstanceProvider
+		var now time.Time
+		var launchTemplate *LaunchTemplate
+		BeforeEach(func() {
+			now = time.Unix(1600000000, 0)
+			instanceProvider = &InstanceProvider{
+				ec2api:               fakeEC2API,
+				unavailableOfferings: cache.New(UnavailableOfferingsTTL, CacheCleanupInterval),
+				idempotencyWindow:    time.Minute,
+				now:                  func() time.Time { return now },
+			}
+			launchTemplate = &LaunchTemplate{Id: aws.String("test-launch-template-id"), Version: aws.String(defaultLaunchTemplateVersion)}
+		})
+		create := func(pods ...*v1.Pod) *string {
+			_, err := instanceProvider.Create(context.Background(), launchTemplate, nil, nil, &Constraints{}, "", pods)
+			Expect(err).ToNot(HaveOccurred())
+			return fakeEC2API.CalledWithCreateFleetInput[len(fakeEC2API.CalledWithCreateFleetInput)-1].ClientToken
+		}
+		It("should reuse client tokens for the same pods within a window", func() {
+			pods := []*v1.Pod{test.PendingPod(), test.PendingPod()}
+			pods[0].UID, pods[1].UID = "pod-a", "pod-b"
+			token := create(pods...)
+			Expect(token).ToNot(BeNil())
+			Expect(len(aws.StringValue(token))).To(BeNumerically("<=", 64))
+			now = now.Add(30 * time.Second)
+			Expect(create(pods[1], pods[0])).To(Equal(token))
+		})
+		It("should generate distinct client tokens for different pods", func() {
+			podA, podB := test.PendingPod(), test.PendingPod()
+			podA.UID, podB.UID = "pod-a", "pod-b"
+			Expect(create(podA)).ToNot(Equal(create(podB)))
+		})
+		It("should generate distinct client tokens across windows", func() {
+			pod := test.PendingPod()
+			pod.UID = "pod-a"
+			token := create(pod)
+			now = now.Add(time.Minute)
+			Expect(create(pod)).ToNot(Equal(token))
+		})
+		It("should not set a client token without pods", func() {
+			Expect(create()).To(BeNil())
+		})
+		It("should launch again when a launch is retried after insufficient capacity", func() {
+			pod := test.PendingPod()
+			pod.UID = "pod-a"
+			pod.Annotations = map[string]string{v1alpha1.LaunchIntentKey: now.Format(time.RFC3339)}
+			subnets := map[string][]*ec2.Subnet{
+				"test-zone-1a": {{SubnetId: aws.String("test-subnet-1")}},
+				"test-zone-1b": {{SubnetId: aws.String("test-subnet-2")}},
+			}
+			instanceTypes := []cloudprovider.InstanceType{
+				&InstanceType{InstanceTypeInfo: ec2.InstanceTypeInfo{InstanceType: aws.String("m5.large")}, ZoneOptions: []string{"test-zone-1a", "test-zone-1b"}},
+			}
+			fakeEC2API.CreateFleetOutput = &ec2.CreateFleetOutput{Errors: []*ec2.CreateFleetError{{
+				ErrorCode: aws.String("InsufficientInstanceCapacity"),
+				LaunchTemplateAndOverrides: &ec2.LaunchTemplateAndOverridesResponse{
+					Overrides: &ec2.FleetLaunchTemplateOverrides{InstanceType: aws.String("m5.large"), SubnetId: aws.String("test-subnet-1")},
+				},
+			}}}
+			_, err := instanceProvider.Create(context.Background(), launchTemplate, instanceTypes, subnets, &Constraints{}, "", []*v1.Pod{pod})
+			Expect(err).To(HaveOccurred())
+			failed := fakeEC2API.CalledWithCreateFleetInput[0].ClientToken
+			Expect(instanceProvider.GetUnavailableOfferings()).To(HaveLen(1))
+
+			// The retry excludes the unavailable offering within the same window
+			// and launch intent
+			fakeEC2API.CreateFleetOutput = nil
+			instanceTypes[0].(*InstanceType).ZoneOptions = []string{"test-zone-1b"}
+			launched, err := instanceProvider.Create(context.Background(), launchTemplate, instanceTypes, subnets, &Constraints{}, "", []*v1.Pod{pod})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeEC2API.CalledWithCreateFleetInput[1].ClientToken).ToNot(Equal(failed))
+			Expect(launched.InstanceType).To(Equal("m5.large"))
+			Expect(fakeEC2API.Instances).To(HaveLen(1))
+		})
+		It("should reconcile a launch interrupted by a restart rather than launching again", func() {
+			pods := []*v1.Pod{test.PendingPod(), test.PendingPod()}
+			pods[0].UID, pods[1].UID = "pod-a", "pod-b"
+			pods[0].Annotations = map[string]string{v1alpha1.LaunchIntentKey: now.Format(time.RFC3339)}
+			launched, err := instanceProvider.Create(context.Background(), launchTemplate, nil, nil, &Constraints{}, "", pods)
+			Expect(err).ToNot(HaveOccurred())
+
+			// The controller restarts before it creates the node, and launches
+			// for the same pods again after several windows
+			now = now.Add(5 * time.Minute)
+			restarted := NewInstanceProvider(fakeEC2API, time.Minute, DefaultLaunchTimeout)
+			restarted.now = func() time.Time { return now }
+			relaunched, err := restarted.Create(context.Background(), launchTemplate, nil, nil, &Constraints{}, "", pods)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(relaunched.ID).To(Equal(launched.ID))
+			Expect(fakeEC2API.Instances).To(HaveLen(1))
+		})
+	})
+	Context("Factory", func() {
+		It("should report all setup errors at once", func() {
+			negative := -1
+			_, err := NewFactory(cloudprovider.Options{
+				LaunchTemplateNamePrefix: "invalid prefix!",
+				VMMemoryOverheadFraction: ptr.Float64(1.5),
+				LaunchIdempotencyWindow:  ptr.Duration(-time.Minute),
+				LaunchTimeout:            ptr.Duration(-time.Minute),
+				MaxConnsPerHost:          &negative,
+				MaxIdleConnsPerHost:      &negative,
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(multierr.Errors(err)).To(HaveLen(8))
+			Expect(err.Error()).To(ContainSubstring("launch template name prefix"))
+			Expect(err.Error()).To(ContainSubstring("vm memory overhead fraction"))
+			Expect(err.Error()).To(ContainSubstring("launch idempotency window"))
+			Expect(err.Error()).To(ContainSubstring("launch timeout"))
+			Expect(err.Error()).To(ContainSubstring("max conns per host"))
+			Expect(err.Error()).To(ContainSubstring("max idle conns per host"))
+			Expect(err.Error()).To(ContainSubstring("kube client is required"))
+			Expect(err.Error()).To(ContainSubstring("kube client set is required"))
+		})
+		It("should succeed for valid options", func() {
+			os.Setenv("AWS_REGION", testRegion)
+			defer os.Unsetenv("AWS_REGION")
+			factory, err := NewFactory(cloudprovider.Options{
+				Client:                   env.Client,
+				ClientSet:                kubernetes.NewForConfigOrDie(env.Manager.GetConfig()),
+				LaunchTemplateNamePrefix: "test-prefix",
+				VMMemoryOverheadFraction: ptr.Float64(0.1),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(factory.subnetProvider.region).To(Equal(testRegion))
+			Expect(factory.launchTemplateProvider.namePrefix).To(Equal("test-prefix"))
+		})
+		It("should apply connection limits to the AWS clients' transport", func() {
+			os.Setenv("AWS_REGION", testRegion)
+			defer os.Unsetenv("AWS_REGION")
+			maxConns, maxIdleConns := 50, 25
+			factory, err := NewFactory(cloudprovider.Options{
+				Client:              env.Client,
+				ClientSet:           kubernetes.NewForConfigOrDie(env.Manager.GetConfig()),
+				MaxConnsPerHost:     &maxConns,
+				MaxIdleConnsPerHost: &maxIdleConns,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			transport := factory.instanceProvider.ec2api.(*ec2.EC2).Config.HTTPClient.Transport.(*http.Transport)
+			Expect(transport.MaxConnsPerHost).To(Equal(50))
+			Expect(transport.MaxIdleConnsPerHost).To(Equal(25))
+		})
+		It("should keep more idle connections per host than the stdlib by default", func() {
+			transport := newHTTPClient(cloudprovider.Options{}).Transport.(*http.Transport)
+			Expect(transport.MaxIdleConnsPerHost).To(Equal(DefaultMaxIdleConnsPerHost))
+			Expect(transport.MaxIdleConnsPerHost).To(BeNumerically(">", http.DefaultMaxIdleConnsPerHost))
+			Expect(transport.MaxConnsPerHost).To(BeZero())
+		})
+	})
+	Context("SpotPools", func() {
+		spotInstance := func(instanceType string, zone string) *ec2.Instance {
+			return &ec2.Instance{
+				InstanceId:        aws.String(randomdata.SillyName()),
+				InstanceType:      aws.String(instanceType),
+				InstanceLifecycle: aws.String(ec2.InstanceLifecycleTypeSpot),
+				Placement:         &ec2.Placement{AvailabilityZone: aws.String(zone)},
+			}
+		}
+		It("should report the number of distinct spot pools and their instances", func() {
+			factory := &Factory{kubeClient: env.Client, instanceProvider: NewInstanceProvider(fakeEC2API, DefaultLaunchIdempotencyWindow, DefaultLaunchTimeout)}
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			fakeEC2API.DescribeInstancesOutput = &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{
+				spotInstance("m5.large", "test-zone-1a"),
+				spotInstance("m5.large", "test-zone-1a"),
+				spotInstance("m5.large", "test-zone-1b"),
+				spotInstance("m5.xlarge", "test-zone-1a"),
+				{
+					InstanceId:   aws.String(randomdata.SillyName()),
+					InstanceType: aws.String("c5.large"),
+					Placement:    &ec2.Placement{AvailabilityZone: aws.String("test-zone-1c")},
+				},
+			}}}}
+			factory.reportSpotPools(context.Background())
+
+			clusterName := provisioner.Spec.Cluster.Name
+			Expect(testutil.ToFloat64(spotPoolsActive.WithLabelValues(clusterName))).To(BeNumerically("==", 3))
+			Expect(testutil.ToFloat64(spotPoolInstances.WithLabelValues(clusterName, "m5.large", "test-zone-1a"))).To(BeNumerically("==", 2))
+			Expect(testutil.ToFloat64(spotPoolInstances.WithLabelValues(clusterName, "m5.large", "test-zone-1b"))).To(BeNumerically("==", 1))
+			Expect(testutil.ToFloat64(spotPoolInstances.WithLabelValues(clusterName, "m5.xlarge", "test-zone-1a"))).To(BeNumerically("==", 1))
+			Expect(testutil.CollectAndCount(spotPoolInstances)).To(Equal(3))
+		})
+	})
+	Context("RoleARN", func() {
+		var factory *Factory
+		capacityFor := func(roleARN string) *Capacity {
+			p := provisioner.DeepCopy()
+			if roleARN != "" {
+				p.Annotations = map[string]string{RoleARNAnnotation: roleARN}
+			}
+			return factory.CapacityFor(p).(*Capacity)
+		}
+		BeforeEach(func() {
+			factory = newFactory(session.Must(session.NewSession(&aws.Config{
+				Region:      aws.String(testRegion),
+				Credentials: credentials.NewStaticCredentials("test-access-key", "test-secret-key", ""),
+			})), cloudprovider.Options{Client: env.Client})
+		})
+		It("should use distinct clients for provisioners with different roles", func() {
+			first := capacityFor("arn:aws:iam::111111111111:role/first")
+			second := capacityFor("arn:aws:iam::222222222222:role/second")
+			Expect(first.instanceProvider.ec2api).ToNot(BeIdenticalTo(second.instanceProvider.ec2api))
+			Expect(first.instanceTypeProvider).ToNot(BeIdenticalTo(second.instanceTypeProvider))
+			Expect(first.instanceProfileProvider).ToNot(BeIdenticalTo(second.instanceProfileProvider))
+			Expect(first.instanceProvider.ec2api).ToNot(BeIdenticalTo(capacityFor("").instanceProvider.ec2api))
+			Expect(first.instanceProvider.ec2api.(*ec2.EC2).Config.Credentials).ToNot(BeIdenticalTo(factory.session.Config.Credentials))
+		})
+		It("should cache the clients of each role", func() {
+			roleARN := "arn:aws:iam::111111111111:role/first"
+			first := capacityFor(roleARN)
+			Expect(capacityFor(roleARN).instanceProvider.ec2api).To(BeIdenticalTo(first.instanceProvider.ec2api))
+			Expect(capacityFor(roleARN).launchTemplateProvider).To(BeIdenticalTo(first.launchTemplateProvider))
+			Expect(factory.roleScoped).To(HaveLen(1))
+		})
+		It("should notify controllers of role-scoped changes through the parent's channel", func() {
+			Expect(factory.forRole("arn:aws:iam::111111111111:role/first").Notify()).To(BeIdenticalTo(factory.Notify()))
+		})
+		It("should throttle the requests of every role with the parent's rate limiter", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprint(w, `<Response><Errors><Error><Code>RequestLimitExceeded</Code><Message>test</Message></Error></Errors><RequestID>test-request-id</RequestID></Response>`)
+			}))
+			defer server.Close()
+			limiter := NewThrottlingRateLimiter(DefaultAPIQPS, DefaultAPIBurst)
+			factory = newFactory(withThrottling(session.Must(session.NewSession(&aws.Config{
+				Region:      aws.String(testRegion),
+				Endpoint:    aws.String(server.URL),
+				Credentials: credentials.NewStaticCredentials("test-access-key", "test-secret-key", ""),
+				MaxRetries:  aws.Int(0),
+			})), limiter), cloudprovider.Options{Client: env.Client})
+			ec2api := capacityFor("arn:aws:iam::111111111111:role/first").instanceProvider.ec2api.(*ec2.EC2)
+			// Sign with static credentials rather than assuming the role
+			ec2api.Config.Credentials = credentials.NewStaticCredentials("test-access-key", "test-secret-key", "")
+			_, err := ec2api.DescribeInstances(&ec2.DescribeInstancesInput{})
+			Expect(err).To(HaveOccurred())
+			Expect(limiter.Limit()).To(BeNumerically("==", DefaultAPIQPS/2))
+		})
+		It("should include role-scoped caches in the debug endpoint", func() {
+			roleARN := "arn:aws:iam::111111111111:role/first"
+			caches := factory.caches()
+			Expect(caches).ToNot(HaveKey(roleARN + "/subnets"))
+			role := factory.forRole(roleARN)
+			caches = factory.caches()
+			Expect(caches).To(HaveKeyWithValue(roleARN+"/subnets", BeIdenticalTo(role.subnetProvider.cache)))
+			Expect(caches).To(HaveKeyWithValue("subnets", BeIdenticalTo(factory.subnetProvider.cache)))
+		})
+		It("should validate role ARNs", func() {
+			for _, value := range []string{"arn:aws:iam::111111111111:role/first", "arn:aws:iam::111111111111:role/path/first"} {
+				Expect((&Capacity{provisioner: &v1alpha1.Provisioner{ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{RoleARNAnnotation: value},
+				}}}).validateRoleARNAnnotation()).To(Succeed())
+			}
+			for _, value := range []string{randomdata.SillyName(), "arn:aws:iam::111111111111:user/first", "arn:aws:s3:::role/first"} {
+				Expect((&Capacity{provisioner: &v1alpha1.Provisioner{ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{RoleARNAnnotation: value},
+				}}}).validateRoleARNAnnotation()).ToNot(Succeed())
+			}
+		})
+	})
+	Context("Interruption", func() {
+		var sqsapi *fake.SQSAPI
+		var handler *InterruptionHandler
+		BeforeEach(func() {
+			sqsapi = &fake.SQSAPI{QueueUrlOutput: sqs.GetQueueUrlOutput{QueueUrl: aws.String("https://sqs.test-region-1/test-queue")}}
+			handler = NewInterruptionHandler(sqsapi, env.Client, "test-queue", v1alpha1.DefaultManagedLabelKey, true)
+		})
+		noticeFor := func(detailType string, instanceID string) *sqs.Message {
+			return &sqs.Message{
+				MessageId:     aws.String(randomdata.SillyName()),
+				ReceiptHandle: aws.String(instanceID),
+				Body:          aws.String(fmt.Sprintf(`{"detail-type": %q, "source": "aws.ec2", "detail": {"instance-id": %q}}`, detailType, instanceID)),
+			}
+		}
+		managedNode := func(instanceID string, labels map[string]string) *v1.Node {
+			node := test.NodeWith(test.NodeOptions{
+				Labels:     functional.UnionStringMaps(map[string]string{v1alpha1.DefaultManagedLabelKey: "true"}, labels),
+				ProviderID: fmt.Sprintf("aws:///test-zone-1a/%s", instanceID),
+			})
+			ExpectCreatedWithStatus(env.Client, node)
+			Eventually(func() (*v1.Node, error) {
+				return handler.getNode(context.Background(), instanceID)
+			}, ReconcilerPropagationTime, RequestInterval).ShouldNot(BeNil())
+			return node
+		}
+		It("should mark the nodes of interrupted instances for involuntary disruption", func() {
+			interrupted := managedNode("i-0123456789abcdef0", nil)
+			rebalanced := managedNode("i-0fedcba9876543210", nil)
+			sqsapi.Messages = []*sqs.Message{
+				noticeFor(SpotInterruptionDetailType, "i-0123456789abcdef0"),
+				noticeFor(RebalanceRecommendationDetailType, "i-0fedcba9876543210"),
+			}
+			Expect(handler.poll(context.Background())).To(Succeed())
+			for _, node := range []*v1.Node{interrupted, rebalanced} {
+				Eventually(func() map[string]string {
+					return ExpectNodeExists(env.Client, node.Name).Annotations
+				}, ReconcilerPropagationTime, RequestInterval).Should(HaveKeyWithValue(v1alpha1.ProvisionerDisruptionKey, v1alpha1.DisruptionInvoluntary))
+				Expect(ExpectNodeExists(env.Client, node.Name).Labels).To(HaveKeyWithValue(v1alpha1.ProvisionerPhaseLabel, v1alpha1.ProvisionerTerminablePhase))
+			}
+			Expect(sqsapi.CalledWithDeleteMessageInput).To(HaveLen(2))
+		})
+		It("should ignore rebalance recommendations unless they're handled", func() {
+			handler = NewInterruptionHandler(sqsapi, env.Client, "test-queue", v1alpha1.DefaultManagedLabelKey, false)
+			interrupted := managedNode("i-0123456789abcdef0", nil)
+			rebalanced := managedNode("i-0fedcba9876543210", nil)
+			sqsapi.Messages = []*sqs.Message{
+				noticeFor(SpotInterruptionDetailType, "i-0123456789abcdef0"),
+				noticeFor(RebalanceRecommendationDetailType, "i-0fedcba9876543210"),
+			}
+			Expect(handler.poll(context.Background())).To(Succeed())
+			Eventually(func() map[string]string {
+				return ExpectNodeExists(env.Client, interrupted.Name).Annotations
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveKeyWithValue(v1alpha1.ProvisionerDisruptionKey, v1alpha1.DisruptionInvoluntary))
+			Expect(ExpectNodeExists(env.Client, rebalanced.Name).Annotations).ToNot(HaveKey(v1alpha1.ProvisionerDisruptionKey))
+			Expect(ExpectNodeExists(env.Client, rebalanced.Name).Labels).ToNot(HaveKey(v1alpha1.ProvisionerPhaseLabel))
+			Expect(sqsapi.CalledWithDeleteMessageInput).To(HaveLen(2))
+		})
+		It("should keep draining nodes draining", func() {
+			node := managedNode("i-0123456789abcdef0", map[string]string{v1alpha1.ProvisionerPhaseLabel: v1alpha1.ProvisionerDrainingPhase})
+			sqsapi.Messages = []*sqs.Message{noticeFor(SpotInterruptionDetailType, "i-0123456789abcdef0")}
+			Expect(handler.poll(context.Background())).To(Succeed())
+			Eventually(func() map[string]string {
+				return ExpectNodeExists(env.Client, node.Name).Annotations
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveKeyWithValue(v1alpha1.ProvisionerDisruptionKey, v1alpha1.DisruptionInvoluntary))
+			Expect(ExpectNodeExists(env.Client, node.Name).Labels).To(HaveKeyWithValue(v1alpha1.ProvisionerPhaseLabel, v1alpha1.ProvisionerDrainingPhase))
+		})
+		It("should delete notices of other events, unmanaged instances, and malformed messages without disrupting nodes", func() {
+			node := managedNode("i-0123456789abcdef0", nil)
+			sqsapi.Messages = []*sqs.Message{
+				noticeFor("EC2 Instance State-change Notification", "i-0123456789abcdef0"),
+				noticeFor(SpotInterruptionDetailType, "i-0fedcba9876543210"),
+				{MessageId: aws.String("malformed"), ReceiptHandle: aws.String("malformed"), Body: aws.String("not json")},
+			}
+			Expect(handler.poll(context.Background())).To(Succeed())
+			Expect(sqsapi.CalledWithDeleteMessageInput).To(HaveLen(3))
+			Expect(ExpectNodeExists(env.Client, node.Name).Annotations).ToNot(HaveKey(v1alpha1.ProvisionerDisruptionKey))
+		})
+		It("should not delete notices when the queue fails", func() {
+			sqsapi.WantErr = errors.New("unauthorized")
+			Expect(handler.poll(context.Background())).ToNot(Succeed())
+			Expect(sqsapi.CalledWithDeleteMessageInput).To(BeEmpty())
+		})
+	})
+	Context("Notifications", func() {
+		var factory *Factory
+		BeforeEach(func() {
+			factory = &Factory{
+				kubeClient:            env.Client,
+				subnetProvider:        &SubnetProvider{ec2api: fakeEC2API, cache: subnetCache, region: testRegion},
+				securityGroupProvider: &SecurityGroupProvider{ec2api: fakeEC2API, cache: securityGroupCache, region: testRegion},
+				changes:               make(chan event.GenericEvent, 10),
+			}
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			_, err := factory.subnetProvider.GetZonalSubnets(context.Background(), provisioner.Spec.Cluster.Name)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = factory.securityGroupProvider.Get(context.Background(), provisioner.Spec.Cluster.Name)
+			Expect(err).ToNot(HaveOccurred())
+		})
+		It("should requeue provisioners when their cluster's subnets change", func() {
+			other := &v1alpha1.Provisioner{
+				ObjectMeta: metav1.ObjectMeta{Name: strings.ToLower(randomdata.SillyName()), Namespace: "default"},
+				Spec: v1alpha1.ProvisionerSpec{Cluster: &v1alpha1.ClusterSpec{
+					Name:     "other-cluster",
+					Endpoint: "https://other-cluster",
+					CABundle: "dGVzdC1jbHVzdGVyCg==",
+				}},
+			}
+			ExpectCreated(env.Client, other)
+			ExpectEventuallyReconciled(env.Client, other)
+			fakeEC2API.DescribeSubnetsOutput = &ec2.DescribeSubnetsOutput{Subnets: []*ec2.Subnet{
+				{SubnetId: aws.String("test-subnet-1"), AvailabilityZone: aws.String("test-zone-1a")},
+				{SubnetId: aws.String("test-subnet-4"), AvailabilityZone: aws.String("test-zone-1a")},
+			}}
+			factory.notifyChanges(context.Background())
+
+			var notification event.GenericEvent
+			Expect(factory.changes).To(Receive(&notification))
+			Expect(notification.Object.GetName()).To(Equal(provisioner.Name))
+			Expect(factory.changes).ToNot(Receive())
+			zonalSubnets, err := factory.subnetProvider.GetZonalSubnets(context.Background(), provisioner.Spec.Cluster.Name)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(zonalSubnets).To(HaveKeyWithValue("test-zone-1a", HaveLen(2)))
+		})
+		It("should requeue provisioners when their cluster's security groups change", func() {
+			fakeEC2API.DescribeSecurityGroupsOutput = &ec2.DescribeSecurityGroupsOutput{SecurityGroups: []*ec2.SecurityGroup{
+				{GroupId: aws.String("test-security-group-4")},
+			}}
+			factory.notifyChanges(context.Background())
+
+			var notification event.GenericEvent
+			Expect(factory.changes).To(Receive(&notification))
+			Expect(notification.Object.GetName()).To(Equal(provisioner.Name))
+		})
+		It("should not requeue provisioners when resources are unchanged", func() {
+			factory.notifyChanges(context.Background())
+			Expect(factory.changes).ToNot(Receive())
+		})
+	})
+	Context("InstanceTypes", func() {
+		It("should reduce allocatable memory by the configured overhead", func() {
+			instanceTypes, err := NewInstanceTypeProvider(fakeEC2API, testRegion, 0.25).Get(context.Background(), provisioner.Spec.Cluster)
+			Expect(err).ToNot(HaveOccurred())
+			memory := map[string]resource.Quantity{}
+			for _, instanceType := range instanceTypes {
+				memory[instanceType.Name()] = *instanceType.Memory()
+			}
+			Expect(memory["m5.large"]).To(Equal(resource.MustParse("6Mi")))
+			Expect(memory["m5.xlarge"]).To(Equal(resource.MustParse("12Mi")))
+		})
+		It("should not reduce allocatable memory without overhead", func() {
+			instanceTypes, err := NewInstanceTypeProvider(fakeEC2API, testRegion, 0).Get(context.Background(), provisioner.Spec.Cluster)
+			Expect(err).ToNot(HaveOccurred())
+			for _, instanceType := range instanceTypes {
+				Expect(instanceType.Memory().Value()).To(Equal(*instanceType.(*InstanceType).MemoryInfo.SizeInMiB * 1024 * 1024))
+			}
+		})
+		It("should derive whether instance types are Nitro-based", func() {
+			instanceTypes, err := NewInstanceTypeProvider(fakeEC2API, testRegion, 0).Get(context.Background(), provisioner.Spec.Cluster)
+			Expect(err).ToNot(HaveOccurred())
+			nitro := map[string]bool{}
+			for _, instanceType := range instanceTypes {
+				nitro[instanceType.Name()] = instanceType.(*InstanceType).NitroBased()
+			}
+			Expect(nitro).To(Equal(map[string]bool{"m5.large": true, "m5.xlarge": true, "p3.8xlarge": false, "inf1.6xlarge": true}))
+		})
+		It("should exclude Xen-based instance types when Nitro is required", func() {
+			provisioner.Spec.Labels = map[string]string{NitroRequiredLabel: "true"}
+			instanceTypes, err := cloudProviderFactory.CapacityFor(provisioner).GetInstanceTypes(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			names := []string{}
+			for _, instanceType := range instanceTypes {
+				names = append(names, instanceType.Name())
+			}
+			Expect(names).To(ConsistOf("m5.large", "m5.xlarge", "inf1.6xlarge"))
+		})
+		It("should derive guaranteed network bandwidth", func() {
+			instanceTypes, err := NewInstanceTypeProvider(fakeEC2API, testRegion, 0).Get(context.Background(), provisioner.Spec.Cluster)
+			Expect(err).ToNot(HaveOccurred())
+			bandwidth := map[string]float64{}
+			for _, instanceType := range instanceTypes {
+				bandwidth[instanceType.Name()] = instanceType.(*InstanceType).NetworkBandwidth()
+			}
+			Expect(bandwidth).To(Equal(map[string]float64{"m5.large": 0, "m5.xlarge": 0, "p3.8xlarge": 10, "inf1.6xlarge": 25}))
+			for performance, expected := range map[string]float64{"4x 100 Gigabit": 400, "12.5 Gigabit": 12.5, "Moderate": 0} {
+				instanceType := &InstanceType{InstanceTypeInfo: ec2.InstanceTypeInfo{NetworkInfo: &ec2.NetworkInfo{NetworkPerformance: aws.String(performance)}}}
+				Expect(instanceType.NetworkBandwidth()).To(Equal(expected), performance)
+			}
+		})
+		It("should exclude instance types without the minimum network bandwidth", func() {
+			provisioner.Spec.Labels = map[string]string{MinNetworkBandwidthLabel: "20"}
+			instanceTypes, err := cloudProviderFactory.CapacityFor(provisioner).GetInstanceTypes(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			names := []string{}
+			for _, instanceType := range instanceTypes {
+				names = append(names, instanceType.Name())
+			}
+			Expect(names).To(ConsistOf("inf1.6xlarge"))
+		})
+		It("should exclude instance types without the minimum instance storage", func() {
+			fakeEC2API.DescribeInstanceTypesOutput = &ec2.DescribeInstanceTypesOutput{InstanceTypes: []*ec2.InstanceTypeInfo{
+				{InstanceType: aws.String("m5.large")},
+				{InstanceType: aws.String("m5d.large"), InstanceStorageInfo: &ec2.InstanceStorageInfo{TotalSizeInGB: aws.Int64(75)}},
+				{InstanceType: aws.String("m5d.2xlarge"), InstanceStorageInfo: &ec2.InstanceStorageInfo{TotalSizeInGB: aws.Int64(300)}},
+			}}
+			factory := &Factory{instanceTypeProvider: NewInstanceTypeProvider(fakeEC2API, testRegion, 0)}
+			provisioner.Spec.Labels = map[string]string{MinInstanceStorageLabel: "100"}
+			instanceTypes, err := factory.CapacityFor(provisioner).GetInstanceTypes(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			names := []string{}
+			for _, instanceType := range instanceTypes {
+				names = append(names, instanceType.Name())
+			}
+			Expect(names).To(ConsistOf("m5d.2xlarge"))
+		})
+		It("should adjust allocatable resources after observing nodes of the same AMI family", func() {
+			factory := &Factory{instanceTypeProvider: NewInstanceTypeProvider(fakeEC2API, testRegion, 0)}
+			custom := provisioner.DeepCopy()
+			custom.Spec.Labels = map[string]string{LaunchTemplateIdLabel: "test-launch-template-id"}
+			allocatableOf := func(p *v1alpha1.Provisioner) (int64, int64) {
+				instanceTypes, err := factory.CapacityFor(p).GetInstanceTypes(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				for _, instanceType := range instanceTypes {
+					if instanceType.Name() == "m5.large" {
+						overhead := instanceType.Overhead()
+						return instanceType.CPU().MilliValue() - overhead.Cpu().MilliValue(), instanceType.Memory().Value() - overhead.Memory().Value()
+					}
+				}
+				Fail("m5.large not found")
+				return 0, 0
+			}
+			estimatedCPU, estimatedMemory := allocatableOf(provisioner)
+			Expect(estimatedCPU).ToNot(BeNumerically("==", 1500))
+
+			factory.CapacityFor(provisioner).(cloudprovider.AllocatableObserver).ObserveAllocatable(context.Background(), &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{v1alpha1.InstanceTypeLabelKey: "m5.large"}},
+				Status: v1.NodeStatus{Allocatable: v1.ResourceList{
+					v1.ResourceCPU:    resource.MustParse("1500m"),
+					v1.ResourceMemory: resource.MustParse("6Mi"),
+				}},
+			})
+			cpu, memory := allocatableOf(provisioner)
+			Expect(cpu).To(BeNumerically("==", 1500))
+			observed := resource.MustParse("6Mi")
+			Expect(memory).To(Equal(observed.Value()))
+			// Nodes launched from custom launch templates may use other AMIs
+			cpu, memory = allocatableOf(custom)
+			Expect(cpu).To(Equal(estimatedCPU))
+			Expect(memory).To(Equal(estimatedMemory))
+		})
+		It("should assume instance types are offered in every zone if offerings are empty", func() {
+			fakeEC2API.DescribeInstanceTypeOfferingsOutput = &ec2.DescribeInstanceTypeOfferingsOutput{}
+			instanceTypes, err := NewInstanceTypeProvider(fakeEC2API, testRegion, 0).Get(context.Background(), provisioner.Spec.Cluster)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(instanceTypes).ToNot(BeEmpty())
+			for _, instanceType := range instanceTypes {
+				Expect(instanceType.Zones()).To(ConsistOf("test-zone-1a", "test-zone-1b", "test-zone-1c"), instanceType.Name())
+			}
+		})
+		It("should only offer instance types in their offered zones if offerings are present", func() {
+			fakeEC2API.DescribeInstanceTypeOfferingsOutput = &ec2.DescribeInstanceTypeOfferingsOutput{InstanceTypeOfferings: []*ec2.InstanceTypeOffering{
+				{InstanceType: aws.String("m5.large"), Location: aws.String("test-zone-1b")},
+			}}
+			instanceTypes, err := NewInstanceTypeProvider(fakeEC2API, testRegion, 0).Get(context.Background(), provisioner.Spec.Cluster)
+			Expect(err).ToNot(HaveOccurred())
+			zones := map[string][]string{}
+			for _, instanceType := range instanceTypes {
+				zones[instanceType.Name()] = instanceType.Zones()
+			}
+			Expect(zones["m5.large"]).To(ConsistOf("test-zone-1b"))
+			Expect(zones["m5.xlarge"]).To(BeEmpty())
+		})
+		It("should describe instance types once for every provisioner's capacity", func() {
+			ec2api := &fake.EC2API{}
+			factory := &Factory{instanceTypeProvider: NewInstanceTypeProvider(ec2api, testRegion, 0)}
+			other := provisioner.DeepCopy()
+			other.Name = strings.ToLower(randomdata.SillyName())
+			wg := sync.WaitGroup{}
+			for _, p := range []*v1alpha1.Provisioner{provisioner, other} {
+				for i := 0; i < 5; i++ {
+					wg.Add(1)
+					go func(capacity cloudprovider.Capacity) {
+						defer GinkgoRecover()
+						defer wg.Done()
+						instanceTypes, err := capacity.GetInstanceTypes(context.Background())
+						Expect(err).ToNot(HaveOccurred())
+						Expect(instanceTypes).ToNot(BeEmpty())
+					}(factory.CapacityFor(p))
+				}
+			}
+			wg.Wait()
+			Expect(ec2api.CalledWithDescribeInstanceTypes).To(HaveLen(1))
+		})
+	})
+
+	Context("SelectionStrategy", func() {
+		catalog := func() []cloudprovider.InstanceType {
+			instanceType := func(name string, cpus int64, memory int64, enis int64, addresses int64) cloudprovider.InstanceType {
+				return &InstanceType{InstanceTypeInfo: ec2.InstanceTypeInfo{
+					InstanceType: aws.String(name),
+					VCpuInfo:     &ec2.VCpuInfo{DefaultVCpus: aws.Int64(cpus)},
+					MemoryInfo:   &ec2.MemoryInfo{SizeInMiB: aws.Int64(memory)},
+					NetworkInfo:  &ec2.NetworkInfo{MaximumNetworkInterfaces: aws.Int64(enis), Ipv4AddressesPerInterface: aws.Int64(addresses)},
+				}}
+			}
+			return []cloudprovider.InstanceType{
+				instanceType("r5.large", 2, 16384, 3, 10),  // 29 pods
+				instanceType("m5.xlarge", 4, 16384, 4, 15), // 58 pods
+				instanceType("c5.large", 2, 4096, 3, 10),   // 29 pods
+				instanceType("t3.large", 2, 8192, 3, 12),   // 35 pods
+			}
+		}
+		rank := func(strategy string) []string {
+			names := []string{}
+			for _, instanceType := range NewInstanceTypeProvider(fakeEC2API, testRegion, 0).Rank(catalog(), strategy) {
+				names = append(names, instanceType.Name())
+			}
+			return names
+		}
+		It("should rank the smallest instance types first for the lowest price", func() {
+			Expect(rank(v1alpha1.SelectionStrategyLowestPrice)).To(Equal([]string{"c5.large", "t3.large", "r5.large", "m5.xlarge"}))
+		})
+		It("should default to the lowest price", func() {
+			Expect(rank("")).To(Equal(rank(v1alpha1.SelectionStrategyLowestPrice)))
+		})
+		It("should rank the instance types that fit the most pods first for most pods", func() {
+			Expect(rank(v1alpha1.SelectionStrategyMostPods)).To(Equal([]string{"m5.xlarge", "t3.large", "c5.large", "r5.large"}))
+		})
+		It("should rank the largest instance types first for fewest nodes", func() {
+			Expect(rank(v1alpha1.SelectionStrategyFewestNodes)).To(Equal([]string{"m5.xlarge", "r5.large", "t3.large", "c5.large"}))
+		})
+		It("should trim the largest instance types from fleet requests regardless of the ranking", func() {
+			instanceTypes := []cloudprovider.InstanceType{}
+			for cpus := int64(maxInstanceTypes + 5); cpus > 0; cpus-- {
+				instanceTypes = append(instanceTypes, &InstanceType{
+					InstanceTypeInfo: ec2.InstanceTypeInfo{
+						InstanceType: aws.String(fmt.Sprintf("test-instance-type-%d", cpus)),
+						VCpuInfo:     &ec2.VCpuInfo{DefaultVCpus: aws.Int64(cpus)},
+						MemoryInfo:   &ec2.MemoryInfo{SizeInMiB: aws.Int64(cpus * 1024)},
+					},
+					ZoneOptions: []string{"test-zone-1a"},
+				})
+			}
+			_, err := NewInstanceProvider(fakeEC2API, DefaultLaunchIdempotencyWindow, DefaultLaunchTimeout).Create(context.Background(),
+				&LaunchTemplate{Id: aws.String("test-launch-template-id"), Version: aws.String(defaultLaunchTemplateVersion)},
+				instanceTypes, map[string][]*ec2.Subnet{"test-zone-1a": {{SubnetId: aws.String("test-subnet-1")}}},
+				&Constraints{}, v1alpha1.SelectionStrategyFewestNodes, nil,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			overrides := fakeEC2API.CalledWithCreateFleetInput[0].LaunchTemplateConfigs[0].Overrides
+			Expect(overrides).To(HaveLen(maxInstanceTypes))
+			// The largest remaining instance type keeps the highest priority
+			Expect(aws.StringValue(overrides[0].InstanceType)).To(Equal(fmt.Sprintf("test-instance-type-%d", maxInstanceTypes)))
+			for _, override := range overrides {
+				Expect(aws.StringValue(override.InstanceType)).ToNot(Equal(fmt.Sprintf("test-instance-type-%d", maxInstanceTypes+1)))
+			}
+		})
+	})
+
+	Context("SelectionReasons", func() {
+		options := func(names ...string) []cloudprovider.InstanceType {
+			instanceTypes := []cloudprovider.InstanceType{}
+			for _, name := range names {
+				instanceTypes = append(instanceTypes, &InstanceType{InstanceTypeInfo: ec2.InstanceTypeInfo{InstanceType: aws.String(name)}})
+			}
+			return instanceTypes
+		}
+		It("should report the only instance type that fits", func() {
+			reason := selectionReasonFor("m5.large", options("m5.large"), &Constraints{}, "", []*v1.Pod{test.PendingPod()})
+			Expect(reason).To(HavePrefix(SelectionReasonOnlyFit + ": m5.large"))
+		})
+		It("should report accelerators that the pods request", func() {
+			pod := test.PendingPodWith(test.PodOptions{ResourceRequirements: v1.ResourceRequirements{
+				Requests: v1.ResourceList{resources.NvidiaGPU: resource.MustParse("1")},
+			}})
+			reason := selectionReasonFor("p3.8xlarge", options("p3.8xlarge", "p3.16xlarge"), &Constraints{}, "", []*v1.Pod{pod})
+			Expect(reason).To(HavePrefix(SelectionReasonRequiredAccelerator + ": p3.8xlarge"))
+			Expect(reason).To(ContainSubstring(resources.NvidiaGPU))
+		})
+		It("should report the lowest price by default", func() {
+			reason := selectionReasonFor("m5.large", options("m5.large", "m5.xlarge"), &Constraints{}, "", []*v1.Pod{test.PendingPod()})
+			Expect(reason).To(HavePrefix(SelectionReasonCheapest + ": m5.large"))
+		})
+		It("should report the selection strategy", func() {
+			reason := selectionReasonFor("m5.xlarge", options("m5.large", "m5.xlarge"), &Constraints{}, v1alpha1.SelectionStrategyFewestNodes, []*v1.Pod{test.PendingPod()})
+			Expect(reason).To(HavePrefix(SelectionReasonFewestNodes + ": m5.xlarge"))
+		})
+		It("should report the spot allocation strategy for spot capacity", func() {
+			constraints := &Constraints{Labels: map[string]string{CapacityTypeLabel: capacityTypeSpot}}
+			reason := selectionReasonFor("m5.large", options("m5.large", "m5.xlarge"), constraints, v1alpha1.SelectionStrategyMostPods, []*v1.Pod{test.PendingPod()})
+			Expect(reason).To(HavePrefix(SelectionReasonSpotAllocation + ": m5.large"))
+			Expect(reason).To(ContainSubstring(ec2.SpotAllocationStrategyCapacityOptimizedPrioritized))
+		})
+		It("should annotate and log launched nodes with the selection reason", func() {
+			var logs *observer.ObservedLogs
+			var core zapcore.Core
+			core, logs = observer.New(zapcore.InfoLevel)
+			defer zap.ReplaceGlobals(zap.New(core))()
+			provisioner.Spec.InstanceTypes = []string{"m5.large"}
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+			node := ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+			Expect(node.Annotations).To(HaveKeyWithValue(v1alpha1.ProvisionerSelectionReasonKey, HavePrefix(SelectionReasonOnlyFit+": m5.large")))
+			entries := logs.FilterMessage(InstanceLaunchedMessage).All()
+			Expect(entries).ToNot(BeEmpty())
+			Expect(entries[0].ContextMap()).To(HaveKeyWithValue("selectionReason", node.Annotations[v1alpha1.ProvisionerSelectionReasonKey]))
+		})
+	})
+
+	Context("Caching", func() {
+		It("should not return instance types cached for another region", func() {
+			sharedCache := cache.New(CacheTTL, CacheCleanupInterval)
+			instanceTypes, err := (&InstanceTypeProvider{ec2api: fakeEC2API, cache: sharedCache, region: testRegion}).Get(context.Background(), provisioner.Spec.Cluster)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(instanceTypes).To(HaveLen(4))
+
+			fakeEC2API.DescribeInstanceTypesOutput = &ec2.DescribeInstanceTypesOutput{InstanceTypes: []*ec2.InstanceTypeInfo{{
+				InstanceType: aws.String("m5.large"),
+				BareMetal:    aws.Bool(false),
+			}}}
+			instanceTypes, err = (&InstanceTypeProvider{ec2api: fakeEC2API, cache: sharedCache, region: "test-region-2"}).Get(context.Background(), provisioner.Spec.Cluster)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(instanceTypes).To(HaveLen(1))
+		})
+		It("should not return subnets cached for another region", func() {
+			sharedCache := cache.New(CacheTTL, CacheCleanupInterval)
+			zonalSubnets, err := (&SubnetProvider{ec2api: fakeEC2API, cache: sharedCache, region: testRegion}).GetZonalSubnets(context.Background(), provisioner.Spec.Cluster.Name)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(zonalSubnets).To(HaveLen(3))
+
+			fakeEC2API.DescribeSubnetsOutput = &ec2.DescribeSubnetsOutput{Subnets: []*ec2.Subnet{
+				{SubnetId: aws.String("test-subnet-4"), AvailabilityZone: aws.String("test-zone-2a")},
+			}}
+			zonalSubnets, err = (&SubnetProvider{ec2api: fakeEC2API, cache: sharedCache, region: "test-region-2"}).GetZonalSubnets(context.Background(), provisioner.Spec.Cluster.Name)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(zonalSubnets).To(HaveKey("test-zone-2a"))
+			Expect(zonalSubnets).To(HaveLen(1))
+		})
+	})
+	Context("Debug", func() {
+		It("should serve cached entries", func() {
+			zonalSubnets, err := cloudProviderFactory.subnetProvider.GetZonalSubnets(context.Background(), provisioner.Spec.Cluster.Name)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(zonalSubnets).To(HaveLen(3))
+
+			server := httptest.NewServer(cloudProviderFactory.debugHandler())
+			defer server.Close()
+			response, err := http.Get(server.URL + DebugCachesPath)
+			Expect(err).ToNot(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			contents := map[string][]CacheEntry{}
+			Expect(json.NewDecoder(response.Body).Decode(&contents)).To(Succeed())
+			Expect(contents).To(HaveKey("subnets"))
+			Expect(contents["subnets"]).To(HaveLen(1))
+			Expect(contents["subnets"][0].Key).To(Equal(cacheKey(testRegion, provisioner.Spec.Cluster.Name)))
+			Expect(contents["subnets"][0].Expiration).ToNot(BeNil())
+			Expect(string(contents["subnets"][0].Value)).To(ContainSubstring("test-subnet-1"))
+			Expect(contents["launchTemplates"]).To(BeEmpty())
+		})
+	})
 	Context("Validation", func() {
 		Context("ClusterSpec", func() {
 			It("should fail if fields are empty", func() {
@@ -357,6 +2217,136 @@ var _ = Describe("Allocation", func() {
 				}
 				Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
 			})
+			It("should fail for unsupported spot allocation strategies", func() {
+				provisioner.Spec.Labels = map[string]string{SpotAllocationStrategyLabel: randomdata.SillyName()}
+				Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+			})
+			It("should succeed for partitions within the placement group", func() {
+				provisioner.Spec.Labels = map[string]string{
+					PlacementGroupNameLabel:       "test-placement-group",
+					PlacementPartitionNumberLabel: "3",
+				}
+				Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+			})
+			It("should fail for partitions outside of the placement group", func() {
+				for _, partition := range []string{"0", "4", "first"} {
+					provisioner.Spec.Labels = map[string]string{
+						PlacementGroupNameLabel:       "test-placement-group",
+						PlacementPartitionNumberLabel: partition,
+					}
+					Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+				}
+			})
+			It("should fail for partitions without a placement group", func() {
+				provisioner.Spec.Labels = map[string]string{PlacementPartitionNumberLabel: "1"}
+				Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+			})
+			It("should succeed for hibernation with supported instance types", func() {
+				provisioner.Spec.Labels = map[string]string{HibernationEnabledLabel: "true"}
+				provisioner.Spec.InstanceTypes = []string{"m5.large"}
+				Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+			})
+			It("should fail for hibernation with unsupported instance types", func() {
+				provisioner.Spec.Labels = map[string]string{HibernationEnabledLabel: "true"}
+				provisioner.Spec.InstanceTypes = []string{"m5.large", "p3.8xlarge"}
+				Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+			})
+			It("should fail for hibernation with a launch template", func() {
+				provisioner.Spec.Labels = map[string]string{
+					HibernationEnabledLabel: "true",
+					LaunchTemplateIdLabel:   "23",
+				}
+				Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+			})
+			It("should fail for non-boolean hibernation values", func() {
+				provisioner.Spec.Labels = map[string]string{HibernationEnabledLabel: randomdata.SillyName()}
+				Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+			})
+			It("should succeed for Nitro with Nitro-based instance types", func() {
+				provisioner.Spec.Labels = map[string]string{NitroRequiredLabel: "true"}
+				provisioner.Spec.InstanceTypes = []string{"m5.large", "inf1.6xlarge"}
+				Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+			})
+			It("should fail for Nitro with Xen-based instance types", func() {
+				provisioner.Spec.Labels = map[string]string{NitroRequiredLabel: "true"}
+				provisioner.Spec.InstanceTypes = []string{"m5.large", "p3.8xlarge"}
+				Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+			})
+			It("should succeed for supported burstable credit options", func() {
+				provisioner.Spec.Labels = map[string]string{BurstableCreditsLabel: "unlimited"}
+				Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+			})
+			It("should fail for unknown burstable credit options", func() {
+				provisioner.Spec.Labels = map[string]string{BurstableCreditsLabel: randomdata.SillyName()}
+				Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+			})
+			It("should fail for burstable credits with a launch template", func() {
+				provisioner.Spec.Labels = map[string]string{
+					BurstableCreditsLabel: "standard",
+					LaunchTemplateIdLabel: "23",
+				}
+				Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+			})
+			It("should fail for non-boolean Nitro values", func() {
+				provisioner.Spec.Labels = map[string]string{NitroRequiredLabel: randomdata.SillyName()}
+				Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+			})
+			It("should succeed for minimum network bandwidth with instance types that have it", func() {
+				provisioner.Spec.Labels = map[string]string{MinNetworkBandwidthLabel: "10"}
+				provisioner.Spec.InstanceTypes = []string{"p3.8xlarge", "inf1.6xlarge"}
+				Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+			})
+			It("should fail for minimum network bandwidth with instance types that don't have it", func() {
+				provisioner.Spec.Labels = map[string]string{MinNetworkBandwidthLabel: "10"}
+				provisioner.Spec.InstanceTypes = []string{"m5.large", "p3.8xlarge"}
+				Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+			})
+			It("should fail for invalid minimum network bandwidth values", func() {
+				for _, value := range []string{randomdata.SillyName(), "0", "-1"} {
+					provisioner.Spec.Labels = map[string]string{MinNetworkBandwidthLabel: value}
+					Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+				}
+			})
+			It("should fail for minimum instance storage with instance types that don't have it", func() {
+				provisioner.Spec.Labels = map[string]string{MinInstanceStorageLabel: "100"}
+				provisioner.Spec.InstanceTypes = []string{"m5.large"}
+				Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+			})
+			It("should fail for invalid minimum instance storage values", func() {
+				for _, value := range []string{randomdata.SillyName(), "0", "-1", "1.5"} {
+					provisioner.Spec.Labels = map[string]string{MinInstanceStorageLabel: value}
+					Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+				}
+			})
+			It("should succeed for a positive max price", func() {
+				provisioner.Spec.Labels = map[string]string{MaxPriceLabel: "1.5"}
+				Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+			})
+			It("should fail for invalid max prices", func() {
+				for _, value := range []string{randomdata.SillyName(), "0", "NaN"} {
+					provisioner.Spec.Labels = map[string]string{MaxPriceLabel: value}
+					Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+				}
+			})
+			It("should succeed for a positive spot max price", func() {
+				provisioner.Spec.Labels = map[string]string{SpotMaxPriceLabel: "0.5"}
+				Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+			})
+			It("should fail for invalid spot max prices", func() {
+				for _, value := range []string{randomdata.SillyName(), "0", "-0.5"} {
+					provisioner.Spec.Labels = map[string]string{SpotMaxPriceLabel: value}
+					Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+				}
+			})
+			It("should fail for an invalid deprecated AMI rejection", func() {
+				for _, labels := range []map[string]string{
+					{RejectDeprecatedAMILabel: randomdata.SillyName()},
+					{RejectDeprecatedAMILabel: "true", LaunchTemplateIdLabel: randomdata.SillyName()},
+				} {
+					provisioner.Spec.Labels = labels
+					Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+				}
+			})
 			It("should fail if only launch template version label present", func() {
 				provisioner.Spec.Labels = map[string]string{"node.k8s.aws/launch-template-version": randomdata.SillyName()}
 				Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
@@ -0,0 +1,133 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultAPIQPS is the rate of AWS API requests before any throttling
+	DefaultAPIQPS = 20
+	// DefaultAPIBurst is how many AWS API requests may be sent at once
+	DefaultAPIBurst = 40
+	// MinAPIQPS bounds how far throttling reduces the rate of AWS API requests
+	MinAPIQPS = 1
+	// APIQPSRecoveryInterval is how often the rate of AWS API requests
+	// recovers after throttling
+	APIQPSRecoveryInterval = 10 * time.Second
+)
+
+// ThrottlingRateLimiter limits the rate of AWS API requests across all
+// services. The rate is halved whenever a request is throttled, and recovers
+// by a tenth of the maximum for every interval without throttling, so that
+// Karpenter backs off when throttling spikes instead of retrying into it.
+type ThrottlingRateLimiter struct {
+	mutex            sync.Mutex
+	limiter          *rate.Limiter
+	maxQPS           rate.Limit
+	minQPS           rate.Limit
+	recoveryInterval time.Duration
+	lastAdjusted     time.Time
+}
+
+func NewThrottlingRateLimiter(qps float64, burst int) *ThrottlingRateLimiter {
+	return &ThrottlingRateLimiter{
+		limiter:          rate.NewLimiter(rate.Limit(qps), burst),
+		maxQPS:           rate.Limit(qps),
+		minQPS:           rate.Limit(MinAPIQPS),
+		recoveryInterval: APIQPSRecoveryInterval,
+	}
+}
+
+// Limit returns the current rate of AWS API requests
+func (t *ThrottlingRateLimiter) Limit() rate.Limit {
+	return t.limiter.Limit()
+}
+
+// throttled reduces the rate after a request is throttled
+func (t *ThrottlingRateLimiter) throttled() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	limit := t.limiter.Limit() / 2
+	if limit < t.minQPS {
+		limit = t.minQPS
+	}
+	if limit != t.limiter.Limit() {
+		zap.S().Debugf("Reducing AWS API rate limit to %.2f qps after throttling", float64(limit))
+	}
+	t.limiter.SetLimit(limit)
+	t.lastAdjusted = time.Now()
+}
+
+// succeeded gradually recovers the rate after a request isn't throttled
+func (t *ThrottlingRateLimiter) succeeded() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.limiter.Limit() >= t.maxQPS || time.Since(t.lastAdjusted) < t.recoveryInterval {
+		return
+	}
+	limit := t.limiter.Limit() + t.maxQPS/10
+	if limit > t.maxQPS {
+		limit = t.maxQPS
+	}
+	t.limiter.SetLimit(limit)
+	t.lastAdjusted = time.Now()
+}
+
+// wait blocks each attempt of a request until the rate limit allows it
+func (t *ThrottlingRateLimiter) wait(r *request.Request) {
+	if err := t.limiter.Wait(r.Context()); err != nil {
+		r.Error = err
+	}
+}
+
+// observe counts throttled attempts of a request and reduces the rate
+func (t *ThrottlingRateLimiter) observe(r *request.Request) {
+	if request.IsErrorThrottle(r.Error) {
+		awsThrottledTotal.WithLabelValues(r.ClientInfo.ServiceName, operationOf(r)).Inc()
+		t.throttled()
+	}
+}
+
+// complete recovers the rate after a request succeeds
+func (t *ThrottlingRateLimiter) complete(r *request.Request) {
+	if r.Error == nil {
+		t.succeeded()
+	}
+}
+
+// withThrottling rate limits the session's requests and reduces the rate when
+// they are throttled
+func withThrottling(sess *session.Session, limiter *ThrottlingRateLimiter) *session.Session {
+	sess.Handlers.Send.PushFront(limiter.wait)
+	// Retry handlers run after every failed attempt, Complete handlers once
+	sess.Handlers.Retry.PushFront(limiter.observe)
+	sess.Handlers.Complete.PushBack(limiter.complete)
+	return sess
+}
+
+func operationOf(r *request.Request) string {
+	if r.Operation == nil {
+		return ""
+	}
+	return r.Operation.Name
+}
@@ -0,0 +1,44 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+)
+
+var (
+	// QuotaExceededErrorCodes are returned by EC2 when an account quota
+	// prevents launching capacity.
+	QuotaExceededErrorCodes = []string{
+		"VcpuLimitExceeded",
+		"MaxSpotInstanceCountExceeded",
+		"InstanceLimitExceeded",
+	}
+	// ConfigurationErrorCodes are returned by EC2 when capacity can't be
+	// launched as configured, e.g. if the spot max price is too low.
+	ConfigurationErrorCodes = []string{
+		"SpotMaxPriceTooLow",
+	}
+)
+
+// IsQuotaExceeded returns true if the error code indicates an account quota has been reached
+func IsQuotaExceeded(code string) bool {
+	return functional.ContainsString(QuotaExceededErrorCodes, code)
+}
+
+// IsConfigurationError returns true if the error code indicates capacity can't be launched as configured
+func IsConfigurationError(code string) bool {
+	return functional.ContainsString(ConfigurationErrorCodes, code)
+}
@@ -23,7 +23,9 @@ import (
 // Retryer implements the aws request.Retryer interface
 // and adds support for retrying ec2 InvalidInstanceID.NotFound
 // which can occur when instances have recently been created
-// and are not yet describe-able due to eventual consistency
+// and are not yet describe-able due to eventual consistency.
+// Quota and configuration errors are never retried since they require a
+// limit increase or configuration change.
 type Retryer struct {
 	request.Retryer
 }
@@ -39,6 +41,9 @@ func NewRetryer() *Retryer {
 
 // ShouldRetry returns true if the request should be retried
 func (r Retryer) ShouldRetry(req *request.Request) bool {
+	if aerr, ok := req.Error.(awserr.Error); ok && (IsQuotaExceeded(aerr.Code()) || IsConfigurationError(aerr.Code())) {
+		return false
+	}
 	if r.Retryer.ShouldRetry(req) {
 		return true
 	}
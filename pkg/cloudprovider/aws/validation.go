@@ -17,8 +17,13 @@ package aws
 import (
 	"context"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/awslabs/karpenter/pkg/utils/functional"
 )
 
@@ -26,11 +31,39 @@ import (
 func (c *Capacity) Validate(ctx context.Context) error {
 	return functional.ValidateAll(
 		c.validateAllowedLabels,
+		c.validateRoleARNAnnotation,
 		c.validateCapacityTypeLabel,
+		c.validateSpotAllocationStrategyLabel,
+		c.validateBurstableCreditsLabel,
 		c.validateLaunchTemplateLabels,
+		func() error { return c.validatePlacementLabels(ctx) },
+		func() error { return c.validateHibernationLabel(ctx) },
+		func() error { return c.validateNitroLabel(ctx) },
+		func() error { return c.validateMinNetworkBandwidthLabel(ctx) },
+		func() error { return c.validateMinInstanceStorageLabel(ctx) },
+		c.validateMaxPriceLabel,
+		c.validateSpotMaxPriceLabel,
+		c.validateRejectDeprecatedAMILabel,
 	)
 }
 
+// validateRoleARNAnnotation requires the annotation, if present, to be the ARN
+// of an IAM role
+func (c *Capacity) validateRoleARNAnnotation() error {
+	value, ok := c.provisioner.Annotations[RoleARNAnnotation]
+	if !ok {
+		return nil
+	}
+	parsed, err := arn.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%s must be an ARN, %w", RoleARNAnnotation, err)
+	}
+	if parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "role/") {
+		return fmt.Errorf("%s must be the ARN of an IAM role, got %s", RoleARNAnnotation, value)
+	}
+	return nil
+}
+
 func (c *Capacity) validateCapacityTypeLabel() error {
 	value, ok := c.provisioner.Spec.Labels[CapacityTypeLabel]
 	if !ok {
@@ -43,6 +76,31 @@ func (c *Capacity) validateCapacityTypeLabel() error {
 	return nil
 }
 
+func (c *Capacity) validateSpotAllocationStrategyLabel() error {
+	value, ok := c.provisioner.Spec.Labels[SpotAllocationStrategyLabel]
+	if !ok {
+		return nil
+	}
+	if !functional.ContainsString(spotAllocationStrategies, value) {
+		return fmt.Errorf("%s must be one of %v", SpotAllocationStrategyLabel, spotAllocationStrategies)
+	}
+	return nil
+}
+
+func (c *Capacity) validateBurstableCreditsLabel() error {
+	value, ok := c.provisioner.Spec.Labels[BurstableCreditsLabel]
+	if !ok {
+		return nil
+	}
+	if !functional.ContainsString(burstableCreditOptions, value) {
+		return fmt.Errorf("%s must be one of %v", BurstableCreditsLabel, burstableCreditOptions)
+	}
+	if _, ok := c.provisioner.Spec.Labels[LaunchTemplateIdLabel]; ok {
+		return fmt.Errorf("%s cannot be specified with %s, configure credits in the launch template instead", BurstableCreditsLabel, LaunchTemplateIdLabel)
+	}
+	return nil
+}
+
 func (c *Capacity) validateAllowedLabels() error {
 	for key := range c.provisioner.Spec.Labels {
 		if strings.HasPrefix(key, nodeLabelPrefix) &&
@@ -61,3 +119,179 @@ func (c *Capacity) validateLaunchTemplateLabels() error {
 	}
 	return nil
 }
+
+func (c *Capacity) validatePlacementLabels(ctx context.Context) error {
+	value, ok := c.provisioner.Spec.Labels[PlacementPartitionNumberLabel]
+	if !ok {
+		return nil
+	}
+	name, ok := c.provisioner.Spec.Labels[PlacementGroupNameLabel]
+	if !ok {
+		return fmt.Errorf("%s can only be specified with %s", PlacementPartitionNumberLabel, PlacementGroupNameLabel)
+	}
+	partition, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s must be an integer, %w", PlacementPartitionNumberLabel, err)
+	}
+	placementGroup, err := c.placementGroupProvider.Get(ctx, name)
+	if err != nil {
+		return fmt.Errorf("getting placement group, %w", err)
+	}
+	if aws.StringValue(placementGroup.Strategy) != ec2.PlacementStrategyPartition {
+		return fmt.Errorf("%s requires a placement group with the %s strategy", PlacementPartitionNumberLabel, ec2.PlacementStrategyPartition)
+	}
+	if count := aws.Int64Value(placementGroup.PartitionCount); partition < 1 || partition > count {
+		return fmt.Errorf("%s must be between 1 and %d for placement group %s", PlacementPartitionNumberLabel, count, name)
+	}
+	return nil
+}
+
+func (c *Capacity) validateHibernationLabel(ctx context.Context) error {
+	value, ok := c.provisioner.Spec.Labels[HibernationEnabledLabel]
+	if !ok {
+		return nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("%s must be a boolean, %w", HibernationEnabledLabel, err)
+	}
+	if !enabled {
+		return nil
+	}
+	if _, ok := c.provisioner.Spec.Labels[LaunchTemplateIdLabel]; ok {
+		return fmt.Errorf("%s cannot be specified with %s, configure hibernation in the launch template instead", HibernationEnabledLabel, LaunchTemplateIdLabel)
+	}
+	if len(c.provisioner.Spec.InstanceTypes) == 0 {
+		return nil
+	}
+	instanceTypes, err := c.instanceTypeProvider.Get(ctx, c.provisioner.Spec.Cluster)
+	if err != nil {
+		return fmt.Errorf("getting instance types, %w", err)
+	}
+	for _, instanceType := range instanceTypes {
+		if functional.ContainsString(c.provisioner.Spec.InstanceTypes, instanceType.Name()) &&
+			!aws.BoolValue(instanceType.(*InstanceType).HibernationSupported) {
+			return fmt.Errorf("%s requires instance types that support hibernation, but %s does not", HibernationEnabledLabel, instanceType.Name())
+		}
+	}
+	return nil
+}
+
+func (c *Capacity) validateNitroLabel(ctx context.Context) error {
+	value, ok := c.provisioner.Spec.Labels[NitroRequiredLabel]
+	if !ok {
+		return nil
+	}
+	required, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("%s must be a boolean, %w", NitroRequiredLabel, err)
+	}
+	if !required || len(c.provisioner.Spec.InstanceTypes) == 0 {
+		return nil
+	}
+	instanceTypes, err := c.instanceTypeProvider.Get(ctx, c.provisioner.Spec.Cluster)
+	if err != nil {
+		return fmt.Errorf("getting instance types, %w", err)
+	}
+	for _, instanceType := range instanceTypes {
+		if functional.ContainsString(c.provisioner.Spec.InstanceTypes, instanceType.Name()) &&
+			!instanceType.(*InstanceType).NitroBased() {
+			return fmt.Errorf("%s requires Nitro-based instance types, but %s is not", NitroRequiredLabel, instanceType.Name())
+		}
+	}
+	return nil
+}
+
+func (c *Capacity) validateMinNetworkBandwidthLabel(ctx context.Context) error {
+	value, ok := c.provisioner.Spec.Labels[MinNetworkBandwidthLabel]
+	if !ok {
+		return nil
+	}
+	bandwidth, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("%s must be a number, %w", MinNetworkBandwidthLabel, err)
+	}
+	if math.IsNaN(bandwidth) || bandwidth <= 0 {
+		return fmt.Errorf("%s must be positive", MinNetworkBandwidthLabel)
+	}
+	if len(c.provisioner.Spec.InstanceTypes) == 0 {
+		return nil
+	}
+	instanceTypes, err := c.instanceTypeProvider.Get(ctx, c.provisioner.Spec.Cluster)
+	if err != nil {
+		return fmt.Errorf("getting instance types, %w", err)
+	}
+	for _, instanceType := range instanceTypes {
+		if functional.ContainsString(c.provisioner.Spec.InstanceTypes, instanceType.Name()) &&
+			instanceType.(*InstanceType).NetworkBandwidth() < bandwidth {
+			return fmt.Errorf("%s requires at least %s Gbps of guaranteed network bandwidth, but %s has %v", MinNetworkBandwidthLabel, value, instanceType.Name(), instanceType.(*InstanceType).NetworkBandwidth())
+		}
+	}
+	return nil
+}
+
+func (c *Capacity) validateMinInstanceStorageLabel(ctx context.Context) error {
+	value, ok := c.provisioner.Spec.Labels[MinInstanceStorageLabel]
+	if !ok {
+		return nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s must be an integer, %w", MinInstanceStorageLabel, err)
+	}
+	if size <= 0 {
+		return fmt.Errorf("%s must be positive", MinInstanceStorageLabel)
+	}
+	if len(c.provisioner.Spec.InstanceTypes) == 0 {
+		return nil
+	}
+	instanceTypes, err := c.instanceTypeProvider.Get(ctx, c.provisioner.Spec.Cluster)
+	if err != nil {
+		return fmt.Errorf("getting instance types, %w", err)
+	}
+	for _, instanceType := range instanceTypes {
+		if functional.ContainsString(c.provisioner.Spec.InstanceTypes, instanceType.Name()) &&
+			instanceType.(*InstanceType).InstanceStorage() < size {
+			return fmt.Errorf("%s requires at least %s GB of instance storage, but %s has %d", MinInstanceStorageLabel, value, instanceType.Name(), instanceType.(*InstanceType).InstanceStorage())
+		}
+	}
+	return nil
+}
+
+func (c *Capacity) validateMaxPriceLabel() error {
+	return c.validatePriceLabel(MaxPriceLabel)
+}
+
+func (c *Capacity) validateSpotMaxPriceLabel() error {
+	return c.validatePriceLabel(SpotMaxPriceLabel)
+}
+
+func (c *Capacity) validateRejectDeprecatedAMILabel() error {
+	value, ok := c.provisioner.Spec.Labels[RejectDeprecatedAMILabel]
+	if !ok {
+		return nil
+	}
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("%s must be a boolean, %w", RejectDeprecatedAMILabel, err)
+	}
+	if _, ok := c.provisioner.Spec.Labels[LaunchTemplateIdLabel]; ok {
+		return fmt.Errorf("%s cannot be specified with %s, whose AMI isn't resolved by karpenter", RejectDeprecatedAMILabel, LaunchTemplateIdLabel)
+	}
+	return nil
+}
+
+// validatePriceLabel requires the label, if present, to be a positive price
+func (c *Capacity) validatePriceLabel(label string) error {
+	value, ok := c.provisioner.Spec.Labels[label]
+	if !ok {
+		return nil
+	}
+	price, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("%s must be a number, %w", label, err)
+	}
+	if math.IsNaN(price) || math.IsInf(price, 0) || price <= 0 {
+		return fmt.Errorf("%s must be a positive price per hour", label)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudprovider
+
+import (
+	"fmt"
+	"time"
+)
+
+// QuotaExceededError is returned when the cloud provider refuses to create
+// capacity because an account quota has been reached. Retrying will not
+// succeed until the quota is raised.
+type QuotaExceededError struct {
+	// Quota is the cloud provider's name for the exceeded quota
+	Quota   string
+	Message string
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("exceeded quota %s, %s", e.Quota, e.Message)
+}
+
+// ConfigurationError is returned when the cloud provider refuses to create
+// capacity because of how it's configured, e.g. a spot max price below the
+// spot price. Retrying will not succeed until the configuration is changed.
+type ConfigurationError struct {
+	// Code is the cloud provider's name for the error
+	Code    string
+	Message string
+}
+
+func (e *ConfigurationError) Error() string {
+	return fmt.Sprintf("invalid configuration %s, %s", e.Code, e.Message)
+}
+
+// LaunchTimeoutError is returned when a call to the cloud provider to launch
+// capacity is cancelled after exceeding the launch timeout. Retrying may
+// succeed, since the call was aborted rather than refused.
+type LaunchTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *LaunchTimeoutError) Error() string {
+	return fmt.Sprintf("launch exceeded timeout %s", e.Timeout)
+}
@@ -20,24 +20,31 @@ import (
 	"strings"
 
 	"github.com/Pallinder/go-randomdata"
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type Capacity struct {
+	factory *Factory
 }
 
 func (c *Capacity) Create(ctx context.Context, packings []*cloudprovider.Packing) ([]*cloudprovider.PackedNode, error) {
+	if c.factory.CreateErr != nil {
+		return nil, c.factory.CreateErr
+	}
 	packedNodes := []*cloudprovider.PackedNode{}
 	for _, packing := range packings {
 		name := strings.ToLower(randomdata.SillyName())
 		packedNodes = append(packedNodes, &cloudprovider.PackedNode{
 			Node: &v1.Node{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:   name,
-					Labels: packing.Constraints.Labels,
+					Name:        name,
+					Labels:      functional.UnionStringMaps(packing.Constraints.Labels, map[string]string{c.factory.ManagedLabelKey: "true"}),
+					Annotations: packing.Constraints.Annotations,
 				},
 				Spec: v1.NodeSpec{
 					ProviderID: fmt.Sprintf("fake:///%s", name),
@@ -45,9 +52,10 @@ func (c *Capacity) Create(ctx context.Context, packings []*cloudprovider.Packing
 				},
 				Status: v1.NodeStatus{
 					Allocatable: v1.ResourceList{
-						v1.ResourcePods:   *packing.InstanceTypeOptions[0].Pods(),
-						v1.ResourceCPU:    *packing.InstanceTypeOptions[0].CPU(),
-						v1.ResourceMemory: *packing.InstanceTypeOptions[0].Memory(),
+						v1.ResourcePods:             *packing.InstanceTypeOptions[0].Pods(),
+						v1.ResourceCPU:              *packing.InstanceTypeOptions[0].CPU(),
+						v1.ResourceMemory:           *packing.InstanceTypeOptions[0].Memory(),
+						v1.ResourceEphemeralStorage: *packing.InstanceTypeOptions[0].EphemeralStorage(),
 					},
 				},
 			},
@@ -57,7 +65,13 @@ func (c *Capacity) Create(ctx context.Context, packings []*cloudprovider.Packing
 	return packedNodes, nil
 }
 
-func (c *Capacity) Delete(ctx context.Context, nodes []*v1.Node) error {
+func (c *Capacity) Delete(ctx context.Context, nodes []*v1.Node, reason string) error {
+	for _, node := range nodes {
+		c.factory.DeletedNodes = append(c.factory.DeletedNodes, node.Name)
+		if c.factory.TerminationReasons != nil {
+			c.factory.TerminationReasons[node.Name] = reason
+		}
+	}
 	return nil
 }
 
@@ -93,6 +107,14 @@ func (c *Capacity) GetInstanceTypes(ctx context.Context) ([]cloudprovider.Instan
 			name:          "arm-instance-type",
 			architectures: []string{"arm64"},
 		}),
+		NewInstanceType(InstanceTypeOptions{
+			name:             "large-ephemeral-storage-instance-type",
+			ephemeralStorage: resource.MustParse("200Gi"),
+		}),
+		NewInstanceType(InstanceTypeOptions{
+			name:      "hugepages-instance-type",
+			hugePages: v1.ResourceList{"hugepages-2Mi": resource.MustParse("1Gi")},
+		}),
 	}, nil
 }
 
@@ -110,6 +132,10 @@ func (c *Capacity) GetOperatingSystems(ctx context.Context) ([]string, error) {
 	}, nil
 }
 
+func (c *Capacity) GetUnavailableOfferings(ctx context.Context) []v1alpha1.UnavailableOffering {
+	return nil
+}
+
 func (c *Capacity) Validate(ctx context.Context) error {
 	return nil
 }
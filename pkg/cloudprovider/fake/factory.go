@@ -30,12 +30,27 @@ type Factory struct {
 	// NodeReplicas is used by tests to control observed replicas.
 	NodeReplicas    map[string]*int32
 	NodeGroupStable bool
+	// DeletedNodes are the names of nodes deleted from the cloud provider
+	DeletedNodes []string
+	// TerminationReasons of deleted nodes, by name
+	TerminationReasons map[string]string
+	// ManagedLabelKey is applied to created nodes
+	ManagedLabelKey string
+	// CreateErr fails the creation of capacity, e.g. to simulate insufficient
+	// capacity
+	CreateErr error
 }
 
 func NewFactory(options cloudprovider.Options) *Factory {
+	managedLabelKey := options.ManagedLabelKey
+	if managedLabelKey == "" {
+		managedLabelKey = provisioning.DefaultManagedLabelKey
+	}
 	return &Factory{
-		NodeReplicas:    make(map[string]*int32),
-		NodeGroupStable: true,
+		NodeReplicas:       make(map[string]*int32),
+		NodeGroupStable:    true,
+		ManagedLabelKey:    managedLabelKey,
+		TerminationReasons: map[string]string{},
 	}
 }
 
@@ -44,5 +59,5 @@ func NewNotImplementedFactory() *Factory {
 }
 
 func (f *Factory) CapacityFor(provisioner *provisioning.Provisioner) cloudprovider.Capacity {
-	return &Capacity{}
+	return &Capacity{factory: f}
 }
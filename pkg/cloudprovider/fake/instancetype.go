@@ -38,6 +38,9 @@ func NewInstanceType(options InstanceTypeOptions) *InstanceType {
 	if options.pods.IsZero() {
 		options.pods = resource.MustParse("5")
 	}
+	if options.ephemeralStorage.IsZero() {
+		options.ephemeralStorage = resource.MustParse("20Gi")
+	}
 	return &InstanceType{
 		InstanceTypeOptions: InstanceTypeOptions{
 			name:             options.name,
@@ -50,6 +53,8 @@ func NewInstanceType(options InstanceTypeOptions) *InstanceType {
 			nvidiaGPUs:       options.nvidiaGPUs,
 			amdGPUs:          options.amdGPUs,
 			awsNeurons:       options.awsNeurons,
+			ephemeralStorage: options.ephemeralStorage,
+			hugePages:        options.hugePages,
 		},
 	}
 }
@@ -65,6 +70,8 @@ type InstanceTypeOptions struct {
 	nvidiaGPUs       resource.Quantity
 	amdGPUs          resource.Quantity
 	awsNeurons       resource.Quantity
+	ephemeralStorage resource.Quantity
+	hugePages        v1.ResourceList
 }
 
 type InstanceType struct {
@@ -111,6 +118,14 @@ func (i *InstanceType) AWSNeurons() *resource.Quantity {
 	return &i.awsNeurons
 }
 
+func (i *InstanceType) EphemeralStorage() *resource.Quantity {
+	return &i.ephemeralStorage
+}
+
+func (i *InstanceType) HugePages() v1.ResourceList {
+	return i.hugePages
+}
+
 func (i *InstanceType) Overhead() v1.ResourceList {
 	return v1.ResourceList{}
 }
@@ -21,6 +21,12 @@ import (
 	"github.com/awslabs/karpenter/pkg/cloudprovider/aws"
 )
 
-func NewFactory(options cloudprovider.Options) cloudprovider.Factory {
-	return aws.NewFactory(options)
+func init() {
+	Register("aws", func(options cloudprovider.Options) (cloudprovider.Factory, error) {
+		factory, err := aws.NewFactory(options)
+		if err != nil {
+			return nil, err
+		}
+		return factory, nil
+	})
 }
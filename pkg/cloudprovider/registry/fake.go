@@ -21,6 +21,8 @@ import (
 	"github.com/awslabs/karpenter/pkg/cloudprovider/fake"
 )
 
-func NewFactory(cloudprovider.Options) cloudprovider.Factory {
-	return fake.NewNotImplementedFactory()
+func init() {
+	Register("fake", func(cloudprovider.Options) (cloudprovider.Factory, error) {
+		return fake.NewNotImplementedFactory(), nil
+	})
 }
@@ -0,0 +1,74 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
+)
+
+// Constructor builds a cloud provider's factory from the options
+type Constructor func(cloudprovider.Options) (cloudprovider.Factory, error)
+
+var (
+	mu           sync.Mutex
+	constructors = map[string]Constructor{}
+)
+
+// Register makes a cloud provider selectable by name. Providers register from
+// the init functions of files in this package, built with their build tags.
+// Registering a name twice panics.
+func Register(name string, constructor Constructor) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := constructors[name]; ok {
+		panic(fmt.Sprintf("cloud provider %s is already registered", name))
+	}
+	constructors[name] = constructor
+}
+
+// Names returns the names of the registered cloud providers, sorted
+func Names() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	names := []string{}
+	for name := range constructors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewFactory constructs the named cloud provider. If the name is empty, the
+// only registered cloud provider is constructed.
+func NewFactory(name string, options cloudprovider.Options) (cloudprovider.Factory, error) {
+	names := Names()
+	if name == "" {
+		if len(names) != 1 {
+			return nil, fmt.Errorf("cloud provider must be one of %v", names)
+		}
+		name = names[0]
+	}
+	mu.Lock()
+	constructor, ok := constructors[name]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("cloud provider %s is not registered, must be one of %v", name, names)
+	}
+	return constructor(options)
+}
@@ -0,0 +1,58 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"testing"
+
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/cloudprovider/fake"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestRegistry(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Registry Suite")
+}
+
+var testFactory = fake.NewFactory(cloudprovider.Options{})
+
+var _ = BeforeSuite(func() {
+	Register("test", func(cloudprovider.Options) (cloudprovider.Factory, error) { return testFactory, nil })
+})
+
+var _ = Describe("Registry", func() {
+	It("should construct registered cloud providers by name", func() {
+		Expect(Names()).To(ContainElement("test"))
+		factory, err := NewFactory("test", cloudprovider.Options{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(factory).To(BeIdenticalTo(testFactory))
+	})
+	It("should reject unregistered cloud providers", func() {
+		_, err := NewFactory("unregistered", cloudprovider.Options{})
+		Expect(err).To(MatchError(ContainSubstring("cloud provider unregistered is not registered")))
+	})
+	It("should require a name when several cloud providers are registered", func() {
+		_, err := NewFactory("", cloudprovider.Options{})
+		Expect(err).To(HaveOccurred())
+	})
+	It("should reject registering a name twice", func() {
+		Expect(func() {
+			Register("test", func(cloudprovider.Options) (cloudprovider.Factory, error) { return testFactory, nil })
+		}).To(Panic())
+	})
+})
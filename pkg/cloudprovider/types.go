@@ -16,12 +16,14 @@ package cloudprovider
 
 import (
 	"context"
+	"time"
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/client-go/kubernetes"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 )
 
 // Factory instantiates the cloud provider's resources
@@ -30,12 +32,38 @@ type Factory interface {
 	CapacityFor(provisioner *v1alpha1.Provisioner) Capacity
 }
 
+// Notifier is optionally implemented by factories whose resources can change
+// outside of Kubernetes. An event is sent for each provisioner that references
+// a changed resource, so that it's reconciled without waiting for its interval.
+type Notifier interface {
+	Notify() <-chan event.GenericEvent
+}
+
+// AllocatableObserver is optionally implemented by capacity whose instance
+// types' allocatable resources are estimated. Ready nodes are observed with the
+// allocatable resources they report, so that estimates converge on what nodes
+// of each instance type actually offer.
+type AllocatableObserver interface {
+	ObserveAllocatable(ctx context.Context, node *v1.Node)
+}
+
+// ConfigurationChecker is optionally implemented by capacity whose
+// configuration can be checked beyond validation, e.g. against permissions
+// that are managed outside of Kubernetes. Problems don't deny provisioners or
+// prevent launches, since they may be fixed at any time, but are surfaced as a
+// warning. CheckConfiguration returns the warning, or empty if there are none.
+type ConfigurationChecker interface {
+	CheckConfiguration(ctx context.Context) string
+}
+
 // Capacity provisions a set of nodes that fulfill a set of constraints.
 type Capacity interface {
 	// Create a set of nodes for each of the given constraints.
 	Create(context.Context, []*Packing) ([]*PackedNode, error)
-	// Delete nodes in cloudprovider
-	Delete(context.Context, []*v1.Node) error
+	// Delete nodes in cloudprovider. Cloud providers may record the reason
+	// they're terminated, e.g. v1alpha1.TerminationReasonTTLEmpty, on their
+	// instances.
+	Delete(ctx context.Context, nodes []*v1.Node, reason string) error
 	// GetInstanceTypes returns the instance types supported by the cloud
 	// provider limited by the provided constraints and daemons.
 	GetInstanceTypes(ctx context.Context) ([]InstanceType, error)
@@ -45,6 +73,9 @@ type Capacity interface {
 	GetArchitectures(context.Context) ([]string, error)
 	// GetOperatingSystems returns the operating systems supported by the cloud provider.
 	GetOperatingSystems(context.Context) ([]string, error)
+	// GetUnavailableOfferings returns the instance types and zones that
+	// recently failed to launch due to insufficient capacity.
+	GetUnavailableOfferings(context.Context) []v1alpha1.UnavailableOffering
 	// Validate cloud provider specific components of the cluster spec
 	Validate(context.Context) error
 }
@@ -58,6 +89,30 @@ type Packing struct {
 	Constraints         *v1alpha1.Constraints
 }
 
+// LaunchIntentOf returns the recorded intent to launch capacity for the pods,
+// or "" if it isn't recorded. It's recorded on the pod with the lowest UID, so
+// that launches write once per node rather than once per pod. Providers should
+// derive idempotency tokens from it, so that a restarted controller launching
+// for the same pods reconciles the launch rather than repeating it.
+func LaunchIntentOf(pods []*v1.Pod) string {
+	if holder := LaunchIntentHolder(pods); holder != nil {
+		return holder.Annotations[v1alpha1.LaunchIntentKey]
+	}
+	return ""
+}
+
+// LaunchIntentHolder returns the pod that records the launch intent of the
+// pods, or nil if there are no pods
+func LaunchIntentHolder(pods []*v1.Pod) *v1.Pod {
+	var holder *v1.Pod
+	for _, pod := range pods {
+		if holder == nil || pod.UID < holder.UID {
+			holder = pod
+		}
+	}
+	return holder
+}
+
 // PackedNode is a node object and the pods that should be bound to it. It is
 // expected that the pods in a cloudprovider.Packing will be equivalent to the
 // pods in a cloudprovider.PackedNode.
@@ -70,6 +125,49 @@ type PackedNode struct {
 type Options struct {
 	Client    client.Client
 	ClientSet *kubernetes.Clientset
+	// LaunchTemplateNamePrefix is prepended to the names of launch templates
+	// created by cloud providers that support them.
+	LaunchTemplateNamePrefix string
+	// VMMemoryOverheadFraction of an instance type's memory is considered to be
+	// reserved by the hypervisor, kernel, and firmware. If unset, cloud
+	// providers use their own default.
+	VMMemoryOverheadFraction *float64
+	// LaunchIdempotencyWindow is how long launches for the same pods are
+	// deduplicated by cloud providers that support idempotent launches. Zero
+	// deduplicates indefinitely. If unset, cloud providers use their own default.
+	LaunchIdempotencyWindow *time.Duration
+	// LaunchTimeout bounds each call to the cloud provider to launch capacity,
+	// so that a hung call is cancelled and retried rather than blocking
+	// provisioning. Zero disables the timeout. If unset, cloud providers use
+	// their own default.
+	LaunchTimeout *time.Duration
+	// DebugBindAddress serves cloud providers' debug endpoints, e.g. the
+	// contents of their caches, if set. Debug endpoints are disabled if empty.
+	DebugBindAddress string
+	// MaxConnsPerHost limits the connections that cloud providers' API
+	// clients open to each host. Zero is unlimited. If unset, cloud providers
+	// use their own default.
+	MaxConnsPerHost *int
+	// MaxIdleConnsPerHost is how many connections cloud providers' API clients
+	// keep open to each host for reuse. If unset, cloud providers use their
+	// own default.
+	MaxIdleConnsPerHost *int
+	// ManagedLabelKey is applied to nodes launched by cloud providers with the
+	// value "true", so that they're distinguished from nodes that aren't
+	// managed by Karpenter. If empty, v1alpha1.DefaultManagedLabelKey is used.
+	ManagedLabelKey string
+	// DisableInstanceProfileCheck skips checking that nodes' instance profile
+	// has the permissions they need to join the cluster, for cloud providers
+	// that check it.
+	DisableInstanceProfileCheck bool
+	// InterruptionQueueName is a queue of notices that instances will be
+	// interrupted, which cloud providers that support it consume to drain the
+	// instances' nodes beforehand. Notices aren't consumed if empty.
+	InterruptionQueueName string
+	// HandleRebalanceRecommendations also drains the nodes of instances that
+	// are recommended for rebalancing, i.e. at elevated risk of interruption,
+	// rather than only those about to be interrupted.
+	HandleRebalanceRecommendations bool
 }
 
 // InstanceType describes the properties of a potential node
@@ -84,5 +182,11 @@ type InstanceType interface {
 	NvidiaGPUs() *resource.Quantity
 	AMDGPUs() *resource.Quantity
 	AWSNeurons() *resource.Quantity
+	// EphemeralStorage is the capacity available to pods' ephemeral storage
+	EphemeralStorage() *resource.Quantity
+	// HugePages are the preallocated huge pages of each page size, e.g.
+	// hugepages-2Mi. Instance types without preallocated huge pages return
+	// an empty list.
+	HugePages() v1.ResourceList
 	Overhead() v1.ResourceList
 }
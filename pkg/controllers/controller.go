@@ -16,12 +16,18 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 
 	"go.uber.org/zap"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
@@ -31,6 +37,9 @@ import (
 type GenericController struct {
 	Controller
 	client.Client
+	// RequeueJitter is the fraction of the controller's interval that's added
+	// at random to each requeue, e.g. 0.1 requeues within 10% of the interval
+	RequeueJitter float64
 }
 
 // Reconcile executes a control loop for the resource
@@ -39,6 +48,9 @@ func (c *GenericController) Reconcile(ctx context.Context, req reconcile.Request
 	resource := c.For()
 	if err := c.Get(ctx, req.NamespacedName, resource); err != nil {
 		if errors.IsNotFound(err) {
+			if observer, ok := c.Controller.(DeletionObservingController); ok {
+				observer.Deleted(ctx, req.NamespacedName)
+			}
 			return reconcile.Result{}, nil
 		}
 		return reconcile.Result{}, err
@@ -54,9 +66,74 @@ func (c *GenericController) Reconcile(ctx context.Context, req reconcile.Request
 	} else {
 		resource.StatusConditions().MarkTrue(v1alpha1.Active)
 	}
-	// 4. Update Status using a merge patch
-	if err := c.Status().Patch(ctx, resource, client.MergeFrom(persisted)); err != nil {
+	// 4. Update Status using a merge patch, retrying conflicts
+	if err := c.patchStatus(ctx, req, resource, persisted); err != nil {
 		return reconcile.Result{}, fmt.Errorf("Failed to persist changes to %s, %w", req.NamespacedName, err)
 	}
-	return reconcile.Result{RequeueAfter: c.Interval()}, nil
+	return reconcile.Result{RequeueAfter: c.requeueAfter(resource)}, nil
+}
+
+// requeueAfter jitters the controller's interval, so that resources reconciled
+// together, e.g. after a restart, spread their periodic reconciles out rather
+// than reconciling in lockstep. Periodic requeues are never sooner than the
+// interval, but controllers may requeue sooner when a deferred action is due.
+func (c *GenericController) requeueAfter(resource Object) time.Duration {
+	interval := c.Interval()
+	if interval > 0 && c.RequeueJitter > 0 {
+		interval = wait.Jitter(interval, c.RequeueJitter)
+	}
+	if requeueing, ok := c.Controller.(RequeueingController); ok {
+		if due := requeueing.RequeueAfter(resource); due > 0 && (interval <= 0 || due < interval) {
+			return due
+		}
+	}
+	return interval
+}
+
+// patchStatus persists the changes made to the resource's status with
+// optimistic concurrency. If another writer updated the resource since it was
+// read, the changes are reapplied to the latest version rather than
+// overwriting it, so that neither writer's changes are lost.
+func (c *GenericController) patchStatus(ctx context.Context, req reconcile.Request, resource Object, persisted runtime.Object) error {
+	changes, err := client.MergeFrom(persisted).Data(resource)
+	if err != nil {
+		return fmt.Errorf("computing status changes, %w", err)
+	}
+	if string(changes) == "{}" {
+		return nil
+	}
+	latest := resource
+	conflicted := false
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if conflicted {
+			latest = c.For()
+			if err := c.Get(ctx, req.NamespacedName, latest); err != nil {
+				return err
+			}
+			zap.S().Debugf("Retrying status update of %s after a conflict", req.NamespacedName)
+		}
+		patch, err := withResourceVersion(changes, latest.GetResourceVersion())
+		if err != nil {
+			return err
+		}
+		err = c.Status().Patch(ctx, latest, client.RawPatch(types.MergePatchType, patch))
+		conflicted = errors.IsConflict(err)
+		return err
+	})
+}
+
+// withResourceVersion adds the resource version to a merge patch, which the
+// API server rejects with a conflict if the resource has since changed
+func withResourceVersion(patch []byte, resourceVersion string) ([]byte, error) {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return nil, fmt.Errorf("unmarshaling patch, %w", err)
+	}
+	metadata, ok := fields["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = map[string]interface{}{}
+		fields["metadata"] = metadata
+	}
+	metadata["resourceVersion"] = resourceVersion
+	return json.Marshal(fields)
 }
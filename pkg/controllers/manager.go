@@ -16,6 +16,7 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/awslabs/karpenter/pkg/apis"
@@ -30,6 +31,7 @@ import (
 	controllerruntime "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
@@ -46,16 +48,25 @@ func init() {
 
 type GenericControllerManager struct {
 	manager.Manager
+	// requeueJitter is the fraction of each controller's interval that's added
+	// at random to its requeues
+	requeueJitter float64
 }
 
-// NewManagerOrDie instantiates a controller manager or panics
-func NewManagerOrDie(config *rest.Config, options controllerruntime.Options) Manager {
+// NewManagerOrDie instantiates a controller manager or panics. The webhook
+// server is configured by options.Host, options.Port, and options.CertDir.
+// Controllers' periodic requeues are jittered by up to requeueJitter of their
+// intervals, which must be in [0, 1].
+func NewManagerOrDie(config *rest.Config, options controllerruntime.Options, requeueJitter float64) Manager {
+	if requeueJitter < 0 || requeueJitter > 1 {
+		log.PanicIfError(fmt.Errorf("requeue jitter must be in [0, 1], got %v", requeueJitter), "Invalid requeue jitter")
+	}
 	options.Scheme = scheme
 	manager, err := controllerruntime.NewManager(config, options)
 	log.PanicIfError(err, "Failed to create controller manager")
 	log.PanicIfError(manager.GetFieldIndexer().
 		IndexField(context.Background(), &v1.Pod{}, "spec.nodeName", podSchedulingIndex), "Failed to setup pod indexer")
-	return &GenericControllerManager{Manager: manager}
+	return &GenericControllerManager{Manager: manager, requeueJitter: requeueJitter}
 }
 
 // RegisterControllers registers a set of controllers to the controller manager
@@ -75,7 +86,12 @@ func (m *GenericControllerManager) RegisterControllers(controllers ...Controller
 		for _, resource := range c.Owns() {
 			builder = builder.Owns(resource)
 		}
-		log.PanicIfError(builder.Complete(&GenericController{Controller: c, Client: m.GetClient()}),
+		if watchingController, ok := c.(WatchingController); ok {
+			for _, source := range watchingController.Watches() {
+				builder = builder.Watches(source, &handler.EnqueueRequestForObject{})
+			}
+		}
+		log.PanicIfError(builder.Complete(&GenericController{Controller: c, Client: m.GetClient(), RequeueJitter: m.requeueJitter}),
 			"Failed to register controller to manager for %s", controlledObject)
 		log.PanicIfError(controllerruntime.NewWebhookManagedBy(m).For(controlledObject).Complete(),
 			"Failed to register controller to manager for %s", controlledObject)
@@ -17,18 +17,25 @@ package allocation
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+	utilsnode "github.com/awslabs/karpenter/pkg/utils/node"
 	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type Binder struct {
-	kubeClient   client.Client
-	coreV1Client corev1.CoreV1Interface
+	kubeClient     client.Client
+	coreV1Client   corev1.CoreV1Interface
+	nodeValidation bool
+	clock          clock.Clock
 }
 
 func (b *Binder) Bind(ctx context.Context, node *v1.Node, pods []*v1.Pod) error {
@@ -44,7 +51,27 @@ func (b *Binder) Bind(ctx context.Context, node *v1.Node, pods []*v1.Pod) error
 		Type:   v1.NodeReady,
 		Status: v1.ConditionUnknown,
 	}}
-	// 2. Idempotently create a node. In rare cases, nodes can come online and
+	// 2. Record the taints applied from the provisioner's spec, so that they
+	// can be reconciled if the provisioner's taints change later on.
+	if err := utilsnode.SetManagedTaints(node, node.Spec.Taints); err != nil {
+		return fmt.Errorf("recording taints for node %s, %w", node.Name, err)
+	}
+	// 3. Keep workloads off the node until the validation hook accepts it.
+	// The taint isn't managed, so it isn't reconciled with the provisioner's.
+	if b.nodeValidation && !hasTaint(node, v1alpha1.ValidationPendingTaintKey) {
+		node.Spec.Taints = append(node.Spec.Taints, v1.Taint{
+			Key:    v1alpha1.ValidationPendingTaintKey,
+			Effect: v1.TaintEffectNoSchedule,
+		})
+	}
+	// 4. Record when the instance launched, the first initialization stage.
+	// Retries of tracked nodes keep the original launch time.
+	if _, ok := node.Annotations[v1alpha1.ProvisionerInstanceLaunchedKey]; !ok {
+		node.Annotations = functional.UnionStringMaps(node.Annotations, map[string]string{
+			v1alpha1.ProvisionerInstanceLaunchedKey: b.clock.Now().Format(time.RFC3339),
+		})
+	}
+	// 5. Idempotently create a node. In rare cases, nodes can come online and
 	// self register before the controller is able to register a node object
 	// with the API server. In the common case, we create the node object
 	// ourselves to enforce the binding decision and enable images to be pulled
@@ -55,7 +82,7 @@ func (b *Binder) Bind(ctx context.Context, node *v1.Node, pods []*v1.Pod) error
 		}
 	}
 
-	// 3. Bind pods
+	// 6. Bind pods
 	for _, pod := range pods {
 		if err := b.bind(ctx, node, pod); err != nil {
 			zap.S().Errorf("Continuing after failing to bind, %s", err.Error())
@@ -75,3 +102,12 @@ func (b *Binder) bind(ctx context.Context, node *v1.Node, pod *v1.Pod) error {
 	}
 	return nil
 }
+
+func hasTaint(node *v1.Node, key string) bool {
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == key {
+			return true
+		}
+	}
+	return false
+}
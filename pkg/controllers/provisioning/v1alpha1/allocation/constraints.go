@@ -21,6 +21,7 @@ import (
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 	"github.com/awslabs/karpenter/pkg/packing"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
 	"github.com/mitchellh/hashstructure/v2"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
@@ -49,8 +50,8 @@ func (c *Constraints) Group(ctx context.Context, provisioner *v1alpha1.Provision
 		if _, ok := groups[key]; !ok {
 			// Uses a theoretical node object to compute schedulablility of daemonset overhead.
 			daemons, err := c.getDaemons(ctx, &v1.Node{
-				ObjectMeta: metav1.ObjectMeta{Labels: constraints.Labels},
-				Spec:       v1.NodeSpec{Taints: provisioner.Spec.Taints},
+				ObjectMeta: metav1.ObjectMeta{Labels: nodeLabelsFor(constraints)},
+				Spec:       v1.NodeSpec{Taints: constraints.Taints},
 			})
 			if err != nil {
 				return nil, fmt.Errorf("computing node overhead, %w", err)
@@ -72,6 +73,25 @@ func (c *Constraints) Group(ctx context.Context, provisioner *v1alpha1.Provision
 	return result, nil
 }
 
+// nodeLabelsFor returns the labels that nodes launched for the constraints are
+// known to have, which daemonsets commonly select upon.
+func nodeLabelsFor(constraints *v1alpha1.Constraints) map[string]string {
+	labels := map[string]string{}
+	if constraints.Architecture != nil {
+		labels[v1alpha1.ArchitectureLabelKey] = *constraints.Architecture
+	}
+	if constraints.OperatingSystem != nil {
+		labels[v1alpha1.OperatingSystemLabelKey] = *constraints.OperatingSystem
+	}
+	if len(constraints.Zones) == 1 {
+		labels[v1alpha1.ZoneLabelKey] = constraints.Zones[0]
+	}
+	if len(constraints.InstanceTypes) == 1 {
+		labels[v1alpha1.InstanceTypeLabelKey] = constraints.InstanceTypes[0]
+	}
+	return functional.UnionStringMaps(labels, constraints.Labels)
+}
+
 func (c *Constraints) getDaemons(ctx context.Context, node *v1.Node) ([]*v1.Pod, error) {
 	// 1. Get DaemonSets
 	daemonSetList := &appsv1.DaemonSetList{}
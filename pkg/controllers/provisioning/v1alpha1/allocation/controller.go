@@ -16,7 +16,11 @@ package allocation
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
@@ -24,18 +28,84 @@ import (
 	"github.com/awslabs/karpenter/pkg/controllers"
 	"github.com/awslabs/karpenter/pkg/packing"
 	"github.com/awslabs/karpenter/pkg/utils/apiobject"
+	"github.com/awslabs/karpenter/pkg/utils/log"
 	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
+const (
+	// ProvisioningSettingsName is the ConfigMap in Karpenter's namespace which
+	// holds settings that apply to every provisioner
+	ProvisioningSettingsName = "karpenter-global-settings"
+	// ProvisioningEnabledKey disables launches for every provisioner if false
+	ProvisioningEnabledKey = "provisioningEnabled"
+)
+
+// Options configure the allocation controller. Behaviors are disabled by
+// their options' zero values.
+type Options struct {
+	// StartupSettlePeriod defers launches after the first reconcile, so that
+	// capacity which already exists is observed before provisioning more.
+	StartupSettlePeriod time.Duration
+	// BatchWindow defers launches after provisionable pods are first observed,
+	// so that pods arriving together are packed together.
+	BatchWindow time.Duration
+	// NodeCreationFailurePolicy determines whether instances are terminated or
+	// tracked if their nodes fail to be created. Instances are terminated if
+	// it's unset.
+	NodeCreationFailurePolicy NodeCreationFailurePolicy
+	// MetricsLabels of provisioners are promoted to labels of launch metrics
+	MetricsLabels []string
+	// SystemNamespace is the namespace of the global settings ConfigMap
+	SystemNamespace string
+	// MaxNoFitAttempts is how many times pods that don't fit any instance type
+	// are evaluated, with backoff, before they're given up on. Zero never
+	// gives up.
+	MaxNoFitAttempts int
+	// NodeValidation taints new nodes until the validation hook accepts them
+	NodeValidation bool
+}
+
 // Controller for the resource
 type Controller struct {
+	kubeClient    client.Client
 	filter        *Filter
 	binder        *Binder
 	constraints   *Constraints
 	packer        packing.Packer
 	cloudProvider cloudprovider.Factory
+	recorder      record.EventRecorder
+	// startupSettlePeriod defers launches after the first reconcile, so that
+	// capacity which already exists is observed before provisioning more.
+	startupSettlePeriod time.Duration
+	settleOnce          sync.Once
+	settledAt           time.Time
+	// batchWindow defers launches after provisionable pods are first observed,
+	// so that pods arriving together are packed together.
+	batchWindow  time.Duration
+	batchesMutex sync.Mutex
+	batches      map[types.NamespacedName]time.Time
+	// nodeCreationFailurePolicy determines whether instances are terminated or
+	// tracked if their nodes fail to be created.
+	nodeCreationFailurePolicy NodeCreationFailurePolicy
+	trackedMutex              sync.Mutex
+	tracked                   map[types.NamespacedName][]*cloudprovider.PackedNode
+	launchMetrics             *launchMetrics
+	// systemNamespace is the namespace of the global settings ConfigMap
+	systemNamespace string
+	// maxNoFitAttempts is how many times pods that don't fit any instance type
+	// are evaluated, with backoff, before they're given up on
+	maxNoFitAttempts int
+	noFitsMutex      sync.Mutex
+	noFits           map[types.UID]*noFit
+	clock            clock.Clock
 }
 
 // For returns the resource this controller is for.
@@ -48,6 +118,38 @@ func (c *Controller) Owns() []controllers.Object {
 	return []controllers.Object{}
 }
 
+// Watches returns the cloud provider's notifications of changed resources, if
+// the cloud provider supports them.
+func (c *Controller) Watches() []source.Source {
+	notifier, ok := c.cloudProvider.(cloudprovider.Notifier)
+	if !ok {
+		return nil
+	}
+	return []source.Source{&source.Channel{Source: notifier.Notify()}}
+}
+
+// Deleted deletes the metrics of deleted provisioners
+func (c *Controller) Deleted(_ context.Context, key types.NamespacedName) {
+	c.launchMetrics.deleted(key)
+	deleteUnschedulable(key)
+}
+
+// RequeueAfter requeues the provisioner once launches that were deferred while
+// caches settled or pending pods were batched are due, since the deferrals are
+// usually shorter than the controller's interval
+func (c *Controller) RequeueAfter(object controllers.Object) time.Duration {
+	if remaining := c.settledAt.Sub(c.clock.Now()); remaining > 0 {
+		return remaining
+	}
+	c.batchesMutex.Lock()
+	defer c.batchesMutex.Unlock()
+	closesAt, ok := c.batches[apiobject.NamespacedName(object)]
+	if !ok {
+		return 0
+	}
+	return closesAt.Sub(c.clock.Now())
+}
+
 func (c *Controller) Interval() time.Duration {
 	return 5 * time.Second
 }
@@ -57,25 +159,91 @@ func (c *Controller) Name() string {
 }
 
 // NewController constructs a controller instance
-func NewController(kubeClient client.Client, coreV1Client corev1.CoreV1Interface, cloudProvider cloudprovider.Factory) *Controller {
+func NewController(kubeClient client.Client, coreV1Client corev1.CoreV1Interface, cloudProvider cloudprovider.Factory, recorder record.EventRecorder, options Options) *Controller {
+	launchMetrics, err := newLaunchMetrics(options.MetricsLabels)
+	log.PanicIfError(err, "Unable to register launch metrics")
+	realClock := clock.RealClock{}
 	return &Controller{
-		cloudProvider: cloudProvider,
-		filter:        &Filter{kubeClient: kubeClient, cloudProvider: cloudProvider},
-		binder:        &Binder{kubeClient: kubeClient, coreV1Client: coreV1Client},
-		constraints:   &Constraints{kubeClient: kubeClient},
-		packer:        packing.NewPacker(),
+		kubeClient:                kubeClient,
+		cloudProvider:             cloudProvider,
+		recorder:                  recorder,
+		filter:                    &Filter{kubeClient: kubeClient, cloudProvider: cloudProvider, recorder: recorder},
+		binder:                    &Binder{kubeClient: kubeClient, coreV1Client: coreV1Client, nodeValidation: options.NodeValidation, clock: realClock},
+		constraints:               &Constraints{kubeClient: kubeClient},
+		packer:                    packing.NewPacker(),
+		startupSettlePeriod:       options.StartupSettlePeriod,
+		batchWindow:               options.BatchWindow,
+		batches:                   map[types.NamespacedName]time.Time{},
+		nodeCreationFailurePolicy: options.NodeCreationFailurePolicy,
+		tracked:                   map[types.NamespacedName][]*cloudprovider.PackedNode{},
+		launchMetrics:             launchMetrics,
+		systemNamespace:           options.SystemNamespace,
+		maxNoFitAttempts:          options.MaxNoFitAttempts,
+		noFits:                    map[types.UID]*noFit{},
+		clock:                     realClock,
 	}
 }
 
 // Reconcile executes an allocation control loop for the resource
 func (c *Controller) Reconcile(ctx context.Context, object controllers.Object) error {
 	provisioner := object.(*v1alpha1.Provisioner)
+	unschedulable := map[string]int{}
+	defer c.reportUnschedulable(provisioner, unschedulable)
+	capacity := c.cloudProvider.CapacityFor(provisioner)
+	provisioner.Status.UnavailableOfferings = capacity.GetUnavailableOfferings(ctx)
+	provisioner.Status.Preview = nil
+	zones, err := capacity.GetZones(ctx)
+	if err != nil {
+		return fmt.Errorf("getting zones, %w", err)
+	}
+	if !c.subnetsMatched(provisioner, zones) {
+		return nil
+	}
+	c.nodesConfigured(ctx, provisioner, capacity)
+	c.retryTracked(ctx, provisioner)
+	if provisioner.Spec.Paused {
+		zap.S().Debugf("Skipping launches for provisioner %s/%s since it's paused", provisioner.Name, provisioner.Namespace)
+		return nil
+	}
+	enabled, err := c.provisioningEnabled(ctx, provisioner)
+	if err != nil {
+		return fmt.Errorf("getting global settings, %w", err)
+	}
+	if !enabled {
+		zap.S().Debugf("Skipping launches for provisioner %s/%s since provisioning is disabled", provisioner.Name, provisioner.Namespace)
+		return nil
+	}
+	remaining, err := c.remainingNodes(ctx, provisioner)
+	if err != nil {
+		return fmt.Errorf("counting nodes, %w", err)
+	}
 	// 1. Filter pods
 	pods, err := c.filter.GetProvisionablePods(ctx, provisioner)
 	if err != nil {
 		return fmt.Errorf("filtering pods, %w", err)
 	}
+	pods = c.untracked(provisioner, pods)
+	var instanceTypes []cloudprovider.InstanceType
+	if len(pods) > 0 {
+		if instanceTypes, err = capacity.GetInstanceTypes(ctx); err != nil {
+			return fmt.Errorf("getting instance types, %w", err)
+		}
+	}
+	pods = c.evaluable(provisioner, instanceTypes, pods)
 	if len(pods) == 0 {
+		c.closeBatch(provisioner)
+		return nil
+	}
+	if remaining == 0 {
+		unschedulable[UnschedulableReasonLimits] = len(pods)
+		return nil
+	}
+	if remaining := c.settling(); remaining > 0 {
+		zap.S().Infof("Deferring %d provisionable pods for %s while caches settle after startup", len(pods), remaining.Round(time.Second))
+		return nil
+	}
+	if remaining := c.batching(provisioner); remaining > 0 {
+		zap.S().Debugf("Deferring %d provisionable pods for %s while batching pending pods", len(pods), remaining)
 		return nil
 	}
 	zap.S().Infof("Found %d provisionable pods", len(pods))
@@ -87,28 +255,254 @@ func (c *Controller) Reconcile(ctx context.Context, object controllers.Object) e
 	}
 
 	// 3. Binpack each group
-	capacity := c.cloudProvider.CapacityFor(provisioner)
 	packings := []*cloudprovider.Packing{}
 	for _, constraintGroup := range constraintGroups {
-		instanceTypes, err := capacity.GetInstanceTypes(ctx)
-		if err != nil {
-			return fmt.Errorf("getting instance types, %w", err)
-		}
+		constraintGroup.Pods = c.schedulable(provisioner, constraintGroup, instanceTypes)
 		packings = append(packings, c.packer.Pack(ctx, constraintGroup, instanceTypes)...)
 	}
+	if len(packings) == 0 {
+		return nil
+	}
+	if len(packings) > remaining {
+		zap.S().Infof("Launching %d of %d nodes for provisioner %s/%s, limited by max nodes", remaining, len(packings), provisioner.Name, provisioner.Namespace)
+		for _, packing := range packings[remaining:] {
+			unschedulable[UnschedulableReasonLimits] += len(packing.Pods)
+		}
+		packings = packings[:remaining]
+	}
+	if err := c.diversify(ctx, provisioner, packings); err != nil {
+		return fmt.Errorf("diversifying instance families, %w", err)
+	}
+	if provisioner.Spec.ObserveOnly {
+		provisioner.Status.Preview = previewFor(packings)
+		zap.S().Infof("Would have launched %d nodes for provisioner %s/%s, skipping since it's observe only", len(packings), provisioner.Name, provisioner.Namespace)
+		return nil
+	}
 
-	// 4. Create packedNodes for packings
+	// 4. Create packedNodes for packings, recording the intent first so that
+	// a restart mid-launch doesn't launch them again
+	c.recordLaunchIntents(ctx, packings)
 	packedNodes, err := capacity.Create(ctx, packings)
 	if err != nil {
+		for _, packing := range packings {
+			unschedulable[UnschedulableReasonNoCapacity] += len(packing.Pods)
+		}
+		var quotaExceededError *cloudprovider.QuotaExceededError
+		if errors.As(err, &quotaExceededError) {
+			c.recorder.Eventf(provisioner, v1.EventTypeWarning, "QuotaExceeded",
+				"Failed to create capacity, request a limit increase for quota %s", quotaExceededError.Quota)
+		}
+		var configurationError *cloudprovider.ConfigurationError
+		if errors.As(err, &configurationError) {
+			c.recorder.Eventf(provisioner, v1.EventTypeWarning, "InvalidConfiguration",
+				"Failed to create capacity, %s", configurationError.Message)
+		}
 		return fmt.Errorf("creating capacity, %w", err)
 	}
+	c.launchMetrics.launched(provisioner, len(packedNodes))
 
-	// 4. Bind pods to nodes
+	provisioner.Status.UnavailableOfferings = capacity.GetUnavailableOfferings(ctx)
+
+	// 5. Bind pods to nodes
 	for _, packedNode := range packedNodes {
 		zap.S().Infof("Binding pods %v to node %s", apiobject.PodNamespacedNames(packedNode.Pods), packedNode.Node.Name)
 		if err := c.binder.Bind(ctx, packedNode.Node, packedNode.Pods); err != nil {
-			zap.S().Errorf("Continuing after failing to bind, %s", err.Error())
+			c.handleNodeCreationFailure(ctx, provisioner, capacity, packedNode, err)
 		}
 	}
 	return nil
 }
+
+// subnetsMatched updates the provisioner's SubnetsMatched condition, and
+// returns false if there are no zones to launch capacity in. The event is
+// only emitted when the condition becomes false, so that operators are alerted
+// at reconcile time rather than silently failing to launch.
+func (c *Controller) subnetsMatched(provisioner *v1alpha1.Provisioner, zones []string) bool {
+	conditions := provisioner.StatusConditions()
+	if len(zones) > 0 {
+		conditions.MarkTrue(v1alpha1.SubnetsMatched)
+		return true
+	}
+	if !conditions.GetCondition(v1alpha1.SubnetsMatched).IsFalse() {
+		c.recorder.Eventf(provisioner, v1.EventTypeWarning, "NoSubnetsMatched",
+			"Failed to discover subnets for cluster, capacity will not be launched until subnets are tagged")
+	}
+	conditions.MarkFalse(v1alpha1.SubnetsMatched, "NoSubnetsMatched", "No subnets matched for cluster")
+	zap.S().Warnf("Failed to discover subnets for provisioner %s/%s", provisioner.Name, provisioner.Namespace)
+	return false
+}
+
+// nodesConfigured updates the provisioner's NodesConfigured condition for
+// cloud providers that check the configuration of nodes. Launches continue
+// regardless, since the configuration may be fixed at any time. The event is
+// only emitted when a problem is first found.
+func (c *Controller) nodesConfigured(ctx context.Context, provisioner *v1alpha1.Provisioner, capacity cloudprovider.Capacity) {
+	checker, ok := capacity.(cloudprovider.ConfigurationChecker)
+	if !ok {
+		return
+	}
+	conditions := provisioner.StatusConditions()
+	warning := checker.CheckConfiguration(ctx)
+	if warning == "" {
+		conditions.MarkTrue(v1alpha1.NodesConfigured)
+		return
+	}
+	if !conditions.GetCondition(v1alpha1.NodesConfigured).IsFalse() {
+		c.recorder.Eventf(provisioner, v1.EventTypeWarning, "NodesMisconfigured", "Nodes may fail to join the cluster, %s", warning)
+	}
+	conditions.MarkFalse(v1alpha1.NodesConfigured, "NodesMisconfigured", "%s", warning)
+	zap.S().Warnf("Nodes of provisioner %s/%s may fail to join the cluster, %s", provisioner.Name, provisioner.Namespace, warning)
+}
+
+// provisioningEnabled updates the provisioner's ProvisioningEnabled condition,
+// and returns false if launches are disabled for every provisioner by the
+// global settings. The event is only emitted when provisioning is first
+// disabled.
+func (c *Controller) provisioningEnabled(ctx context.Context, provisioner *v1alpha1.Provisioner) (bool, error) {
+	enabled, err := c.getProvisioningEnabled(ctx)
+	if err != nil {
+		return false, err
+	}
+	conditions := provisioner.StatusConditions()
+	if enabled {
+		conditions.MarkTrue(v1alpha1.ProvisioningEnabled)
+		return true, nil
+	}
+	if !conditions.GetCondition(v1alpha1.ProvisioningEnabled).IsFalse() {
+		zap.S().Warnf("Skipping launches for provisioner %s/%s since provisioning is disabled by %s/%s", provisioner.Name, provisioner.Namespace, c.systemNamespace, ProvisioningSettingsName)
+		c.recorder.Eventf(provisioner, v1.EventTypeWarning, "ProvisioningDisabled",
+			"Provisioning is disabled for all provisioners by %s in configmap %s/%s", ProvisioningEnabledKey, c.systemNamespace, ProvisioningSettingsName)
+	}
+	conditions.MarkFalse(v1alpha1.ProvisioningEnabled, "ProvisioningDisabled",
+		"Provisioning is disabled for all provisioners by %s in configmap %s/%s", ProvisioningEnabledKey, c.systemNamespace, ProvisioningSettingsName)
+	return false, nil
+}
+
+// getProvisioningEnabled returns false if launches are disabled by the global
+// settings ConfigMap, which is read through the manager's cache. Provisioning
+// is enabled if it doesn't exist.
+func (c *Controller) getProvisioningEnabled(ctx context.Context) (bool, error) {
+	configMap := &v1.ConfigMap{}
+	err := c.kubeClient.Get(ctx, types.NamespacedName{Namespace: c.systemNamespace, Name: ProvisioningSettingsName}, configMap)
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("getting configmap %s/%s, %w", c.systemNamespace, ProvisioningSettingsName, err)
+	}
+	value, ok := configMap.Data[ProvisioningEnabledKey]
+	if !ok {
+		return true, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("parsing %s, %w", ProvisioningEnabledKey, err)
+	}
+	return enabled, nil
+}
+
+// remainingNodes updates the provisioner's BelowMaxNodes condition, and
+// returns the number of nodes that may be launched before the provisioner
+// reaches spec.maxNodes. Nodes are counted by the provisioner's labels, so
+// launches resume as nodes are removed.
+func (c *Controller) remainingNodes(ctx context.Context, provisioner *v1alpha1.Provisioner) (int, error) {
+	conditions := provisioner.StatusConditions()
+	if provisioner.Spec.MaxNodes == nil {
+		conditions.MarkTrue(v1alpha1.BelowMaxNodes)
+		return math.MaxInt32, nil
+	}
+	nodes := &v1.NodeList{}
+	if err := c.kubeClient.List(ctx, nodes, client.MatchingLabels(map[string]string{
+		v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+		v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+	})); err != nil {
+		return 0, fmt.Errorf("listing nodes, %w", err)
+	}
+	remaining := int(*provisioner.Spec.MaxNodes) - len(nodes.Items)
+	if remaining > 0 {
+		conditions.MarkTrue(v1alpha1.BelowMaxNodes)
+		return remaining, nil
+	}
+	if !conditions.GetCondition(v1alpha1.BelowMaxNodes).IsFalse() {
+		c.recorder.Eventf(provisioner, v1.EventTypeWarning, "MaxNodesReached",
+			"Provisioner has %d nodes, capacity will not be launched until nodes are removed", len(nodes.Items))
+	}
+	conditions.MarkFalse(v1alpha1.BelowMaxNodes, "MaxNodesReached", "Provisioner has %d of %d nodes", len(nodes.Items), *provisioner.Spec.MaxNodes)
+	return 0, nil
+}
+
+// previewFor returns the nodes that would be launched for the packings
+func previewFor(packings []*cloudprovider.Packing) []v1alpha1.PreviewNode {
+	preview := []v1alpha1.PreviewNode{}
+	for _, packing := range packings {
+		instanceTypes := []string{}
+		for _, instanceType := range packing.InstanceTypeOptions {
+			instanceTypes = append(instanceTypes, instanceType.Name())
+		}
+		preview = append(preview, v1alpha1.PreviewNode{InstanceTypes: instanceTypes, Pods: int32(len(packing.Pods))})
+	}
+	return preview
+}
+
+// settling returns how long launches remain deferred after startup. The
+// settle period starts on the first reconcile, which controller-runtime runs
+// once the manager's caches have synced, and gives capacity launched by a
+// previous leader time to be observed before provisioning more.
+func (c *Controller) settling() time.Duration {
+	c.settleOnce.Do(func() { c.settledAt = c.clock.Now().Add(c.startupSettlePeriod) })
+	return c.settledAt.Sub(c.clock.Now())
+}
+
+// batching returns how long launches for the provisioner remain deferred
+// while pending pods are batched. The batch opens when provisionable pods are
+// first observed, and closes once the window has elapsed, so that pods which
+// arrive within the window are packed into fewer nodes.
+func (c *Controller) batching(provisioner *v1alpha1.Provisioner) time.Duration {
+	if c.batchWindow <= 0 {
+		return 0
+	}
+	c.batchesMutex.Lock()
+	defer c.batchesMutex.Unlock()
+	key := apiobject.NamespacedName(provisioner)
+	closesAt, ok := c.batches[key]
+	if !ok {
+		closesAt = c.clock.Now().Add(c.batchWindow)
+		c.batches[key] = closesAt
+	}
+	remaining := closesAt.Sub(c.clock.Now())
+	if remaining <= 0 {
+		delete(c.batches, key)
+	}
+	return remaining
+}
+
+// closeBatch discards the provisioner's batch, e.g. if its pods were
+// scheduled elsewhere before it closed
+func (c *Controller) closeBatch(provisioner *v1alpha1.Provisioner) {
+	c.batchesMutex.Lock()
+	defer c.batchesMutex.Unlock()
+	delete(c.batches, apiobject.NamespacedName(provisioner))
+}
+
+// schedulable returns the pods whose resource requests fit at least one of the
+// viable instance types. Pods that cannot fit any instance type are reported
+// with an event naming the limiting resource, since they'd otherwise remain
+// pending without a signal, and are backed off.
+func (c *Controller) schedulable(provisioner *v1alpha1.Provisioner, constraints *packing.Constraints, instanceTypes []cloudprovider.InstanceType) []*v1.Pod {
+	packables := packing.PackablesFor(instanceTypes, constraints)
+	if len(packables) == 0 {
+		return constraints.Pods
+	}
+	pods := []*v1.Pod{}
+	for _, pod := range constraints.Pods {
+		if resourceName, ok := packing.LimitingResource(pod, packables); ok {
+			zap.S().Warnf("Failed to find an instance type for pod %s with sufficient %s", apiobject.NamespacedName(pod), resourceName)
+			c.recorder.Eventf(pod, v1.EventTypeWarning, "Unschedulable",
+				"No instance type satisfies the pod's %s request", resourceName)
+			c.recordNoFit(provisioner, instanceTypes, pod, resourceName)
+			continue
+		}
+		pods = append(pods, pod)
+	}
+	return pods
+}
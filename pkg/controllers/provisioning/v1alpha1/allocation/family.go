@@ -0,0 +1,91 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package allocation
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// diversify removes instance type options from the packings whose family
+// would exceed the provisioner's max family percentage. Each packing's launch
+// is attributed to the family of its first option, which is the packer's
+// preference. If every option's family is at the cap, the options of the
+// families with the fewest nodes are kept, so that pods are still provisioned.
+func (c *Controller) diversify(ctx context.Context, provisioner *v1alpha1.Provisioner, packings []*cloudprovider.Packing) error {
+	if provisioner.Spec.MaxFamilyPercentage == nil {
+		return nil
+	}
+	nodes := &v1.NodeList{}
+	if err := c.kubeClient.List(ctx, nodes, client.MatchingLabels(map[string]string{
+		v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+		v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+	})); err != nil {
+		return fmt.Errorf("listing nodes, %w", err)
+	}
+	families := map[string]int{}
+	total := 0
+	for _, node := range nodes.Items {
+		if instanceType, ok := node.Labels[v1alpha1.InstanceTypeLabelKey]; ok {
+			families[familyOf(instanceType)]++
+			total++
+		}
+	}
+	percentage := int(*provisioner.Spec.MaxFamilyPercentage)
+	for _, packing := range packings {
+		options := []cloudprovider.InstanceType{}
+		for _, instanceType := range packing.InstanceTypeOptions {
+			if (families[familyOf(instanceType.Name())]+1)*100 <= percentage*(total+1) {
+				options = append(options, instanceType)
+			}
+		}
+		if len(options) == 0 {
+			options = leastCommonFamilies(packing.InstanceTypeOptions, families)
+		}
+		packing.InstanceTypeOptions = options
+		families[familyOf(options[0].Name())]++
+		total++
+	}
+	return nil
+}
+
+// leastCommonFamilies returns the instance types whose families have the fewest nodes
+func leastCommonFamilies(instanceTypes []cloudprovider.InstanceType, families map[string]int) []cloudprovider.InstanceType {
+	fewest := -1
+	for _, instanceType := range instanceTypes {
+		if count := families[familyOf(instanceType.Name())]; fewest < 0 || count < fewest {
+			fewest = count
+		}
+	}
+	result := []cloudprovider.InstanceType{}
+	for _, instanceType := range instanceTypes {
+		if families[familyOf(instanceType.Name())] == fewest {
+			result = append(result, instanceType)
+		}
+	}
+	return result
+}
+
+// familyOf returns the instance family of the instance type, e.g. m5 for
+// m5.large. Instance types without a family are their own family.
+func familyOf(instanceType string) string {
+	return strings.SplitN(instanceType, ".", 2)[0]
+}
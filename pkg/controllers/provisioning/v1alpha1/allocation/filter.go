@@ -17,21 +17,27 @@ package allocation
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/utils/apiobject"
 	"github.com/awslabs/karpenter/pkg/utils/functional"
 	"github.com/awslabs/karpenter/pkg/utils/pod"
 	"github.com/awslabs/karpenter/pkg/utils/ptr"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type Filter struct {
 	kubeClient    client.Client
 	cloudProvider cloudprovider.Factory
+	recorder      record.EventRecorder
 }
 
 func (f *Filter) GetProvisionablePods(ctx context.Context, provisioner *v1alpha1.Provisioner) ([]*v1.Pod, error) {
@@ -41,10 +47,65 @@ func (f *Filter) GetProvisionablePods(ctx context.Context, provisioner *v1alpha1
 		return nil, fmt.Errorf("listing unscheduled pods, %w", err)
 	}
 	if len(pods.Items) == 0 {
+		reportUnmatched(0)
 		return nil, nil
 	}
+	provisioners := &v1alpha1.ProvisionerList{}
+	if err := f.kubeClient.List(ctx, provisioners); err != nil {
+		return nil, fmt.Errorf("listing provisioners, %w", err)
+	}
+	reportUnmatched(f.unmatched(pods.Items, provisioner, provisioners.Items))
+
+	// 2. Get supported labels and zones
+	support, err := f.getSupport(ctx, provisioner)
+	if err != nil {
+		return nil, err
+	}
+	supports := map[string]*provisionerSupport{apiobject.NamespacedName(provisioner).String(): support}
+
+	// 2. Filter pods that aren't provisionable
+	provisionable := []*v1.Pod{}
+	for _, pod := range pods.Items {
+		if err := functional.ValidateAll(
+			func() error { return f.isUnschedulable(&pod) },
+			func() error { return f.matchesProvisioner(&pod, provisioner) },
+			func() error { return f.hasSupportedSchedulingConstraints(&pod) },
+			func() error { return f.toleratesTaints(&pod, provisioner) },
+			func() error { return f.hasSupportedLabels(&pod, support.labels) },
+			func() error { return f.hasCompatibleRequirements(&pod, provisioner) },
+			func() error { return f.isSelected(ctx, &pod, provisioner, provisioners.Items, supports) },
+		); err != nil {
+			zap.S().Debugf("Ignored pod %s/%s when allocating for provisioner %s/%s, %s",
+				pod.Name, pod.Namespace,
+				provisioner.Name, provisioner.Namespace,
+				err.Error(),
+			)
+			continue
+		}
+		if err := f.hasAllowedZones(&pod, provisioner, support.zones); err != nil {
+			zap.S().Debugf("Ignored pod %s/%s when allocating for provisioner %s/%s, %s",
+				pod.Name, pod.Namespace,
+				provisioner.Name, provisioner.Namespace,
+				err.Error(),
+			)
+			f.recorder.Eventf(&pod, v1.EventTypeWarning, "NoAllowedZones", "Failed to provision capacity, %s", err.Error())
+			continue
+		}
+		provisionable = append(provisionable, ptr.Pod(pod))
+	}
+	return provisionable, nil
+}
+
+// provisionerSupport is what a provisioner's cloud provider supports, which
+// pods' requirements are checked against
+type provisionerSupport struct {
+	// labels are the supported values of well known labels. Zones are checked
+	// separately, so that pods are alerted when their zones have no capacity.
+	labels map[string][]string
+	zones  []string
+}
 
-	// 2. Get Supported Labels
+func (f *Filter) getSupport(ctx context.Context, provisioner *v1alpha1.Provisioner) (*provisionerSupport, error) {
 	capacity := f.cloudProvider.CapacityFor(provisioner)
 	architectures, err := capacity.GetArchitectures(ctx)
 	if err != nil {
@@ -66,33 +127,56 @@ func (f *Filter) GetProvisionablePods(ctx context.Context, provisioner *v1alpha1
 	for _, instanceType := range instanceTypes {
 		instanceTypeNames = append(instanceTypeNames, instanceType.Name())
 	}
-	supportedLabels := map[string][]string{
-		v1alpha1.ArchitectureLabelKey:    architectures,
-		v1alpha1.OperatingSystemLabelKey: operatingSystems,
-		v1alpha1.ZoneLabelKey:            zones,
-		v1alpha1.InstanceTypeLabelKey:    instanceTypeNames,
-	}
+	return &provisionerSupport{
+		labels: map[string][]string{
+			v1alpha1.ArchitectureLabelKey:    architectures,
+			v1alpha1.OperatingSystemLabelKey: operatingSystems,
+			v1alpha1.InstanceTypeLabelKey:    instanceTypeNames,
+		},
+		zones: zones,
+	}, nil
+}
 
-	// 2. Filter pods that aren't provisionable
-	provisionable := []*v1.Pod{}
-	for _, pod := range pods.Items {
-		if err := functional.ValidateAll(
-			func() error { return f.isUnschedulable(&pod) },
-			func() error { return f.matchesProvisioner(&pod, provisioner) },
-			func() error { return f.hasSupportedSchedulingConstraints(&pod) },
-			func() error { return f.toleratesTaints(&pod, provisioner) },
-			func() error { return f.hasSupportedLabels(&pod, supportedLabels) },
-		); err != nil {
-			zap.S().Debugf("Ignored pod %s/%s when allocating for provisioner %s/%s, %s",
-				pod.Name, pod.Namespace,
-				provisioner.Name, provisioner.Namespace,
-				err.Error(),
-			)
+// canProvision returns an error if the provisioner can't provision the pod,
+// with the same checks that filter the provisioner's own pods
+func (f *Filter) canProvision(pod *v1.Pod, provisioner *v1alpha1.Provisioner, support *provisionerSupport) error {
+	return functional.ValidateAll(
+		func() error { return f.matchesProvisioner(pod, provisioner) },
+		func() error { return f.toleratesTaints(pod, provisioner) },
+		func() error { return f.hasSupportedLabels(pod, support.labels) },
+		func() error { return f.hasCompatibleRequirements(pod, provisioner) },
+		func() error { return f.hasAllowedZones(pod, provisioner, support.zones) },
+	)
+}
+
+// unmatched returns the number of pods that failed to schedule, but that
+// neither the provisioner nor any other provisioner matches, since they select
+// another provisioner or don't tolerate its taints.
+func (f *Filter) unmatched(pods []v1.Pod, provisioner *v1alpha1.Provisioner, provisioners []v1alpha1.Provisioner) int {
+	candidates := []*v1alpha1.Provisioner{provisioner}
+	for i := range provisioners {
+		if provisioners[i].Name != provisioner.Name || provisioners[i].Namespace != provisioner.Namespace {
+			candidates = append(candidates, &provisioners[i])
+		}
+	}
+	count := 0
+	for i := range pods {
+		pod := &pods[i]
+		if f.isUnschedulable(pod) != nil {
 			continue
 		}
-		provisionable = append(provisionable, ptr.Pod(pod))
+		matched := false
+		for _, candidate := range candidates {
+			if f.matchesProvisioner(pod, candidate) == nil && f.toleratesTaints(pod, candidate) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			count++
+		}
 	}
-	return provisionable, nil
+	return count
 }
 
 func (f *Filter) isUnschedulable(p *v1.Pod) error {
@@ -106,8 +190,11 @@ func (f *Filter) isUnschedulable(p *v1.Pod) error {
 }
 
 func (f *Filter) hasSupportedSchedulingConstraints(pod *v1.Pod) error {
-	if pod.Spec.Affinity != nil {
-		return fmt.Errorf("affinity is not supported")
+	if pod.Spec.Affinity != nil && (pod.Spec.Affinity.PodAffinity != nil || pod.Spec.Affinity.PodAntiAffinity != nil) {
+		return fmt.Errorf("pod affinity is not supported")
+	}
+	if _, err := v1alpha1.PodRequirements(pod); err != nil {
+		return err
 	}
 	if pod.Spec.TopologySpreadConstraints != nil {
 		return fmt.Errorf("topology spread constraints are not supported")
@@ -133,6 +220,50 @@ func (f *Filter) matchesProvisioner(pod *v1.Pod, provisioner *v1alpha1.Provision
 	return fmt.Errorf("matched another provisioner, %s/%s", name, namespace)
 }
 
+// isSelected returns an error if another provisioner is selected for the pod.
+// The highest weighted provisioners that can provision the pod are considered,
+// and ties are broken by a hash of the pod's UID. This is stable across
+// reconciles, but balances pods across equally weighted provisioners. The
+// support of each candidate is cached in supports, by namespaced name.
+func (f *Filter) isSelected(ctx context.Context, pod *v1.Pod, provisioner *v1alpha1.Provisioner, provisioners []v1alpha1.Provisioner, supports map[string]*provisionerSupport) error {
+	candidates := []*v1alpha1.Provisioner{}
+	for i := range provisioners {
+		candidate := &provisioners[i]
+		if len(candidates) > 0 && candidate.GetWeight() < candidates[0].GetWeight() {
+			continue
+		}
+		key := apiobject.NamespacedName(candidate).String()
+		support, ok := supports[key]
+		if !ok {
+			var err error
+			if support, err = f.getSupport(ctx, candidate); err != nil {
+				return fmt.Errorf("getting support of provisioner %s, %w", key, err)
+			}
+			supports[key] = support
+		}
+		if f.canProvision(pod, candidate, support) != nil {
+			continue
+		}
+		if len(candidates) > 0 && candidate.GetWeight() > candidates[0].GetWeight() {
+			candidates = []*v1alpha1.Provisioner{}
+		}
+		candidates = append(candidates, candidate)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return apiobject.NamespacedName(candidates[i]).String() < apiobject.NamespacedName(candidates[j]).String()
+	})
+	hash := fnv.New32a()
+	hash.Write([]byte(pod.UID))
+	selected := candidates[hash.Sum32()%uint32(len(candidates))]
+	if selected.Name != provisioner.Name || selected.Namespace != provisioner.Namespace {
+		return fmt.Errorf("selected provisioner %s/%s", selected.Name, selected.Namespace)
+	}
+	return nil
+}
+
 func (f *Filter) toleratesTaints(p *v1.Pod, provisioner *v1alpha1.Provisioner) error {
 	var err error
 	for _, taint := range provisioner.Spec.Taints {
@@ -144,15 +275,45 @@ func (f *Filter) toleratesTaints(p *v1.Pod, provisioner *v1alpha1.Provisioner) e
 }
 
 func (f *Filter) hasSupportedLabels(pod *v1.Pod, supportedLabels map[string][]string) error {
-	var err error
+	requirements, err := v1alpha1.PodRequirements(pod)
+	if err != nil {
+		return err
+	}
 	for label, supported := range supportedLabels {
-		selected, ok := pod.Spec.NodeSelector[label]
+		values, ok := requirements[label]
 		if !ok {
 			continue
 		}
-		if !functional.ContainsString(supported, selected) {
-			err = multierr.Append(err, fmt.Errorf("unsupported value for label %s=%s", label, selected))
+		if len(functional.IntersectStringSlice(values, supported)) == 0 {
+			err = multierr.Append(err, fmt.Errorf("unsupported value for label %s=%s", label, strings.Join(values, ",")))
 		}
 	}
 	return err
 }
+
+// hasCompatibleRequirements returns an error if the pod's requirements
+// contradict the provisioner's, since no node could satisfy both.
+func (f *Filter) hasCompatibleRequirements(pod *v1.Pod, provisioner *v1alpha1.Provisioner) error {
+	if _, err := provisioner.Requirements(pod); err != nil {
+		return fmt.Errorf("incompatible with provisioner, %w", err)
+	}
+	return nil
+}
+
+// hasAllowedZones returns an error if none of the zones required by the pod and
+// the provisioner have capacity, i.e. subnets to launch nodes in. Zones are
+// hard constraints, so the pod can't be provisioned elsewhere.
+func (f *Filter) hasAllowedZones(pod *v1.Pod, provisioner *v1alpha1.Provisioner, zones []string) error {
+	requirements, err := provisioner.Requirements(pod)
+	if err != nil {
+		return fmt.Errorf("incompatible with provisioner, %w", err)
+	}
+	allowed := requirements.Get(v1alpha1.ZoneLabelKey)
+	if allowed == nil {
+		return nil
+	}
+	if len(functional.IntersectStringSlice(allowed, zones)) == 0 {
+		return fmt.Errorf("no capacity in required zones %s", strings.Join(allowed, ","))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package allocation
+
+import (
+	"context"
+	"time"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/utils/apiobject"
+	"go.uber.org/zap"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// LaunchIntentTTL is how long a recorded launch intent is reused. Within it,
+// a restarted controller launching for the same pods reconciles the launch
+// that was in flight, rather than launching another instance. After it, pods
+// that are still pending, e.g. because their instance was interrupted before
+// they were bound, are launched for again. Launches that are retried with
+// other offerings, e.g. after insufficient capacity, aren't deduplicated.
+const LaunchIntentTTL = 10 * time.Minute
+
+// recordLaunchIntents persists the intent to launch each packing before it's
+// launched, since launches are otherwise only tracked in memory. Intents that
+// fail to be recorded are logged, and the packing is launched regardless.
+func (c *Controller) recordLaunchIntents(ctx context.Context, packings []*cloudprovider.Packing) {
+	now := c.clock.Now()
+	for _, packing := range packings {
+		holder := cloudprovider.LaunchIntentHolder(packing.Pods)
+		if holder == nil {
+			continue
+		}
+		if recorded, err := time.Parse(time.RFC3339, holder.Annotations[v1alpha1.LaunchIntentKey]); err == nil &&
+			!recorded.After(now) && now.Sub(recorded) < LaunchIntentTTL {
+			continue
+		}
+		persisted := holder.DeepCopy()
+		if holder.Annotations == nil {
+			holder.Annotations = map[string]string{}
+		}
+		holder.Annotations[v1alpha1.LaunchIntentKey] = now.Format(time.RFC3339)
+		if err := c.kubeClient.Patch(ctx, holder, client.MergeFrom(persisted)); err != nil {
+			zap.S().Errorf("Continuing after failing to record launch intent on pod %s, %s", apiobject.NamespacedName(holder), err.Error())
+		}
+	}
+}
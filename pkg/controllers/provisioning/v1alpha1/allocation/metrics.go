@@ -0,0 +1,209 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package allocation
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/utils/apiobject"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// MaxMetricsLabels bounds the provisioner labels promoted into launch
+// metrics, since each label multiplies the metrics' cardinality.
+const MaxMetricsLabels = 5
+
+// Reasons that pending pods can't be provisioned
+const (
+	// UnschedulableReasonNoFit pods don't fit any instance type
+	UnschedulableReasonNoFit = "no-fit"
+	// UnschedulableReasonLimits pods would exceed the provisioner's max nodes
+	UnschedulableReasonLimits = "limits"
+	// UnschedulableReasonNoCapacity pods' capacity failed to launch
+	UnschedulableReasonNoCapacity = "no-capacity"
+	// UnschedulableReasonNoMatchingProvisioner pods select a provisioner that
+	// doesn't exist or don't tolerate any provisioner's taints
+	UnschedulableReasonNoMatchingProvisioner = "no-matching-provisioner"
+)
+
+var (
+	// launchMetricsLabels are always present on launch metrics
+	launchMetricsLabels = []string{"provisioner", "namespace"}
+	// invalidMetricsLabelCharacters are replaced when label keys are converted
+	// into prometheus label names
+	invalidMetricsLabelCharacters = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	// unschedulablePods is the number of pending pods that can't be
+	// provisioned, set on each reconcile. Pods that no provisioner matches
+	// aren't attributed to a provisioner, so their labels are empty.
+	unschedulablePods = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "karpenter_pending_pods_unschedulable",
+		Help: "The number of pending pods that Karpenter can't provision, by provisioner and reason.",
+	}, []string{"provisioner", "namespace", "reason"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(unschedulablePods)
+}
+
+// ParseMetricsLabels parses a comma separated list of provisioner label keys,
+// e.g. example.com/team,example.com/cost-center, which are promoted into the
+// launch metrics' labels.
+func ParseMetricsLabels(labels string) ([]string, error) {
+	if strings.TrimSpace(labels) == "" {
+		return nil, nil
+	}
+	keys := []string{}
+	names := map[string]string{}
+	for _, name := range launchMetricsLabels {
+		names[name] = name
+	}
+	for _, key := range strings.Split(labels, ",") {
+		key = strings.TrimSpace(key)
+		if errs := validation.IsQualifiedName(key); len(errs) != 0 {
+			return nil, fmt.Errorf("invalid metrics label %s, %s", key, strings.Join(errs, ", "))
+		}
+		name := metricsLabelName(key)
+		if existing, ok := names[name]; ok {
+			return nil, fmt.Errorf("metrics label %s conflicts with %s", key, existing)
+		}
+		names[name] = key
+		keys = append(keys, key)
+	}
+	if len(keys) > MaxMetricsLabels {
+		return nil, fmt.Errorf("at most %d metrics labels are supported, got %d", MaxMetricsLabels, len(keys))
+	}
+	return keys, nil
+}
+
+// metricsLabelName converts a label key into a prometheus label name, e.g.
+// example.com/cost-center becomes example_com_cost_center.
+func metricsLabelName(key string) string {
+	return invalidMetricsLabelCharacters.ReplaceAllString(key, "_")
+}
+
+// launchMetrics count the nodes launched for each provisioner, labeled with
+// the values of its promoted labels so that capacity can be attributed to
+// teams. Cardinality is bounded by the number of provisioners, since the
+// series of deleted provisioners are deleted.
+type launchMetrics struct {
+	labelKeys     []string
+	nodesLaunched *prometheus.CounterVec
+	seriesMutex   sync.Mutex
+	series        map[types.NamespacedName][]prometheus.Labels
+}
+
+// newLaunchMetrics registers the launch metrics. Controllers constructed with
+// the same labels share the collector, and other registration errors, e.g.
+// conflicting labels, are returned.
+func newLaunchMetrics(labelKeys []string) (*launchMetrics, error) {
+	names := append([]string{}, launchMetricsLabels...)
+	for _, key := range labelKeys {
+		names = append(names, metricsLabelName(key))
+	}
+	nodesLaunched := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "karpenter_nodes_launched_total",
+		Help: "The number of nodes launched by Karpenter for each provisioner.",
+	}, names)
+	if err := metrics.Registry.Register(nodesLaunched); err != nil {
+		var alreadyRegistered prometheus.AlreadyRegisteredError
+		if !errors.As(err, &alreadyRegistered) {
+			return nil, fmt.Errorf("registering launch metrics, %w", err)
+		}
+		nodesLaunched = alreadyRegistered.ExistingCollector.(*prometheus.CounterVec)
+	}
+	return &launchMetrics{
+		labelKeys:     labelKeys,
+		nodesLaunched: nodesLaunched,
+		series:        map[types.NamespacedName][]prometheus.Labels{},
+	}, nil
+}
+
+// labelsFor returns the launch metrics' labels for the provisioner. Promoted
+// labels that the provisioner doesn't have are empty.
+func (l *launchMetrics) labelsFor(provisioner *v1alpha1.Provisioner) prometheus.Labels {
+	labels := prometheus.Labels{
+		"provisioner": provisioner.Name,
+		"namespace":   provisioner.Namespace,
+	}
+	for _, key := range l.labelKeys {
+		labels[metricsLabelName(key)] = provisioner.Labels[key]
+	}
+	return labels
+}
+
+// launched records nodes launched for the provisioner
+func (l *launchMetrics) launched(provisioner *v1alpha1.Provisioner, count int) {
+	labels := l.labelsFor(provisioner)
+	l.nodesLaunched.With(labels).Add(float64(count))
+	l.seriesMutex.Lock()
+	defer l.seriesMutex.Unlock()
+	key := apiobject.NamespacedName(provisioner)
+	for _, existing := range l.series[key] {
+		if reflect.DeepEqual(existing, labels) {
+			return
+		}
+	}
+	l.series[key] = append(l.series[key], labels)
+}
+
+// deleted deletes the series of a deleted provisioner, including series of
+// promoted label values that it had before they changed
+func (l *launchMetrics) deleted(key types.NamespacedName) {
+	l.seriesMutex.Lock()
+	defer l.seriesMutex.Unlock()
+	for _, labels := range l.series[key] {
+		l.nodesLaunched.Delete(labels)
+	}
+	delete(l.series, key)
+}
+
+// reportUnschedulable sets the provisioner's unschedulable pods for each
+// reason, where missing reasons have none. Pods that don't fit any instance
+// type are counted while they're backed off or given up on.
+func (c *Controller) reportUnschedulable(provisioner *v1alpha1.Provisioner, unschedulable map[string]int) {
+	unschedulable[UnschedulableReasonNoFit] = c.noFitPods(provisioner)
+	for _, reason := range []string{UnschedulableReasonNoFit, UnschedulableReasonLimits, UnschedulableReasonNoCapacity} {
+		unschedulablePods.With(prometheus.Labels{
+			"provisioner": provisioner.Name,
+			"namespace":   provisioner.Namespace,
+			"reason":      reason,
+		}).Set(float64(unschedulable[reason]))
+	}
+}
+
+// deleteUnschedulable deletes a deleted provisioner's unschedulable pods
+func deleteUnschedulable(key types.NamespacedName) {
+	for _, reason := range []string{UnschedulableReasonNoFit, UnschedulableReasonLimits, UnschedulableReasonNoCapacity} {
+		unschedulablePods.DeleteLabelValues(key.Name, key.Namespace, reason)
+	}
+}
+
+// reportUnmatched sets the number of pods that no provisioner matches
+func reportUnmatched(count int) {
+	unschedulablePods.With(prometheus.Labels{
+		"provisioner": "",
+		"namespace":   "",
+		"reason":      UnschedulableReasonNoMatchingProvisioner,
+	}).Set(float64(count))
+}
@@ -0,0 +1,149 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package allocation
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/utils/apiobject"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// NoFitBackoff is how long a pod that doesn't fit any instance type is
+	// skipped before it's evaluated again. The backoff doubles after each
+	// evaluation, up to MaxNoFitBackoff.
+	NoFitBackoff    = 30 * time.Second
+	MaxNoFitBackoff = 10 * time.Minute
+)
+
+// noFit is a pod that didn't fit any instance type when last evaluated
+type noFit struct {
+	provisioner types.NamespacedName
+	// fitHash identifies what the pod failed to fit, see fitHashOf
+	fitHash  string
+	attempts int
+	retryAt  time.Time
+}
+
+// evaluable returns the pods that aren't backing off or given up on after not
+// fitting any instance type. Pods are evaluated again if their spec, the
+// provisioner's spec, or the instance types changed, and pods that are no
+// longer provisionable are forgotten.
+func (c *Controller) evaluable(provisioner *v1alpha1.Provisioner, instanceTypes []cloudprovider.InstanceType, pods []*v1.Pod) []*v1.Pod {
+	c.noFitsMutex.Lock()
+	defer c.noFitsMutex.Unlock()
+	key := apiobject.NamespacedName(provisioner)
+	provisionable := map[types.UID]bool{}
+	result := []*v1.Pod{}
+	for _, pod := range pods {
+		provisionable[pod.UID] = true
+		entry, ok := c.noFits[pod.UID]
+		if !ok {
+			result = append(result, pod)
+			continue
+		}
+		if entry.fitHash != fitHashOf(provisioner, instanceTypes, pod) {
+			delete(c.noFits, pod.UID)
+			result = append(result, pod)
+			continue
+		}
+		if c.givenUp(entry) || c.clock.Now().Before(entry.retryAt) {
+			continue
+		}
+		result = append(result, pod)
+	}
+	for uid, entry := range c.noFits {
+		if entry.provisioner == key && !provisionable[uid] {
+			delete(c.noFits, uid)
+		}
+	}
+	return result
+}
+
+// recordNoFit backs off the pod, and gives up on it with an event once it has
+// failed to fit maxNoFitAttempts times in a row. Zero never gives up.
+func (c *Controller) recordNoFit(provisioner *v1alpha1.Provisioner, instanceTypes []cloudprovider.InstanceType, pod *v1.Pod, resourceName v1.ResourceName) {
+	c.noFitsMutex.Lock()
+	defer c.noFitsMutex.Unlock()
+	entry, ok := c.noFits[pod.UID]
+	if !ok {
+		entry = &noFit{provisioner: apiobject.NamespacedName(provisioner), fitHash: fitHashOf(provisioner, instanceTypes, pod)}
+		c.noFits[pod.UID] = entry
+	}
+	entry.attempts++
+	backoff := NoFitBackoff
+	for i := 1; i < entry.attempts && backoff < MaxNoFitBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxNoFitBackoff {
+		backoff = MaxNoFitBackoff
+	}
+	entry.retryAt = c.clock.Now().Add(backoff)
+	if c.givenUp(entry) {
+		zap.S().Warnf("Giving up on pod %s after it failed to fit any instance type %d times", apiobject.NamespacedName(pod), entry.attempts)
+		c.recorder.Eventf(pod, v1.EventTypeWarning, "NoFit",
+			"No instance type satisfied the pod's %s request after %d attempts, the pod won't be provisioned until its spec, the provisioner, or the instance types change", resourceName, entry.attempts)
+	}
+}
+
+// noFitPods returns the number of the provisioner's pods that are backed off
+// or given up on
+func (c *Controller) noFitPods(provisioner *v1alpha1.Provisioner) int {
+	c.noFitsMutex.Lock()
+	defer c.noFitsMutex.Unlock()
+	key := apiobject.NamespacedName(provisioner)
+	count := 0
+	for _, entry := range c.noFits {
+		if entry.provisioner == key {
+			count++
+		}
+	}
+	return count
+}
+
+func (c *Controller) givenUp(entry *noFit) bool {
+	return c.maxNoFitAttempts > 0 && entry.attempts >= c.maxNoFitAttempts
+}
+
+// fitHashOf identifies the pod's spec, the provisioner's generation, and the
+// instance types that the pod was evaluated against, so that pods are
+// evaluated again if any of them change. Pods' resource requests are
+// immutable, so pods would otherwise never fit, e.g. after the provisioner is
+// changed to allow larger instance types.
+func fitHashOf(provisioner *v1alpha1.Provisioner, instanceTypes []cloudprovider.InstanceType, pod *v1.Pod) string {
+	spec, err := json.Marshal(pod.Spec)
+	if err != nil {
+		zap.S().Panicf("marshaling pod spec, %s", err.Error())
+	}
+	names := []string{}
+	for _, instanceType := range instanceTypes {
+		names = append(names, instanceType.Name())
+	}
+	sort.Strings(names)
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d/%s/", provisioner.Generation, strings.Join(names, ","))
+	hash.Write(spec)
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
@@ -0,0 +1,112 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package allocation
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/utils/apiobject"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// NodeCreationFailurePolicy determines what happens to an instance that
+// launched, but whose node object couldn't be created.
+type NodeCreationFailurePolicy string
+
+const (
+	// NodeCreationFailureTerminate terminates the instance, so that it isn't
+	// leaked. Its pods are provisioned again by a later reconcile.
+	NodeCreationFailureTerminate NodeCreationFailurePolicy = "Terminate"
+	// NodeCreationFailureTrack keeps the instance and retries creating its node
+	// on later reconciles, which avoids relaunching capacity if the failure is
+	// transient. Tracked instances are held in memory, so they're leaked if the
+	// controller restarts before their nodes are created.
+	NodeCreationFailureTrack NodeCreationFailurePolicy = "Track"
+)
+
+// ParseNodeCreationFailurePolicy returns an error if the policy is unknown
+func ParseNodeCreationFailurePolicy(policy string) (NodeCreationFailurePolicy, error) {
+	switch NodeCreationFailurePolicy(policy) {
+	case NodeCreationFailureTerminate, NodeCreationFailureTrack:
+		return NodeCreationFailurePolicy(policy), nil
+	default:
+		return "", fmt.Errorf("node creation failure policy must be one of %v, got %s",
+			[]NodeCreationFailurePolicy{NodeCreationFailureTerminate, NodeCreationFailureTrack}, policy)
+	}
+}
+
+// handleNodeCreationFailure terminates or tracks the packed node's instance,
+// depending on the policy.
+func (c *Controller) handleNodeCreationFailure(ctx context.Context, provisioner *v1alpha1.Provisioner, capacity cloudprovider.Capacity, packedNode *cloudprovider.PackedNode, err error) {
+	if c.nodeCreationFailurePolicy == NodeCreationFailureTrack {
+		zap.S().Errorf("Tracking node %s to retry creating it, %s", packedNode.Node.Name, err.Error())
+		c.trackedMutex.Lock()
+		defer c.trackedMutex.Unlock()
+		key := apiobject.NamespacedName(provisioner)
+		c.tracked[key] = append(c.tracked[key], packedNode)
+		return
+	}
+	zap.S().Errorf("Terminating node %s after failing to create it, %s", packedNode.Node.Name, err.Error())
+	if err := capacity.Delete(ctx, []*v1.Node{packedNode.Node}, v1alpha1.TerminationReasonRegistrationFailure); err != nil {
+		zap.S().Errorf("Failed to terminate node %s, %s", packedNode.Node.Name, err.Error())
+	}
+}
+
+// retryTracked retries creating the provisioner's tracked nodes and binding
+// their pods. Nodes are tracked until they're created.
+func (c *Controller) retryTracked(ctx context.Context, provisioner *v1alpha1.Provisioner) {
+	c.trackedMutex.Lock()
+	defer c.trackedMutex.Unlock()
+	key := apiobject.NamespacedName(provisioner)
+	remaining := []*cloudprovider.PackedNode{}
+	for _, packedNode := range c.tracked[key] {
+		if err := c.binder.Bind(ctx, packedNode.Node, packedNode.Pods); err != nil {
+			zap.S().Errorf("Continuing to track node %s after failing to create it, %s", packedNode.Node.Name, err.Error())
+			remaining = append(remaining, packedNode)
+			continue
+		}
+		zap.S().Infof("Created tracked node %s", packedNode.Node.Name)
+	}
+	if len(remaining) == 0 {
+		delete(c.tracked, key)
+		return
+	}
+	c.tracked[key] = remaining
+}
+
+// untracked returns the pods that aren't waiting on a tracked node, which
+// prevents launching capacity for them again.
+func (c *Controller) untracked(provisioner *v1alpha1.Provisioner, pods []*v1.Pod) []*v1.Pod {
+	c.trackedMutex.Lock()
+	defer c.trackedMutex.Unlock()
+	tracked := map[types.UID]bool{}
+	for _, packedNode := range c.tracked[apiobject.NamespacedName(provisioner)] {
+		for _, pod := range packedNode.Pods {
+			tracked[pod.UID] = true
+		}
+	}
+	result := []*v1.Pod{}
+	for _, pod := range pods {
+		if !tracked[pod.UID] {
+			result = append(result, pod)
+		}
+	}
+	return result
+}
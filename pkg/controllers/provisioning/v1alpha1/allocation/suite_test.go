@@ -16,29 +16,77 @@ package allocation
 
 import (
 	"context"
+	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Pallinder/go-randomdata"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
 	"github.com/awslabs/karpenter/pkg/cloudprovider/fake"
 	"github.com/awslabs/karpenter/pkg/test"
+	"github.com/awslabs/karpenter/pkg/utils/apiobject"
+	utilsnode "github.com/awslabs/karpenter/pkg/utils/node"
 	"github.com/awslabs/karpenter/pkg/utils/resources"
 	webhooksprovisioning "github.com/awslabs/karpenter/pkg/webhooks/provisioning/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"knative.dev/pkg/ptr"
 
 	. "github.com/awslabs/karpenter/pkg/test/expectations"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest/printer"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 )
 
+func daemonSetWith(name string, spec v1.PodSpec, cpu resource.Quantity) *appsv1.DaemonSet {
+	spec.Containers = test.PendingPodWith(test.PodOptions{
+		ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: cpu}},
+	}).Spec.Containers
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": name}},
+				Spec:       spec,
+			},
+		},
+	}
+}
+
+// failingNodes fails to create nodes while fail is set
+type failingNodes struct {
+	corev1.NodeInterface
+	fail bool
+}
+
+func (n *failingNodes) Create(ctx context.Context, node *v1.Node, options metav1.CreateOptions) (*v1.Node, error) {
+	if n.fail {
+		return nil, fmt.Errorf("failed to create node")
+	}
+	return n.NodeInterface.Create(ctx, node, options)
+}
+
+type failingCoreV1 struct {
+	corev1.CoreV1Interface
+	nodes *failingNodes
+}
+
+func (c *failingCoreV1) Nodes() corev1.NodeInterface {
+	return c.nodes
+}
+
 func TestAPIs(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecsWithDefaultAndCustomReporters(t,
@@ -47,12 +95,16 @@ func TestAPIs(t *testing.T) {
 }
 
 var controller *Controller
+var metricsLabels = []string{"example.com/team"}
+var systemNamespace = "default"
 var env = test.NewEnvironment(func(e *test.Environment) {
 	cloudProvider := fake.NewFactory(cloudprovider.Options{})
 	controller = NewController(
 		e.Manager.GetClient(),
 		corev1.NewForConfigOrDie(e.Manager.GetConfig()),
 		cloudProvider,
+		e.Manager.GetEventRecorderFor("karpenter"),
+		Options{MetricsLabels: metricsLabels, SystemNamespace: systemNamespace},
 	)
 	e.Manager.RegisterWebhooks(
 		&webhooksprovisioning.Validator{CloudProvider: cloudProvider},
@@ -88,6 +140,681 @@ var _ = Describe("Allocation", func() {
 		ExpectCleanedUp(env.Client)
 	})
 
+	Context("Startup", func() {
+		It("should not launch capacity for visible pending pods while caches settle", func() {
+			settling := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				fake.NewFactory(cloudprovider.Options{}),
+				env.Manager.GetEventRecorderFor("karpenter"),
+				Options{
+					StartupSettlePeriod: time.Hour,
+					MetricsLabels:       metricsLabels,
+					SystemNamespace:     systemNamespace,
+				},
+			)
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			// The provisioner isn't created, so only the settling controller reconciles it
+			Eventually(func() ([]*v1.Pod, error) {
+				return settling.filter.GetProvisionablePods(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+
+			Expect(settling.Reconcile(ctx, provisioner)).To(Succeed())
+			nodes := &v1.NodeList{}
+			Expect(env.Client.List(ctx, nodes)).To(Succeed())
+			Expect(nodes.Items).To(BeEmpty())
+			Expect(ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace()).Spec.NodeName).To(BeEmpty())
+		})
+		It("should launch capacity once caches have settled", func() {
+			settled := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				fake.NewFactory(cloudprovider.Options{}),
+				env.Manager.GetEventRecorderFor("karpenter"),
+				Options{
+					StartupSettlePeriod: time.Hour,
+					MetricsLabels:       metricsLabels,
+					SystemNamespace:     systemNamespace,
+				},
+			)
+			fakeClock := clock.NewFakeClock(time.Now())
+			settled.clock = fakeClock
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			Eventually(func() ([]*v1.Pod, error) {
+				return settled.filter.GetProvisionablePods(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+			Expect(settled.Reconcile(ctx, provisioner)).To(Succeed())
+			Expect(ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace()).Spec.NodeName).To(BeEmpty())
+
+			fakeClock.Step(time.Hour)
+			Eventually(func() string {
+				Expect(settled.Reconcile(ctx, provisioner)).To(Succeed())
+				return ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace()).Spec.NodeName
+			}, ReconcilerPropagationTime, RequestInterval).ShouldNot(BeEmpty())
+		})
+	})
+	Context("Batching", func() {
+		// launch creates pods one at a time, reconciling after each, closes the
+		// controller's batch window, and returns the nodes that the controller
+		// launched for the pods
+		launch := func(controller *Controller, count int) []v1.Node {
+			fakeClock := clock.NewFakeClock(time.Now())
+			controller.clock = fakeClock
+			for i := 0; i < count; i++ {
+				pod := test.PendingPod()
+				ExpectCreatedWithStatus(env.Client, pod)
+				// The provisioner isn't created, so only the test's controller reconciles it
+				Eventually(func() ([]*v1.Pod, error) {
+					return controller.filter.GetProvisionablePods(ctx, provisioner)
+				}, ReconcilerPropagationTime, RequestInterval).Should(ContainElement(WithTransform(func(provisionable *v1.Pod) string {
+					return provisionable.Name
+				}, Equal(pod.Name))))
+				Expect(controller.Reconcile(ctx, provisioner)).To(Succeed())
+			}
+			fakeClock.Step(controller.batchWindow)
+			Eventually(func() ([]*v1.Pod, error) {
+				Expect(controller.Reconcile(ctx, provisioner)).To(Succeed())
+				return controller.filter.GetProvisionablePods(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).Should(BeEmpty())
+			nodes := &v1.NodeList{}
+			Expect(env.Client.List(ctx, nodes)).To(Succeed())
+			return nodes.Items
+		}
+		It("should pack pods that arrive within the batch window together", func() {
+			batching := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				fake.NewFactory(cloudprovider.Options{}),
+				env.Manager.GetEventRecorderFor("karpenter"),
+				Options{
+					BatchWindow:     time.Hour,
+					MetricsLabels:   metricsLabels,
+					SystemNamespace: systemNamespace,
+				},
+			)
+			Expect(launch(batching, 3)).To(HaveLen(1))
+			Expect(batching.batches).To(BeEmpty())
+		})
+		It("should launch pods individually without a batch window", func() {
+			individual := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				fake.NewFactory(cloudprovider.Options{}),
+				env.Manager.GetEventRecorderFor("karpenter"),
+				Options{MetricsLabels: metricsLabels, SystemNamespace: systemNamespace},
+			)
+			Expect(launch(individual, 3)).To(HaveLen(3))
+		})
+		It("should requeue the provisioner and launch pods once the batch window closes", func() {
+			batching := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				fake.NewFactory(cloudprovider.Options{}),
+				env.Manager.GetEventRecorderFor("karpenter"),
+				Options{
+					BatchWindow:     time.Second,
+					MetricsLabels:   metricsLabels,
+					SystemNamespace: systemNamespace,
+				},
+			)
+			fakeClock := clock.NewFakeClock(time.Now())
+			batching.clock = fakeClock
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			Eventually(func() ([]*v1.Pod, error) {
+				return batching.filter.GetProvisionablePods(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+			Expect(batching.Reconcile(ctx, provisioner)).To(Succeed())
+			Expect(ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace()).Spec.NodeName).To(BeEmpty())
+			requeueAfter := batching.RequeueAfter(provisioner)
+			Expect(requeueAfter).To(Equal(time.Second))
+			Expect(requeueAfter).To(BeNumerically("<", batching.Interval()))
+
+			fakeClock.Step(requeueAfter)
+			Eventually(func() string {
+				Expect(batching.Reconcile(ctx, provisioner)).To(Succeed())
+				return ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace()).Spec.NodeName
+			}, ReconcilerPropagationTime, RequestInterval).ShouldNot(BeEmpty())
+			Expect(batching.RequeueAfter(provisioner)).To(BeZero())
+		})
+	})
+	Context("ObserveOnly", func() {
+		It("should preview nodes without launching them", func() {
+			provisioner.Spec.ObserveOnly = true
+			pods := []*v1.Pod{test.PendingPod(), test.PendingPod()}
+			for _, pod := range pods {
+				ExpectCreatedWithStatus(env.Client, pod)
+			}
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+
+			preview := []v1alpha1.PreviewNode{}
+			Eventually(func() []v1alpha1.PreviewNode {
+				updated := &v1alpha1.Provisioner{}
+				Expect(env.Client.Get(ctx, apiobject.NamespacedName(provisioner), updated)).To(Succeed())
+				preview = updated.Status.Preview
+				return preview
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+			Expect(preview[0].Pods).To(BeEquivalentTo(2))
+			Expect(preview[0].InstanceTypes).ToNot(BeEmpty())
+			nodes := &v1.NodeList{}
+			Expect(env.Client.List(ctx, nodes)).To(Succeed())
+			Expect(nodes.Items).To(BeEmpty())
+			for _, pod := range pods {
+				Expect(ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace()).Spec.NodeName).To(BeEmpty())
+			}
+		})
+	})
+	Context("Paused", func() {
+		It("should not launch nodes for paused provisioners and leave their nodes untouched", func() {
+			provisioner.Spec.Paused = true
+			node := test.NodeWith(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+					v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+				},
+			})
+			ExpectCreatedWithStatus(env.Client, node)
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+
+			nodes := &v1.NodeList{}
+			Expect(env.Client.List(ctx, nodes)).To(Succeed())
+			Expect(nodes.Items).To(HaveLen(1))
+			Expect(nodes.Items[0].Name).To(Equal(node.Name))
+			Expect(nodes.Items[0].Spec.Unschedulable).To(BeFalse())
+			Expect(ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace()).Spec.NodeName).To(BeEmpty())
+		})
+	})
+	Context("ProvisioningDisabled", func() {
+		It("should not launch nodes while provisioning is disabled and resume when it's enabled", func() {
+			recorder := record.NewFakeRecorder(10)
+			disabled := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				fake.NewFactory(cloudprovider.Options{}),
+				recorder,
+				Options{MetricsLabels: metricsLabels, SystemNamespace: systemNamespace},
+			)
+			settings := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: ProvisioningSettingsName, Namespace: systemNamespace},
+				Data:       map[string]string{ProvisioningEnabledKey: "false"},
+			}
+			ExpectCreated(env.Client, settings)
+			defer ExpectDeleted(env.Client, settings)
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			// The provisioner isn't created, so only the disabled controller reconciles it
+			Eventually(func() ([]*v1.Pod, error) {
+				return disabled.filter.GetProvisionablePods(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+			Eventually(func() (bool, error) {
+				return disabled.getProvisioningEnabled(ctx)
+			}, ReconcilerPropagationTime, RequestInterval).Should(BeFalse())
+
+			Expect(disabled.Reconcile(ctx, provisioner)).To(Succeed())
+			Expect(disabled.Reconcile(ctx, provisioner)).To(Succeed())
+			nodes := &v1.NodeList{}
+			Expect(env.Client.List(ctx, nodes)).To(Succeed())
+			Expect(nodes.Items).To(BeEmpty())
+			Expect(ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace()).Spec.NodeName).To(BeEmpty())
+			Expect(provisioner.StatusConditions().GetCondition(v1alpha1.ProvisioningEnabled).IsFalse()).To(BeTrue())
+			// The event is only emitted when provisioning is first disabled
+			Expect(recorder.Events).To(HaveLen(1))
+			Expect(<-recorder.Events).To(ContainSubstring("ProvisioningDisabled"))
+
+			settings.Data[ProvisioningEnabledKey] = "true"
+			Expect(env.Client.Update(ctx, settings)).To(Succeed())
+			Eventually(func() string {
+				Expect(disabled.Reconcile(ctx, provisioner)).To(Succeed())
+				return ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace()).Spec.NodeName
+			}, ReconcilerPropagationTime, RequestInterval).ShouldNot(BeEmpty())
+			Expect(provisioner.StatusConditions().GetCondition(v1alpha1.ProvisioningEnabled).IsTrue()).To(BeTrue())
+		})
+		It("should not launch nodes if the provisioning enabled setting is invalid", func() {
+			settings := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: ProvisioningSettingsName, Namespace: systemNamespace},
+				Data:       map[string]string{ProvisioningEnabledKey: "maybe"},
+			}
+			ExpectCreated(env.Client, settings)
+			defer ExpectDeleted(env.Client, settings)
+			Eventually(func() error {
+				return controller.Reconcile(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).ShouldNot(Succeed())
+		})
+	})
+	Context("InstanceFamilies", func() {
+		var instanceTypes []cloudprovider.InstanceType
+		BeforeEach(func() {
+			var err error
+			instanceTypes, err = fake.NewFactory(cloudprovider.Options{}).CapacityFor(provisioner).GetInstanceTypes(ctx)
+			Expect(err).ToNot(HaveOccurred())
+		})
+		namesOf := func(instanceTypes []cloudprovider.InstanceType) []string {
+			names := []string{}
+			for _, instanceType := range instanceTypes {
+				names = append(names, instanceType.Name())
+			}
+			return names
+		}
+		nodesOf := func(instanceType string, count int) {
+			for i := 0; i < count; i++ {
+				ExpectCreatedWithStatus(env.Client, test.NodeWith(test.NodeOptions{Labels: map[string]string{
+					v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+					v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+					v1alpha1.InstanceTypeLabelKey:         instanceType,
+				}}))
+			}
+			Eventually(func() (int, error) {
+				nodes := &v1.NodeList{}
+				err := env.Client.List(ctx, nodes, client.MatchingLabels{v1alpha1.InstanceTypeLabelKey: instanceType})
+				return len(nodes.Items), err
+			}, ReconcilerPropagationTime, RequestInterval).Should(Equal(count))
+		}
+		It("should diversify families once one family dominates", func() {
+			provisioner.Spec.MaxFamilyPercentage = ptr.Int32(50)
+			nodesOf(instanceTypes[0].Name(), 2)
+			nodesOf(instanceTypes[1].Name(), 1)
+			packings := []*cloudprovider.Packing{{InstanceTypeOptions: instanceTypes[:3]}, {InstanceTypeOptions: instanceTypes[:3]}}
+			Expect(controller.diversify(ctx, provisioner, packings)).To(Succeed())
+			// 3 of 4 nodes would be the dominant family, so it's excluded
+			Expect(namesOf(packings[0].InstanceTypeOptions)).To(Equal(namesOf(instanceTypes[1:3])))
+			// The second family would then be 3 of 5 nodes
+			Expect(namesOf(packings[1].InstanceTypeOptions)).To(Equal(namesOf(instanceTypes[2:3])))
+		})
+		It("should launch the least common families if every family is at the cap", func() {
+			provisioner.Spec.MaxFamilyPercentage = ptr.Int32(10)
+			nodesOf(instanceTypes[0].Name(), 2)
+			nodesOf(instanceTypes[1].Name(), 1)
+			packings := []*cloudprovider.Packing{{InstanceTypeOptions: instanceTypes[:2]}}
+			Expect(controller.diversify(ctx, provisioner, packings)).To(Succeed())
+			Expect(namesOf(packings[0].InstanceTypeOptions)).To(Equal(namesOf(instanceTypes[1:2])))
+		})
+		It("should not constrain families if unspecified", func() {
+			nodesOf(instanceTypes[0].Name(), 2)
+			packings := []*cloudprovider.Packing{{InstanceTypeOptions: instanceTypes[:2]}}
+			Expect(controller.diversify(ctx, provisioner, packings)).To(Succeed())
+			Expect(namesOf(packings[0].InstanceTypeOptions)).To(Equal(namesOf(instanceTypes[:2])))
+		})
+	})
+	Context("MaxNodes", func() {
+		It("should stop launching nodes at max nodes and resume when a node is removed", func() {
+			limited := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				fake.NewFactory(cloudprovider.Options{}),
+				env.Manager.GetEventRecorderFor("karpenter"),
+				Options{MetricsLabels: metricsLabels, SystemNamespace: systemNamespace},
+			)
+			provisioner.Spec.MaxNodes = ptr.Int32(1)
+			pods := []*v1.Pod{
+				test.PendingPodWith(test.PodOptions{NodeSelector: map[string]string{v1alpha1.ZoneLabelKey: "test-zone-1"}}),
+				test.PendingPodWith(test.PodOptions{NodeSelector: map[string]string{v1alpha1.ZoneLabelKey: "test-zone-2"}}),
+			}
+			for _, pod := range pods {
+				ExpectCreatedWithStatus(env.Client, pod)
+			}
+			// The provisioner isn't created, so only the limited controller reconciles it
+			Eventually(func() ([]*v1.Pod, error) {
+				return limited.filter.GetProvisionablePods(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(2))
+
+			Expect(limited.Reconcile(ctx, provisioner)).To(Succeed())
+			nodes := &v1.NodeList{}
+			Eventually(func() ([]v1.Node, error) {
+				err := env.Client.List(ctx, nodes)
+				return nodes.Items, err
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+			Expect(limited.Reconcile(ctx, provisioner)).To(Succeed())
+			Expect(env.Client.List(ctx, nodes)).To(Succeed())
+			Expect(nodes.Items).To(HaveLen(1))
+			Expect(provisioner.StatusConditions().GetCondition(v1alpha1.BelowMaxNodes).IsFalse()).To(BeTrue())
+
+			removed := nodes.Items[0].Name
+			ExpectDeleted(env.Client, &nodes.Items[0])
+			Eventually(func() ([]v1.Node, error) {
+				if err := limited.Reconcile(ctx, provisioner); err != nil {
+					return nil, err
+				}
+				err := env.Client.List(ctx, nodes)
+				return nodes.Items, err
+			}, ReconcilerPropagationTime, RequestInterval).Should(And(HaveLen(1), Not(ContainElement(WithTransform(func(node v1.Node) string { return node.Name }, Equal(removed))))))
+		})
+	})
+	Context("NodeCreationFailures", func() {
+		var cloudProvider *fake.Factory
+		var coreV1 *failingCoreV1
+		BeforeEach(func() {
+			cloudProvider = fake.NewFactory(cloudprovider.Options{})
+			coreV1Client := corev1.NewForConfigOrDie(env.Manager.GetConfig())
+			coreV1 = &failingCoreV1{CoreV1Interface: coreV1Client, nodes: &failingNodes{NodeInterface: coreV1Client.Nodes(), fail: true}}
+		})
+		provisionablePod := func(controller *Controller) *v1.Pod {
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			// The provisioner isn't created, so only the test's controller reconciles it
+			Eventually(func() ([]*v1.Pod, error) {
+				return controller.filter.GetProvisionablePods(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+			return pod
+		}
+		It("should terminate instances whose nodes fail to be created", func() {
+			terminating := NewController(env.Client, coreV1, cloudProvider, env.Manager.GetEventRecorderFor("karpenter"), Options{NodeCreationFailurePolicy: NodeCreationFailureTerminate, MetricsLabels: metricsLabels, SystemNamespace: systemNamespace})
+			pod := provisionablePod(terminating)
+
+			Expect(terminating.Reconcile(ctx, provisioner)).To(Succeed())
+			Expect(cloudProvider.DeletedNodes).To(HaveLen(1))
+			Expect(cloudProvider.TerminationReasons).To(HaveKeyWithValue(cloudProvider.DeletedNodes[0], v1alpha1.TerminationReasonRegistrationFailure))
+			Expect(terminating.tracked).To(BeEmpty())
+			Expect(ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace()).Spec.NodeName).To(BeEmpty())
+		})
+		It("should track instances whose nodes fail to be created and retry creating them", func() {
+			tracking := NewController(env.Client, coreV1, cloudProvider, env.Manager.GetEventRecorderFor("karpenter"), Options{NodeCreationFailurePolicy: NodeCreationFailureTrack, MetricsLabels: metricsLabels, SystemNamespace: systemNamespace})
+			pod := provisionablePod(tracking)
+
+			Expect(tracking.Reconcile(ctx, provisioner)).To(Succeed())
+			Expect(cloudProvider.DeletedNodes).To(BeEmpty())
+			Expect(tracking.tracked[apiobject.NamespacedName(provisioner)]).To(HaveLen(1))
+			name := tracking.tracked[apiobject.NamespacedName(provisioner)][0].Node.Name
+
+			// The pod isn't provisioned again while its node is tracked
+			Expect(tracking.Reconcile(ctx, provisioner)).To(Succeed())
+			Expect(tracking.tracked[apiobject.NamespacedName(provisioner)]).To(HaveLen(1))
+			Expect(tracking.tracked[apiobject.NamespacedName(provisioner)][0].Node.Name).To(Equal(name))
+
+			coreV1.nodes.fail = false
+			Expect(tracking.Reconcile(ctx, provisioner)).To(Succeed())
+			Expect(tracking.tracked).To(BeEmpty())
+			ExpectNodeExists(env.Client, name)
+			Expect(ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace()).Spec.NodeName).To(Equal(name))
+		})
+		It("should keep the launch intent of in flight launches across a restart", func() {
+			tracking := NewController(env.Client, coreV1, cloudProvider, env.Manager.GetEventRecorderFor("karpenter"), Options{NodeCreationFailurePolicy: NodeCreationFailureTrack, MetricsLabels: metricsLabels, SystemNamespace: systemNamespace})
+			pod := provisionablePod(tracking)
+			Expect(tracking.Reconcile(ctx, provisioner)).To(Succeed())
+			intent := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace()).Annotations[v1alpha1.LaunchIntentKey]
+			Expect(intent).ToNot(BeEmpty())
+
+			// The restarted controller has no record of the tracked launch, so it
+			// launches for the pod again with the same intent
+			restarted := NewController(env.Client, coreV1, cloudProvider, env.Manager.GetEventRecorderFor("karpenter"), Options{NodeCreationFailurePolicy: NodeCreationFailureTrack, MetricsLabels: metricsLabels, SystemNamespace: systemNamespace})
+			restarted.clock = clock.NewFakeClock(time.Now().Add(time.Minute))
+			Eventually(func() (map[string]string, error) {
+				pods, err := restarted.filter.GetProvisionablePods(ctx, provisioner)
+				if err != nil || len(pods) != 1 {
+					return nil, err
+				}
+				return pods[0].Annotations, nil
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveKeyWithValue(v1alpha1.LaunchIntentKey, intent))
+			coreV1.nodes.fail = false
+			Expect(restarted.Reconcile(ctx, provisioner)).To(Succeed())
+			Expect(ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace()).Annotations).To(HaveKeyWithValue(v1alpha1.LaunchIntentKey, intent))
+
+			// Intents aren't reused once they expire
+			expired := cloudprovider.Packing{Pods: []*v1.Pod{ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())}}
+			restarted.clock = clock.NewFakeClock(time.Now().Add(LaunchIntentTTL + time.Minute))
+			restarted.recordLaunchIntents(ctx, []*cloudprovider.Packing{&expired})
+			Expect(expired.Pods[0].Annotations[v1alpha1.LaunchIntentKey]).ToNot(Equal(intent))
+		})
+		It("should reject unknown policies", func() {
+			_, err := ParseNodeCreationFailurePolicy("Unknown")
+			Expect(err).To(HaveOccurred())
+			policy, err := ParseNodeCreationFailurePolicy("Track")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(policy).To(Equal(NodeCreationFailureTrack))
+		})
+	})
+	Context("NodeValidation", func() {
+		It("should taint new nodes until they're validated, without managing the taint", func() {
+			validating := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				fake.NewFactory(cloudprovider.Options{}),
+				env.Manager.GetEventRecorderFor("karpenter"),
+				Options{
+					MetricsLabels:   metricsLabels,
+					SystemNamespace: systemNamespace,
+					NodeValidation:  true,
+				},
+			)
+			provisioner.Spec.Taints = []v1.Taint{{Key: "test-key", Value: "test-value", Effect: v1.TaintEffectNoSchedule}}
+			pod := test.PendingPodWith(test.PodOptions{
+				Tolerations: []v1.Toleration{{Key: "test-key", Operator: v1.TolerationOpExists}},
+			})
+			ExpectCreatedWithStatus(env.Client, pod)
+			// The provisioner isn't created, so only the validating controller reconciles it
+			Eventually(func() ([]*v1.Pod, error) {
+				return validating.filter.GetProvisionablePods(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+
+			Expect(validating.Reconcile(ctx, provisioner)).To(Succeed())
+			node := ExpectNodeExists(env.Client, ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace()).Spec.NodeName)
+			Expect(node.Spec.Taints).To(ConsistOf(
+				v1.Taint{Key: "test-key", Value: "test-value", Effect: v1.TaintEffectNoSchedule},
+				v1.Taint{Key: v1alpha1.ValidationPendingTaintKey, Effect: v1.TaintEffectNoSchedule},
+			))
+			Expect(utilsnode.ManagedTaints(node)).To(ConsistOf(provisioner.Spec.Taints))
+		})
+	})
+	Context("Metrics", func() {
+		It("should label launch metrics with the provisioner's promoted labels", func() {
+			labeled := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				fake.NewFactory(cloudprovider.Options{}),
+				env.Manager.GetEventRecorderFor("karpenter"),
+				Options{MetricsLabels: metricsLabels, SystemNamespace: systemNamespace},
+			)
+			provisioner.Labels = map[string]string{"example.com/team": "payments", "example.com/unpromoted": "value"}
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			// The provisioner isn't created, so only the labeled controller reconciles it
+			Eventually(func() ([]*v1.Pod, error) {
+				return labeled.filter.GetProvisionablePods(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+
+			Expect(labeled.Reconcile(ctx, provisioner)).To(Succeed())
+			Expect(labeled.launchMetrics.labelsFor(provisioner)).To(Equal(prometheus.Labels{
+				"provisioner":      provisioner.Name,
+				"namespace":        provisioner.Namespace,
+				"example_com_team": "payments",
+			}))
+			Expect(testutil.ToFloat64(labeled.launchMetrics.nodesLaunched.With(prometheus.Labels{
+				"provisioner":      provisioner.Name,
+				"namespace":        provisioner.Namespace,
+				"example_com_team": "payments",
+			}))).To(BeNumerically("==", 1))
+		})
+		It("should delete the metrics of deleted provisioners", func() {
+			// seriesOf counts the provisioner's series of every metric
+			seriesOf := func(provisioner *v1alpha1.Provisioner) int {
+				families, err := metrics.Registry.Gather()
+				Expect(err).ToNot(HaveOccurred())
+				count := 0
+				for _, family := range families {
+					for _, metric := range family.GetMetric() {
+						for _, label := range metric.GetLabel() {
+							if label.GetName() == "provisioner" && label.GetValue() == provisioner.Name {
+								count++
+							}
+						}
+					}
+				}
+				return count
+			}
+			labeled := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				fake.NewFactory(cloudprovider.Options{}),
+				env.Manager.GetEventRecorderFor("karpenter"),
+				Options{MetricsLabels: metricsLabels, SystemNamespace: systemNamespace},
+			)
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			// The provisioner isn't created, so only the labeled controller reconciles it
+			Eventually(func() ([]*v1.Pod, error) {
+				return labeled.filter.GetProvisionablePods(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+			Expect(labeled.Reconcile(ctx, provisioner)).To(Succeed())
+			// A node launched after the promoted label changed
+			provisioner.Labels = map[string]string{"example.com/team": "payments"}
+			labeled.launchMetrics.launched(provisioner, 1)
+			Expect(seriesOf(provisioner)).To(Equal(5))
+
+			labeled.Deleted(ctx, apiobject.NamespacedName(provisioner))
+			Expect(seriesOf(provisioner)).To(BeZero())
+		})
+		It("should return errors registering launch metrics other than shared collectors", func() {
+			_, err := newLaunchMetrics(metricsLabels)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = newLaunchMetrics([]string{"example.com/cost-center"})
+			Expect(err).To(HaveOccurred())
+		})
+		It("should report pods that don't fit or exceed max nodes by reason", func() {
+			limited := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				fake.NewFactory(cloudprovider.Options{}),
+				env.Manager.GetEventRecorderFor("karpenter"),
+				Options{MetricsLabels: metricsLabels, SystemNamespace: systemNamespace},
+			)
+			provisioner.Spec.MaxNodes = ptr.Int32(1)
+			pods := []*v1.Pod{
+				test.PendingPodWith(test.PodOptions{NodeSelector: map[string]string{v1alpha1.ZoneLabelKey: "test-zone-1"}}),
+				test.PendingPodWith(test.PodOptions{NodeSelector: map[string]string{v1alpha1.ZoneLabelKey: "test-zone-2"}}),
+				test.PendingPodWith(test.PodOptions{
+					ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1000")}},
+				}),
+			}
+			for _, pod := range pods {
+				ExpectCreatedWithStatus(env.Client, pod)
+			}
+			// The provisioner isn't created, so only the limited controller reconciles it
+			Eventually(func() ([]*v1.Pod, error) {
+				return limited.filter.GetProvisionablePods(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(3))
+
+			Expect(limited.Reconcile(ctx, provisioner)).To(Succeed())
+			unschedulable := func(reason string) float64 {
+				return testutil.ToFloat64(unschedulablePods.With(prometheus.Labels{
+					"provisioner": provisioner.Name,
+					"namespace":   provisioner.Namespace,
+					"reason":      reason,
+				}))
+			}
+			Expect(unschedulable(UnschedulableReasonNoFit)).To(BeNumerically("==", 1))
+			Expect(unschedulable(UnschedulableReasonLimits)).To(BeNumerically("==", 1))
+			Expect(unschedulable(UnschedulableReasonNoCapacity)).To(BeNumerically("==", 0))
+		})
+		It("should report pods whose capacity failed to launch", func() {
+			cloudProvider := fake.NewFactory(cloudprovider.Options{})
+			cloudProvider.CreateErr = fmt.Errorf("insufficient capacity")
+			failing := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				cloudProvider,
+				env.Manager.GetEventRecorderFor("karpenter"),
+				Options{MetricsLabels: metricsLabels, SystemNamespace: systemNamespace},
+			)
+			pod := test.PendingPod()
+			ExpectCreatedWithStatus(env.Client, pod)
+			// The provisioner isn't created, so only the failing controller reconciles it
+			Eventually(func() ([]*v1.Pod, error) {
+				return failing.filter.GetProvisionablePods(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+
+			Expect(failing.Reconcile(ctx, provisioner)).ToNot(Succeed())
+			Expect(testutil.ToFloat64(unschedulablePods.With(prometheus.Labels{
+				"provisioner": provisioner.Name,
+				"namespace":   provisioner.Namespace,
+				"reason":      UnschedulableReasonNoCapacity,
+			}))).To(BeNumerically("==", 1))
+		})
+		It("should report pods that no provisioner matches", func() {
+			matched := test.PendingPod()
+			unmatched := test.PendingPodWith(test.PodOptions{NodeSelector: map[string]string{
+				v1alpha1.ProvisionerNameLabelKey:      "unknown",
+				v1alpha1.ProvisionerNamespaceLabelKey: "default",
+			}})
+			ExpectCreatedWithStatus(env.Client, matched, unmatched)
+			Eventually(func() (float64, error) {
+				if _, err := controller.filter.GetProvisionablePods(ctx, provisioner); err != nil {
+					return 0, err
+				}
+				return testutil.ToFloat64(unschedulablePods.With(prometheus.Labels{
+					"provisioner": "",
+					"namespace":   "",
+					"reason":      UnschedulableReasonNoMatchingProvisioner,
+				})), nil
+			}, ReconcilerPropagationTime, RequestInterval).Should(BeNumerically("==", 1))
+		})
+		It("should parse metrics labels", func() {
+			labels, err := ParseMetricsLabels("example.com/team, example.com/cost-center")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(labels).To(Equal([]string{"example.com/team", "example.com/cost-center"}))
+			labels, err = ParseMetricsLabels("")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(labels).To(BeEmpty())
+		})
+		It("should reject invalid, conflicting, or too many metrics labels", func() {
+			_, err := ParseMetricsLabels("example.com/team,")
+			Expect(err).To(HaveOccurred())
+			_, err = ParseMetricsLabels("example.com/cost-center,example.com/cost_center")
+			Expect(err).To(HaveOccurred())
+			_, err = ParseMetricsLabels("provisioner")
+			Expect(err).To(HaveOccurred())
+			_, err = ParseMetricsLabels("a,b,c,d,e,f")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Context("Zones", func() {
+		It("should launch nodes in the zone required by the pod", func() {
+			pod := test.PendingPodWith(test.PodOptions{
+				NodeRequirements: []v1.NodeSelectorRequirement{
+					{Key: v1alpha1.ZoneLabelKey, Operator: v1.NodeSelectorOpIn, Values: []string{"test-zone-2"}},
+				},
+			})
+			ExpectCreatedWithStatus(env.Client, pod)
+			// The provisioner isn't created, so only the suite's controller reconciles it
+			Eventually(func() ([]*v1.Pod, error) {
+				return controller.filter.GetProvisionablePods(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+			constraintGroups, err := controller.constraints.Group(ctx, provisioner, []*v1.Pod{pod})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(constraintGroups).To(HaveLen(1))
+			Expect(constraintGroups[0].Zones).To(Equal([]string{"test-zone-2"}))
+
+			Expect(controller.Reconcile(ctx, provisioner)).To(Succeed())
+			ExpectNodeExists(env.Client, ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace()).Spec.NodeName)
+		})
+		It("should alert pods whose required zones have no capacity", func() {
+			pod := test.PendingPodWith(test.PodOptions{
+				NodeRequirements: []v1.NodeSelectorRequirement{
+					{Key: v1alpha1.ZoneLabelKey, Operator: v1.NodeSelectorOpIn, Values: []string{"test-zone-3"}},
+				},
+			})
+			ExpectCreatedWithStatus(env.Client, pod)
+			Eventually(func() []string {
+				pods, err := controller.filter.GetProvisionablePods(ctx, provisioner)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(pods).To(BeEmpty())
+				events := &v1.EventList{}
+				Expect(env.Client.List(ctx, events, client.InNamespace(pod.Namespace))).To(Succeed())
+				reasons := []string{}
+				for _, event := range events.Items {
+					if event.InvolvedObject.Name == pod.Name {
+						reasons = append(reasons, event.Reason)
+					}
+				}
+				return reasons
+			}, ReconcilerPropagationTime, RequestInterval).Should(ContainElement("NoAllowedZones"))
+			Expect(ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace()).Spec.NodeName).To(BeEmpty())
+		})
+	})
 	Context("Reconcilation", func() {
 		It("should provision nodes for unconstrained pods", func() {
 			pods := []*v1.Pod{test.PendingPod(), test.PendingPod()}
@@ -100,6 +827,7 @@ var _ = Describe("Allocation", func() {
 			nodes := &v1.NodeList{}
 			Expect(env.Client.List(ctx, nodes)).To(Succeed())
 			Expect(len(nodes.Items)).To(Equal(1))
+			Expect(nodes.Items[0].Annotations).To(HaveKey(v1alpha1.ProvisionerInstanceLaunchedKey))
 			for _, object := range pods {
 				pod := ExpectPodExists(env.Client, object.GetName(), object.GetNamespace())
 				Expect(pod.Spec.NodeName).To(Equal(nodes.Items[0].Name))
@@ -163,6 +891,84 @@ var _ = Describe("Allocation", func() {
 				Expect(unscheduled.Spec.NodeName).To(Equal(""))
 			}
 		})
+		It("should provision nodes for pods whose requirements intersect the provisioner's", func() {
+			provisioner.Spec.InstanceTypes = []string{"default-instance-type", "nvidia-gpu-instance-type"}
+			schedulable := []client.Object{
+				// Selects an instance type of the provisioner
+				test.PendingPodWith(test.PodOptions{
+					NodeSelector: map[string]string{v1alpha1.InstanceTypeLabelKey: "default-instance-type"},
+				}),
+				// Requires instance types that overlap with the provisioner's
+				test.PendingPodWith(test.PodOptions{
+					NodeRequirements: []v1.NodeSelectorRequirement{
+						{Key: v1alpha1.InstanceTypeLabelKey, Operator: v1.NodeSelectorOpIn, Values: []string{"nvidia-gpu-instance-type", "arm-instance-type"}},
+					},
+				}),
+				// Requires a zone, which the provisioner doesn't constrain
+				test.PendingPodWith(test.PodOptions{
+					NodeRequirements: []v1.NodeSelectorRequirement{
+						{Key: v1alpha1.ZoneLabelKey, Operator: v1.NodeSelectorOpIn, Values: []string{"test-zone-1"}},
+					},
+				}),
+			}
+			unschedulable := []client.Object{
+				// Selects an instance type the provisioner doesn't launch
+				test.PendingPodWith(test.PodOptions{
+					NodeSelector: map[string]string{v1alpha1.InstanceTypeLabelKey: "arm-instance-type"},
+				}),
+				// Requires instance types that don't overlap with the provisioner's
+				test.PendingPodWith(test.PodOptions{
+					NodeRequirements: []v1.NodeSelectorRequirement{
+						{Key: v1alpha1.InstanceTypeLabelKey, Operator: v1.NodeSelectorOpIn, Values: []string{"arm-instance-type"}},
+					},
+				}),
+				// Node selector contradicts node affinity
+				test.PendingPodWith(test.PodOptions{
+					NodeSelector: map[string]string{v1alpha1.ZoneLabelKey: "test-zone-1"},
+					NodeRequirements: []v1.NodeSelectorRequirement{
+						{Key: v1alpha1.ZoneLabelKey, Operator: v1.NodeSelectorOpIn, Values: []string{"test-zone-2"}},
+					},
+				}),
+				// Unsupported operator
+				test.PendingPodWith(test.PodOptions{
+					NodeRequirements: []v1.NodeSelectorRequirement{
+						{Key: v1alpha1.ZoneLabelKey, Operator: v1.NodeSelectorOpNotIn, Values: []string{"test-zone-1"}},
+					},
+				}),
+			}
+			ExpectCreatedWithStatus(env.Client, schedulable...)
+			ExpectCreatedWithStatus(env.Client, unschedulable...)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+
+			for _, pod := range schedulable {
+				scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+				ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+			}
+			for _, pod := range unschedulable {
+				unscheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+				Expect(unscheduled.Spec.NodeName).To(BeEmpty())
+			}
+		})
+		It("should intersect pod and provisioner requirements", func() {
+			provisioner.Spec.Zones = []string{"test-zone-1", "test-zone-2"}
+			provisioner.Spec.Architecture = &v1alpha1.ArchitectureArm64
+			constraints := provisioner.ConstraintsWithOverrides(test.PendingPodWith(test.PodOptions{
+				NodeRequirements: []v1.NodeSelectorRequirement{
+					{Key: v1alpha1.ZoneLabelKey, Operator: v1.NodeSelectorOpIn, Values: []string{"test-zone-2", "test-zone-3"}},
+					{Key: v1alpha1.InstanceTypeLabelKey, Operator: v1.NodeSelectorOpIn, Values: []string{"default-instance-type"}},
+				},
+			}))
+			Expect(constraints.Zones).To(Equal([]string{"test-zone-2"}))
+			Expect(constraints.InstanceTypes).To(Equal([]string{"default-instance-type"}))
+			Expect(*constraints.Architecture).To(Equal(v1alpha1.ArchitectureArm64))
+			Expect(*constraints.OperatingSystem).To(Equal(v1alpha1.OperatingSystemLinux))
+
+			_, err := provisioner.Requirements(test.PendingPodWith(test.PodOptions{
+				NodeSelector: map[string]string{v1alpha1.ArchitectureLabelKey: v1alpha1.ArchitectureAmd64},
+			}))
+			Expect(err).To(HaveOccurred())
+		})
 		It("should provision nodes for pods with tolerations", func() {
 			provisioner.Spec.Taints = []v1.Taint{{Key: "test-key", Value: "test-value", Effect: v1.TaintEffectNoSchedule}}
 			schedulable := []client.Object{
@@ -232,6 +1038,45 @@ var _ = Describe("Allocation", func() {
 				ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
 			}
 		})
+		It("should provision nodes for ephemeral storage and huge pages", func() {
+			ephemeralStorage := test.PendingPodWith(test.PodOptions{
+				ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceEphemeralStorage: resource.MustParse("100Gi")}},
+			})
+			hugePages := test.PendingPodWith(test.PodOptions{
+				ResourceRequirements: v1.ResourceRequirements{Limits: v1.ResourceList{
+					v1.ResourceCPU:  resource.MustParse("1"),
+					"hugepages-2Mi": resource.MustParse("512Mi"),
+				}},
+			})
+			unschedulable := []client.Object{
+				test.PendingPodWith(test.PodOptions{
+					ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceEphemeralStorage: resource.MustParse("1Ti")}},
+				}),
+				test.PendingPodWith(test.PodOptions{
+					ResourceRequirements: v1.ResourceRequirements{Limits: v1.ResourceList{
+						v1.ResourceCPU:  resource.MustParse("1"),
+						"hugepages-1Gi": resource.MustParse("1Gi"),
+					}},
+				}),
+			}
+			ExpectCreatedWithStatus(env.Client, ephemeralStorage, hugePages)
+			ExpectCreatedWithStatus(env.Client, unschedulable...)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+
+			nodes := &v1.NodeList{}
+			Expect(env.Client.List(ctx, nodes)).To(Succeed())
+			Expect(len(nodes.Items)).To(Equal(2))
+			scheduled := ExpectPodExists(env.Client, ephemeralStorage.GetName(), ephemeralStorage.GetNamespace())
+			node := ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+			Expect(node.Status.Allocatable[v1.ResourceEphemeralStorage]).To(Equal(resource.MustParse("200Gi")))
+			scheduled = ExpectPodExists(env.Client, hugePages.GetName(), hugePages.GetNamespace())
+			ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+			for _, pod := range unschedulable {
+				unscheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+				Expect(unscheduled.Spec.NodeName).To(BeEmpty())
+			}
+		})
 		It("should account for daemonsets", func() {
 			daemonsets := []client.Object{
 				&appsv1.DaemonSet{
@@ -272,5 +1117,274 @@ var _ = Describe("Allocation", func() {
 			Expect(*nodes.Items[0].Status.Allocatable.Cpu()).To(Equal(resource.MustParse("4")))
 			Expect(*nodes.Items[0].Status.Allocatable.Memory()).To(Equal(resource.MustParse("4Gi")))
 		})
+		Context("Weight", func() {
+			var other *v1alpha1.Provisioner
+			BeforeEach(func() {
+				other = provisioner.DeepCopy()
+				other.Name = strings.ToLower(randomdata.SillyName())
+			})
+			It("should balance pods across equally weighted provisioners", func() {
+				pods := []client.Object{}
+				for i := 0; i < 20; i++ {
+					pods = append(pods, test.PendingPod())
+				}
+				// Both provisioners must be observed before pods are provisioned
+				ExpectCreated(env.Client, provisioner, other)
+				ExpectEventuallyReconciled(env.Client, provisioner, other)
+				ExpectCreatedWithStatus(env.Client, pods...)
+				ExpectEventuallyScheduled(env.Client, pods...)
+
+				provisioned := map[string]int{}
+				for _, pod := range pods {
+					scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+					node := ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+					provisioned[node.Labels[v1alpha1.ProvisionerNameLabelKey]]++
+				}
+				Expect(provisioned).To(HaveKey(provisioner.Name))
+				Expect(provisioned).To(HaveKey(other.Name))
+			})
+			It("should select the provisioner with the highest weight", func() {
+				other.Spec.Weight = ptr.Int32(10)
+				pods := []client.Object{}
+				for i := 0; i < 5; i++ {
+					pods = append(pods, test.PendingPod())
+				}
+				// Both provisioners must be observed before pods are provisioned
+				ExpectCreated(env.Client, provisioner, other)
+				ExpectEventuallyReconciled(env.Client, provisioner, other)
+				ExpectCreatedWithStatus(env.Client, pods...)
+				ExpectEventuallyScheduled(env.Client, pods...)
+
+				for _, pod := range pods {
+					scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+					node := ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+					Expect(node.Labels).To(HaveKeyWithValue(v1alpha1.ProvisionerNameLabelKey, other.Name))
+				}
+			})
+			It("should only select among equally weighted provisioners that can provision the pod", func() {
+				provisioner.Spec.Zones = []string{"test-zone-1"}
+				other.Spec.Zones = []string{"test-zone-2"}
+				pods := []client.Object{}
+				for i := 0; i < 10; i++ {
+					pods = append(pods, test.PendingPodWith(test.PodOptions{NodeSelector: map[string]string{v1alpha1.ZoneLabelKey: "test-zone-2"}}))
+				}
+				// Both provisioners must be observed before pods are provisioned
+				ExpectCreated(env.Client, provisioner, other)
+				ExpectEventuallyReconciled(env.Client, provisioner, other)
+				ExpectCreatedWithStatus(env.Client, pods...)
+				ExpectEventuallyScheduled(env.Client, pods...)
+
+				for _, pod := range pods {
+					scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+					node := ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+					Expect(node.Labels).To(HaveKeyWithValue(v1alpha1.ProvisionerNameLabelKey, other.Name))
+				}
+			})
+			It("should fall back to lower weighted provisioners when higher weighted ones can't provision the pod", func() {
+				other.Spec.Weight = ptr.Int32(10)
+				other.Spec.Zones = []string{"test-zone-1"}
+				pods := []client.Object{}
+				for i := 0; i < 5; i++ {
+					pods = append(pods, test.PendingPodWith(test.PodOptions{NodeSelector: map[string]string{v1alpha1.ZoneLabelKey: "test-zone-2"}}))
+				}
+				// Both provisioners must be observed before pods are provisioned
+				ExpectCreated(env.Client, provisioner, other)
+				ExpectEventuallyReconciled(env.Client, provisioner, other)
+				ExpectCreatedWithStatus(env.Client, pods...)
+				ExpectEventuallyScheduled(env.Client, pods...)
+
+				for _, pod := range pods {
+					scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+					node := ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+					Expect(node.Labels).To(HaveKeyWithValue(v1alpha1.ProvisionerNameLabelKey, provisioner.Name))
+				}
+			})
+		})
+		It("should only account for daemonsets that tolerate the provisioner's taints", func() {
+			provisioner.Spec.Taints = []v1.Taint{{Key: "test-key", Value: "test-value", Effect: v1.TaintEffectNoSchedule}}
+			daemonsets := []client.Object{
+				daemonSetWith("tolerating", v1.PodSpec{
+					Tolerations: []v1.Toleration{{Key: "test-key", Operator: v1.TolerationOpExists}},
+				}, resource.MustParse("1")),
+				daemonSetWith("intolerant", v1.PodSpec{
+					Tolerations: []v1.Toleration{{Key: "other-key", Operator: v1.TolerationOpExists}},
+				}, resource.MustParse("2")),
+			}
+			schedulable := []client.Object{}
+			for i := 0; i < 3; i++ {
+				schedulable = append(schedulable, test.PendingPodWith(test.PodOptions{
+					Tolerations:          []v1.Toleration{{Key: "test-key", Operator: v1.TolerationOpExists}},
+					ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")}},
+				}))
+			}
+			ExpectCreatedWithStatus(env.Client, daemonsets...)
+			ExpectCreatedWithStatus(env.Client, schedulable...)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+
+			nodes := &v1.NodeList{}
+			Expect(env.Client.List(ctx, nodes)).To(Succeed())
+			Expect(len(nodes.Items)).To(Equal(1)) // 1 cpu daemon + 3 cpu pods
+			for _, pod := range schedulable {
+				scheduled := ExpectPodExists(env.Client, pod.GetName(), pod.GetNamespace())
+				ExpectNodeExists(env.Client, scheduled.Spec.NodeName)
+			}
+		})
+		It("should account for daemonsets that select well known labels and tolerate all taints", func() {
+			provisioner.Spec.Taints = []v1.Taint{{Key: "test-key", Value: "test-value", Effect: v1.TaintEffectNoSchedule}}
+			daemonsets := []client.Object{
+				daemonSetWith("selective", v1.PodSpec{
+					NodeSelector: map[string]string{v1alpha1.OperatingSystemLabelKey: v1alpha1.OperatingSystemLinux},
+					Tolerations:  []v1.Toleration{{Operator: v1.TolerationOpExists}},
+				}, resource.MustParse("2")),
+			}
+			schedulable := []client.Object{}
+			for i := 0; i < 3; i++ {
+				schedulable = append(schedulable, test.PendingPodWith(test.PodOptions{
+					Tolerations:          []v1.Toleration{{Key: "test-key", Operator: v1.TolerationOpExists}},
+					ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")}},
+				}))
+			}
+			ExpectCreatedWithStatus(env.Client, daemonsets...)
+			ExpectCreatedWithStatus(env.Client, schedulable...)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+
+			nodes := &v1.NodeList{}
+			Expect(env.Client.List(ctx, nodes)).To(Succeed())
+			Expect(len(nodes.Items)).To(Equal(2)) // 2 cpu daemon + 2 cpu pods, 2 cpu daemon + 1 cpu pod
+		})
+		It("should not provision nodes for pods that exceed every instance type", func() {
+			pod := test.PendingPodWith(test.PodOptions{
+				ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1000")}},
+			})
+			ExpectCreatedWithStatus(env.Client, pod)
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+
+			Eventually(func() []string {
+				events := &v1.EventList{}
+				Expect(env.Client.List(ctx, events, client.InNamespace(pod.Namespace))).To(Succeed())
+				messages := []string{}
+				for _, event := range events.Items {
+					if event.InvolvedObject.Name == pod.Name && event.Reason == "Unschedulable" {
+						messages = append(messages, event.Message)
+					}
+				}
+				return messages
+			}, ReconcilerPropagationTime, RequestInterval).Should(ContainElement(ContainSubstring(string(v1.ResourceCPU))))
+			nodes := &v1.NodeList{}
+			Expect(env.Client.List(ctx, nodes)).To(Succeed())
+			Expect(nodes.Items).To(BeEmpty())
+			Expect(ExpectPodExists(env.Client, pod.Name, pod.Namespace).Spec.NodeName).To(BeEmpty())
+		})
+	})
+	Context("NoFit", func() {
+		It("should back off pods that don't fit any instance type and give up on them", func() {
+			fakeClock := clock.NewFakeClock(time.Now())
+			impossible := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				fake.NewFactory(cloudprovider.Options{}),
+				env.Manager.GetEventRecorderFor("karpenter"),
+				Options{
+					MetricsLabels:    metricsLabels,
+					SystemNamespace:  systemNamespace,
+					MaxNoFitAttempts: 3,
+				},
+			)
+			impossible.clock = fakeClock
+			pod := test.PendingPodWith(test.PodOptions{
+				ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1000")}},
+			})
+			ExpectCreatedWithStatus(env.Client, pod)
+			// The provisioner isn't created, so only the test's controller reconciles it
+			Eventually(func() ([]*v1.Pod, error) {
+				return impossible.filter.GetProvisionablePods(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+			attempts := func() int {
+				Expect(impossible.Reconcile(ctx, provisioner)).To(Succeed())
+				return impossible.noFits[pod.UID].attempts
+			}
+
+			Expect(attempts()).To(Equal(1))
+			// Backing off
+			Expect(attempts()).To(Equal(1))
+			fakeClock.Step(NoFitBackoff)
+			Expect(attempts()).To(Equal(2))
+			fakeClock.Step(NoFitBackoff)
+			Expect(attempts()).To(Equal(2))
+			fakeClock.Step(NoFitBackoff)
+			Expect(attempts()).To(Equal(3))
+			// Given up
+			fakeClock.Step(time.Hour)
+			Expect(attempts()).To(Equal(3))
+			Expect(ExpectPodExists(env.Client, pod.Name, pod.Namespace).Spec.NodeName).To(BeEmpty())
+		})
+		It("should evaluate pods again once their spec changes", func() {
+			impossible := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				fake.NewFactory(cloudprovider.Options{}),
+				env.Manager.GetEventRecorderFor("karpenter"),
+				Options{
+					MetricsLabels:    metricsLabels,
+					SystemNamespace:  systemNamespace,
+					MaxNoFitAttempts: 1,
+				},
+			)
+			pod := test.PendingPodWith(test.PodOptions{
+				ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1000")}},
+			})
+			ExpectCreatedWithStatus(env.Client, pod)
+			Eventually(func() ([]*v1.Pod, error) {
+				return impossible.filter.GetProvisionablePods(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+			Expect(impossible.Reconcile(ctx, provisioner)).To(Succeed())
+			Expect(impossible.noFits[pod.UID].attempts).To(Equal(1))
+
+			instanceTypes, err := impossible.cloudProvider.CapacityFor(provisioner).GetInstanceTypes(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			updated := ExpectPodExists(env.Client, pod.Name, pod.Namespace)
+			updated.Spec.Containers[0].Image = "updated-image"
+			Expect(env.Client.Update(ctx, updated)).To(Succeed())
+			Eventually(func() ([]*v1.Pod, error) {
+				return impossible.evaluable(provisioner, instanceTypes, []*v1.Pod{ExpectPodExists(env.Client, pod.Name, pod.Namespace)}), nil
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+		})
+		It("should evaluate pods again once the provisioner or its instance types change", func() {
+			impossible := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				fake.NewFactory(cloudprovider.Options{}),
+				env.Manager.GetEventRecorderFor("karpenter"),
+				Options{
+					MetricsLabels:    metricsLabels,
+					SystemNamespace:  systemNamespace,
+					MaxNoFitAttempts: 1,
+				},
+			)
+			pod := test.PendingPodWith(test.PodOptions{
+				ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1000")}},
+			})
+			ExpectCreatedWithStatus(env.Client, pod)
+			Eventually(func() ([]*v1.Pod, error) {
+				return impossible.filter.GetProvisionablePods(ctx, provisioner)
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+			Expect(impossible.Reconcile(ctx, provisioner)).To(Succeed())
+			Expect(impossible.noFits[pod.UID].attempts).To(Equal(1))
+
+			instanceTypes, err := impossible.cloudProvider.CapacityFor(provisioner).GetInstanceTypes(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			pods := []*v1.Pod{ExpectPodExists(env.Client, pod.Name, pod.Namespace)}
+			Expect(impossible.evaluable(provisioner, instanceTypes, pods)).To(BeEmpty())
+			Expect(impossible.evaluable(provisioner, instanceTypes[:1], pods)).To(HaveLen(1))
+
+			Expect(impossible.Reconcile(ctx, provisioner)).To(Succeed())
+			Expect(impossible.evaluable(provisioner, instanceTypes, pods)).To(BeEmpty())
+			edited := provisioner.DeepCopy()
+			edited.Generation++
+			Expect(impossible.evaluable(edited, instanceTypes, pods)).To(HaveLen(1))
+		})
 	})
 })
@@ -0,0 +1,54 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reallocation
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Allocatable reports the allocatable resources of a provisioner's ready nodes
+// to cloud providers that estimate them, see cloudprovider.AllocatableObserver.
+// Nodes are only observed once ready, since the allocatable resources of nodes
+// created before their kubelet registers are placeholders.
+type Allocatable struct {
+	kubeClient      client.Client
+	cloudProvider   cloudprovider.Factory
+	managedLabelKey string
+}
+
+func (a *Allocatable) Reconcile(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
+	observer, ok := a.cloudProvider.CapacityFor(provisioner).(cloudprovider.AllocatableObserver)
+	if !ok {
+		return nil
+	}
+	nodes := &v1.NodeList{}
+	if err := a.kubeClient.List(ctx, nodes, client.MatchingLabels(nodeLabelsFor(provisioner, a.managedLabelKey))); err != nil {
+		return fmt.Errorf("listing nodes, %w", err)
+	}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if !isNodeReady(node) || len(node.Status.Allocatable) == 0 {
+			continue
+		}
+		observer.ObserveAllocatable(ctx, node)
+	}
+	return nil
+}
@@ -17,9 +17,12 @@ package reallocation
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"time"
 
+	"k8s.io/apimachinery/pkg/util/clock"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
@@ -29,9 +32,14 @@ import (
 
 // Controller for the resource
 type Controller struct {
-	terminator    *Terminator
-	utilization   *Utilization
-	cloudProvider cloudprovider.Factory
+	migration      *ManagedLabelMigration
+	terminator     *Terminator
+	utilization    *Utilization
+	taints         *Taints
+	initialization *Initialization
+	validation     *Validation
+	allocatable    *Allocatable
+	cloudProvider  cloudprovider.Factory
 }
 
 // For returns the resource this controller is for.
@@ -53,10 +61,33 @@ func (c *Controller) Name() string {
 }
 
 // NewController constructs a controller instance
-func NewController(kubeClient client.Client, coreV1Client corev1.CoreV1Interface, cloudProvider cloudprovider.Factory) *Controller {
+func NewController(kubeClient client.Client, coreV1Client corev1.CoreV1Interface, cloudProvider cloudprovider.Factory, recorder record.EventRecorder, evictionPolicies EvictionPolicies, managedLabelKey string, validationHook *ValidationHook) *Controller {
+	realClock := clock.RealClock{}
 	return &Controller{
-		utilization:   &Utilization{kubeClient: kubeClient},
-		terminator:    &Terminator{kubeClient: kubeClient, cloudprovider: cloudProvider, coreV1Client: coreV1Client},
+		migration:      &ManagedLabelMigration{kubeClient: kubeClient, managedLabelKey: managedLabelKey, startedAt: realClock.Now(), clock: realClock},
+		utilization:    &Utilization{kubeClient: kubeClient, managedLabelKey: managedLabelKey, clock: realClock},
+		taints:         &Taints{kubeClient: kubeClient, managedLabelKey: managedLabelKey},
+		initialization: &Initialization{kubeClient: kubeClient, managedLabelKey: managedLabelKey, clock: realClock},
+		validation: &Validation{
+			kubeClient:      kubeClient,
+			recorder:        recorder,
+			managedLabelKey: managedLabelKey,
+			hook:            validationHook,
+			httpClient:      &http.Client{},
+		},
+		allocatable: &Allocatable{kubeClient: kubeClient, cloudProvider: cloudProvider, managedLabelKey: managedLabelKey},
+		terminator: &Terminator{
+			kubeClient:      kubeClient,
+			cloudprovider:   cloudProvider,
+			recorder:        recorder,
+			managedLabelKey: managedLabelKey,
+			evictors: map[EvictionPolicy]Evictor{
+				EvictionPolicyEvict:  &APIEvictor{coreV1Client: coreV1Client},
+				EvictionPolicyDelete: &DeleteEvictor{kubeClient: kubeClient},
+			},
+			evictionPolicies: evictionPolicies,
+			clock:            realClock,
+		},
 		cloudProvider: cloudProvider,
 	}
 }
@@ -64,11 +95,42 @@ func NewController(kubeClient client.Client, coreV1Client corev1.CoreV1Interface
 // Reconcile executes a reallocation control loop for the resource
 func (c *Controller) Reconcile(ctx context.Context, object controllers.Object) error {
 	provisioner := object.(*v1alpha1.Provisioner)
+	// Observe only provisioners never modify nodes
+	if provisioner.Spec.ObserveOnly {
+		return nil
+	}
+	if err := c.migration.Reconcile(ctx, provisioner); err != nil {
+		return fmt.Errorf("reconciling managed label migration, %w", err)
+	}
 	if err := c.utilization.Reconcile(ctx, provisioner); err != nil {
 		return fmt.Errorf("reconciling utilization sub-controller, %w", err)
 	}
+	if err := c.taints.Reconcile(ctx, provisioner); err != nil {
+		return fmt.Errorf("reconciling taints sub-controller, %w", err)
+	}
+	if err := c.validation.Reconcile(ctx, provisioner); err != nil {
+		return fmt.Errorf("reconciling validation sub-controller, %w", err)
+	}
+	if err := c.initialization.Reconcile(ctx, provisioner); err != nil {
+		return fmt.Errorf("reconciling initialization sub-controller, %w", err)
+	}
+	if err := c.allocatable.Reconcile(ctx, provisioner); err != nil {
+		return fmt.Errorf("reconciling allocatable sub-controller, %w", err)
+	}
 	if err := c.terminator.Reconcile(ctx, provisioner); err != nil {
 		return fmt.Errorf("reconciling termination sub-controller, %w", err)
 	}
 	return nil
 }
+
+// nodeLabelsFor returns the labels of the provisioner's nodes that are managed
+// by Karpenter. Nodes without the managed label, e.g. nodes that joined with
+// the provisioner's labels by hand, are never selected, so never disrupted.
+// Nodes launched before the label existed are labeled by the migration.
+func nodeLabelsFor(provisioner *v1alpha1.Provisioner, managedLabelKey string) map[string]string {
+	return map[string]string{
+		v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+		v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+		managedLabelKey:                       "true",
+	}
+}
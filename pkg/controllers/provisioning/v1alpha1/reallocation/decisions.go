@@ -0,0 +1,101 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reallocation
+
+import (
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/utils/apiobject"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+)
+
+// DecisionMessage is the message of every deprovisioning decision log entry
+const DecisionMessage = "Deprovisioning decision"
+
+// Actions taken on nodes by deprovisioning decisions
+const (
+	DecisionActionCordon     = "Cordon"
+	DecisionActionForceDrain = "ForceDrain"
+	DecisionActionUncordon   = "Uncordon"
+	DecisionActionTerminate  = "Terminate"
+)
+
+// Reasons for deprovisioning decisions
+const (
+	// DecisionReasonTTLExpired nodes were underutilized for longer than the
+	// provisioner's TTL
+	DecisionReasonTTLExpired = "TTLExpired"
+	// DecisionReasonInvoluntaryDisruption nodes were marked for termination
+	// regardless of whether they can be drained, e.g. spot interruptions
+	DecisionReasonInvoluntaryDisruption = "InvoluntaryDisruption"
+	// DecisionReasonDrainTimeout nodes had evictions blocked by
+	// PodDisruptionBudgets for longer than the drain timeout
+	DecisionReasonDrainTimeout = "DrainTimeout"
+	// DecisionReasonDrainDeadline nodes drained for longer than the drain
+	// deadline and were terminated with pods remaining
+	DecisionReasonDrainDeadline = "DrainDeadline"
+	// DecisionReasonDrained nodes have no evictable pods left
+	DecisionReasonDrained = "Drained"
+)
+
+// Decision is a structured log entry explaining why a node was disrupted.
+// Every disruption path logs the same fields, so that operators can query
+// decisions uniformly.
+type Decision struct {
+	Action      string
+	Reason      string
+	Disruption  string
+	Node        string
+	Provisioner string
+	// Pods that the action moves off the node
+	Pods []string
+}
+
+// decisionFor returns the decision of an action on the provisioner's node
+func decisionFor(action string, reason string, provisioner *v1alpha1.Provisioner, node *v1.Node, pods []*v1.Pod) Decision {
+	names := []string{}
+	for _, name := range apiobject.PodNamespacedNames(pods) {
+		names = append(names, name.String())
+	}
+	return Decision{
+		Action:      action,
+		Reason:      reason,
+		Disruption:  disruptionOf(node),
+		Node:        node.Name,
+		Provisioner: apiobject.NamespacedName(provisioner).String(),
+		Pods:        names,
+	}
+}
+
+// Log writes the decision as a structured log entry
+func (d Decision) Log() {
+	zap.S().Infow(DecisionMessage,
+		"action", d.Action,
+		"reason", d.Reason,
+		"disruption", d.Disruption,
+		"node", d.Node,
+		"provisioner", d.Provisioner,
+		"pods", d.Pods,
+	)
+}
+
+// disruptionOf returns whether the node's disruption is voluntary or
+// involuntary. Nodes are voluntarily disrupted unless annotated otherwise.
+func disruptionOf(node *v1.Node) string {
+	if node.Annotations[v1alpha1.ProvisionerDisruptionKey] == v1alpha1.DisruptionInvoluntary {
+		return v1alpha1.DisruptionInvoluntary
+	}
+	return v1alpha1.DisruptionVoluntary
+}
@@ -0,0 +1,110 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reallocation
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// EvictionPolicy determines how pods are removed from draining nodes
+type EvictionPolicy string
+
+const (
+	// EvictionPolicyEvict uses the eviction API, which respects
+	// PodDisruptionBudgets.
+	EvictionPolicyEvict EvictionPolicy = "Evict"
+	// EvictionPolicyDelete deletes pods directly, which bypasses
+	// PodDisruptionBudgets. It's useful for clusters without the eviction API,
+	// or to force drains.
+	EvictionPolicyDelete EvictionPolicy = "Delete"
+)
+
+// ParseEvictionPolicy returns an error if the policy is unknown
+func ParseEvictionPolicy(policy string) (EvictionPolicy, error) {
+	switch EvictionPolicy(policy) {
+	case EvictionPolicyEvict, EvictionPolicyDelete:
+		return EvictionPolicy(policy), nil
+	default:
+		return "", fmt.Errorf("eviction policy must be one of %v, got %s",
+			[]EvictionPolicy{EvictionPolicyEvict, EvictionPolicyDelete}, policy)
+	}
+}
+
+// EvictionPolicies select the eviction policy of each disruption. Unset
+// policies default to EvictionPolicyEvict.
+type EvictionPolicies struct {
+	Voluntary   EvictionPolicy
+	Involuntary EvictionPolicy
+}
+
+// For returns the eviction policy of the node's disruption
+func (e EvictionPolicies) For(node *v1.Node) EvictionPolicy {
+	policy := e.Voluntary
+	if node.Annotations[v1alpha1.ProvisionerDisruptionKey] == v1alpha1.DisruptionInvoluntary {
+		policy = e.Involuntary
+	}
+	if policy == "" {
+		return EvictionPolicyEvict
+	}
+	return policy
+}
+
+// Evictor removes pods from draining nodes
+type Evictor interface {
+	// Evict returns true if the pod's removal is blocked by a
+	// PodDisruptionBudget.
+	Evict(ctx context.Context, pod *v1.Pod) (bool, error)
+}
+
+// APIEvictor evicts pods with the eviction API
+type APIEvictor struct {
+	coreV1Client corev1.CoreV1Interface
+}
+
+func (a *APIEvictor) Evict(ctx context.Context, pod *v1.Pod) (bool, error) {
+	if err := a.coreV1Client.Pods(pod.Namespace).Evict(ctx, &v1beta1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: pod.Name,
+		},
+	}); err != nil {
+		// The eviction API responds with 429 when a PodDisruptionBudget is violated
+		if errors.IsTooManyRequests(err) {
+			return true, nil
+		}
+		return false, fmt.Errorf("evicting pod %s/%s, %w", pod.Namespace, pod.Name, err)
+	}
+	return false, nil
+}
+
+// DeleteEvictor deletes pods, ignoring PodDisruptionBudgets
+type DeleteEvictor struct {
+	kubeClient client.Client
+}
+
+func (d *DeleteEvictor) Evict(ctx context.Context, pod *v1.Pod) (bool, error) {
+	if err := d.kubeClient.Delete(ctx, pod); client.IgnoreNotFound(err) != nil {
+		return false, fmt.Errorf("deleting pod %s/%s, %w", pod.Namespace, pod.Name, err)
+	}
+	return false, nil
+}
@@ -0,0 +1,168 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reallocation
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/utils/pod"
+	"github.com/awslabs/karpenter/pkg/utils/ptr"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// startupTaints are applied to nodes while they initialize, and removed by
+// the node lifecycle controller and cloud controller manager once they're
+// ready, or by the validation sub-controller once the hook accepts them
+var startupTaints = []string{
+	v1.TaintNodeNotReady,
+	v1.TaintNodeUnreachable,
+	v1.TaintNodeNetworkUnavailable,
+	"node.cloudprovider.kubernetes.io/uninitialized",
+	v1alpha1.ValidationPendingTaintKey,
+}
+
+// initializationStage is complete when its predicate is true for the node and
+// its daemonset pods
+type initializationStage struct {
+	key      string
+	complete func(node *v1.Node, daemonSetPods []*v1.Pod) bool
+}
+
+// initializationStages in the order that nodes progress through them. The
+// instance launched stage is annotated when the node is created.
+var initializationStages = []initializationStage{
+	{key: v1alpha1.ProvisionerNodeRegisteredKey, complete: isRegistered},
+	{key: v1alpha1.ProvisionerDaemonSetsReadyKey, complete: areDaemonSetsReady},
+	{key: v1alpha1.ProvisionerStartupTaintsRemovedKey, complete: areStartupTaintsRemoved},
+}
+
+// Initialization annotates a provisioner's nodes with the time each
+// initialization stage completed, so that operators can see where slow nodes
+// spend their time joining the cluster. Stages are annotated in order, and
+// nodes launched before stages were recorded are ignored.
+type Initialization struct {
+	kubeClient      client.Client
+	managedLabelKey string
+	clock           clock.Clock
+}
+
+func (i *Initialization) Reconcile(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
+	nodes := &v1.NodeList{}
+	if err := i.kubeClient.List(ctx, nodes, client.MatchingLabels(nodeLabelsFor(provisioner, i.managedLabelKey))); err != nil {
+		return fmt.Errorf("listing nodes, %w", err)
+	}
+	for j := range nodes.Items {
+		node := &nodes.Items[j]
+		if !isInitializing(node) {
+			continue
+		}
+		pods := &v1.PodList{}
+		if err := i.kubeClient.List(ctx, pods, client.MatchingFields{"spec.nodeName": node.Name}); err != nil {
+			return fmt.Errorf("listing pods on node %s, %w", node.Name, err)
+		}
+		daemonSetPods := []*v1.Pod{}
+		for _, p := range ptr.PodListToSlice(pods) {
+			if pod.IsOwnedByDaemonSet(p) {
+				daemonSetPods = append(daemonSetPods, p)
+			}
+		}
+		persisted := node.DeepCopy()
+		now := i.clock.Now().Format(time.RFC3339)
+		for _, stage := range initializationStages {
+			if _, ok := node.Annotations[stage.key]; ok {
+				continue
+			}
+			if !stage.complete(node, daemonSetPods) {
+				break
+			}
+			node.Annotations[stage.key] = now
+			zap.S().Debugf("Node %s completed initialization stage %s", node.Name, stage.key)
+		}
+		if len(node.Annotations) == len(persisted.Annotations) {
+			continue
+		}
+		if err := i.kubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil {
+			return fmt.Errorf("patching node %s, %w", node.Name, err)
+		}
+	}
+	return nil
+}
+
+// isInitializing returns true if the node's instance launch was recorded and
+// it hasn't completed every stage
+func isInitializing(node *v1.Node) bool {
+	if _, ok := node.Annotations[v1alpha1.ProvisionerInstanceLaunchedKey]; !ok {
+		return false
+	}
+	_, ok := node.Annotations[initializationStages[len(initializationStages)-1].key]
+	return !ok
+}
+
+// isRegistered returns true once the kubelet has reported its node info.
+// Karpenter creates node objects before their kubelets register, so the
+// node's existence alone doesn't indicate registration.
+func isRegistered(node *v1.Node, _ []*v1.Pod) bool {
+	return node.Status.NodeInfo.KubeletVersion != ""
+}
+
+// areDaemonSetsReady returns true if every daemonset pod on the node is ready
+func areDaemonSetsReady(_ *v1.Node, daemonSetPods []*v1.Pod) bool {
+	for _, p := range daemonSetPods {
+		if !isPodReady(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// areStartupTaintsRemoved returns true once the node is ready and none of the
+// taints applied while it initialized remain
+func areStartupTaintsRemoved(node *v1.Node, _ []*v1.Pod) bool {
+	if !isNodeReady(node) {
+		return false
+	}
+	for _, taint := range node.Spec.Taints {
+		for _, key := range startupTaints {
+			if taint.Key == key {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isNodeReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func isPodReady(p *v1.Pod) bool {
+	for _, condition := range p.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reallocation
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ManagedLabelMigration labels the nodes that a provisioner launched before
+// nodes were labeled as managed, so that they're still disrupted. It runs once
+// per provisioner, which is annotated once its nodes are labeled. Nodes that
+// join with the provisioner's labels afterwards stay unmanaged.
+//
+// Nodes launched by a previous version were created before the controller
+// started, so nodes created since, and all nodes of provisioners created
+// since, are never labeled, e.g. nodes joined by hand with a provisioner's
+// labels.
+type ManagedLabelMigration struct {
+	kubeClient      client.Client
+	managedLabelKey string
+	startedAt       time.Time
+	clock           clock.Clock
+}
+
+func (m *ManagedLabelMigration) Reconcile(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
+	if _, ok := provisioner.Annotations[v1alpha1.ProvisionerManagedLabelMigratedKey]; ok {
+		return nil
+	}
+	if provisioner.CreationTimestamp.Time.Before(m.startedAt) {
+		if err := m.labelNodes(ctx, provisioner); err != nil {
+			return err
+		}
+	}
+	persisted := provisioner.DeepCopy()
+	provisioner.Annotations = functional.UnionStringMaps(provisioner.Annotations, map[string]string{
+		v1alpha1.ProvisionerManagedLabelMigratedKey: m.clock.Now().Format(time.RFC3339),
+	})
+	if err := m.kubeClient.Patch(ctx, provisioner, client.MergeFrom(persisted)); err != nil {
+		return fmt.Errorf("patching provisioner, %w", err)
+	}
+	return nil
+}
+
+// labelNodes labels the provisioner's nodes that were created before the
+// controller started as managed
+func (m *ManagedLabelMigration) labelNodes(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
+	nodes := &v1.NodeList{}
+	if err := m.kubeClient.List(ctx, nodes, client.MatchingLabels{
+		v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+		v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+	}); err != nil {
+		return fmt.Errorf("listing nodes, %w", err)
+	}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if _, ok := node.Labels[m.managedLabelKey]; ok {
+			continue
+		}
+		if !node.CreationTimestamp.Time.Before(m.startedAt) {
+			continue
+		}
+		persisted := node.DeepCopy()
+		node.Labels = functional.UnionStringMaps(node.Labels, map[string]string{m.managedLabelKey: "true"})
+		if err := m.kubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil {
+			return fmt.Errorf("patching node %s, %w", node.Name, err)
+		}
+		zap.S().Infof("Labeled node %s launched by provisioner %s/%s as managed", node.Name, provisioner.Name, provisioner.Namespace)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reallocation
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// nextSerialEviction returns the pod to evict next from a node drained
+// serially. No pod is returned while the last evicted pod is terminating,
+// before the delay since the last eviction elapses, or before the evicted
+// pod's replacement is ready. Pod readiness includes readiness gates, so
+// workloads may hold back the drain until they've recovered.
+func (t *Terminator) nextSerialEviction(ctx context.Context, provisioner *v1alpha1.Provisioner, node *v1.Node, pods []*v1.Pod) ([]*v1.Pod, error) {
+	// 1. Wait for the last evicted pod to terminate
+	for _, p := range pods {
+		if !p.DeletionTimestamp.IsZero() {
+			return nil, nil
+		}
+	}
+	if evicted, err := time.Parse(time.RFC3339, node.Annotations[v1alpha1.ProvisionerLastEvictionKey]); err == nil {
+		// 2. Wait for the delay between evictions
+		if remaining := secondsOf(provisioner.Spec.SerialEviction.DelaySeconds) - t.clock.Since(evicted); remaining > 0 {
+			zap.S().Debugf("Deferring eviction from node %s for %s after the last eviction", node.Name, remaining.Round(time.Second))
+			return nil, nil
+		}
+		// 3. Wait for the last evicted pod's replacement to become ready
+		if owner := node.Annotations[v1alpha1.ProvisionerLastEvictedOwnerKey]; owner != "" {
+			ready, err := t.isReplacementReady(ctx, node, owner, evicted)
+			if err != nil {
+				return nil, fmt.Errorf("checking replacement of evicted pod, %w", err)
+			}
+			if !ready {
+				zap.S().Debugf("Deferring eviction from node %s until the last evicted pod's replacement is ready", node.Name)
+				return nil, nil
+			}
+		}
+	}
+	// 4. Evict the first pod in order
+	ordered := append([]*v1.Pod{}, pods...)
+	sort.Slice(ordered, func(i, j int) bool { return evictsBefore(ordered[i], ordered[j]) })
+	return ordered[:1], nil
+}
+
+// recordSerialEviction annotates the node with the time of the eviction and
+// the namespace and uid of the evicted pod's controller, if any
+func (t *Terminator) recordSerialEviction(ctx context.Context, node *v1.Node, pod *v1.Pod) error {
+	owner := ""
+	if controller := metav1.GetControllerOf(pod); controller != nil {
+		owner = fmt.Sprintf("%s/%s", pod.Namespace, controller.UID)
+	}
+	persisted := node.DeepCopy()
+	node.Annotations = functional.UnionStringMaps(node.Annotations, map[string]string{
+		v1alpha1.ProvisionerLastEvictionKey:     t.clock.Now().Format(time.RFC3339),
+		v1alpha1.ProvisionerLastEvictedOwnerKey: owner,
+	})
+	if err := t.kubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil {
+		return fmt.Errorf("patching node %s, %w", node.Name, err)
+	}
+	zap.S().Debugf("Evicted pod %s/%s from node %s", pod.Namespace, pod.Name, node.Name)
+	return nil
+}
+
+// isReplacementReady returns true if the controller of the last evicted pod
+// has created a pod on another node since the eviction, and it's ready
+func (t *Terminator) isReplacementReady(ctx context.Context, node *v1.Node, owner string, evicted time.Time) (bool, error) {
+	parts := strings.SplitN(owner, "/", 2)
+	if len(parts) != 2 {
+		return false, fmt.Errorf("invalid owner %s", owner)
+	}
+	pods := &v1.PodList{}
+	if err := t.kubeClient.List(ctx, pods, client.InNamespace(parts[0])); err != nil {
+		return false, fmt.Errorf("listing pods, %w", err)
+	}
+	for i := range pods.Items {
+		p := &pods.Items[i]
+		if p.Spec.NodeName == node.Name || p.CreationTimestamp.Time.Before(evicted) {
+			continue
+		}
+		if controller := metav1.GetControllerOf(p); controller != nil && string(controller.UID) == parts[1] && isPodReady(p) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// evictsBefore orders serial evictions by descending name. The ordinals of
+// StatefulSet pods are compared numerically, so replicas are evicted from the
+// highest ordinal, like StatefulSet rolling updates.
+func evictsBefore(a *v1.Pod, b *v1.Pod) bool {
+	if a.Namespace != b.Namespace {
+		return a.Namespace > b.Namespace
+	}
+	aPrefix, aOrdinal := ordinalOf(a.Name)
+	bPrefix, bOrdinal := ordinalOf(b.Name)
+	if aPrefix != bPrefix {
+		return aPrefix > bPrefix
+	}
+	if aOrdinal != bOrdinal {
+		return aOrdinal > bOrdinal
+	}
+	return a.Name > b.Name
+}
+
+// ordinalOf splits a pod name into its prefix and numeric suffix, which is -1
+// if the name has none
+func ordinalOf(name string) (string, int) {
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return name, -1
+	}
+	ordinal, err := strconv.Atoi(name[i+1:])
+	if err != nil || ordinal < 0 {
+		return name, -1
+	}
+	return name[:i], ordinal
+}
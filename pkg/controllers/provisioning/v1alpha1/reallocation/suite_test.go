@@ -16,7 +16,11 @@ package reallocation
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -27,14 +31,24 @@ import (
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
 	"github.com/awslabs/karpenter/pkg/cloudprovider/fake"
 	"github.com/awslabs/karpenter/pkg/test"
+	utilsnode "github.com/awslabs/karpenter/pkg/utils/node"
+	"github.com/awslabs/karpenter/pkg/utils/pod"
 	webhooksprovisioning "github.com/awslabs/karpenter/pkg/webhooks/provisioning/v1alpha1"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/api/policy/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"knative.dev/pkg/ptr"
 
 	. "github.com/awslabs/karpenter/pkg/test/expectations"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest/printer"
 )
@@ -53,6 +67,10 @@ var env = test.NewEnvironment(func(e *test.Environment) {
 		e.Manager.GetClient(),
 		corev1.NewForConfigOrDie(e.Manager.GetConfig()),
 		cloudProvider,
+		e.Manager.GetEventRecorderFor("karpenter"),
+		EvictionPolicies{},
+		v1alpha1.DefaultManagedLabelKey,
+		nil,
 	)
 	e.Manager.RegisterWebhooks(
 		&webhooksprovisioning.Validator{CloudProvider: cloudProvider},
@@ -60,6 +78,15 @@ var env = test.NewEnvironment(func(e *test.Environment) {
 	).RegisterControllers(controller)
 })
 
+// decisionsFor returns the fields of the deprovisioning decisions logged for the node
+func decisionsFor(logs *observer.ObservedLogs, node *v1.Node) []map[string]interface{} {
+	decisions := []map[string]interface{}{}
+	for _, entry := range logs.FilterMessage(DecisionMessage).FilterField(zap.String("node", node.Name)).All() {
+		decisions = append(decisions, entry.ContextMap())
+	}
+	return decisions
+}
+
 var _ = BeforeSuite(func() {
 	Expect(env.Start()).To(Succeed(), "Failed to start environment")
 })
@@ -71,8 +98,13 @@ var _ = AfterSuite(func() {
 var _ = Describe("Reallocation", func() {
 	var provisioner *v1alpha1.Provisioner
 	var ctx context.Context
+	var logs *observer.ObservedLogs
+	var restoreLogger func()
 
 	BeforeEach(func() {
+		var core zapcore.Core
+		core, logs = observer.New(zapcore.InfoLevel)
+		restoreLogger = zap.ReplaceGlobals(zap.New(core))
 		provisioner = &v1alpha1.Provisioner{
 			ObjectMeta: metav1.ObjectMeta{Name: strings.ToLower(randomdata.SillyName()),
 				Namespace: "default",
@@ -85,6 +117,7 @@ var _ = Describe("Reallocation", func() {
 	})
 
 	AfterEach(func() {
+		restoreLogger()
 		ExpectCleanedUp(env.Manager.GetClient())
 	})
 
@@ -95,6 +128,7 @@ var _ = Describe("Reallocation", func() {
 				Labels: map[string]string{
 					v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
 					v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+					v1alpha1.DefaultManagedLabelKey:       "true",
 				},
 			})
 			ExpectCreatedWithStatus(env.Client, node)
@@ -107,11 +141,156 @@ var _ = Describe("Reallocation", func() {
 			Expect(updatedNode.Labels).To(HaveKeyWithValue(v1alpha1.ProvisionerPhaseLabel, v1alpha1.ProvisionerUnderutilizedPhase))
 			Expect(updatedNode.Annotations).To(HaveKey(v1alpha1.ProvisionerTTLKey))
 		})
+		It("should back off nodes that were returned to service after a blocked drain", func() {
+			fakeClock := clock.NewFakeClock(time.Now())
+			node := test.NodeWith(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+					v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+					v1alpha1.DefaultManagedLabelKey:       "true",
+				},
+				Annotations: map[string]string{
+					v1alpha1.ProvisionerDrainFailedKey: fakeClock.Now().Format(time.RFC3339),
+				},
+			})
+			ExpectCreatedWithStatus(env.Client, node)
+			// The provisioner isn't created, so only the test's utilization reconciles it
+			provisioner.Spec.TTLSeconds = ptr.Int32(30)
+			utilization := &Utilization{kubeClient: env.Client, managedLabelKey: v1alpha1.DefaultManagedLabelKey, clock: fakeClock}
+			Expect(utilization.Reconcile(ctx, provisioner)).To(Succeed())
+			Expect(ExpectNodeExists(env.Client, node.Name).Labels).ToNot(HaveKey(v1alpha1.ProvisionerPhaseLabel))
+
+			fakeClock.Step(DrainFailureBackoff)
+			Eventually(func() map[string]string {
+				Expect(utilization.Reconcile(ctx, provisioner)).To(Succeed())
+				return ExpectNodeExists(env.Client, node.Name).Labels
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveKeyWithValue(v1alpha1.ProvisionerPhaseLabel, v1alpha1.ProvisionerUnderutilizedPhase))
+		})
+		It("should not modify nodes of observe only provisioners", func() {
+			provisioner.Spec.ObserveOnly = true
+			node := test.NodeWith(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+					v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+					v1alpha1.DefaultManagedLabelKey:       "true",
+				},
+			})
+			ExpectCreatedWithStatus(env.Client, node)
+
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+
+			updatedNode := ExpectNodeExists(env.Client, node.Name)
+			Expect(updatedNode.Labels).ToNot(HaveKey(v1alpha1.ProvisionerPhaseLabel))
+			Expect(updatedNode.Annotations).ToNot(HaveKey(v1alpha1.ProvisionerTTLKey))
+		})
+		It("should never disrupt nodes without the managed label", func() {
+			managed := test.NodeWith(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+					v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+					v1alpha1.DefaultManagedLabelKey:       "true",
+				},
+			})
+			underutilized := test.NodeWith(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+					v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+				},
+			})
+			terminable := test.NodeWith(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+					v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+					v1alpha1.ProvisionerPhaseLabel:        v1alpha1.ProvisionerTerminablePhase,
+				},
+				Annotations: map[string]string{
+					v1alpha1.ProvisionerTTLKey:        time.Now().Add(-100 * time.Second).Format(time.RFC3339),
+					v1alpha1.ProvisionerDisruptionKey: v1alpha1.DisruptionInvoluntary,
+				},
+			})
+			ExpectCreatedWithStatus(env.Client, managed, underutilized, terminable)
+
+			// The nodes launched before the managed label existed were already labeled
+			provisioner.Annotations = map[string]string{v1alpha1.ProvisionerManagedLabelMigratedKey: time.Now().Format(time.RFC3339)}
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			Eventually(func() map[string]string {
+				return ExpectNodeExists(env.Client, managed.Name).Labels
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveKeyWithValue(v1alpha1.ProvisionerPhaseLabel, v1alpha1.ProvisionerUnderutilizedPhase))
+
+			updatedUnderutilized := ExpectNodeExists(env.Client, underutilized.Name)
+			Expect(updatedUnderutilized.Labels).ToNot(HaveKey(v1alpha1.ProvisionerPhaseLabel))
+			Expect(updatedUnderutilized.Annotations).ToNot(HaveKey(v1alpha1.ProvisionerTTLKey))
+			updatedTerminable := ExpectNodeExists(env.Client, terminable.Name)
+			Expect(updatedTerminable.Spec.Unschedulable).To(BeFalse())
+			Expect(updatedTerminable.Labels).To(HaveKeyWithValue(v1alpha1.ProvisionerPhaseLabel, v1alpha1.ProvisionerTerminablePhase))
+		})
+		It("should label nodes launched before nodes were labeled as managed", func() {
+			node := test.NodeWith(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+					v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+				},
+			})
+			ExpectCreatedWithStatus(env.Client, node)
+			ExpectCreated(env.Client, provisioner)
+
+			// The node and provisioner were created before the upgraded controller started
+			migration := &ManagedLabelMigration{
+				kubeClient:      env.Client,
+				managedLabelKey: v1alpha1.DefaultManagedLabelKey,
+				startedAt:       time.Now().Add(time.Minute),
+				clock:           clock.RealClock{},
+			}
+			Expect(migration.Reconcile(ctx, provisioner)).To(Succeed())
+			Expect(ExpectNodeExists(env.Client, node.Name).Labels).To(HaveKeyWithValue(v1alpha1.DefaultManagedLabelKey, "true"))
+			Eventually(func() map[string]string {
+				migrated := &v1alpha1.Provisioner{}
+				Expect(env.Client.Get(ctx, client.ObjectKey{Name: provisioner.Name, Namespace: provisioner.Namespace}, migrated)).To(Succeed())
+				return migrated.Annotations
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveKey(v1alpha1.ProvisionerManagedLabelMigratedKey))
+		})
+		It("should not label nodes that joined after the controller started", func() {
+			unmanaged := test.NodeWith(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+					v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+				},
+			})
+			ExpectCreatedWithStatus(env.Client, unmanaged)
+
+			ExpectCreated(env.Client, provisioner)
+			ExpectEventuallyReconciled(env.Client, provisioner)
+			Eventually(func() map[string]string {
+				migrated := &v1alpha1.Provisioner{}
+				Expect(env.Client.Get(ctx, client.ObjectKey{Name: provisioner.Name, Namespace: provisioner.Namespace}, migrated)).To(Succeed())
+				return migrated.Annotations
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveKey(v1alpha1.ProvisionerManagedLabelMigratedKey))
+			Consistently(func() map[string]string {
+				return ExpectNodeExists(env.Client, unmanaged.Name).Labels
+			}, 2*time.Second, RequestInterval).ShouldNot(HaveKey(v1alpha1.DefaultManagedLabelKey))
+
+			// Provisioners created since the controller started never launched
+			// unlabeled nodes, even if nodes with their labels predate it
+			migration := &ManagedLabelMigration{
+				kubeClient:      env.Client,
+				managedLabelKey: v1alpha1.DefaultManagedLabelKey,
+				startedAt:       time.Now().Add(time.Minute),
+				clock:           clock.RealClock{},
+			}
+			recreated := provisioner.DeepCopy()
+			recreated.Annotations = nil
+			recreated.CreationTimestamp = metav1.NewTime(time.Now().Add(2 * time.Minute))
+			Expect(migration.Reconcile(ctx, recreated)).To(Succeed())
+			Expect(ExpectNodeExists(env.Client, unmanaged.Name).Labels).ToNot(HaveKey(v1alpha1.DefaultManagedLabelKey))
+		})
 		It("should remove labels from utilized nodes", func() {
 			node := test.NodeWith(test.NodeOptions{
 				Labels: map[string]string{
 					v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
 					v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+					v1alpha1.DefaultManagedLabelKey:       "true",
 					v1alpha1.ProvisionerPhaseLabel:        v1alpha1.ProvisionerUnderutilizedPhase,
 				},
 				Annotations: map[string]string{
@@ -142,6 +321,7 @@ var _ = Describe("Reallocation", func() {
 				Labels: map[string]string{
 					v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
 					v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+					v1alpha1.DefaultManagedLabelKey:       "true",
 					v1alpha1.ProvisionerPhaseLabel:        v1alpha1.ProvisionerTerminablePhase,
 				},
 				Annotations: map[string]string{
@@ -156,5 +336,880 @@ var _ = Describe("Reallocation", func() {
 			updatedNode := &v1.Node{}
 			Eventually(Expect(errors.IsNotFound(env.Client.Get(ctx, client.ObjectKey{Name: node.Name}, updatedNode))).To(BeTrue()))
 		})
+		It("should not terminate nodes that share a provider id", func() {
+			nodes := []*v1.Node{}
+			for i := 0; i < 2; i++ {
+				nodes = append(nodes, test.NodeWith(test.NodeOptions{
+					Labels: map[string]string{
+						v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+						v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+						v1alpha1.DefaultManagedLabelKey:       "true",
+						v1alpha1.ProvisionerPhaseLabel:        v1alpha1.ProvisionerDrainingPhase,
+					},
+					ProviderID: "fake:///duplicate",
+				}))
+				ExpectCreatedWithStatus(env.Client, nodes[i])
+			}
+			cloudProvider := fake.NewFactory(cloudprovider.Options{})
+			// The provisioner isn't created, so only the test's controller terminates its nodes
+			terminator := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				cloudProvider,
+				env.Manager.GetEventRecorderFor("karpenter"),
+				EvictionPolicies{},
+				v1alpha1.DefaultManagedLabelKey,
+				nil,
+			).terminator
+			Eventually(func() ([]*v1.Node, error) {
+				return terminator.getNodes(ctx, provisioner, map[string]string{})
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(2))
+			Eventually(func() int {
+				Expect(terminator.terminateNodes(ctx, provisioner)).To(Succeed())
+				return logs.FilterMessageSnippet("is shared by nodes").Len()
+			}, ReconcilerPropagationTime, RequestInterval).Should(BeNumerically(">=", 2))
+			Expect(cloudProvider.DeletedNodes).To(BeEmpty())
+			for _, node := range nodes {
+				ExpectNodeExists(env.Client, node.Name)
+			}
+		})
+		It("should record why nodes are terminated before deleting them", func() {
+			voluntary := test.NodeWith(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+					v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+					v1alpha1.DefaultManagedLabelKey:       "true",
+					v1alpha1.ProvisionerPhaseLabel:        v1alpha1.ProvisionerDrainingPhase,
+				},
+			})
+			involuntary := test.NodeWith(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+					v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+					v1alpha1.DefaultManagedLabelKey:       "true",
+					v1alpha1.ProvisionerPhaseLabel:        v1alpha1.ProvisionerDrainingPhase,
+				},
+				Annotations: map[string]string{
+					v1alpha1.ProvisionerDisruptionKey: v1alpha1.DisruptionInvoluntary,
+				},
+			})
+			expired := test.NodeWith(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+					v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+					v1alpha1.DefaultManagedLabelKey:       "true",
+					v1alpha1.ProvisionerPhaseLabel:        v1alpha1.ProvisionerDrainingPhase,
+				},
+				Annotations: map[string]string{
+					v1alpha1.ProvisionerDrainStartKey: time.Now().Add(-time.Hour).Format(time.RFC3339),
+				},
+			})
+			provisioner.Spec.DrainDeadlineSeconds = ptr.Int32(60)
+			ExpectCreatedWithStatus(env.Client, voluntary)
+			ExpectCreatedWithStatus(env.Client, involuntary)
+			ExpectCreatedWithStatus(env.Client, expired)
+			cloudProvider := fake.NewFactory(cloudprovider.Options{})
+			// The provisioner isn't created, so only the test's controller terminates its nodes
+			terminator := NewController(
+				env.Client,
+				corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+				cloudProvider,
+				env.Manager.GetEventRecorderFor("karpenter"),
+				EvictionPolicies{},
+				v1alpha1.DefaultManagedLabelKey,
+				nil,
+			).terminator
+			Eventually(func() ([]*v1.Node, error) {
+				return terminator.getNodes(ctx, provisioner, map[string]string{})
+			}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(3))
+			Expect(terminator.terminateNodes(ctx, provisioner)).To(Succeed())
+			Expect(cloudProvider.TerminationReasons).To(Equal(map[string]string{
+				voluntary.Name:   v1alpha1.TerminationReasonTTLEmpty,
+				involuntary.Name: v1alpha1.TerminationReasonInterruption,
+				expired.Name:     v1alpha1.TerminationReasonDrainDeadline,
+			}))
+		})
+		Context("Decisions", func() {
+			It("should log decisions to cordon and terminate nodes past their TTL", func() {
+				node := test.NodeWith(test.NodeOptions{
+					Labels: map[string]string{
+						v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+						v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+						v1alpha1.DefaultManagedLabelKey:       "true",
+						v1alpha1.ProvisionerPhaseLabel:        v1alpha1.ProvisionerUnderutilizedPhase,
+					},
+					Annotations: map[string]string{
+						v1alpha1.ProvisionerTTLKey: time.Now().Add(-time.Minute).Format(time.RFC3339),
+					},
+				})
+				ExpectCreatedWithStatus(env.Client, node)
+				ExpectCreated(env.Client, provisioner)
+				ExpectEventuallyReconciled(env.Client, provisioner)
+
+				Eventually(func() []map[string]interface{} {
+					return decisionsFor(logs, node)
+				}, ReconcilerPropagationTime, RequestInterval).Should(ContainElements(
+					And(
+						HaveKeyWithValue("action", DecisionActionCordon),
+						HaveKeyWithValue("reason", DecisionReasonTTLExpired),
+						HaveKeyWithValue("disruption", v1alpha1.DisruptionVoluntary),
+						HaveKeyWithValue("provisioner", provisioner.Namespace+"/"+provisioner.Name),
+					),
+					And(
+						HaveKeyWithValue("action", DecisionActionTerminate),
+						HaveKeyWithValue("reason", DecisionReasonDrained),
+					),
+				))
+			})
+			It("should log decisions to cordon involuntarily disrupted nodes with the pods to move", func() {
+				node := test.NodeWith(test.NodeOptions{
+					Labels: map[string]string{
+						v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+						v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+						v1alpha1.DefaultManagedLabelKey:       "true",
+						v1alpha1.ProvisionerPhaseLabel:        v1alpha1.ProvisionerTerminablePhase,
+					},
+					Annotations: map[string]string{
+						v1alpha1.ProvisionerDisruptionKey: v1alpha1.DisruptionInvoluntary,
+					},
+				})
+				pod := test.PendingPodWith(test.PodOptions{NodeName: node.Name})
+				ExpectCreatedWithStatus(env.Client, node)
+				ExpectCreatedWithStatus(env.Client, pod)
+				// The provisioner isn't created, so only the test's reconciles cordon the node
+				Eventually(func() []map[string]interface{} {
+					Expect(controller.terminator.cordonNodes(ctx, provisioner)).To(Succeed())
+					return decisionsFor(logs, node)
+				}, ReconcilerPropagationTime, RequestInterval).Should(ContainElement(And(
+					HaveKeyWithValue("action", DecisionActionCordon),
+					HaveKeyWithValue("reason", DecisionReasonInvoluntaryDisruption),
+					HaveKeyWithValue("disruption", v1alpha1.DisruptionInvoluntary),
+					HaveKeyWithValue("pods", ConsistOf(pod.Namespace+"/"+pod.Name)),
+				)))
+			})
+		})
+		Context("DisruptionWindows", func() {
+			var terminator *Terminator
+			var fakeClock *clock.FakeClock
+			BeforeEach(func() {
+				provisioner.Spec.Disruption = &v1alpha1.DisruptionSpec{Window: &v1alpha1.DisruptionWindow{
+					Schedule: "0 22 * * *",
+					Duration: metav1.Duration{Duration: 4 * time.Hour},
+				}}
+				fakeClock = clock.NewFakeClock(time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC))
+				// The provisioner isn't created, so only the test's controller cordons its nodes
+				terminator = NewController(
+					env.Client,
+					corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+					fake.NewFactory(cloudprovider.Options{}),
+					env.Manager.GetEventRecorderFor("karpenter"),
+					EvictionPolicies{},
+					v1alpha1.DefaultManagedLabelKey,
+					nil,
+				).terminator
+				terminator.clock = fakeClock
+			})
+			terminableNode := func(annotations map[string]string) *v1.Node {
+				node := test.NodeWith(test.NodeOptions{
+					Labels: map[string]string{
+						v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+						v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+						v1alpha1.DefaultManagedLabelKey:       "true",
+						v1alpha1.ProvisionerPhaseLabel:        v1alpha1.ProvisionerTerminablePhase,
+					},
+					Annotations: annotations,
+				})
+				ExpectCreatedWithStatus(env.Client, node)
+				Eventually(func() ([]*v1.Node, error) {
+					return terminator.getNodes(ctx, provisioner, map[string]string{})
+				}, ReconcilerPropagationTime, RequestInterval).Should(HaveLen(1))
+				return node
+			}
+			It("should defer voluntary disruptions outside the window", func() {
+				node := terminableNode(map[string]string{})
+				Expect(terminator.cordonNodes(ctx, provisioner)).To(Succeed())
+				updated := ExpectNodeExists(env.Client, node.Name)
+				Expect(updated.Spec.Unschedulable).To(BeFalse())
+				Expect(updated.Labels).To(HaveKeyWithValue(v1alpha1.ProvisionerPhaseLabel, v1alpha1.ProvisionerTerminablePhase))
+				Expect(decisionsFor(logs, node)).To(BeEmpty())
+			})
+			It("should allow voluntary disruptions inside the window", func() {
+				node := terminableNode(map[string]string{})
+				fakeClock.SetTime(time.Date(2021, time.June, 2, 1, 30, 0, 0, time.UTC))
+				Expect(terminator.cordonNodes(ctx, provisioner)).To(Succeed())
+				updated := ExpectNodeExists(env.Client, node.Name)
+				Expect(updated.Spec.Unschedulable).To(BeTrue())
+				Expect(updated.Labels).To(HaveKeyWithValue(v1alpha1.ProvisionerPhaseLabel, v1alpha1.ProvisionerDrainingPhase))
+				Expect(updated.Annotations).To(HaveKeyWithValue(v1alpha1.ProvisionerDrainStartKey, "2021-06-02T01:30:00Z"))
+				fakeClock.Step(time.Minute)
+				Expect(utilsnode.DrainDuration(updated, fakeClock.Now())).To(Equal(time.Minute))
+			})
+			It("should defer voluntary disruptions after the window closes", func() {
+				node := terminableNode(map[string]string{})
+				fakeClock.SetTime(time.Date(2021, time.June, 2, 2, 0, 0, 0, time.UTC))
+				Expect(terminator.cordonNodes(ctx, provisioner)).To(Succeed())
+				Expect(ExpectNodeExists(env.Client, node.Name).Spec.Unschedulable).To(BeFalse())
+			})
+			It("should always allow involuntary disruptions", func() {
+				node := terminableNode(map[string]string{v1alpha1.ProvisionerDisruptionKey: v1alpha1.DisruptionInvoluntary})
+				Expect(terminator.cordonNodes(ctx, provisioner)).To(Succeed())
+				Expect(ExpectNodeExists(env.Client, node.Name).Spec.Unschedulable).To(BeTrue())
+			})
+			It("should defer voluntary disruptions while paused, even inside the window", func() {
+				provisioner.Spec.Disruption.Paused = true
+				node := terminableNode(map[string]string{})
+				fakeClock.SetTime(time.Date(2021, time.June, 2, 1, 30, 0, 0, time.UTC))
+				Expect(terminator.cordonNodes(ctx, provisioner)).To(Succeed())
+				updated := ExpectNodeExists(env.Client, node.Name)
+				Expect(updated.Spec.Unschedulable).To(BeFalse())
+				Expect(updated.Labels).To(HaveKeyWithValue(v1alpha1.ProvisionerPhaseLabel, v1alpha1.ProvisionerTerminablePhase))
+			})
+			It("should defer voluntary disruptions while paused without a window", func() {
+				provisioner.Spec.Disruption = &v1alpha1.DisruptionSpec{Paused: true}
+				node := terminableNode(map[string]string{})
+				Expect(terminator.cordonNodes(ctx, provisioner)).To(Succeed())
+				Expect(ExpectNodeExists(env.Client, node.Name).Spec.Unschedulable).To(BeFalse())
+			})
+		})
+		Context("DaemonSets", func() {
+			var node *v1.Node
+			var pods []*v1.Pod
+			BeforeEach(func() {
+				node = test.NodeWith(test.NodeOptions{
+					Labels: map[string]string{
+						v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+						v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+						v1alpha1.DefaultManagedLabelKey:       "true",
+					},
+				})
+				pods = []*v1.Pod{
+					test.PendingPodWith(test.PodOptions{
+						Namespace:       provisioner.Namespace,
+						NodeName:        node.Name,
+						OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "DaemonSet", Name: "test", UID: "test"}},
+						Conditions:      []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+					}),
+					test.PendingPodWith(test.PodOptions{
+						Namespace:   provisioner.Namespace,
+						NodeName:    node.Name,
+						Annotations: map[string]string{pod.MirrorPodAnnotationKey: "test"},
+						Conditions:  []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+					}),
+				}
+			})
+			It("should consider nodes with only daemonset and mirror pods empty", func() {
+				ExpectCreatedWithStatus(env.Client, node)
+				for _, p := range pods {
+					ExpectCreatedWithStatus(env.Client, p)
+				}
+				ExpectCreated(env.Client, provisioner)
+				ExpectEventuallyReconciled(env.Client, provisioner)
+
+				Eventually(func() map[string]string {
+					return ExpectNodeExists(env.Client, node.Name).Labels
+				}, ReconcilerPropagationTime, RequestInterval).Should(HaveKeyWithValue(v1alpha1.ProvisionerPhaseLabel, v1alpha1.ProvisionerUnderutilizedPhase))
+			})
+			It("should terminate nodes without evicting daemonset and mirror pods", func() {
+				node.Labels[v1alpha1.ProvisionerPhaseLabel] = v1alpha1.ProvisionerTerminablePhase
+				ExpectCreatedWithStatus(env.Client, node)
+				for _, p := range pods {
+					ExpectCreatedWithStatus(env.Client, p)
+				}
+				ExpectCreated(env.Client, provisioner)
+				ExpectEventuallyReconciled(env.Client, provisioner)
+
+				Eventually(func() bool {
+					return errors.IsNotFound(env.Client.Get(ctx, client.ObjectKey{Name: node.Name}, &v1.Node{}))
+				}, ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+				for _, p := range pods {
+					Expect(ExpectPodExists(env.Client, p.Name, p.Namespace).DeletionTimestamp.IsZero()).To(BeTrue())
+				}
+			})
+		})
+		Context("Taints", func() {
+			managed := v1.Taint{Key: "managed", Value: "true", Effect: v1.TaintEffectNoSchedule}
+			external := v1.Taint{Key: "external", Value: "true", Effect: v1.TaintEffectNoSchedule}
+			It("should add taints added to the provisioner to existing nodes", func() {
+				node := test.NodeWith(test.NodeOptions{
+					Labels: map[string]string{
+						v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+						v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+						v1alpha1.DefaultManagedLabelKey:       "true",
+					},
+					Taints: []v1.Taint{external},
+				})
+				ExpectCreatedWithStatus(env.Client, node)
+
+				provisioner.Spec.Taints = []v1.Taint{managed}
+				ExpectCreated(env.Client, provisioner)
+				ExpectEventuallyReconciled(env.Client, provisioner)
+
+				Eventually(func() []v1.Taint {
+					return ExpectNodeExists(env.Client, node.Name).Spec.Taints
+				}, ReconcilerPropagationTime, RequestInterval).Should(ConsistOf(external, managed))
+			})
+			It("should remove taints removed from the provisioner from existing nodes", func() {
+				node := test.NodeWith(test.NodeOptions{
+					Labels: map[string]string{
+						v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+						v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+						v1alpha1.DefaultManagedLabelKey:       "true",
+					},
+					Taints: []v1.Taint{managed, external},
+				})
+				Expect(utilsnode.SetManagedTaints(node, []v1.Taint{managed})).To(Succeed())
+				ExpectCreatedWithStatus(env.Client, node)
+
+				ExpectCreated(env.Client, provisioner)
+				ExpectEventuallyReconciled(env.Client, provisioner)
+
+				Eventually(func() []v1.Taint {
+					return ExpectNodeExists(env.Client, node.Name).Spec.Taints
+				}, ReconcilerPropagationTime, RequestInterval).Should(ConsistOf(external))
+			})
+		})
+		Context("Initialization", func() {
+			It("should annotate initialization stages in order as the node becomes ready", func() {
+				fakeClock := clock.NewFakeClock(time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC))
+				// The provisioner isn't created, so only the test's sub-controller annotates its nodes
+				initialization := &Initialization{kubeClient: env.Client, managedLabelKey: v1alpha1.DefaultManagedLabelKey, clock: fakeClock}
+				node := test.NodeWith(test.NodeOptions{
+					Labels: map[string]string{
+						v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+						v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+						v1alpha1.DefaultManagedLabelKey:       "true",
+					},
+					Annotations: map[string]string{v1alpha1.ProvisionerInstanceLaunchedKey: fakeClock.Now().Format(time.RFC3339)},
+					ReadyStatus: v1.ConditionUnknown,
+					Taints:      []v1.Taint{{Key: v1.TaintNodeNotReady, Effect: v1.TaintEffectNoSchedule}},
+				})
+				daemonSetPod := test.PendingPodWith(test.PodOptions{
+					Namespace:       provisioner.Namespace,
+					NodeName:        node.Name,
+					OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "DaemonSet", Name: "test", UID: "test"}},
+					Conditions:      []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionFalse}},
+				})
+				ExpectCreatedWithStatus(env.Client, node, daemonSetPod)
+				stagesOf := func() map[string]string {
+					stages := map[string]string{}
+					for _, key := range []string{
+						v1alpha1.ProvisionerInstanceLaunchedKey,
+						v1alpha1.ProvisionerNodeRegisteredKey,
+						v1alpha1.ProvisionerDaemonSetsReadyKey,
+						v1alpha1.ProvisionerStartupTaintsRemovedKey,
+					} {
+						if value, ok := ExpectNodeExists(env.Client, node.Name).Annotations[key]; ok {
+							stages[key] = value
+						}
+					}
+					return stages
+				}
+				reconciled := func() map[string]string {
+					Expect(initialization.Reconcile(ctx, provisioner)).To(Succeed())
+					return stagesOf()
+				}
+				Expect(reconciled()).To(Equal(map[string]string{
+					v1alpha1.ProvisionerInstanceLaunchedKey: "2021-06-01T12:00:00Z",
+				}))
+
+				// The kubelet registers
+				fakeClock.Step(time.Minute)
+				node = ExpectNodeExists(env.Client, node.Name)
+				node.Status.NodeInfo.KubeletVersion = "v1.19.6"
+				Expect(env.Client.Status().Update(ctx, node)).To(Succeed())
+				Eventually(reconciled, ReconcilerPropagationTime, RequestInterval).Should(Equal(map[string]string{
+					v1alpha1.ProvisionerInstanceLaunchedKey: "2021-06-01T12:00:00Z",
+					v1alpha1.ProvisionerNodeRegisteredKey:   "2021-06-01T12:01:00Z",
+				}))
+
+				// Daemonsets become ready
+				fakeClock.Step(time.Minute)
+				daemonSetPod = ExpectPodExists(env.Client, daemonSetPod.Name, daemonSetPod.Namespace)
+				daemonSetPod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+				Expect(env.Client.Status().Update(ctx, daemonSetPod)).To(Succeed())
+				Eventually(reconciled, ReconcilerPropagationTime, RequestInterval).Should(Equal(map[string]string{
+					v1alpha1.ProvisionerInstanceLaunchedKey: "2021-06-01T12:00:00Z",
+					v1alpha1.ProvisionerNodeRegisteredKey:   "2021-06-01T12:01:00Z",
+					v1alpha1.ProvisionerDaemonSetsReadyKey:  "2021-06-01T12:02:00Z",
+				}))
+
+				// The node becomes ready and its startup taints are removed
+				fakeClock.Step(time.Minute)
+				node = ExpectNodeExists(env.Client, node.Name)
+				node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+				Expect(env.Client.Status().Update(ctx, node)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+				node.Spec.Taints = nil
+				Expect(env.Client.Update(ctx, node)).To(Succeed())
+				Eventually(reconciled, ReconcilerPropagationTime, RequestInterval).Should(Equal(map[string]string{
+					v1alpha1.ProvisionerInstanceLaunchedKey:     "2021-06-01T12:00:00Z",
+					v1alpha1.ProvisionerNodeRegisteredKey:       "2021-06-01T12:01:00Z",
+					v1alpha1.ProvisionerDaemonSetsReadyKey:      "2021-06-01T12:02:00Z",
+					v1alpha1.ProvisionerStartupTaintsRemovedKey: "2021-06-01T12:03:00Z",
+				}))
+			})
+			It("should ignore nodes whose instance launch wasn't recorded", func() {
+				node := test.NodeWith(test.NodeOptions{
+					Labels: map[string]string{
+						v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+						v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+						v1alpha1.DefaultManagedLabelKey:       "true",
+					},
+				})
+				node.Status.NodeInfo.KubeletVersion = "v1.19.6"
+				ExpectCreatedWithStatus(env.Client, node)
+				ExpectCreated(env.Client, provisioner)
+				ExpectEventuallyReconciled(env.Client, provisioner)
+
+				Consistently(func() map[string]string {
+					return ExpectNodeExists(env.Client, node.Name).Annotations
+				}, "2s", RequestInterval).ShouldNot(HaveKey(v1alpha1.ProvisionerNodeRegisteredKey))
+			})
+		})
+		Context("Validation", func() {
+			var server *httptest.Server
+			var status int32
+			var requests chan ValidationRequest
+			var validation *Validation
+			var node *v1.Node
+			BeforeEach(func() {
+				status = http.StatusInternalServerError
+				requests = make(chan ValidationRequest, 10)
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					defer GinkgoRecover()
+					request := ValidationRequest{}
+					Expect(json.NewDecoder(r.Body).Decode(&request)).To(Succeed())
+					select {
+					case requests <- request:
+					default:
+					}
+					if r.URL.Path == "/slow" {
+						<-r.Context().Done()
+						return
+					}
+					w.WriteHeader(int(atomic.LoadInt32(&status)))
+				}))
+				// The provisioner isn't created, so only the test's controller validates its nodes
+				validation = NewController(
+					env.Client,
+					corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+					fake.NewFactory(cloudprovider.Options{}),
+					env.Manager.GetEventRecorderFor("karpenter"),
+					EvictionPolicies{},
+					v1alpha1.DefaultManagedLabelKey,
+					&ValidationHook{URL: server.URL, Timeout: 500 * time.Millisecond},
+				).validation
+				node = test.NodeWith(test.NodeOptions{
+					Labels: map[string]string{
+						v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+						v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+						v1alpha1.DefaultManagedLabelKey:       "true",
+					},
+					ProviderID: "fake:///validated",
+					Taints: []v1.Taint{
+						{Key: "test-key", Effect: v1.TaintEffectNoSchedule},
+						{Key: v1alpha1.ValidationPendingTaintKey, Effect: v1.TaintEffectNoSchedule},
+					},
+				})
+			})
+			AfterEach(func() {
+				server.Close()
+			})
+			validateEventually := func() {
+				Eventually(func() int {
+					Expect(validation.Reconcile(ctx, provisioner)).To(Succeed())
+					return len(requests)
+				}, ReconcilerPropagationTime, RequestInterval).Should(BeNumerically(">=", 1))
+			}
+			It("should remove the validation taint only once the hook accepts the node", func() {
+				ExpectCreatedWithStatus(env.Client, node)
+				validateEventually()
+				request := <-requests
+				Expect(request.NodeName).To(Equal(node.Name))
+				Expect(request.ProviderID).To(Equal("fake:///validated"))
+				Expect(request.Provisioner).To(Equal(provisioner.Namespace + "/" + provisioner.Name))
+				Expect(ExpectNodeExists(env.Client, node.Name).Spec.Taints).To(ContainElement(
+					v1.Taint{Key: v1alpha1.ValidationPendingTaintKey, Effect: v1.TaintEffectNoSchedule},
+				))
+
+				atomic.StoreInt32(&status, http.StatusOK)
+				Eventually(func() []v1.Taint {
+					Expect(validation.Reconcile(ctx, provisioner)).To(Succeed())
+					return ExpectNodeExists(env.Client, node.Name).Spec.Taints
+				}, ReconcilerPropagationTime, RequestInterval).Should(ConsistOf(
+					v1.Taint{Key: "test-key", Effect: v1.TaintEffectNoSchedule},
+				))
+			})
+			It("should keep the validation taint if the hook times out", func() {
+				validation.hook.URL = server.URL + "/slow"
+				atomic.StoreInt32(&status, http.StatusOK)
+				ExpectCreatedWithStatus(env.Client, node)
+				validateEventually()
+				Expect(ExpectNodeExists(env.Client, node.Name).Spec.Taints).To(ContainElement(
+					v1.Taint{Key: v1alpha1.ValidationPendingTaintKey, Effect: v1.TaintEffectNoSchedule},
+				))
+			})
+			It("should reject invalid hooks", func() {
+				hook, err := NewValidationHook("", time.Second)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(hook).To(BeNil())
+				_, err = NewValidationHook("not a url", time.Second)
+				Expect(err).To(HaveOccurred())
+				_, err = NewValidationHook("ftp://example.com", time.Second)
+				Expect(err).To(HaveOccurred())
+				_, err = NewValidationHook("https://example.com/validate", 0)
+				Expect(err).To(HaveOccurred())
+			})
+			It("should not validate nodes until they're ready", func() {
+				atomic.StoreInt32(&status, http.StatusOK)
+				node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionUnknown}}
+				ExpectCreatedWithStatus(env.Client, node)
+				Eventually(func() error {
+					return env.Client.Get(ctx, client.ObjectKey{Name: node.Name}, &v1.Node{})
+				}, ReconcilerPropagationTime, RequestInterval).Should(Succeed())
+				Consistently(func() int {
+					Expect(validation.Reconcile(ctx, provisioner)).To(Succeed())
+					return len(requests)
+				}, "2s", RequestInterval).Should(BeZero())
+				Expect(ExpectNodeExists(env.Client, node.Name).Spec.Taints).To(ContainElement(
+					v1.Taint{Key: v1alpha1.ValidationPendingTaintKey, Effect: v1.TaintEffectNoSchedule},
+				))
+			})
+		})
+		Context("Deregistration", func() {
+			var node *v1.Node
+			var pod *v1.Pod
+			BeforeEach(func() {
+				node = test.NodeWith(test.NodeOptions{
+					Labels: map[string]string{
+						v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+						v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+						v1alpha1.DefaultManagedLabelKey:       "true",
+						v1alpha1.ProvisionerPhaseLabel:        v1alpha1.ProvisionerTerminablePhase,
+					},
+				})
+				pod = test.PendingPodWith(test.PodOptions{
+					Namespace:  provisioner.Namespace,
+					NodeName:   node.Name,
+					Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+				})
+			})
+			It("should exclude draining nodes from external load balancers before evicting pods", func() {
+				provisioner.Spec.DeregistrationDelaySeconds = ptr.Int32(3600)
+				ExpectCreatedWithStatus(env.Client, node)
+				ExpectCreatedWithStatus(env.Client, pod)
+				ExpectCreated(env.Client, provisioner)
+				ExpectEventuallyReconciled(env.Client, provisioner)
+
+				Eventually(func() map[string]string {
+					return ExpectNodeExists(env.Client, node.Name).Labels
+				}, ReconcilerPropagationTime, RequestInterval).Should(HaveKeyWithValue(v1alpha1.ExcludeFromExternalLoadBalancersLabelKey, "true"))
+				Consistently(func() bool {
+					return ExpectPodExists(env.Client, pod.Name, pod.Namespace).DeletionTimestamp.IsZero()
+				}, 3*time.Second, RequestInterval).Should(BeTrue())
+			})
+			It("should evict pods after the deregistration delay", func() {
+				provisioner.Spec.DeregistrationDelaySeconds = ptr.Int32(1)
+				ExpectCreatedWithStatus(env.Client, node)
+				ExpectCreatedWithStatus(env.Client, pod)
+				ExpectCreated(env.Client, provisioner)
+				ExpectEventuallyReconciled(env.Client, provisioner)
+
+				Eventually(func() bool {
+					evicted := &v1.Pod{}
+					if err := env.Client.Get(ctx, client.ObjectKey{Name: pod.Name, Namespace: pod.Namespace}, evicted); err != nil {
+						return errors.IsNotFound(err)
+					}
+					return !evicted.DeletionTimestamp.IsZero()
+				}, ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+				Expect(ExpectNodeExists(env.Client, node.Name).Labels).To(HaveKeyWithValue(v1alpha1.ExcludeFromExternalLoadBalancersLabelKey, "true"))
+			})
+		})
+		Context("SerialEviction", func() {
+			var node *v1.Node
+			var terminator *Terminator
+			var fakeClock *clock.FakeClock
+			var prefix string
+			BeforeEach(func() {
+				provisioner.Spec.SerialEviction = &v1alpha1.SerialEvictionSpec{DelaySeconds: ptr.Int32(60)}
+				provisioner.Spec.DeregistrationDelaySeconds = ptr.Int32(0)
+				node = test.NodeWith(test.NodeOptions{
+					Labels: map[string]string{
+						v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+						v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+						v1alpha1.DefaultManagedLabelKey:       "true",
+						v1alpha1.ProvisionerPhaseLabel:        v1alpha1.ProvisionerDrainingPhase,
+					},
+					Annotations: map[string]string{
+						v1alpha1.ProvisionerDrainStartKey: time.Now().Format(time.RFC3339),
+					},
+					Unschedulable: true,
+				})
+				ExpectCreatedWithStatus(env.Client, node)
+				prefix = strings.ToLower(randomdata.SillyName())
+				fakeClock = clock.NewFakeClock(time.Now())
+				// The provisioner isn't created, so only the test's controller drains its nodes
+				terminator = NewController(
+					env.Client,
+					corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+					fake.NewFactory(cloudprovider.Options{}),
+					env.Manager.GetEventRecorderFor("karpenter"),
+					EvictionPolicies{},
+					v1alpha1.DefaultManagedLabelKey,
+					nil,
+				).terminator
+				terminator.clock = fakeClock
+			})
+			podOn := func(nodeName string, name string, owners []metav1.OwnerReference) *v1.Pod {
+				p := test.PendingPodWith(test.PodOptions{
+					Name:            name,
+					Namespace:       provisioner.Namespace,
+					NodeName:        nodeName,
+					OwnerReferences: owners,
+					Conditions:      []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+				})
+				ExpectCreatedWithStatus(env.Client, p)
+				return p
+			}
+			isEvicted := func(p *v1.Pod) func() bool {
+				return func() bool {
+					Expect(terminator.terminateNodes(ctx, provisioner)).To(Succeed())
+					evicted := &v1.Pod{}
+					if err := env.Client.Get(ctx, client.ObjectKey{Name: p.Name, Namespace: p.Namespace}, evicted); err != nil {
+						return errors.IsNotFound(err)
+					}
+					return !evicted.DeletionTimestamp.IsZero()
+				}
+			}
+			expectTerminated := func(p *v1.Pod) {
+				Expect(env.Client.Delete(ctx, p, client.GracePeriodSeconds(0))).To(Succeed())
+				Eventually(func() bool {
+					return errors.IsNotFound(env.Client.Get(ctx, client.ObjectKey{Name: p.Name, Namespace: p.Namespace}, &v1.Pod{}))
+				}, ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+			}
+			It("should evict pods one at a time from the highest ordinal", func() {
+				owners := []metav1.OwnerReference{{
+					APIVersion: "apps/v1",
+					Kind:       "StatefulSet",
+					Name:       prefix,
+					UID:        types.UID(strings.ToLower(randomdata.SillyName())),
+					Controller: ptr.Bool(true),
+				}}
+				low := podOn(node.Name, prefix+"-2", owners)
+				high := podOn(node.Name, prefix+"-10", owners)
+
+				Eventually(isEvicted(high), ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+				Consistently(isEvicted(low), 3*time.Second, RequestInterval).Should(BeFalse())
+				Expect(ExpectNodeExists(env.Client, node.Name).Annotations).To(HaveKeyWithValue(
+					v1alpha1.ProvisionerLastEvictedOwnerKey, provisioner.Namespace+"/"+string(owners[0].UID),
+				))
+
+				// The evicted pod terminates, but its replacement isn't ready
+				expectTerminated(high)
+				fakeClock.Step(time.Minute)
+				Consistently(isEvicted(low), 3*time.Second, RequestInterval).Should(BeFalse())
+
+				// The replacement is rescheduled to another node and becomes ready
+				podOn("", prefix+"-10", owners)
+				Eventually(isEvicted(low), ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+			})
+			It("should wait for the delay between evictions", func() {
+				first := podOn(node.Name, prefix+"-b", nil)
+				second := podOn(node.Name, prefix+"-a", nil)
+
+				Eventually(isEvicted(first), ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+				expectTerminated(first)
+				Consistently(isEvicted(second), 3*time.Second, RequestInterval).Should(BeFalse())
+
+				fakeClock.Step(59 * time.Second)
+				Consistently(isEvicted(second), 3*time.Second, RequestInterval).Should(BeFalse())
+				fakeClock.Step(time.Second)
+				Eventually(isEvicted(second), ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+			})
+		})
+		Context("PodDisruptionBudgets", func() {
+			var node *v1.Node
+			var pod *v1.Pod
+			var budget *v1beta1.PodDisruptionBudget
+			BeforeEach(func() {
+				node = test.NodeWith(test.NodeOptions{
+					Labels: map[string]string{
+						v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
+						v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
+						v1alpha1.DefaultManagedLabelKey:       "true",
+						v1alpha1.ProvisionerPhaseLabel:        v1alpha1.ProvisionerDrainingPhase,
+					},
+					Annotations: map[string]string{
+						v1alpha1.ProvisionerDrainStartKey: time.Now().Add(-time.Hour).Format(time.RFC3339),
+					},
+					Unschedulable: true,
+				})
+				pod = test.PendingPodWith(test.PodOptions{
+					Namespace:  provisioner.Namespace,
+					Labels:     map[string]string{"app": "test"},
+					NodeName:   node.Name,
+					Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+				})
+				minAvailable := intstr.FromInt(1)
+				budget = &v1beta1.PodDisruptionBudget{
+					ObjectMeta: metav1.ObjectMeta{Name: strings.ToLower(randomdata.SillyName()), Namespace: provisioner.Namespace},
+					Spec: v1beta1.PodDisruptionBudgetSpec{
+						MinAvailable: &minAvailable,
+						Selector:     &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}},
+					},
+				}
+				ExpectCreated(env.Client, budget)
+			})
+			AfterEach(func() {
+				ExpectDeleted(env.Client, budget)
+			})
+			Context("EvictionPolicies", func() {
+				BeforeEach(func() {
+					// Drains that just started aren't escalated
+					node.Annotations[v1alpha1.ProvisionerDrainStartKey] = time.Now().Format(time.RFC3339)
+					provisioner.Spec.DrainTimeoutSeconds = ptr.Int32(600)
+					provisioner.Spec.DrainWarningSeconds = ptr.Int32(60)
+					provisioner.Spec.DeregistrationDelaySeconds = ptr.Int32(0)
+				})
+				// The provisioner isn't created, so only the test's controller reconciles it
+				drainedWith := func(evictionPolicies EvictionPolicies) func() bool {
+					ExpectCreatedWithStatus(env.Client, node)
+					ExpectCreatedWithStatus(env.Client, pod)
+					terminator := NewController(
+						env.Client,
+						corev1.NewForConfigOrDie(env.Manager.GetConfig()),
+						fake.NewFactory(cloudprovider.Options{}),
+						env.Manager.GetEventRecorderFor("karpenter"),
+						evictionPolicies,
+						v1alpha1.DefaultManagedLabelKey,
+						nil,
+					).terminator
+					return func() bool {
+						Expect(terminator.terminateNodes(ctx, provisioner)).To(Succeed())
+						deleted := &v1.Pod{}
+						if err := env.Client.Get(ctx, client.ObjectKey{Name: pod.Name, Namespace: pod.Namespace}, deleted); err != nil {
+							return errors.IsNotFound(err)
+						}
+						return !deleted.DeletionTimestamp.IsZero()
+					}
+				}
+				It("should respect PodDisruptionBudgets when evicting", func() {
+					drained := drainedWith(EvictionPolicies{Voluntary: EvictionPolicyEvict, Involuntary: EvictionPolicyDelete})
+					Consistently(drained, 3*time.Second, RequestInterval).Should(BeFalse())
+				})
+				It("should bypass PodDisruptionBudgets when deleting", func() {
+					drained := drainedWith(EvictionPolicies{Voluntary: EvictionPolicyDelete, Involuntary: EvictionPolicyEvict})
+					Eventually(drained, ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+				})
+				It("should select the policy of the node's disruption", func() {
+					node.Annotations[v1alpha1.ProvisionerDisruptionKey] = v1alpha1.DisruptionInvoluntary
+					drained := drainedWith(EvictionPolicies{Voluntary: EvictionPolicyEvict, Involuntary: EvictionPolicyDelete})
+					Eventually(drained, ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+				})
+				It("should reject unknown policies", func() {
+					_, err := ParseEvictionPolicy("Unknown")
+					Expect(err).To(HaveOccurred())
+					policy, err := ParseEvictionPolicy("Delete")
+					Expect(err).ToNot(HaveOccurred())
+					Expect(policy).To(Equal(EvictionPolicyDelete))
+				})
+			})
+			It("should return voluntarily disrupted nodes to service after the drain timeout", func() {
+				ExpectCreatedWithStatus(env.Client, node)
+				ExpectCreatedWithStatus(env.Client, pod)
+				ExpectCreated(env.Client, provisioner)
+				ExpectEventuallyReconciled(env.Client, provisioner)
+
+				Eventually(func() bool {
+					updatedNode := ExpectNodeExists(env.Client, node.Name)
+					_, draining := updatedNode.Labels[v1alpha1.ProvisionerPhaseLabel]
+					return !updatedNode.Spec.Unschedulable && !draining
+				}, ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+				ExpectPodExists(env.Client, pod.Name, pod.Namespace)
+				Expect(ExpectNodeExists(env.Client, node.Name).Annotations).To(HaveKey(v1alpha1.ProvisionerDrainFailedKey))
+				Expect(decisionsFor(logs, node)).To(ContainElement(And(
+					HaveKeyWithValue("action", DecisionActionUncordon),
+					HaveKeyWithValue("reason", DecisionReasonDrainTimeout),
+				)))
+			})
+			It("should fall back to the default drain timeout if it's unset", func() {
+				node.Annotations[v1alpha1.ProvisionerDrainStartKey] = time.Now().Add(-2 * time.Minute).Format(time.RFC3339)
+				provisioner.Spec.DrainWarningSeconds = nil
+				provisioner.Spec.DrainTimeoutSeconds = nil
+				ExpectCreatedWithStatus(env.Client, node)
+				ExpectCreatedWithStatus(env.Client, pod)
+				ExpectCreated(env.Client, provisioner)
+				ExpectEventuallyReconciled(env.Client, provisioner)
+
+				Consistently(func() bool {
+					updatedNode := ExpectNodeExists(env.Client, node.Name)
+					return updatedNode.Spec.Unschedulable && updatedNode.Labels[v1alpha1.ProvisionerPhaseLabel] == v1alpha1.ProvisionerDrainingPhase
+				}, 3*time.Second, RequestInterval).Should(BeTrue())
+				ExpectPodExists(env.Client, pod.Name, pod.Namespace)
+			})
+			It("should terminate nodes with pods remaining after the drain deadline", func() {
+				provisioner.Spec.DrainDeadlineSeconds = ptr.Int32(60)
+				ExpectCreatedWithStatus(env.Client, node)
+				ExpectCreatedWithStatus(env.Client, pod)
+				ExpectCreated(env.Client, provisioner)
+				ExpectEventuallyReconciled(env.Client, provisioner)
+
+				Eventually(func() bool {
+					return errors.IsNotFound(env.Client.Get(ctx, client.ObjectKey{Name: node.Name}, &v1.Node{}))
+				}, ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+				Expect(decisionsFor(logs, node)).To(ContainElement(And(
+					HaveKeyWithValue("action", DecisionActionTerminate),
+					HaveKeyWithValue("reason", DecisionReasonDrainDeadline),
+				)))
+			})
+			It("should not terminate nodes with pods remaining before the drain deadline", func() {
+				provisioner.Spec.DrainTimeoutSeconds = ptr.Int32(7200)
+				provisioner.Spec.DrainDeadlineSeconds = ptr.Int32(7200)
+				ExpectCreatedWithStatus(env.Client, node)
+				ExpectCreatedWithStatus(env.Client, pod)
+				ExpectCreated(env.Client, provisioner)
+				ExpectEventuallyReconciled(env.Client, provisioner)
+
+				Consistently(func() error {
+					return env.Client.Get(ctx, client.ObjectKey{Name: node.Name}, &v1.Node{})
+				}, 3*time.Second, RequestInterval).Should(Succeed())
+			})
+			It("should not escalate drains whose start time is in the future", func() {
+				// The drain start was recorded by a replica whose clock is ahead
+				node.Annotations[v1alpha1.ProvisionerDrainStartKey] = time.Now().Add(time.Hour).Format(time.RFC3339)
+				node.Annotations[v1alpha1.ProvisionerDisruptionKey] = v1alpha1.DisruptionInvoluntary
+				Expect(utilsnode.DrainDuration(node, time.Now())).To(BeZero())
+				ExpectCreatedWithStatus(env.Client, node)
+				ExpectCreatedWithStatus(env.Client, pod)
+				ExpectCreated(env.Client, provisioner)
+				ExpectEventuallyReconciled(env.Client, provisioner)
+
+				Consistently(func() bool {
+					return ExpectPodExists(env.Client, pod.Name, pod.Namespace).DeletionTimestamp.IsZero()
+				}, 3*time.Second, RequestInterval).Should(BeTrue())
+				Expect(ExpectNodeExists(env.Client, node.Name).Spec.Unschedulable).To(BeTrue())
+			})
+			It("should delete pods on involuntarily disrupted nodes after the drain timeout", func() {
+				node.Annotations[v1alpha1.ProvisionerDisruptionKey] = v1alpha1.DisruptionInvoluntary
+				ExpectCreatedWithStatus(env.Client, node)
+				ExpectCreatedWithStatus(env.Client, pod)
+				ExpectCreated(env.Client, provisioner)
+				ExpectEventuallyReconciled(env.Client, provisioner)
+
+				Eventually(func() bool {
+					deleted := &v1.Pod{}
+					if err := env.Client.Get(ctx, client.ObjectKey{Name: pod.Name, Namespace: pod.Namespace}, deleted); err != nil {
+						return errors.IsNotFound(err)
+					}
+					return !deleted.DeletionTimestamp.IsZero()
+				}, ReconcilerPropagationTime, RequestInterval).Should(BeTrue())
+				Expect(ExpectNodeExists(env.Client, node.Name).Spec.Unschedulable).To(BeTrue())
+				Expect(decisionsFor(logs, node)).To(ContainElement(And(
+					HaveKeyWithValue("action", DecisionActionForceDrain),
+					HaveKeyWithValue("reason", DecisionReasonDrainTimeout),
+					HaveKeyWithValue("pods", ConsistOf(pod.Namespace+"/"+pod.Name)),
+				)))
+			})
+		})
 	})
 })
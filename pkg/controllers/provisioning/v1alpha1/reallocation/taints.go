@@ -0,0 +1,93 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reallocation
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	utilsnode "github.com/awslabs/karpenter/pkg/utils/node"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Taints keeps the taints of a provisioner's nodes in sync with its spec.
+// Only taints previously applied by the provisioner are removed, so taints
+// added by other actors (e.g. the node lifecycle controller) are left alone.
+type Taints struct {
+	kubeClient      client.Client
+	managedLabelKey string
+}
+
+func (t *Taints) Reconcile(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
+	nodes := &v1.NodeList{}
+	if err := t.kubeClient.List(ctx, nodes, client.MatchingLabels(nodeLabelsFor(provisioner, t.managedLabelKey))); err != nil {
+		return fmt.Errorf("listing nodes, %w", err)
+	}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		persisted := node.DeepCopy()
+		node.Spec.Taints = taintsFor(node, provisioner.Spec.Taints)
+		if err := utilsnode.SetManagedTaints(node, provisioner.Spec.Taints); err != nil {
+			return fmt.Errorf("recording taints for node %s, %w", node.Name, err)
+		}
+		if equality.Semantic.DeepEqual(node, persisted) {
+			continue
+		}
+		if err := t.kubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil {
+			return fmt.Errorf("patching node %s, %w", node.Name, err)
+		}
+		zap.S().Debugf("Reconciled taints on node %s", node.Name)
+	}
+	return nil
+}
+
+// taintsFor returns the node's taints with previously managed taints removed
+// and desired taints added or updated in place, preserving existing order.
+func taintsFor(node *v1.Node, desired []v1.Taint) []v1.Taint {
+	managed := utilsnode.ManagedTaints(node)
+	taints := []v1.Taint{}
+	for _, taint := range node.Spec.Taints {
+		if i := indexOf(taint, desired); i >= 0 {
+			if indexOf(taint, taints) < 0 {
+				taints = append(taints, desired[i])
+			}
+			continue
+		}
+		if indexOf(taint, managed) >= 0 {
+			continue
+		}
+		taints = append(taints, taint)
+	}
+	for _, taint := range desired {
+		if indexOf(taint, taints) < 0 {
+			taints = append(taints, taint)
+		}
+	}
+	return taints
+}
+
+// indexOf returns the index of the taint with the same key and effect, or -1
+func indexOf(taint v1.Taint, taints []v1.Taint) int {
+	for i := range taints {
+		if taint.MatchTaint(&taints[i]) {
+			return i
+		}
+	}
+	return -1
+}
@@ -17,24 +17,38 @@ package reallocation
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/utils/apiobject"
 	"github.com/awslabs/karpenter/pkg/utils/functional"
+	utilsnode "github.com/awslabs/karpenter/pkg/utils/node"
 	"github.com/awslabs/karpenter/pkg/utils/pod"
 	"github.com/awslabs/karpenter/pkg/utils/ptr"
 	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/api/policy/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type Terminator struct {
-	kubeClient    client.Client
-	cloudprovider cloudprovider.Factory
-	coreV1Client  corev1.CoreV1Interface
+	kubeClient      client.Client
+	cloudprovider   cloudprovider.Factory
+	recorder        record.EventRecorder
+	managedLabelKey string
+	// evictors remove pods from draining nodes with the policy of each node's
+	// disruption
+	evictors         map[EvictionPolicy]Evictor
+	evictionPolicies EvictionPolicies
+	// clock determines whether provisioners' disruption windows are open, and
+	// how long nodes have drained
+	clock clock.Clock
 }
 
 func (t *Terminator) Reconcile(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
@@ -50,7 +64,9 @@ func (t *Terminator) Reconcile(ctx context.Context, provisioner *v1alpha1.Provis
 	return nil
 }
 
-// cordonNodes takes in a list of expired nodes as input and cordons them
+// cordonNodes takes in a list of expired nodes as input and cordons them. The
+// nodes are excluded from external load balancers, so that they're
+// deregistered before their pods are evicted.
 func (t *Terminator) cordonNodes(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
 	// 1. Get terminable nodes
 	nodeList, err := t.getNodes(ctx, provisioner, map[string]string{
@@ -59,18 +75,36 @@ func (t *Terminator) cordonNodes(ctx context.Context, provisioner *v1alpha1.Prov
 	if err != nil {
 		return err
 	}
-	// 2. Cordon nodes
+	// 2. Cordon nodes, deferring voluntary disruptions while disruptions are
+	// paused or outside the disruption window
+	windowOpen := disruptionWindowOpen(provisioner, t.clock.Now())
 	for _, node := range nodeList {
+		if !windowOpen && disruptionOf(node) == v1alpha1.DisruptionVoluntary {
+			zap.S().Debugf("Deferring voluntary disruption of node %s until disruptions are permitted", node.Name)
+			continue
+		}
+		pods, err := t.getPods(ctx, node)
+		if err != nil {
+			return fmt.Errorf("listing pods for node %s, %w", node.Name, err)
+		}
 		persisted := node.DeepCopy()
 		node.Spec.Unschedulable = true
 		node.Labels = functional.UnionStringMaps(
 			node.Labels,
-			map[string]string{v1alpha1.ProvisionerPhaseLabel: v1alpha1.ProvisionerDrainingPhase},
+			map[string]string{
+				v1alpha1.ProvisionerPhaseLabel:                    v1alpha1.ProvisionerDrainingPhase,
+				v1alpha1.ExcludeFromExternalLoadBalancersLabelKey: "true",
+			},
+		)
+		node.Annotations = functional.UnionStringMaps(
+			node.Annotations,
+			map[string]string{v1alpha1.ProvisionerDrainStartKey: t.clock.Now().Format(time.RFC3339)},
 		)
 		if err := t.kubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil {
 			return fmt.Errorf("patching node %s, %w", node.Name, err)
 		}
 		zap.S().Debugf("Cordoned node %s", node.Name)
+		decisionFor(DecisionActionCordon, cordonReasonOf(node), provisioner, node, evictablePods(pods)).Log()
 	}
 	return nil
 }
@@ -84,50 +118,295 @@ func (t *Terminator) terminateNodes(ctx context.Context, provisioner *v1alpha1.P
 	if err != nil {
 		return fmt.Errorf("listing draining nodes, %w", err)
 	}
-	// 2. Drain nodes
+	// 2. Drain nodes, forcing termination of nodes past the drain deadline
 	drained := []*v1.Node{}
+	expired := []*v1.Node{}
 	for _, node := range draining {
+		pastDeadline, err := t.pastDrainDeadline(ctx, provisioner, node)
+		if err != nil {
+			return fmt.Errorf("checking drain deadline of node %s, %w", node.Name, err)
+		}
+		if pastDeadline {
+			expired = append(expired, node)
+			continue
+		}
 		// TODO: Check if Node should be drained
-		// - Disrupts PDB
 		// - Pods owned by controller object
 		// - Pod on Node can't be rescheduled elsewhere
-
-		// 2a. Get pods on node
-		pods, err := t.getPods(ctx, node)
+		empty, err := t.drain(ctx, provisioner, node)
 		if err != nil {
-			return fmt.Errorf("listing pods for node %s, %w", node.Name, err)
+			return fmt.Errorf("draining node %s, %w", node.Name, err)
 		}
-		// 2b. Evict pods on node
-		empty := true
-		for _, p := range pods {
-			if !pod.IsOwnedByDaemonSet(p) {
-				empty = false
-				if err := t.coreV1Client.Pods(p.Namespace).Evict(ctx, &v1beta1.Eviction{
-					ObjectMeta: metav1.ObjectMeta{
-						Name: p.Name,
-					},
-				}); err != nil {
-					zap.S().Debugf("Continuing after failing to evict pods from node %s, %s", node.Name, err.Error())
-				}
-			}
-		}
-		// 2c. If node is empty, add to list of nodes to delete
+		// If node is empty, add to list of nodes to delete
 		if empty {
 			drained = append(drained, node)
 		}
 	}
-	// 3. Delete empty nodes
-	if err := t.deleteNodes(ctx, drained, provisioner); err != nil {
+	// 3. Delete empty and expired nodes whose instances are unambiguous
+	drained, err = t.unambiguous(ctx, drained)
+	if err != nil {
+		return fmt.Errorf("checking provider ids, %w", err)
+	}
+	if err := t.deleteNodes(ctx, drained, provisioner, DecisionReasonDrained); err != nil {
 		return fmt.Errorf("deleting %d nodes, %w", len(drained), err)
 	}
+	expired, err = t.unambiguous(ctx, expired)
+	if err != nil {
+		return fmt.Errorf("checking provider ids, %w", err)
+	}
+	if err := t.deleteNodes(ctx, expired, provisioner, DecisionReasonDrainDeadline); err != nil {
+		return fmt.Errorf("deleting %d nodes, %w", len(expired), err)
+	}
 	return nil
 }
 
+// cordonReasonOf returns why the node was cordoned. Involuntarily disrupted
+// nodes were marked for termination, and others were underutilized.
+func cordonReasonOf(node *v1.Node) string {
+	if disruptionOf(node) == v1alpha1.DisruptionInvoluntary {
+		return DecisionReasonInvoluntaryDisruption
+	}
+	return DecisionReasonTTLExpired
+}
+
+// terminationReasons that cloud providers record on instances, by the reason
+// for the decision to terminate their nodes
+var terminationReasons = map[string]string{
+	DecisionReasonTTLExpired:            v1alpha1.TerminationReasonTTLEmpty,
+	DecisionReasonInvoluntaryDisruption: v1alpha1.TerminationReasonInterruption,
+	DecisionReasonDrainDeadline:         v1alpha1.TerminationReasonDrainDeadline,
+}
+
+// terminationReasonOf returns why the node is terminated. Drained nodes are
+// terminated for the reason they were cordoned.
+func terminationReasonOf(reason string, node *v1.Node) string {
+	if reason == DecisionReasonDrained {
+		reason = cordonReasonOf(node)
+	}
+	return terminationReasons[reason]
+}
+
+// pastDrainDeadline returns true if the node has drained for longer than the
+// provisioner's drain deadline. A warning event lists the pods that weren't
+// evicted before the node is terminated.
+func (t *Terminator) pastDrainDeadline(ctx context.Context, provisioner *v1alpha1.Provisioner, node *v1.Node) (bool, error) {
+	if provisioner.Spec.DrainDeadlineSeconds == nil {
+		return false, nil
+	}
+	draining := utilsnode.DrainDuration(node, t.clock.Now())
+	if draining < secondsOf(provisioner.Spec.DrainDeadlineSeconds) {
+		return false, nil
+	}
+	pods, err := t.getPods(ctx, node)
+	if err != nil {
+		return false, fmt.Errorf("listing pods for node %s, %w", node.Name, err)
+	}
+	names := []string{}
+	for _, name := range apiobject.PodNamespacedNames(evictablePods(pods)) {
+		names = append(names, name.String())
+	}
+	if len(names) > 0 {
+		t.recorder.Eventf(node, v1.EventTypeWarning, "DrainDeadlineExceeded", "Terminating after draining for %s, pods %v weren't evicted", draining.Round(time.Second), names)
+	}
+	return true, nil
+}
+
+// drain evicts the pods on a node and returns true if the node is empty.
+// Evictions wait for the deregistration delay after the drain starts, so that
+// load balancers stop sending traffic to the node's pods first. Provisioners
+// with serial eviction evict one pod at a time.
+func (t *Terminator) drain(ctx context.Context, provisioner *v1alpha1.Provisioner, node *v1.Node) (bool, error) {
+	// 1. Get pods on node
+	pods, err := t.getPods(ctx, node)
+	if err != nil {
+		return false, fmt.Errorf("listing pods for node %s, %w", node.Name, err)
+	}
+	evictable := evictablePods(pods)
+	if len(evictable) == 0 {
+		return true, nil
+	}
+	// 2. Wait for load balancers to deregister the node
+	if remaining := secondsOr(provisioner.Spec.DeregistrationDelaySeconds, v1alpha1.DefaultDeregistrationDelaySeconds) - utilsnode.DrainDuration(node, t.clock.Now()); remaining > 0 {
+		zap.S().Debugf("Deferring evictions from node %s for %s while load balancers deregister it", node.Name, remaining.Round(time.Second))
+		return false, nil
+	}
+	// 3. Select pods to evict, one at a time if evictions are serial
+	if provisioner.Spec.SerialEviction != nil {
+		if evictable, err = t.nextSerialEviction(ctx, provisioner, node, evictable); err != nil {
+			return false, fmt.Errorf("selecting serial eviction, %w", err)
+		}
+	}
+	// 4. Evict pods on node
+	evictor := t.evictors[t.evictionPolicies.For(node)]
+	blocked := []*v1.Pod{}
+	for _, p := range evictable {
+		isBlocked, err := evictor.Evict(ctx, p)
+		if err != nil {
+			zap.S().Debugf("Continuing after failing to evict pods from node %s, %s", node.Name, err.Error())
+			continue
+		}
+		if isBlocked {
+			blocked = append(blocked, p)
+			continue
+		}
+		if provisioner.Spec.SerialEviction != nil {
+			if err := t.recordSerialEviction(ctx, node, p); err != nil {
+				return false, fmt.Errorf("recording serial eviction, %w", err)
+			}
+		}
+	}
+	// 5. Escalate evictions blocked by PodDisruptionBudgets
+	if len(blocked) > 0 {
+		if err := t.escalate(ctx, provisioner, node, blocked); err != nil {
+			return false, fmt.Errorf("escalating blocked evictions, %w", err)
+		}
+	}
+	return false, nil
+}
+
+// escalate handles pods whose eviction is blocked by a PodDisruptionBudget. A
+// warning is emitted after the drain warning period. After the drain timeout,
+// involuntarily disrupted nodes have their blocked pods deleted, while
+// voluntarily disrupted nodes are returned to service.
+func (t *Terminator) escalate(ctx context.Context, provisioner *v1alpha1.Provisioner, node *v1.Node, pods []*v1.Pod) error {
+	draining := utilsnode.DrainDuration(node, t.clock.Now())
+	if draining < secondsOr(provisioner.Spec.DrainWarningSeconds, v1alpha1.DefaultDrainWarningSeconds) {
+		return nil
+	}
+	budgets, err := t.getDisruptionBudgets(ctx, pods)
+	if err != nil {
+		return fmt.Errorf("getting disruption budgets, %w", err)
+	}
+	if draining < secondsOr(provisioner.Spec.DrainTimeoutSeconds, v1alpha1.DefaultDrainTimeoutSeconds) {
+		t.recorder.Eventf(node, v1.EventTypeWarning, "DrainBlocked", "Eviction blocked by PodDisruptionBudgets %v for %s", budgets, draining.Round(time.Second))
+		return nil
+	}
+	if node.Annotations[v1alpha1.ProvisionerDisruptionKey] == v1alpha1.DisruptionInvoluntary {
+		t.recorder.Eventf(node, v1.EventTypeWarning, "DrainForced", "Deleting pods blocked by PodDisruptionBudgets %v after %s", budgets, draining.Round(time.Second))
+		decisionFor(DecisionActionForceDrain, DecisionReasonDrainTimeout, provisioner, node, pods).Log()
+		for _, p := range pods {
+			if err := t.kubeClient.Delete(ctx, p); client.IgnoreNotFound(err) != nil {
+				return fmt.Errorf("deleting pod %s/%s, %w", p.Namespace, p.Name, err)
+			}
+		}
+		return nil
+	}
+	t.recorder.Eventf(node, v1.EventTypeWarning, "DrainSkipped", "Skipping termination, eviction blocked by PodDisruptionBudgets %v after %s", budgets, draining.Round(time.Second))
+	decisionFor(DecisionActionUncordon, DecisionReasonDrainTimeout, provisioner, node, nil).Log()
+	return t.uncordon(ctx, node)
+}
+
+// uncordon returns a draining node to service, and records the failed drain
+// so that it's backed off, see DrainFailureBackoff
+func (t *Terminator) uncordon(ctx context.Context, node *v1.Node) error {
+	persisted := node.DeepCopy()
+	node.Spec.Unschedulable = false
+	node.Annotations = functional.UnionStringMaps(node.Annotations, map[string]string{
+		v1alpha1.ProvisionerDrainFailedKey: t.clock.Now().Format(time.RFC3339),
+	})
+	delete(node.Labels, v1alpha1.ProvisionerPhaseLabel)
+	delete(node.Labels, v1alpha1.ExcludeFromExternalLoadBalancersLabelKey)
+	delete(node.Annotations, v1alpha1.ProvisionerTTLKey)
+	delete(node.Annotations, v1alpha1.ProvisionerDrainStartKey)
+	delete(node.Annotations, v1alpha1.ProvisionerLastEvictionKey)
+	delete(node.Annotations, v1alpha1.ProvisionerLastEvictedOwnerKey)
+	if err := t.kubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil {
+		return fmt.Errorf("patching node %s, %w", node.Name, err)
+	}
+	zap.S().Infof("Uncordoned node %s after failing to drain", node.Name)
+	return nil
+}
+
+// getDisruptionBudgets returns the names of the PodDisruptionBudgets selecting the pods
+func (t *Terminator) getDisruptionBudgets(ctx context.Context, pods []*v1.Pod) ([]string, error) {
+	names := []string{}
+	for _, p := range pods {
+		budgets := &v1beta1.PodDisruptionBudgetList{}
+		if err := t.kubeClient.List(ctx, budgets, client.InNamespace(p.Namespace)); err != nil {
+			return nil, fmt.Errorf("listing pod disruption budgets, %w", err)
+		}
+		for _, budget := range budgets.Items {
+			selector, err := metav1.LabelSelectorAsSelector(budget.Spec.Selector)
+			if err != nil {
+				continue
+			}
+			if selector.Matches(labels.Set(p.Labels)) {
+				names = append(names, types.NamespacedName{Name: budget.Name, Namespace: budget.Namespace}.String())
+			}
+		}
+	}
+	return functional.UniqueStrings(names), nil
+}
+
+// unambiguous returns the nodes whose provider ids aren't shared by another
+// node in the cluster. Instances are terminated by provider id, so terminating
+// an ambiguous one could terminate another node's instance. These nodes are
+// skipped with a warning until the duplicates are resolved.
+func (t *Terminator) unambiguous(ctx context.Context, nodes []*v1.Node) ([]*v1.Node, error) {
+	if len(nodes) == 0 {
+		return nodes, nil
+	}
+	all := &v1.NodeList{}
+	if err := t.kubeClient.List(ctx, all); err != nil {
+		return nil, fmt.Errorf("listing nodes, %w", err)
+	}
+	owners := map[string][]string{}
+	for _, node := range all.Items {
+		if node.Spec.ProviderID != "" {
+			owners[node.Spec.ProviderID] = append(owners[node.Spec.ProviderID], node.Name)
+		}
+	}
+	result := []*v1.Node{}
+	for _, node := range nodes {
+		if names := owners[node.Spec.ProviderID]; len(names) > 1 {
+			zap.S().Warnf("Skipping termination of node %s, provider id %s is shared by nodes %v", node.Name, node.Spec.ProviderID, names)
+			t.recorder.Eventf(node, v1.EventTypeWarning, "DuplicateProviderID", "Skipping termination, provider id %s is shared by nodes %v", node.Spec.ProviderID, names)
+			continue
+		}
+		result = append(result, node)
+	}
+	return result, nil
+}
+
+// evictablePods returns the pods that are evicted when draining a node
+func evictablePods(pods []*v1.Pod) []*v1.Pod {
+	evictable := []*v1.Pod{}
+	for _, p := range pods {
+		if pod.IsEvictable(p) {
+			evictable = append(evictable, p)
+		}
+	}
+	return evictable
+}
+
+func secondsOf(seconds *int32) time.Duration {
+	if seconds == nil {
+		return 0
+	}
+	return time.Duration(*seconds) * time.Second
+}
+
+// secondsOr returns the seconds as a duration, or the default if they're unset
+func secondsOr(seconds *int32, defaultSeconds int32) time.Duration {
+	if seconds == nil {
+		return time.Duration(defaultSeconds) * time.Second
+	}
+	return secondsOf(seconds)
+}
+
 // deleteNode uses a cloudprovider-specific delete to delete a set of nodes
-func (t *Terminator) deleteNodes(ctx context.Context, nodes []*v1.Node, provisioner *v1alpha1.Provisioner) error {
-	// 1. Delete node in cloudprovider's instanceprovider
-	if err := t.cloudprovider.CapacityFor(provisioner).Delete(ctx, nodes); err != nil {
-		return fmt.Errorf("terminating cloudprovider instance, %w", err)
+func (t *Terminator) deleteNodes(ctx context.Context, nodes []*v1.Node, provisioner *v1alpha1.Provisioner, reason string) error {
+	// 1. Delete node in cloudprovider's instanceprovider, which may record
+	// the termination reason on the instance
+	byTerminationReason := map[string][]*v1.Node{}
+	for _, node := range nodes {
+		terminationReason := terminationReasonOf(reason, node)
+		byTerminationReason[terminationReason] = append(byTerminationReason[terminationReason], node)
+	}
+	for terminationReason, terminating := range byTerminationReason {
+		if err := t.cloudprovider.CapacityFor(provisioner).Delete(ctx, terminating, terminationReason); err != nil {
+			return fmt.Errorf("terminating cloudprovider instance, %w", err)
+		}
 	}
 	// 2. Delete node in APIServer
 	for _, node := range nodes {
@@ -135,6 +414,7 @@ func (t *Terminator) deleteNodes(ctx context.Context, nodes []*v1.Node, provisio
 			zap.S().Debugf("Continuing after failing to delete node %s, %s", node.Name, err.Error())
 		}
 		zap.S().Infof("Terminated node %s", node.Name)
+		decisionFor(DecisionActionTerminate, reason, provisioner, node, nil).Log()
 	}
 	return nil
 }
@@ -142,10 +422,7 @@ func (t *Terminator) deleteNodes(ctx context.Context, nodes []*v1.Node, provisio
 // getNodes returns a list of nodes with the provisioner's labels and given labels
 func (t *Terminator) getNodes(ctx context.Context, provisioner *v1alpha1.Provisioner, additionalLabels map[string]string) ([]*v1.Node, error) {
 	nodes := &v1.NodeList{}
-	if err := t.kubeClient.List(ctx, nodes, client.MatchingLabels(functional.UnionStringMaps(map[string]string{
-		v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
-		v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
-	}, additionalLabels))); err != nil {
+	if err := t.kubeClient.List(ctx, nodes, client.MatchingLabels(functional.UnionStringMaps(nodeLabelsFor(provisioner, t.managedLabelKey), additionalLabels))); err != nil {
 		return nil, fmt.Errorf("listing nodes, %w", err)
 	}
 	return ptr.NodeListToSlice(nodes), nil
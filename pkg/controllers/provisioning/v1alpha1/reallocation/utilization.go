@@ -25,11 +25,20 @@ import (
 	"github.com/awslabs/karpenter/pkg/utils/ptr"
 	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// DrainFailureBackoff is how long a node that was returned to service after
+// its drain was blocked, e.g. by a PodDisruptionBudget, isn't marked
+// underutilized again. Otherwise, an empty node would be cordoned, partially
+// evicted, and uncordoned repeatedly while the drain remains blocked.
+const DrainFailureBackoff = time.Hour
+
 type Utilization struct {
-	kubeClient client.Client
+	kubeClient      client.Client
+	managedLabelKey string
+	clock           clock.Clock
 }
 
 func (u *Utilization) Reconcile(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
@@ -65,7 +74,7 @@ func (u *Utilization) markUnderutilized(ctx context.Context, provisioner *v1alph
 		if err != nil {
 			return fmt.Errorf("getting pods for node %s, %w", node.Name, err)
 		}
-		if utilsnode.IsUnderutilized(node, pods) {
+		if utilsnode.IsUnderutilized(node, pods) && !u.drainRecentlyFailed(node) {
 			if _, ok := node.Annotations[v1alpha1.ProvisionerTTLKey]; !ok {
 				ttlable = append(ttlable, node)
 			}
@@ -81,7 +90,7 @@ func (u *Utilization) markUnderutilized(ctx context.Context, provisioner *v1alph
 		)
 		node.Annotations = functional.UnionStringMaps(
 			node.Annotations,
-			map[string]string{v1alpha1.ProvisionerTTLKey: time.Now().Add(time.Duration(*provisioner.Spec.TTLSeconds) * time.Second).Format(time.RFC3339)},
+			map[string]string{v1alpha1.ProvisionerTTLKey: u.clock.Now().Add(time.Duration(*provisioner.Spec.TTLSeconds) * time.Second).Format(time.RFC3339)},
 		)
 		if err := u.kubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil {
 			return fmt.Errorf("patching node %s, %w", node.Name, err)
@@ -91,6 +100,16 @@ func (u *Utilization) markUnderutilized(ctx context.Context, provisioner *v1alph
 	return nil
 }
 
+// drainRecentlyFailed returns true if the node was returned to service after
+// its drain was blocked within DrainFailureBackoff
+func (u *Utilization) drainRecentlyFailed(node *v1.Node) bool {
+	failed, err := time.Parse(time.RFC3339, node.Annotations[v1alpha1.ProvisionerDrainFailedKey])
+	if err != nil {
+		return false
+	}
+	return u.clock.Now().Before(failed.Add(DrainFailureBackoff))
+}
+
 // clearUnderutilized removes the TTL on underutilized nodes if there is sufficient resource usage
 func (u *Utilization) clearUnderutilized(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
 	// 1. Get underutilized nodes
@@ -149,10 +168,7 @@ func (u *Utilization) markTerminable(ctx context.Context, provisioner *v1alpha1.
 // getNodes returns a list of nodes with the provisioner's labels and given labels
 func (u *Utilization) getNodes(ctx context.Context, provisioner *v1alpha1.Provisioner, additionalLabels map[string]string) ([]*v1.Node, error) {
 	nodes := &v1.NodeList{}
-	if err := u.kubeClient.List(ctx, nodes, client.MatchingLabels(functional.UnionStringMaps(map[string]string{
-		v1alpha1.ProvisionerNameLabelKey:      provisioner.Name,
-		v1alpha1.ProvisionerNamespaceLabelKey: provisioner.Namespace,
-	}, additionalLabels))); err != nil {
+	if err := u.kubeClient.List(ctx, nodes, client.MatchingLabels(functional.UnionStringMaps(nodeLabelsFor(provisioner, u.managedLabelKey), additionalLabels))); err != nil {
 		return nil, fmt.Errorf("listing nodes, %w", err)
 	}
 	return ptr.NodeListToSlice(nodes), nil
@@ -0,0 +1,171 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reallocation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/utils/apiobject"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ValidationHook is a user supplied HTTP endpoint that accepts or rejects new
+// nodes before workloads are scheduled to them
+type ValidationHook struct {
+	// URL receives a POST of the node's ValidationRequest. Any 2xx response
+	// accepts the node.
+	URL string
+	// Timeout of each call to the hook. Calls that time out are retried.
+	Timeout time.Duration
+}
+
+// NewValidationHook returns the hook, or nil if the URL is empty, which
+// disables node validation
+func NewValidationHook(rawURL string, timeout time.Duration) (*ValidationHook, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+	parsed, err := url.ParseRequestURI(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing url %s, %w", rawURL, err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("url %s must use http or https", rawURL)
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("timeout %s must be positive", timeout)
+	}
+	return &ValidationHook{URL: rawURL, Timeout: timeout}, nil
+}
+
+// ValidationRequest describes the node being validated
+type ValidationRequest struct {
+	NodeName    string             `json:"nodeName"`
+	ProviderID  string             `json:"providerID"`
+	Provisioner string             `json:"provisioner"`
+	Labels      map[string]string  `json:"labels,omitempty"`
+	Addresses   []v1.NodeAddress   `json:"addresses,omitempty"`
+	Capacity    v1.ResourceList    `json:"capacity,omitempty"`
+	NodeInfo    v1.NodeSystemInfo  `json:"nodeInfo"`
+	Conditions  []v1.NodeCondition `json:"conditions,omitempty"`
+}
+
+// Validation removes the validation pending taint from a provisioner's nodes
+// once they're ready and the hook accepts them. Nodes the hook rejects, or
+// fails to answer for in time, stay tainted and are retried.
+type Validation struct {
+	kubeClient      client.Client
+	recorder        record.EventRecorder
+	managedLabelKey string
+	hook            *ValidationHook
+	httpClient      *http.Client
+}
+
+func (v *Validation) Reconcile(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
+	if v.hook == nil {
+		return nil
+	}
+	nodes := &v1.NodeList{}
+	if err := v.kubeClient.List(ctx, nodes, client.MatchingLabels(nodeLabelsFor(provisioner, v.managedLabelKey))); err != nil {
+		return fmt.Errorf("listing nodes, %w", err)
+	}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if !isValidationPending(node) || !isNodeReady(node) {
+			continue
+		}
+		if err := v.validate(ctx, provisioner, node); err != nil {
+			zap.S().Warnf("Node %s failed validation, %s", node.Name, err.Error())
+			v.recorder.Eventf(node, v1.EventTypeWarning, "ValidationFailed", "Node validation hook didn't accept the node, %s", err.Error())
+			continue
+		}
+		persisted := node.DeepCopy()
+		node.Spec.Taints = withoutValidationTaint(node.Spec.Taints)
+		if err := v.kubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil {
+			return fmt.Errorf("patching node %s, %w", node.Name, err)
+		}
+		zap.S().Infof("Node %s passed validation", node.Name)
+	}
+	return nil
+}
+
+// validate calls the hook with the node's details and returns an error unless
+// it responds successfully within the timeout
+func (v *Validation) validate(ctx context.Context, provisioner *v1alpha1.Provisioner, node *v1.Node) error {
+	body, err := json.Marshal(ValidationRequest{
+		NodeName:    node.Name,
+		ProviderID:  node.Spec.ProviderID,
+		Provisioner: apiobject.NamespacedName(provisioner).String(),
+		Labels:      node.Labels,
+		Addresses:   node.Status.Addresses,
+		Capacity:    node.Status.Capacity,
+		NodeInfo:    node.Status.NodeInfo,
+		Conditions:  node.Status.Conditions,
+	})
+	if err != nil {
+		return fmt.Errorf("marshaling validation request, %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, v.hook.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, v.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating validation request, %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := v.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("calling validation hook, %w", err)
+	}
+	defer response.Body.Close()
+	// Drain the body so that the connection is reused
+	if _, err := io.Copy(ioutil.Discard, response.Body); err != nil {
+		return fmt.Errorf("reading validation response, %w", err)
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("validation hook responded %s", response.Status)
+	}
+	return nil
+}
+
+func isValidationPending(node *v1.Node) bool {
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == v1alpha1.ValidationPendingTaintKey {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutValidationTaint(taints []v1.Taint) []v1.Taint {
+	result := []v1.Taint{}
+	for _, taint := range taints {
+		if taint.Key != v1alpha1.ValidationPendingTaintKey {
+			result = append(result, taint)
+		}
+	}
+	return result
+}
@@ -0,0 +1,53 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reallocation
+
+import (
+	"time"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/utils/cron"
+	"go.uber.org/zap"
+)
+
+// disruptionWindowOpen returns true if the provisioner permits voluntary
+// disruptions at the time, i.e. disruptions aren't paused and it has no
+// disruption window or the window opened less than its duration ago.
+func disruptionWindowOpen(provisioner *v1alpha1.Provisioner, now time.Time) bool {
+	if provisioner.Spec.Disruption == nil {
+		return true
+	}
+	if provisioner.Spec.Disruption.Paused {
+		return false
+	}
+	if provisioner.Spec.Disruption.Window == nil {
+		return true
+	}
+	window := provisioner.Spec.Disruption.Window
+	schedule, err := cron.Parse(window.Schedule)
+	if err != nil {
+		// Invalid windows are rejected by the webhook, so never disrupt nodes
+		// voluntarily if one is persisted anyways
+		zap.S().Errorf("Failed to parse disruption window schedule of provisioner %s/%s, %s", provisioner.Namespace, provisioner.Name, err.Error())
+		return false
+	}
+	opened := now.UTC().Add(-window.Duration.Duration)
+	for t := now.UTC().Truncate(time.Minute); t.After(opened); t = t.Add(-time.Minute) {
+		if schedule.Matches(t) {
+			return true
+		}
+	}
+	return false
+}
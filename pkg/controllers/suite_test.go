@@ -0,0 +1,178 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pallinder/go-randomdata"
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/awslabs/karpenter/pkg/controllers"
+	"github.com/awslabs/karpenter/pkg/test"
+	"github.com/awslabs/karpenter/pkg/utils/apiobject"
+	webhooksprovisioning "github.com/awslabs/karpenter/pkg/webhooks/provisioning/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"knative.dev/pkg/apis"
+	controllerruntime "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	. "github.com/awslabs/karpenter/pkg/test/expectations"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/envtest/printer"
+)
+
+func TestAPIs(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecsWithDefaultAndCustomReporters(t,
+		"Controllers/Manager",
+		[]Reporter{printer.NewlineReporter{}})
+}
+
+var env = test.NewEnvironment(func(e *test.Environment) {
+	e.Manager.RegisterWebhooks(&webhooksprovisioning.Defaulter{})
+})
+
+// conflictingController updates the provisioner's status while reconciling
+// it, like another controller or a user would concurrently
+type conflictingController struct {
+	kubeClient client.Client
+}
+
+func (c *conflictingController) Reconcile(ctx context.Context, object controllers.Object) error {
+	provisioner := object.(*v1alpha1.Provisioner)
+	concurrent := provisioner.DeepCopy()
+	concurrent.Status.LastScaleTime = &apis.VolatileTime{Inner: metav1.NewTime(time.Unix(1600000000, 0))}
+	Expect(c.kubeClient.Status().Update(ctx, concurrent)).To(Succeed())
+	provisioner.Status.UnavailableOfferings = []v1alpha1.UnavailableOffering{{
+		InstanceType:     "m5.large",
+		Zone:             "test-zone-1a",
+		LastObservedTime: apis.VolatileTime{Inner: metav1.Now()},
+	}}
+	return nil
+}
+
+func (c *conflictingController) Interval() time.Duration    { return 0 }
+func (c *conflictingController) For() controllers.Object    { return &v1alpha1.Provisioner{} }
+func (c *conflictingController) Owns() []controllers.Object { return nil }
+
+// periodicController requeues resources at a fixed interval
+type periodicController struct{}
+
+func (c *periodicController) Reconcile(ctx context.Context, object controllers.Object) error {
+	return nil
+}
+
+func (c *periodicController) Interval() time.Duration    { return 10 * time.Second }
+func (c *periodicController) For() controllers.Object    { return &v1alpha1.Provisioner{} }
+func (c *periodicController) Owns() []controllers.Object { return nil }
+
+// deferringController requeues resources sooner than its interval while an
+// action that it deferred is due
+type deferringController struct {
+	periodicController
+	due time.Duration
+}
+
+func (c *deferringController) RequeueAfter(controllers.Object) time.Duration { return c.due }
+
+var _ = BeforeSuite(func() {
+	Expect(env.Start()).To(Succeed(), "Failed to start environment")
+})
+
+var _ = AfterSuite(func() {
+	Expect(env.Stop()).To(Succeed(), "Failed to stop environment")
+})
+
+var _ = Describe("Manager", func() {
+	It("should serve webhooks from the configured cert directory", func() {
+		certDir := "/tmp/karpenter-test/" + strings.ToLower(randomdata.SillyName())
+		manager := controllers.NewManagerOrDie(env.Config, controllerruntime.Options{
+			CertDir:            certDir,
+			MetricsBindAddress: "0",
+		}, 0)
+		Expect(manager.GetWebhookServer().CertDir).To(Equal(certDir))
+		Expect(manager.GetWebhookServer().CertDir).ToNot(Equal(env.WebhookInstallOptions.LocalServingCertDir))
+	})
+
+	It("should jitter requeues within the configured bounds", func() {
+		provisioner := &v1alpha1.Provisioner{
+			ObjectMeta: metav1.ObjectMeta{Name: strings.ToLower(randomdata.SillyName()), Namespace: "default"},
+			Spec: v1alpha1.ProvisionerSpec{
+				Cluster: &v1alpha1.ClusterSpec{Name: "test-cluster", Endpoint: "http://test-cluster", CABundle: "dGVzdC1jbHVzdGVyCg=="},
+			},
+		}
+		ExpectCreated(env.Client, provisioner)
+		defer ExpectCleanedUp(env.Client)
+		requeues := func(jitter float64) map[time.Duration]bool {
+			generic := &controllers.GenericController{Controller: &periodicController{}, Client: env.Client, RequeueJitter: jitter}
+			intervals := map[time.Duration]bool{}
+			for i := 0; i < 10; i++ {
+				result, err := generic.Reconcile(context.Background(), reconcile.Request{NamespacedName: apiobject.NamespacedName(provisioner)})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.RequeueAfter).To(BeNumerically(">=", 10*time.Second))
+				Expect(result.RequeueAfter).To(BeNumerically("<=", 15*time.Second))
+				intervals[result.RequeueAfter] = true
+			}
+			return intervals
+		}
+		Expect(len(requeues(0.5))).To(BeNumerically(">", 1))
+		Expect(requeues(0)).To(Equal(map[time.Duration]bool{10 * time.Second: true}))
+	})
+	It("should requeue sooner than the interval when a deferred action is due", func() {
+		provisioner := &v1alpha1.Provisioner{
+			ObjectMeta: metav1.ObjectMeta{Name: strings.ToLower(randomdata.SillyName()), Namespace: "default"},
+			Spec: v1alpha1.ProvisionerSpec{
+				Cluster: &v1alpha1.ClusterSpec{Name: "test-cluster", Endpoint: "http://test-cluster", CABundle: "dGVzdC1jbHVzdGVyCg=="},
+			},
+		}
+		ExpectCreated(env.Client, provisioner)
+		defer ExpectCleanedUp(env.Client)
+		requeueAfter := func(due time.Duration) time.Duration {
+			generic := &controllers.GenericController{Controller: &deferringController{due: due}, Client: env.Client, RequeueJitter: 0.5}
+			result, err := generic.Reconcile(context.Background(), reconcile.Request{NamespacedName: apiobject.NamespacedName(provisioner)})
+			Expect(err).ToNot(HaveOccurred())
+			return result.RequeueAfter
+		}
+		Expect(requeueAfter(2 * time.Second)).To(Equal(2 * time.Second))
+		Expect(requeueAfter(0)).To(BeNumerically(">=", 10*time.Second))
+		Expect(requeueAfter(time.Minute)).To(BeNumerically("<=", 15*time.Second))
+	})
+	It("should retry conflicting status updates without losing either update", func() {
+		provisioner := &v1alpha1.Provisioner{
+			ObjectMeta: metav1.ObjectMeta{Name: strings.ToLower(randomdata.SillyName()), Namespace: "default"},
+			Spec: v1alpha1.ProvisionerSpec{
+				Cluster: &v1alpha1.ClusterSpec{Name: "test-cluster", Endpoint: "http://test-cluster", CABundle: "dGVzdC1jbHVzdGVyCg=="},
+			},
+		}
+		ExpectCreated(env.Client, provisioner)
+		defer ExpectCleanedUp(env.Client)
+		generic := &controllers.GenericController{Controller: &conflictingController{kubeClient: env.Client}, Client: env.Client}
+		_, err := generic.Reconcile(context.Background(), reconcile.Request{NamespacedName: apiobject.NamespacedName(provisioner)})
+		Expect(err).ToNot(HaveOccurred())
+
+		updated := &v1alpha1.Provisioner{}
+		Expect(env.Client.Get(context.Background(), apiobject.NamespacedName(provisioner), updated)).To(Succeed())
+		Expect(updated.Status.LastScaleTime).ToNot(BeNil())
+		Expect(updated.Status.LastScaleTime.Inner.Unix()).To(BeNumerically("==", 1600000000))
+		Expect(updated.Status.UnavailableOfferings).To(HaveLen(1))
+		Expect(updated.Status.UnavailableOfferings[0].InstanceType).To(Equal("m5.large"))
+		Expect(updated.StatusConditions().GetCondition(v1alpha1.Active).IsTrue()).To(BeTrue())
+	})
+})
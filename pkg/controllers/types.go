@@ -18,9 +18,11 @@ import (
 	"context"
 	"time"
 
+	"k8s.io/apimachinery/pkg/types"
 	"knative.dev/pkg/apis"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 )
 
@@ -50,6 +52,32 @@ type NamedController interface {
 	Name() string
 }
 
+// WatchingController allows controllers to optionally watch sources other than
+// the reconciled resource, e.g. changes to cloud provider resources. Events
+// from the sources enqueue the event's object for reconciliation.
+type WatchingController interface {
+	Controller
+	// Watches returns the additional sources to watch
+	Watches() []source.Source
+}
+
+// DeletionObservingController allows controllers to optionally clean up state
+// that they keep for resources, e.g. metrics, once the resources are deleted.
+type DeletionObservingController interface {
+	Controller
+	// Deleted is called when the reconciled resource no longer exists
+	Deleted(context.Context, types.NamespacedName)
+}
+
+// RequeueingController allows controllers to optionally reconcile a resource
+// sooner than their interval, e.g. once an action that they deferred is due.
+type RequeueingController interface {
+	Controller
+	// RequeueAfter returns how long to wait before reconciling the resource
+	// again, or zero to wait for the controller's interval
+	RequeueAfter(Object) time.Duration
+}
+
 // Webhook implements both a handler and path and can be attached to a webhook server.
 type Webhook interface {
 	webhook.AdmissionHandler
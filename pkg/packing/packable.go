@@ -72,14 +72,15 @@ func PackablesFor(instanceTypes []cloudprovider.InstanceType, constraints *Const
 func PackableFor(i cloudprovider.InstanceType) *Packable {
 	return &Packable{
 		InstanceType: i,
-		total: v1.ResourceList{
-			v1.ResourceCPU:      *i.CPU(),
-			v1.ResourceMemory:   *i.Memory(),
-			resources.NvidiaGPU: *i.NvidiaGPUs(),
-			resources.AMDGPU:    *i.AMDGPUs(),
-			resources.AWSNeuron: *i.AWSNeurons(),
-			v1.ResourcePods:     *i.Pods(),
-		},
+		total: resources.Merge(v1.ResourceList{
+			v1.ResourceCPU:              *i.CPU(),
+			v1.ResourceMemory:           *i.Memory(),
+			resources.NvidiaGPU:         *i.NvidiaGPUs(),
+			resources.AMDGPU:            *i.AMDGPUs(),
+			resources.AWSNeuron:         *i.AWSNeurons(),
+			v1.ResourcePods:             *i.Pods(),
+			v1.ResourceEphemeralStorage: *i.EphemeralStorage(),
+		}, i.HugePages()),
 	}
 }
 
@@ -102,22 +103,59 @@ func (p *Packable) Pack(pods []*v1.Pod) *Result {
 	return result
 }
 
-func (p *Packable) reserve(requests v1.ResourceList) bool {
-	candidate := resources.Merge(p.reserved, requests)
-	// If any candidate resource exceeds total, fail to reserve
-	for resourceName, quantity := range candidate {
+// LimitingResource returns the resource requested by the pod that prevents it
+// from fitting on any of the packables, preferring the resource exceeded by the
+// most packables. It returns false if the pod fits on at least one packable.
+func LimitingResource(pod *v1.Pod, packables []*Packable) (v1.ResourceName, bool) {
+	exceeded := map[v1.ResourceName]int{}
+	for _, packable := range packables {
+		resourceNames := packable.exceeds(requestsFor(pod))
+		if len(resourceNames) == 0 {
+			return "", false
+		}
+		for _, resourceName := range resourceNames {
+			exceeded[resourceName]++
+		}
+	}
+	var limiting v1.ResourceName
+	for resourceName, count := range exceeded {
+		if count > exceeded[limiting] || (count == exceeded[limiting] && resourceName < limiting) {
+			limiting = resourceName
+		}
+	}
+	return limiting, len(limiting) > 0
+}
+
+// exceeds returns the resources that would exceed total capacity if the
+// requests were reserved.
+func (p *Packable) exceeds(requests v1.ResourceList) []v1.ResourceName {
+	resourceNames := []v1.ResourceName{}
+	for resourceName, quantity := range resources.Merge(p.reserved, requests) {
 		if quantity.Cmp(p.total[resourceName]) > 0 {
-			return false
+			resourceNames = append(resourceNames, resourceName)
 		}
 	}
-	p.reserved = candidate
+	return resourceNames
+}
+
+func (p *Packable) reserve(requests v1.ResourceList) bool {
+	// If any candidate resource exceeds total, fail to reserve
+	if len(p.exceeds(requests)) > 0 {
+		return false
+	}
+	p.reserved = resources.Merge(p.reserved, requests)
 	return true
 }
 
 func (p *Packable) reservePod(pod *v1.Pod) bool {
+	return p.reserve(requestsFor(pod))
+}
+
+// requestsFor returns the pod's resource requests, including the pod itself.
+func requestsFor(pod *v1.Pod) v1.ResourceList {
 	requests := resources.RequestsForPods(pod)
 	requests[v1.ResourcePods] = *resource.NewQuantity(1, resource.BinarySI)
-	return p.reserve(requests)
+	return requests
 }
 
 func (p *Packable) validateInstanceType(constraints *Constraints) error {
@@ -99,7 +99,7 @@ func (e *Environment) Start() (err error) {
 		Host:               e.WebhookInstallOptions.LocalServingHost,
 		Port:               e.WebhookInstallOptions.LocalServingPort,
 		MetricsBindAddress: "0", // Skip the metrics server to avoid port conflicts for parallel testing
-	})
+	}, 0)
 
 	// Client
 	kubeClient, err := client.New(e.Manager.GetConfig(), client.Options{
@@ -23,6 +23,7 @@ import (
 	"github.com/awslabs/karpenter/pkg/controllers"
 	"github.com/awslabs/karpenter/pkg/utils/log"
 	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -81,6 +82,14 @@ func ExpectEventuallyHappy(c client.Client, objects ...controllers.Object) {
 	}
 }
 
+func ExpectEventuallyScheduled(c client.Client, pods ...client.Object) {
+	for _, pod := range pods {
+		Eventually(func() string {
+			return ExpectPodExists(c, pod.GetName(), pod.GetNamespace()).Spec.NodeName
+		}, ReconcilerPropagationTime, RequestInterval).ShouldNot(BeEmpty(), fmt.Sprintf("pod %s/%s was never scheduled", pod.GetNamespace(), pod.GetName()))
+	}
+}
+
 func ExpectEventuallyReconciled(c client.Client, objects ...controllers.Object) {
 	for _, object := range objects {
 		nn := types.NamespacedName{Name: object.GetName(), Namespace: object.GetNamespace()}
@@ -105,6 +114,11 @@ func ExpectCleanedUp(c client.Client) {
 	for _, node := range nodes.Items {
 		ExpectDeleted(c, &node)
 	}
+	daemonSets := appsv1.DaemonSetList{}
+	Expect(c.List(ctx, &daemonSets)).To(Succeed())
+	for _, daemonSet := range daemonSets.Items {
+		ExpectDeleted(c, &daemonSet)
+	}
 	provisioners := v1alpha1.ProvisionerList{}
 	Expect(c.List(ctx, &provisioners)).To(Succeed())
 	for _, provisioner := range provisioners.Items {
@@ -28,6 +28,8 @@ type NodeOptions struct {
 	Annotations   map[string]string
 	ReadyStatus   v1.ConditionStatus
 	Unschedulable bool
+	ProviderID    string
+	Taints        []v1.Taint
 	Allocatable   v1.ResourceList
 }
 
@@ -53,6 +55,8 @@ func NodeWith(options NodeOptions) *v1.Node {
 		},
 		Spec: v1.NodeSpec{
 			Unschedulable: options.Unschedulable,
+			ProviderID:    options.ProviderID,
+			Taints:        options.Taints,
 		},
 		Status: v1.NodeStatus{
 			Allocatable: options.Allocatable,
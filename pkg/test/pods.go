@@ -28,11 +28,14 @@ import (
 type PodOptions struct {
 	Name                 string
 	Namespace            string
+	Labels               map[string]string
+	Annotations          map[string]string
 	OwnerReferences      []metav1.OwnerReference
 	Image                string
 	NodeName             string
 	ResourceRequirements v1.ResourceRequirements
 	NodeSelector         map[string]string
+	NodeRequirements     []v1.NodeSelectorRequirement
 	Tolerations          []v1.Toleration
 	Conditions           []v1.PodCondition
 }
@@ -50,14 +53,25 @@ func defaults(options PodOptions) *v1.Pod {
 	if len(options.Conditions) == 0 {
 		options.Conditions = []v1.PodCondition{{Type: v1.PodScheduled, Reason: v1.PodReasonUnschedulable, Status: v1.ConditionFalse}}
 	}
+	var affinity *v1.Affinity
+	if options.NodeRequirements != nil {
+		affinity = &v1.Affinity{NodeAffinity: &v1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+				NodeSelectorTerms: []v1.NodeSelectorTerm{{MatchExpressions: options.NodeRequirements}},
+			},
+		}}
+	}
 	return &v1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            options.Name,
 			Namespace:       options.Namespace,
+			Labels:          options.Labels,
+			Annotations:     options.Annotations,
 			OwnerReferences: options.OwnerReferences,
 		},
 		Spec: v1.PodSpec{
 			NodeSelector: options.NodeSelector,
+			Affinity:     affinity,
 			Tolerations:  options.Tolerations,
 			Containers: []v1.Container{{
 				Name:      options.Name,
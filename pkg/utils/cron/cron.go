@@ -0,0 +1,118 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression with minute, hour, day of month,
+// month, and day of week fields, e.g. "0 22 * * 1-5" for 10pm on weekdays.
+// Fields support *, values, ranges, steps, and lists, e.g. "0-30/10,45".
+type Schedule struct {
+	minutes     field
+	hours       field
+	daysOfMonth field
+	months      field
+	daysOfWeek  field
+	// daysRestricted is true if both day fields are restricted, in which case
+	// times matching either field match, as in standard cron
+	daysRestricted bool
+}
+
+// field is the set of values that a field matches
+type field map[int]bool
+
+// bounds of each field. Sunday is both 0 and 7.
+var bounds = []struct{ min, max int }{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// Parse returns an error if the expression isn't a valid cron expression
+func Parse(expression string) (*Schedule, error) {
+	expressions := strings.Fields(expression)
+	if len(expressions) != len(bounds) {
+		return nil, fmt.Errorf("expected %d fields, got %d", len(bounds), len(expressions))
+	}
+	fields := []field{}
+	for i, expression := range expressions {
+		parsed, err := parseField(expression, bounds[i].min, bounds[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("parsing field %s, %w", expression, err)
+		}
+		fields = append(fields, parsed)
+	}
+	return &Schedule{
+		minutes:        fields[0],
+		hours:          fields[1],
+		daysOfMonth:    fields[2],
+		months:         fields[3],
+		daysOfWeek:     fields[4],
+		daysRestricted: expressions[2] != "*" && expressions[4] != "*",
+	}, nil
+}
+
+func parseField(expression string, min int, max int) (field, error) {
+	values := field{}
+	for _, part := range strings.Split(expression, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			parsed, err := strconv.Atoi(part[i+1:])
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("invalid step %s", part[i+1:])
+			}
+			step = parsed
+			part = part[:i]
+		}
+		low, high := min, max
+		if part != "*" {
+			values := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(values[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %s", values[0])
+			}
+			high = low
+			if len(values) == 2 {
+				if high, err = strconv.Atoi(values[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %s", values[1])
+				}
+			} else if step != 1 {
+				// Steps from a value continue to the end of the range
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("range %d-%d must be within %d-%d", low, high, min, max)
+		}
+		for value := low; value <= high; value += step {
+			values[value] = true
+		}
+	}
+	return values, nil
+}
+
+// Matches returns true if the schedule includes the minute of the time
+func (s *Schedule) Matches(t time.Time) bool {
+	if !s.minutes[t.Minute()] || !s.hours[t.Hour()] || !s.months[int(t.Month())] {
+		return false
+	}
+	dayOfMonth := s.daysOfMonth[t.Day()]
+	dayOfWeek := s.daysOfWeek[int(t.Weekday())] || (t.Weekday() == time.Sunday && s.daysOfWeek[7])
+	if s.daysRestricted {
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
@@ -0,0 +1,99 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cron
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+func TestCron(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cron Suite")
+}
+
+// at returns the time in 2021, e.g. June 1st 2021 is a Tuesday
+func at(month time.Month, day int, hour int, minute int) time.Time {
+	return time.Date(2021, month, day, hour, minute, 0, 0, time.UTC)
+}
+
+var _ = Describe("Cron", func() {
+	table.DescribeTable("Matches",
+		func(expression string, t time.Time, matches bool) {
+			schedule, err := Parse(expression)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(schedule.Matches(t)).To(Equal(matches))
+		},
+		table.Entry("every minute", "* * * * *", at(time.June, 1, 13, 37), true),
+		table.Entry("a value", "30 * * * *", at(time.June, 1, 13, 30), true),
+		table.Entry("another value", "30 * * * *", at(time.June, 1, 13, 31), false),
+		table.Entry("the start of a range", "0 9-17 * * *", at(time.June, 1, 9, 0), true),
+		table.Entry("the end of a range", "0 9-17 * * *", at(time.June, 1, 17, 0), true),
+		table.Entry("outside a range", "0 9-17 * * *", at(time.June, 1, 18, 0), false),
+		table.Entry("a step of every value", "*/15 * * * *", at(time.June, 1, 13, 45), true),
+		table.Entry("between steps of every value", "*/15 * * * *", at(time.June, 1, 13, 10), false),
+		table.Entry("a step of a range", "0-30/10 * * * *", at(time.June, 1, 13, 20), true),
+		table.Entry("past the end of a stepped range", "0-30/10 * * * *", at(time.June, 1, 13, 40), false),
+		table.Entry("a step from a value to the end of the field", "10/20 * * * *", at(time.June, 1, 13, 50), true),
+		table.Entry("before a step from a value", "10/20 * * * *", at(time.June, 1, 13, 0), false),
+		table.Entry("an element of a list", "1,3,5 * * * *", at(time.June, 1, 13, 3), true),
+		table.Entry("outside a list", "1,3,5 * * * *", at(time.June, 1, 13, 4), false),
+		table.Entry("a list of steps and values", "0-30/10,45 * * * *", at(time.June, 1, 13, 45), true),
+		table.Entry("a day of the week", "0 22 * * 1-5", at(time.June, 1, 22, 0), true),
+		table.Entry("another day of the week", "0 22 * * 1-5", at(time.June, 6, 22, 0), false),
+		table.Entry("sunday as 0", "0 0 * * 0", at(time.June, 6, 0, 0), true),
+		table.Entry("sunday as 7", "0 0 * * 7", at(time.June, 6, 0, 0), true),
+		table.Entry("a day of the month", "0 0 13 * *", at(time.June, 13, 0, 0), true),
+		table.Entry("another day of the month", "0 0 13 * *", at(time.August, 12, 0, 0), false),
+		table.Entry("the day of the month if both days are restricted", "0 0 13 * 5", at(time.June, 13, 0, 0), true),
+		table.Entry("the day of the week if both days are restricted", "0 0 13 * 5", at(time.June, 4, 0, 0), true),
+		table.Entry("neither day if both days are restricted", "0 0 13 * 5", at(time.June, 1, 0, 0), false),
+		table.Entry("only the day of the week if the day of the month isn't restricted", "0 0 * * 5", at(time.June, 13, 0, 0), false),
+		table.Entry("a month", "0 0 * 6 *", at(time.June, 1, 0, 0), true),
+		table.Entry("another month", "0 0 * 6 *", at(time.July, 1, 0, 0), false),
+		table.Entry("the last day of a month", "59 23 30 * *", at(time.April, 30, 23, 59), true),
+		table.Entry("the first day of the next month", "0 0 1 * *", at(time.May, 1, 0, 0), true),
+		table.Entry("a day that the month doesn't have", "0 0 31 * *", at(time.May, 1, 0, 0), false),
+		table.Entry("the first day of the next year", "0 0 1 1 *", time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC), true),
+		table.Entry("the last day of the year", "0 0 1 1 *", at(time.December, 31, 0, 0), false),
+	)
+	table.DescribeTable("Parse errors",
+		func(expression string) {
+			_, err := Parse(expression)
+			Expect(err).To(HaveOccurred())
+		},
+		table.Entry("no fields", ""),
+		table.Entry("too few fields", "* * * *"),
+		table.Entry("too many fields", "* * * * * *"),
+		table.Entry("a minute out of bounds", "60 * * * *"),
+		table.Entry("an hour out of bounds", "* 24 * * *"),
+		table.Entry("a day of the month below bounds", "* * 0 * *"),
+		table.Entry("a month out of bounds", "* * * 13 *"),
+		table.Entry("a day of the week out of bounds", "* * * * 8"),
+		table.Entry("a reversed range", "30-10 * * * *"),
+		table.Entry("a range past bounds", "* 20-25 * * *"),
+		table.Entry("a zero step", "*/0 * * * *"),
+		table.Entry("a negative step", "*/-5 * * * *"),
+		table.Entry("a non-numeric step", "*/x * * * *"),
+		table.Entry("a non-numeric value", "a * * * *"),
+		table.Entry("a non-numeric end of a range", "1-a * * * *"),
+		table.Entry("an empty list element", "1,,2 * * * *"),
+		table.Entry("a named month", "* * * JAN *"),
+	)
+})
@@ -15,6 +15,9 @@ limitations under the License.
 package node
 
 import (
+	"encoding/json"
+	"fmt"
+
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 	"github.com/awslabs/karpenter/pkg/utils/pod"
 	v1 "k8s.io/api/core/v1"
@@ -42,15 +45,62 @@ func IsPastTTL(node *v1.Node) bool {
 	return time.Now().After(ttlTime)
 }
 
-// IsUnderutilized returns if the node has 0 non-daemonset pods
+// DrainDuration returns how long the node has been draining as of now, or
+// zero if the drain start time is unknown. The start time may have been
+// recorded by a replica whose clock is ahead, so a start time in the future is
+// treated as zero elapsed rather than extending the drain by the skew.
+func DrainDuration(node *v1.Node, now time.Time) time.Duration {
+	start, ok := node.Annotations[v1alpha1.ProvisionerDrainStartKey]
+	if !ok {
+		return 0
+	}
+	startTime, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return 0
+	}
+	if elapsed := now.Sub(startTime); elapsed > 0 {
+		return elapsed
+	}
+	return 0
+}
+
+// IsUnderutilized returns if the node has 0 evictable pods
 func IsUnderutilized(node *v1.Node, pods []*v1.Pod) bool {
 	for _, p := range pods {
 		if pod.HasFailed(p) {
 			continue
 		}
-		if !pod.IsOwnedByDaemonSet(p) {
+		if pod.IsEvictable(p) {
 			return false
 		}
 	}
 	return true
 }
+
+// ManagedTaints returns the taints recorded as applied by the provisioner, or
+// nil if the node has no record or the record is malformed.
+func ManagedTaints(node *v1.Node) []v1.Taint {
+	value, ok := node.Annotations[v1alpha1.ProvisionerTaintsKey]
+	if !ok {
+		return nil
+	}
+	taints := []v1.Taint{}
+	if err := json.Unmarshal([]byte(value), &taints); err != nil {
+		return nil
+	}
+	return taints
+}
+
+// SetManagedTaints records the taints applied by the provisioner so they can
+// later be told apart from taints added by other actors.
+func SetManagedTaints(node *v1.Node, taints []v1.Taint) error {
+	value, err := json.Marshal(taints)
+	if err != nil {
+		return fmt.Errorf("marshalling taints, %w", err)
+	}
+	if node.Annotations == nil {
+		node.Annotations = map[string]string{}
+	}
+	node.Annotations[v1alpha1.ProvisionerTaintsKey] = string(value)
+	return nil
+}
@@ -15,8 +15,11 @@ limitations under the License.
 package pod
 
 import (
+	"fmt"
+
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
 )
 
 func FailedToSchedule(pod *v1.Pod) bool {
@@ -38,8 +41,45 @@ func IsSchedulable(pod *v1.PodSpec, node *v1.Node) bool {
 	if !labels.SelectorFromSet(pod.NodeSelector).Matches(labels.Set(node.Labels)) {
 		return false
 	}
-	// TODO, support node affinity
-	return true
+	// Match required Node Affinity
+	return MatchesNodeAffinity(pod, node)
+}
+
+// MatchesNodeAffinity returns true if the node satisfies any of the pod's
+// required node selector terms. Preferred terms are not considered.
+func MatchesNodeAffinity(pod *v1.PodSpec, node *v1.Node) bool {
+	if pod.Affinity == nil || pod.Affinity.NodeAffinity == nil || pod.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return true
+	}
+	for _, term := range pod.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		if selector, err := selectorFor(term.MatchExpressions); err == nil && selector.Matches(labels.Set(node.Labels)) {
+			return true
+		}
+	}
+	return false
+}
+
+func selectorFor(requirements []v1.NodeSelectorRequirement) (labels.Selector, error) {
+	selector := labels.NewSelector()
+	for _, requirement := range requirements {
+		operator, ok := map[v1.NodeSelectorOperator]selection.Operator{
+			v1.NodeSelectorOpIn:           selection.In,
+			v1.NodeSelectorOpNotIn:        selection.NotIn,
+			v1.NodeSelectorOpExists:       selection.Exists,
+			v1.NodeSelectorOpDoesNotExist: selection.DoesNotExist,
+			v1.NodeSelectorOpGt:           selection.GreaterThan,
+			v1.NodeSelectorOpLt:           selection.LessThan,
+		}[requirement.Operator]
+		if !ok {
+			return nil, fmt.Errorf("unsupported operator %s", requirement.Operator)
+		}
+		parsed, err := labels.NewRequirement(requirement.Key, operator, requirement.Values)
+		if err != nil {
+			return nil, err
+		}
+		selector = selector.Add(*parsed)
+	}
+	return selector, nil
 }
 
 // ToleratesAllTaints returns true if the pod tolerates all taints
@@ -60,6 +100,14 @@ func ToleratesTaint(pod *v1.PodSpec, taint v1.Taint) bool {
 		return true
 	}
 	for _, toleration := range pod.Tolerations {
+		// An empty effect matches all effects
+		if len(toleration.Effect) != 0 && toleration.Effect != taint.Effect {
+			continue
+		}
+		// An empty key with OpExists matches all keys
+		if len(toleration.Key) == 0 && toleration.Operator == v1.TolerationOpExists {
+			return true
+		}
 		if toleration.Key == taint.Key {
 			if toleration.Operator == v1.TolerationOpExists {
 				return true
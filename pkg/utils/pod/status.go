@@ -19,6 +19,10 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
+// MirrorPodAnnotationKey is set by the kubelet on the API server's mirrors of
+// its static pods
+const MirrorPodAnnotationKey = "kubernetes.io/config.mirror"
+
 var (
 	IgnoredOwners = []schema.GroupVersionKind{
 		{Group: "apps", Version: "v1", Kind: "DaemonSet"},
@@ -39,3 +43,17 @@ func IsOwnedByDaemonSet(pod *v1.Pod) bool {
 	}
 	return false
 }
+
+// IsMirror returns true if the pod mirrors a static pod, which is managed by
+// the kubelet rather than the API server
+func IsMirror(pod *v1.Pod) bool {
+	_, ok := pod.Annotations[MirrorPodAnnotationKey]
+	return ok
+}
+
+// IsEvictable returns false for daemonset and mirror pods, which are bound to
+// their node. Evicting them is rejected or pointless, so they neither block
+// drains nor prevent a node from being considered empty.
+func IsEvictable(pod *v1.Pod) bool {
+	return !IsOwnedByDaemonSet(pod) && !IsMirror(pod)
+}
@@ -59,6 +59,7 @@ func (v *Defaulter) Handle(ctx context.Context, req admission.Request) admission
 
 func (v *Defaulter) applyDefaults(spec *provisioning.ProvisionerSpec) {
 	v.defaultTTL(spec)
+	v.defaultDrain(spec)
 }
 
 func (v *Defaulter) defaultTTL(spec *provisioning.ProvisionerSpec) {
@@ -66,3 +67,15 @@ func (v *Defaulter) defaultTTL(spec *provisioning.ProvisionerSpec) {
 		spec.TTLSeconds = ptr.Int32(300)
 	}
 }
+
+func (v *Defaulter) defaultDrain(spec *provisioning.ProvisionerSpec) {
+	if spec.DrainWarningSeconds == nil {
+		spec.DrainWarningSeconds = ptr.Int32(provisioning.DefaultDrainWarningSeconds)
+	}
+	if spec.DrainTimeoutSeconds == nil {
+		spec.DrainTimeoutSeconds = ptr.Int32(provisioning.DefaultDrainTimeoutSeconds)
+	}
+	if spec.DeregistrationDelaySeconds == nil {
+		spec.DeregistrationDelaySeconds = ptr.Int32(provisioning.DefaultDeregistrationDelaySeconds)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Pallinder/go-randomdata"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
@@ -106,6 +107,23 @@ var _ = Describe("Validation", func() {
 		}
 	})
 
+	Context("Annotations", func() {
+		It("should succeed for unreserved annotations", func() {
+			provisioner.Spec.Annotations = map[string]string{"example.com/owner": randomdata.SillyName()}
+			Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+		})
+		It("should fail for reserved annotations", func() {
+			for _, annotation := range []string{
+				"karpenter.sh/example",
+				v1alpha1.ProvisionerTTLKey,
+				v1alpha1.ProvisionerDrainStartKey,
+			} {
+				provisioner.Spec.Annotations = map[string]string{annotation: randomdata.SillyName()}
+				Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+			}
+		})
+	})
+
 	Context("Zones", func() {
 		It("should succeed if unspecified", func() {
 			Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
@@ -163,4 +181,124 @@ var _ = Describe("Validation", func() {
 			Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
 		})
 	})
+
+	Context("MaxNodes", func() {
+		It("should succeed if unspecified", func() {
+			Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+		})
+		It("should fail if negative", func() {
+			provisioner.Spec.MaxNodes = ptr.Int32(-1)
+			Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+		})
+		It("should succeed if zero or positive", func() {
+			provisioner.Spec.MaxNodes = ptr.Int32(0)
+			Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+		})
+	})
+
+	Context("Drain", func() {
+		It("should fail if a drain duration is negative", func() {
+			for _, set := range []func(spec *v1alpha1.ProvisionerSpec){
+				func(spec *v1alpha1.ProvisionerSpec) { spec.DrainWarningSeconds = ptr.Int32(-1) },
+				func(spec *v1alpha1.ProvisionerSpec) { spec.DrainTimeoutSeconds = ptr.Int32(-1) },
+				func(spec *v1alpha1.ProvisionerSpec) { spec.DrainDeadlineSeconds = ptr.Int32(-1) },
+				func(spec *v1alpha1.ProvisionerSpec) { spec.DeregistrationDelaySeconds = ptr.Int32(-1) },
+			} {
+				invalid := provisioner.DeepCopy()
+				set(&invalid.Spec)
+				Expect(env.Client.Create(context.Background(), invalid)).ToNot(Succeed())
+			}
+		})
+		It("should succeed if drain durations are zero", func() {
+			provisioner.Spec.DrainWarningSeconds = ptr.Int32(0)
+			provisioner.Spec.DrainTimeoutSeconds = ptr.Int32(0)
+			provisioner.Spec.DrainDeadlineSeconds = ptr.Int32(0)
+			provisioner.Spec.DeregistrationDelaySeconds = ptr.Int32(0)
+			Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+		})
+	})
+
+	Context("SerialEviction", func() {
+		It("should fail if the delay is negative", func() {
+			provisioner.Spec.SerialEviction = &v1alpha1.SerialEvictionSpec{DelaySeconds: ptr.Int32(-1)}
+			Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+		})
+		It("should succeed if the delay is unspecified", func() {
+			provisioner.Spec.SerialEviction = &v1alpha1.SerialEvictionSpec{}
+			Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+		})
+		It("should succeed if the delay is positive", func() {
+			provisioner.Spec.SerialEviction = &v1alpha1.SerialEvictionSpec{DelaySeconds: ptr.Int32(30)}
+			Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+		})
+	})
+
+	Context("MaxFamilyPercentage", func() {
+		It("should succeed if unspecified", func() {
+			Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+		})
+		It("should fail if not a percentage", func() {
+			for _, percentage := range []int32{-1, 0, 101} {
+				provisioner.Spec.MaxFamilyPercentage = ptr.Int32(percentage)
+				Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+			}
+		})
+		It("should succeed if a percentage", func() {
+			provisioner.Spec.MaxFamilyPercentage = ptr.Int32(50)
+			Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+		})
+	})
+
+	Context("SelectionStrategy", func() {
+		It("should succeed if unspecified", func() {
+			Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+		})
+		It("should fail if unsupported", func() {
+			provisioner.Spec.SelectionStrategy = ptr.String("unknown")
+			Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+		})
+		It("should succeed if supported", func() {
+			provisioner.Spec.SelectionStrategy = ptr.String(v1alpha1.SelectionStrategyFewestNodes)
+			Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+		})
+	})
+
+	Context("SubnetSelectionPolicy", func() {
+		It("should fail if unsupported", func() {
+			provisioner.Spec.SubnetSelectionPolicy = ptr.String("unknown")
+			Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+		})
+		It("should succeed if supported", func() {
+			provisioner.Spec.SubnetSelectionPolicy = ptr.String(v1alpha1.SubnetSelectionPolicyRoundRobin)
+			Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+		})
+	})
+
+	Context("Disruption", func() {
+		It("should fail for invalid window schedules", func() {
+			for _, schedule := range []string{"", "0 22 * *", "60 22 * * *", "0 22 * * MON", "*/0 * * * *"} {
+				provisioner.Spec.Disruption = &v1alpha1.DisruptionSpec{Window: &v1alpha1.DisruptionWindow{
+					Schedule: schedule,
+					Duration: metav1.Duration{Duration: time.Hour},
+				}}
+				Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+			}
+		})
+		It("should fail for window durations that aren't positive or exceed a week", func() {
+			for _, duration := range []time.Duration{0, -time.Hour, v1alpha1.MaxDisruptionWindowDuration + time.Minute} {
+				provisioner.Spec.Disruption = &v1alpha1.DisruptionSpec{Window: &v1alpha1.DisruptionWindow{
+					Schedule: "0 22 * * *",
+					Duration: metav1.Duration{Duration: duration},
+				}}
+				Expect(env.Client.Create(context.Background(), provisioner)).ToNot(Succeed())
+			}
+		})
+		It("should succeed for valid windows", func() {
+			provisioner.Spec.Disruption = &v1alpha1.DisruptionSpec{Window: &v1alpha1.DisruptionWindow{
+				Schedule: "0-30/15 22 * 1-6 1-5,0",
+				Duration: metav1.Duration{Duration: 4 * time.Hour},
+			}}
+			Expect(env.Client.Create(context.Background(), provisioner)).To(Succeed())
+		})
+	})
 })
@@ -23,6 +23,7 @@ import (
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/utils/cron"
 	"github.com/awslabs/karpenter/pkg/utils/functional"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
@@ -54,10 +55,18 @@ func (v *Validator) Handle(ctx context.Context, req admission.Request) admission
 	if err := functional.ValidateAll(
 		func() error { return v.validateClusterSpec(ctx, provisioner) },
 		func() error { return v.validateLabels(ctx, provisioner) },
+		func() error { return v.validateAnnotations(ctx, provisioner) },
 		func() error { return v.validateZones(ctx, provisioner) },
 		func() error { return v.validateInstanceTypes(ctx, provisioner) },
 		func() error { return v.validateArchitecture(ctx, provisioner) },
 		func() error { return v.validateOperatingSystem(ctx, provisioner) },
+		func() error { return v.validateMaxNodes(ctx, provisioner) },
+		func() error { return v.validateMaxFamilyPercentage(ctx, provisioner) },
+		func() error { return v.validateSelectionStrategy(ctx, provisioner) },
+		func() error { return v.validateSubnetSelectionPolicy(ctx, provisioner) },
+		func() error { return v.validateDisruption(ctx, provisioner) },
+		func() error { return v.validateSerialEviction(ctx, provisioner) },
+		func() error { return v.validateDrain(ctx, provisioner) },
 		func() error { return v.CloudProvider.CapacityFor(provisioner).Validate(ctx) },
 	); err != nil {
 		return admission.Denied(fmt.Sprintf("failed to validate provisioner '%s/%s', %s", provisioner.Name, provisioner.Namespace, err.Error()))
@@ -90,6 +99,8 @@ func (v *Validator) validateLabels(ctx context.Context, provisioner *v1alpha1.Pr
 			v1alpha1.ProvisionerNamespaceLabelKey,
 			v1alpha1.ProvisionerPhaseLabel,
 			v1alpha1.ProvisionerTTLKey,
+			v1alpha1.ProvisionerDrainStartKey,
+			v1alpha1.ProvisionerDisruptionKey,
 			v1alpha1.ZoneLabelKey,
 			v1alpha1.InstanceTypeLabelKey,
 		} {
@@ -101,6 +112,15 @@ func (v *Validator) validateLabels(ctx context.Context, provisioner *v1alpha1.Pr
 	return nil
 }
 
+func (v *Validator) validateAnnotations(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
+	for annotation := range provisioner.Spec.Annotations {
+		if v1alpha1.IsReservedKey(annotation) {
+			return fmt.Errorf("spec.annotations contains restricted annotation '%s'", annotation)
+		}
+	}
+	return nil
+}
+
 func (v *Validator) validateArchitecture(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
 	if provisioner.Spec.Architecture == nil {
 		return nil
@@ -164,3 +184,78 @@ func (v *Validator) validateInstanceTypes(ctx context.Context, provisioner *v1al
 	}
 	return nil
 }
+
+func (v *Validator) validateMaxNodes(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
+	if provisioner.Spec.MaxNodes != nil && *provisioner.Spec.MaxNodes < 0 {
+		return fmt.Errorf("spec.maxNodes cannot be negative")
+	}
+	return nil
+}
+
+func (v *Validator) validateMaxFamilyPercentage(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
+	if percentage := provisioner.Spec.MaxFamilyPercentage; percentage != nil && (*percentage < 1 || *percentage > 100) {
+		return fmt.Errorf("spec.maxFamilyPercentage must be between 1 and 100, got %d", *percentage)
+	}
+	return nil
+}
+
+func (v *Validator) validateSelectionStrategy(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
+	if provisioner.Spec.SelectionStrategy == nil {
+		return nil
+	}
+	if !functional.ContainsString(v1alpha1.SelectionStrategies, *provisioner.Spec.SelectionStrategy) {
+		return fmt.Errorf("unsupported selection strategy '%s' not in %v", *provisioner.Spec.SelectionStrategy, v1alpha1.SelectionStrategies)
+	}
+	return nil
+}
+
+func (v *Validator) validateSubnetSelectionPolicy(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
+	if provisioner.Spec.SubnetSelectionPolicy == nil {
+		return nil
+	}
+	if !functional.ContainsString(v1alpha1.SubnetSelectionPolicies, *provisioner.Spec.SubnetSelectionPolicy) {
+		return fmt.Errorf("unsupported subnet selection policy '%s' not in %v", *provisioner.Spec.SubnetSelectionPolicy, v1alpha1.SubnetSelectionPolicies)
+	}
+	return nil
+}
+
+func (v *Validator) validateDisruption(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
+	if provisioner.Spec.Disruption == nil || provisioner.Spec.Disruption.Window == nil {
+		return nil
+	}
+	window := provisioner.Spec.Disruption.Window
+	if _, err := cron.Parse(window.Schedule); err != nil {
+		return fmt.Errorf("invalid disruption window schedule '%s', %w", window.Schedule, err)
+	}
+	if window.Duration.Duration <= 0 || window.Duration.Duration > v1alpha1.MaxDisruptionWindowDuration {
+		return fmt.Errorf("disruption window duration %s must be positive and at most %s", window.Duration.Duration, v1alpha1.MaxDisruptionWindowDuration)
+	}
+	return nil
+}
+
+func (v *Validator) validateDrain(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
+	for _, field := range []struct {
+		name    string
+		seconds *int32
+	}{
+		{"spec.drainWarningSeconds", provisioner.Spec.DrainWarningSeconds},
+		{"spec.drainTimeoutSeconds", provisioner.Spec.DrainTimeoutSeconds},
+		{"spec.drainDeadlineSeconds", provisioner.Spec.DrainDeadlineSeconds},
+		{"spec.deregistrationDelaySeconds", provisioner.Spec.DeregistrationDelaySeconds},
+	} {
+		if field.seconds != nil && *field.seconds < 0 {
+			return fmt.Errorf("%s cannot be negative", field.name)
+		}
+	}
+	return nil
+}
+
+func (v *Validator) validateSerialEviction(ctx context.Context, provisioner *v1alpha1.Provisioner) error {
+	if provisioner.Spec.SerialEviction == nil {
+		return nil
+	}
+	if delay := provisioner.Spec.SerialEviction.DelaySeconds; delay != nil && *delay < 0 {
+		return fmt.Errorf("spec.serialEviction.delaySeconds cannot be negative")
+	}
+	return nil
+}